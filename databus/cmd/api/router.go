@@ -1,42 +1,127 @@
 package api
 
 import (
+	"context"
 	"databus/handlers"
+	"log"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func InitializeRoutes() {
-	router := gin.Default()
+// shutdownTimeout bounds the requests in progress when the server stops
+const shutdownTimeout = 10 * time.Second
+
+// InitializeRoutes serves the API of app until ctx is cancelled, then stops accepting requests and lets those
+// in progress finish (for up to shutdownTimeout)
+func InitializeRoutes(ctx context.Context, app *handlers.App) {
+	serverAddr := os.Getenv("SERVER_ADDRESS")
+	if serverAddr == "" {
+		serverAddr = "127.0.0.1:8080"
+	}
+	server := &http.Server{Addr: serverAddr, Handler: NewRouter(app)}
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.ListenAndServe() }() // Start the server
+	log.Printf("Listening and serving HTTP on %s", serverAddr)
+
+	select {
+	case err := <-errs:
+		log.Fatal("Error serving HTTP: ", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down the HTTP server: %v", err)
+	}
+}
+
+// NewRouter returns the router serving the probes and the API of app
+func NewRouter(app *handlers.App) *gin.Engine {
+	// Like gin.Default, without logging the probes polled every few seconds
+	router := gin.New()
+	router.Use(gin.LoggerWithConfig(gin.LoggerConfig{SkipPaths: []string{"/healthz", "/readyz"}}), gin.Recovery())
 
 	router.SetTrustedProxies(nil)
 	// router.SetTrustedProxies([]string{"192.168.1.2"})  // Example
 
+	// ------------ Probes ------------
+	router.GET("/healthz", app.HealthzHandler)
+	router.GET("/readyz", app.ReadyzHandler)
+
 	// ------------ API Endpoints ------------
 	// Definitions API
-	router.GET("/api/definitions", handlers.GetAllDefinitionsHandler)
-	router.GET("/api/definitions/:definitionName", handlers.GetDefinitionByNameHandler)
+	router.GET("/api/definitions", app.GetAllDefinitionsHandler)
+	router.GET("/api/definitions/:definitionName", app.GetDefinitionByNameHandler)
+	router.GET("/api/definitions/:definitionName/transitions", app.GetDefinitionTransitionsHandler)
+	router.POST("/api/definitions", app.CreateDefinitionHandler)
+	router.PUT("/api/definitions/:definitionName", app.UpdateDefinitionHandler)
+	router.DELETE("/api/definitions/:definitionName", app.DeleteDefinitionHandler)
 
 	// Groups API
-	router.GET("/api/groups", handlers.GetAllGroupsHandler)
-	router.GET("/api/groups/:groupName", handlers.GetGroupByNameHandler)
+	router.GET("/api/groups", app.GetAllGroupsHandler)
+	router.GET("/api/groups/:groupName", app.GetGroupByNameHandler)
+	router.GET("/api/groups/:groupName/violations", app.GetGroupViolationsHandler)
+	router.GET("/api/groups/:groupName/history", app.GetGroupHistoryHandler)
+	router.POST("/api/groups", app.CreateGroupHandler)
+	router.PUT("/api/groups/:groupName", app.UpdateGroupHandler)
+	router.DELETE("/api/groups/:groupName", app.DeleteGroupHandler)
 
 	// Reactive Entities API
-	router.GET("/api/reactive-entities", handlers.GetAllReactiveEntitiesHandler)
-	router.GET("/api/reactive-entities/byHex/:entityHex", handlers.GetReactiveEntityByHexHandler)
-	router.GET("/api/reactive-entities/byGroups/:groupList", handlers.GetReactiveEntitiesByGroupHandler)
-	router.POST("/api/reactive-entities", handlers.CreateReactiveEntityHandler)
-	router.DELETE("/api/reactive-entities/:entityHex", handlers.DeleteReactiveEntityHandler)
-	// TODO: Add PUT endpoint for updating reactive entities
-	// router.PUT("/api/reactive-entities/:entityHex", handlers.UpdateReactiveEntityHandler)
+	router.GET("/api/reactive-entities", app.GetAllReactiveEntitiesHandler)
+	router.GET("/api/reactive-entities/byHex/:entityHex", app.GetReactiveEntityByHexHandler)
+	router.GET("/api/reactive-entities/byHex/:entityHex/history", app.GetReactiveEntityHistoryHandler)
+	router.GET("/api/reactive-entities/byGroups/:groupList", app.GetReactiveEntitiesByGroupHandler)
+	router.GET("/api/reactive-entities/delta", app.GetReactiveEntityDeltasHandler)
+	router.PATCH("/api/reactive-entities/byHex/:entityHex/state", app.UpdateDataObjectByEntityIdHandler)
+	router.PATCH("/api/reactive-entities/byGroups/:groupList/state", app.UpdateDataObjectsByGroupHandler)
+	router.PATCH("/api/reactive-entities/byHex/:entityHex/attributes", app.UpdateAttributesByEntityIdHandler)
+	router.PATCH("/api/reactive-entities/byGroups/:groupList/attributes", app.UpdateAttributesByGroupHandler)
+	router.POST("/api/reactive-entities", app.CreateReactiveEntityHandler)
+	router.DELETE("/api/reactive-entities/:entityHex", app.DeleteReactiveEntityHandler)
+	router.PUT("/api/reactive-entities/:entityHex", app.UpdateReactiveEntityHandler)
+	router.PATCH("/api/reactive-entities/:entityHex", app.PatchReactiveEntityHandler)
+	router.POST("/api/reactive-entities/byHex/:entityHex/secret", app.CreateEntitySecretHandler)
+
+	// Rules API
+	router.GET("/api/rules", app.GetAllRulesHandler)
+	router.GET("/api/rules/:ruleName", app.GetRuleByNameHandler)
+	router.POST("/api/rules", app.CreateRuleHandler)
+	router.POST("/api/rules/dry-run", app.DryRunRulesHandler)
+	router.PUT("/api/rules/:ruleName", app.UpdateRuleHandler)
+	router.DELETE("/api/rules/:ruleName", app.DeleteRuleHandler)
+
+	// Schedules API
+	router.GET("/api/schedules", app.GetAllSchedulesHandler)
+	router.GET("/api/schedules/:scheduleName", app.GetScheduleByNameHandler)
+	router.GET("/api/schedules/:scheduleName/next", app.GetScheduleNextRunsHandler)
+	router.POST("/api/schedules", app.CreateScheduleHandler)
+	router.POST("/api/schedules/preview", app.PreviewScheduleHandler)
+	router.PUT("/api/schedules/:scheduleName", app.UpdateScheduleHandler)
+	router.DELETE("/api/schedules/:scheduleName", app.DeleteScheduleHandler)
+
+	// Webhooks API
+	router.GET("/api/webhooks", app.GetAllWebhooksHandler)
+	router.GET("/api/webhooks/:webhookName", app.GetWebhookByNameHandler)
+	router.GET("/api/webhooks/:webhookName/deliveries", app.GetWebhookDeliveriesHandler)
+	router.GET("/api/webhooks/:webhookName/dead-letters", app.GetWebhookDeadLettersHandler)
+	router.POST("/api/webhooks", app.CreateWebhookHandler)
+	router.PUT("/api/webhooks/:webhookName", app.UpdateWebhookHandler)
+	router.DELETE("/api/webhooks/:webhookName", app.DeleteWebhookHandler)
+
+	// Admin API
+	router.POST("/api/admin/config/reload", app.ReloadConfigHandler)
+
+	// Live notifications
+	router.GET("/api/ws", app.WebSocketHandler)
+	router.GET("/api/events/stream", app.EventStreamHandler)
 
 	// ------------ Groups API ------------
-	// router.GET("/groups", handlers.GetGroupsHandler)
+	// router.GET("/groups", app.GetGroupsHandler)
 
-	serverAddr := os.Getenv("SERVER_ADDRESS")
-	if serverAddr == "" {
-		serverAddr = "127.0.0.1:8080"
-	}
-	router.Run(serverAddr) // Start the server
+	return router
 }
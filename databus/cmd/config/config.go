@@ -1 +1,222 @@
 package config
+
+import (
+	"crypto/rand"
+	"databus/network"
+	"encoding/hex"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeltaThreshold is how long an entity's reported state may differ from its desired state
+// before it is listed in the delta view (DELTA_THRESHOLD, default 30s)
+func DeltaThreshold() time.Duration {
+	return durationFromEnv("DELTA_THRESHOLD", 30*time.Second)
+}
+
+// WatchInterval is how often the configuration documents are checked for changes
+// (CONFIG_WATCH_INTERVAL, default 5s, 0 disables the watcher)
+func WatchInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("CONFIG_WATCH_INTERVAL")); err == nil && d == 0 {
+		return 0
+	}
+	return durationFromEnv("CONFIG_WATCH_INTERVAL", 5*time.Second)
+}
+
+// ScheduleMisfireGrace is how late a scheduled run may still be executed, e.g. after a restart
+// (SCHEDULE_MISFIRE_GRACE, default 1m). Runs missed by longer are skipped.
+func ScheduleMisfireGrace() time.Duration {
+	return durationFromEnv("SCHEDULE_MISFIRE_GRACE", time.Minute)
+}
+
+// WebhookWorkers is the number of concurrent webhook deliveries (WEBHOOK_WORKERS, default 4)
+func WebhookWorkers() int {
+	return intFromEnv("WEBHOOK_WORKERS", 4)
+}
+
+// WebhookMaxAttempts is how often a webhook delivery is attempted before the event is moved to the dead letters
+// (WEBHOOK_MAX_ATTEMPTS, default 5)
+func WebhookMaxAttempts() int {
+	return intFromEnv("WEBHOOK_MAX_ATTEMPTS", 5)
+}
+
+// WebhookTimeout bounds a single webhook delivery attempt (WEBHOOK_TIMEOUT, default 10s)
+func WebhookTimeout() time.Duration {
+	return durationFromEnv("WEBHOOK_TIMEOUT", 10*time.Second)
+}
+
+// ReadyOutboxBacklog is how many outbox entries may wait to be published on MQTT before /readyz fails
+// (READY_OUTBOX_BACKLOG, default 1000)
+func ReadyOutboxBacklog() int {
+	return intFromEnv("READY_OUTBOX_BACKLOG", 1000)
+}
+
+// WebSocketAllowedOrigins are the origins of the pages allowed to open /api/ws besides the API's own
+// (WS_ALLOWED_ORIGINS, comma separated, e.g. https://dashboard.example.com; * allows every page)
+func WebSocketAllowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimRight(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// AllowStandaloneMongo lets the server start on a standalone MongoDB server, without transactions
+// (MONGODB_ALLOW_STANDALONE=true). Outbox events are then written after the entity changes and a crash in
+// between loses them, so by default the server refuses to start.
+func AllowStandaloneMongo() bool {
+	return os.Getenv("MONGODB_ALLOW_STANDALONE") == "true"
+}
+
+// ForceRemove allows reconciliation to remove definitions and groups that are still referenced by
+// reactive entities (CONFIG_FORCE_REMOVE=true). Without it such removals are refused.
+func ForceRemove() bool {
+	return os.Getenv("CONFIG_FORCE_REMOVE") == "true"
+}
+
+// MQTTBrokers are the brokers the MQTT client connects to, in order of preference
+// (MQTT_BROKER_URL, comma separated, default tcp://localhost:1883). The next one is tried when a broker is unreachable.
+func MQTTBrokers() []string {
+	var brokers []string
+	for _, broker := range strings.Split(os.Getenv("MQTT_BROKER_URL"), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return []string{"tcp://localhost:1883"}
+	}
+	return brokers
+}
+
+// MQTTClientID is the client ID of the databus on the broker (MQTT_CLIENT_ID). It must be unique per instance,
+// the broker disconnects a client when another one connects with its ID. The default is databus-{hostname}-{random}.
+func MQTTClientID() string {
+	if id := os.Getenv("MQTT_CLIENT_ID"); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Fatalf("Error generating MQTT client ID: %v", err)
+	}
+	return "databus-" + hostname + "-" + hex.EncodeToString(suffix)
+}
+
+// MQTTCredentials returns the username and password of the MQTT client (MQTT_USERNAME and MQTT_PASSWORD, or the
+// files named by MQTT_USERNAME_FILE and MQTT_PASSWORD_FILE, e.g. Docker secrets; none by default)
+func MQTTCredentials() (string, string) {
+	return secretFromEnv("MQTT_USERNAME"), secretFromEnv("MQTT_PASSWORD")
+}
+
+// MQTTTLS returns the TLS files of the MQTT client, used for ssl:// and wss:// brokers (MQTT_TLS_CA_FILE,
+// MQTT_TLS_CERT_FILE and MQTT_TLS_KEY_FILE for mutual TLS, MQTT_TLS_INSECURE_SKIP_VERIFY=true for labs)
+func MQTTTLS() network.TLSFiles {
+	return network.TLSFiles{
+		CAFile:             os.Getenv("MQTT_TLS_CA_FILE"),
+		CertFile:           os.Getenv("MQTT_TLS_CERT_FILE"),
+		KeyFile:            os.Getenv("MQTT_TLS_KEY_FILE"),
+		InsecureSkipVerify: os.Getenv("MQTT_TLS_INSECURE_SKIP_VERIFY") == "true",
+	}
+}
+
+// MQTTMaxReconnectInterval caps the backoff between attempts to reconnect to the brokers
+// (MQTT_MAX_RECONNECT_INTERVAL, default 1m)
+func MQTTMaxReconnectInterval() time.Duration {
+	return durationFromEnv("MQTT_MAX_RECONNECT_INTERVAL", time.Minute)
+}
+
+// MQTTPublishQueueSize bounds the command acks, delta views, rule actions and configuration announcements kept in
+// memory while the MQTT client is disconnected (MQTT_PUBLISH_QUEUE_SIZE, default 1000)
+func MQTTPublishQueueSize() int {
+	return intFromEnv("MQTT_PUBLISH_QUEUE_SIZE", 1000)
+}
+
+// MQTTEmbedded runs the embedded MQTT broker instead of connecting to MQTT_BROKER_URL (MQTT_EMBEDDED=true)
+func MQTTEmbedded() bool {
+	return os.Getenv("MQTT_EMBEDDED") == "true"
+}
+
+// MQTTEmbeddedTCPAddress is the MQTT listener of the embedded broker (MQTT_EMBEDDED_TCP_ADDRESS, default :1883)
+func MQTTEmbeddedTCPAddress() string {
+	return stringFromEnv("MQTT_EMBEDDED_TCP_ADDRESS", ":1883")
+}
+
+// MQTTEmbeddedWSAddress is the MQTT over WebSocket listener of the embedded broker
+// (MQTT_EMBEDDED_WS_ADDRESS, default :9001)
+func MQTTEmbeddedWSAddress() string {
+	return stringFromEnv("MQTT_EMBEDDED_WS_ADDRESS", ":9001")
+}
+
+// MQTTEmbeddedAdmin returns the credentials allowed to use every topic of the embedded broker
+// (MQTT_EMBEDDED_USERNAME and MQTT_EMBEDDED_PASSWORD, or their _FILE variants; no admin by default)
+func MQTTEmbeddedAdmin() (string, string) {
+	return secretFromEnv("MQTT_EMBEDDED_USERNAME"), secretFromEnv("MQTT_EMBEDDED_PASSWORD")
+}
+
+// MQTTEmbeddedTLS returns the TLS files of the embedded broker's listeners (MQTT_EMBEDDED_TLS_CERT_FILE and
+// MQTT_EMBEDDED_TLS_KEY_FILE, plus MQTT_EMBEDDED_TLS_CA_FILE to require client certificates; plain by default)
+func MQTTEmbeddedTLS() network.TLSFiles {
+	return network.TLSFiles{
+		CAFile:   os.Getenv("MQTT_EMBEDDED_TLS_CA_FILE"),
+		CertFile: os.Getenv("MQTT_EMBEDDED_TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("MQTT_EMBEDDED_TLS_KEY_FILE"),
+	}
+}
+
+// secretFromEnv returns the value of key, or the content of the file named by key_FILE without its trailing newline.
+// An unreadable file is fatal rather than silently connecting without the secret.
+func secretFromEnv(key string) string {
+	path := os.Getenv(key + "_FILE")
+	if path == "" {
+		return os.Getenv(key)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Error reading %s_FILE: %v", key, err)
+	}
+	return strings.TrimRight(string(content), "\r\n")
+}
+
+func stringFromEnv(key string, fallback string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return fallback
+}
+
+// durationFromEnv parses a positive duration, invalid or non-positive values fall back (tickers and backoffs panic or
+// spin on them)
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		log.Printf("Invalid duration %q for %s, using %s", val, key, fallback)
+		return fallback
+	}
+	return d
+}
+
+func intFromEnv(key string, fallback int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 {
+		log.Printf("Invalid value %q for %s, using %d", val, key, fallback)
+		return fallback
+	}
+	return n
+}
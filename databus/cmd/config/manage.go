@@ -0,0 +1,302 @@
+package config
+
+import (
+	"databus/models"
+	"databus/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Definitions and groups can also be managed through the API. Every change is applied to the full set of
+definitions and groups currently in the database and goes through the same validate and reconcile steps as
+the JSON documents, so the API can never produce a configuration the documents could not.
+
+By default the result is written back to definitions.json and groups.json so disk and database stay consistent,
+otherwise the next reload of the documents would undo the change. CONFIG_WRITE_BACK=false or ?writeBack=false
+only change the database, until the next reload.
+*/
+
+var (
+	ErrConfigNotFound = errors.New("not found")
+	ErrConfigExists   = errors.New("already exists")
+	ErrConfigInUse    = errors.New("in use")
+)
+
+// WriteBack reports whether API changes to definitions and groups are written back to the JSON documents by default
+// (unless CONFIG_WRITE_BACK=false)
+func WriteBack() bool {
+	return os.Getenv("CONFIG_WRITE_BACK") != "false"
+}
+
+// CreateDefinition adds a new definition
+func (m *Manager) CreateDefinition(definition models.DefinitionJs, writeBack bool) (models.ReconcileReport, error) {
+	return m.manageConfigs(writeBack, func(djs []models.DefinitionJs, gps []models.GroupJs) ([]models.DefinitionJs, []models.GroupJs, error) {
+		if indexOfDefinition(djs, definition.Name) >= 0 {
+			return nil, nil, fmt.Errorf("definition '%s' %w", definition.Name, ErrConfigExists)
+		}
+		return append(djs, definition), gps, nil
+	})
+}
+
+// UpdateDefinition replaces the description and states of a definition (it cannot be renamed). States the
+// reactive entities of the definition are in cannot be dropped, nor can attributes they hold change type: like
+// for a reload, reconciliation refuses such a change.
+func (m *Manager) UpdateDefinition(name string, definition models.DefinitionJs, writeBack bool) (models.ReconcileReport, error) {
+	if definition.Name == "" {
+		definition.Name = name
+	}
+	if definition.Name != name {
+		return models.ReconcileReport{}, fmt.Errorf("%w: definition '%s' cannot be renamed", ErrInvalidConfig, name)
+	}
+
+	return m.manageConfigs(writeBack, func(djs []models.DefinitionJs, gps []models.GroupJs) ([]models.DefinitionJs, []models.GroupJs, error) {
+		i := indexOfDefinition(djs, name)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("definition '%s' %w", name, ErrConfigNotFound)
+		}
+		djs[i] = definition
+		return djs, gps, nil
+	})
+}
+
+// DeleteDefinition removes a definition that is neither allowed by any group nor used by any reactive entity
+func (m *Manager) DeleteDefinition(name string, writeBack bool) (models.ReconcileReport, error) {
+	return m.manageConfigs(writeBack, func(djs []models.DefinitionJs, gps []models.GroupJs) ([]models.DefinitionJs, []models.GroupJs, error) {
+		i := indexOfDefinition(djs, name)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("definition '%s' %w", name, ErrConfigNotFound)
+		}
+
+		var usedBy []string
+		for _, group := range gps {
+			for _, allowed := range group.AllowedDefinitions {
+				if allowed == name {
+					usedBy = append(usedBy, group.Name)
+				}
+			}
+		}
+		if len(usedBy) > 0 {
+			return nil, nil, fmt.Errorf("definition '%s' %w, allowed by group(s) '%s'", name, ErrConfigInUse, strings.Join(usedBy, "', '"))
+		}
+		if err := m.checkRuleReferences("definition", name, func(rule *models.Rule) bool {
+			return utils.Contains(rule.When.Definitions, name)
+		}); err != nil {
+			return nil, nil, err
+		}
+
+		// Removal is refused by reconciliation while reactive entities still use the definition
+		return append(djs[:i], djs[i+1:]...), gps, nil
+	})
+}
+
+// CreateGroup adds a new group
+func (m *Manager) CreateGroup(group models.GroupJs, writeBack bool) (models.ReconcileReport, error) {
+	return m.manageConfigs(writeBack, func(djs []models.DefinitionJs, gps []models.GroupJs) ([]models.DefinitionJs, []models.GroupJs, error) {
+		if indexOfGroup(gps, group.Name) >= 0 {
+			return nil, nil, fmt.Errorf("group '%s' %w", group.Name, ErrConfigExists)
+		}
+		return djs, append(gps, group), nil
+	})
+}
+
+// UpdateGroup replaces the description and allowed definitions of a group (it cannot be renamed). Reconciliation
+// refuses to drop an allowed definition members of the group use.
+func (m *Manager) UpdateGroup(name string, group models.GroupJs, writeBack bool) (models.ReconcileReport, error) {
+	if group.Name == "" {
+		group.Name = name
+	}
+	if group.Name != name {
+		return models.ReconcileReport{}, fmt.Errorf("%w: group '%s' cannot be renamed", ErrInvalidConfig, name)
+	}
+
+	return m.manageConfigs(writeBack, func(djs []models.DefinitionJs, gps []models.GroupJs) ([]models.DefinitionJs, []models.GroupJs, error) {
+		i := indexOfGroup(gps, name)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("group '%s' %w", name, ErrConfigNotFound)
+		}
+		gps[i] = group
+		return djs, gps, nil
+	})
+}
+
+// DeleteGroup removes a group that no reactive entity belongs to, and no rule or schedule targets
+func (m *Manager) DeleteGroup(name string, writeBack bool) (models.ReconcileReport, error) {
+	return m.manageConfigs(writeBack, func(djs []models.DefinitionJs, gps []models.GroupJs) ([]models.DefinitionJs, []models.GroupJs, error) {
+		i := indexOfGroup(gps, name)
+		if i < 0 {
+			return nil, nil, fmt.Errorf("group '%s' %w", name, ErrConfigNotFound)
+		}
+
+		if err := m.checkRuleReferences("group", name, func(rule *models.Rule) bool {
+			return ruleReferencesGroup(rule, name)
+		}); err != nil {
+			return nil, nil, err
+		}
+		if err := m.checkScheduleReferences(name); err != nil {
+			return nil, nil, err
+		}
+
+		// Removal is refused by reconciliation while reactive entities still belong to the group
+		return djs, append(gps[:i], gps[i+1:]...), nil
+	})
+}
+
+// manageConfigs applies a change to the current definitions and groups, then optionally writes them back to disk
+func (m *Manager) manageConfigs(writeBack bool, change func([]models.DefinitionJs, []models.GroupJs) ([]models.DefinitionJs, []models.GroupJs, error)) (models.ReconcileReport, error) {
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+
+	djs, gps, err := m.currentConfigs()
+	if err != nil {
+		return models.ReconcileReport{}, err
+	}
+
+	djs, gps, err = change(djs, gps)
+	if err != nil {
+		return models.ReconcileReport{}, err
+	}
+
+	// The rules of rules.json must stay valid with the changed definitions and groups
+	rjs, err := m.store.GetRulesByOrigin(models.RuleOriginDocument)
+	if err != nil {
+		return models.ReconcileReport{}, err
+	}
+
+	// API changes never force the removal of referenced records
+	report, err := m.applyConfigs(djs, gps, rjs, false)
+	if err != nil {
+		return report, err
+	}
+
+	if writeBack {
+		if err := writeDocuments(djs, gps); err != nil {
+			return report, fmt.Errorf("configuration applied but not written back to disk: %v", err)
+		}
+	}
+
+	m.announceConfigChange(report)
+	return report, nil
+}
+
+// checkRuleReferences refuses the removal of a definition or group that rules (from rules.json or the API) still reference
+func (m *Manager) checkRuleReferences(kind string, name string, references func(*models.Rule) bool) error {
+	rules, err := m.store.GetAllRules()
+	if err != nil {
+		return err
+	}
+
+	var usedBy []string
+	for i := range rules {
+		if references(&rules[i]) {
+			usedBy = append(usedBy, rules[i].Name)
+		}
+	}
+	if len(usedBy) > 0 {
+		return fmt.Errorf("%s '%s' %w, referenced by rule(s) '%s'", kind, name, ErrConfigInUse, strings.Join(usedBy, "', '"))
+	}
+	return nil
+}
+
+// checkScheduleReferences refuses the removal of a group schedules still target
+func (m *Manager) checkScheduleReferences(group string) error {
+	schedules, err := m.store.GetAllSchedules()
+	if err != nil {
+		return err
+	}
+
+	var usedBy []string
+	for i := range schedules {
+		if utils.Contains(schedules[i].Groups, group) {
+			usedBy = append(usedBy, schedules[i].Name)
+		}
+	}
+	if len(usedBy) > 0 {
+		return fmt.Errorf("group '%s' %w, targeted by schedule(s) '%s'", group, ErrConfigInUse, strings.Join(usedBy, "', '"))
+	}
+	return nil
+}
+
+func ruleReferencesGroup(rule *models.Rule, group string) bool {
+	if utils.Contains(rule.When.Groups, group) {
+		return true
+	}
+	for _, cond := range rule.Conditions {
+		if cond.Group == group {
+			return true
+		}
+	}
+	for _, action := range rule.Actions {
+		if utils.Contains(action.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// currentConfigs returns the definitions and groups in the database in their document (JSON) form
+func (m *Manager) currentConfigs() ([]models.DefinitionJs, []models.GroupJs, error) {
+	definitions, err := m.store.GetAllDefinitions()
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, err := m.store.GetAllGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	djs := make([]models.DefinitionJs, len(definitions))
+	for i := range definitions {
+		djs[i] = definitions[i].ToJs()
+	}
+	gps := make([]models.GroupJs, len(groups))
+	for i := range groups {
+		gps[i] = *groups[i].ToJs(definitions)
+	}
+	return djs, gps, nil
+}
+
+// writeDocuments replaces definitions.json and groups.json with the given configuration
+func writeDocuments(djs []models.DefinitionJs, gps []models.GroupJs) error {
+	if err := writeDocument(jsons.definitions, djs); err != nil {
+		return err
+	}
+	return writeDocument(jsons.groups, gps)
+}
+
+func writeDocument(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers (and the watcher) never see a partial document
+	target := filepath.Join(path, name)
+	tmp := target + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, target)
+}
+
+func indexOfDefinition(djs []models.DefinitionJs, name string) int {
+	for i := range djs {
+		if djs[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func indexOfGroup(gps []models.GroupJs, name string) int {
+	for i := range gps {
+		if gps[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
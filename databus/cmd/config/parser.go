@@ -2,15 +2,19 @@ package config
 
 import (
 	"databus/models"
+	"databus/network"
 	"databus/persistence"
 	"databus/utils"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
 )
 
 var path string
@@ -18,10 +22,32 @@ var path string
 type documents struct {
 	definitions string
 	groups      string
+	rules       string
 }
 
 var jsons documents
 
+/* The configuration manager, built in main from the store and the MQTT publisher announcing changes */
+type Manager struct {
+	store     persistence.Store
+	publisher network.Publisher
+
+	// loadMu serializes configuration loads (startup, file watcher, reload endpoint)
+	loadMu sync.Mutex
+
+	// loadedAt is the time of the last successful load, loadErr the error of the last failed one (both guarded by loadMu)
+	loadedAt time.Time
+	loadErr  error
+}
+
+// NewManager returns the configuration manager of the store, nothing is loaded until ParseAllConfigs
+func NewManager(store persistence.Store, publisher network.Publisher) *Manager {
+	return &Manager{store: store, publisher: publisher}
+}
+
+// ErrInvalidConfig is returned when a configuration document cannot be parsed or fails validation
+var ErrInvalidConfig = errors.New("invalid configuration")
+
 func init() {
 	// Check for environment variable first (for Docker/production)
 	if documentsPath := os.Getenv("DOCUMENTS_PATH"); documentsPath != "" {
@@ -46,6 +72,7 @@ func init() {
 					jsons = documents{
 						definitions: "definitions.json",
 						groups:      "groups.json",
+						rules:       "rules.json",
 					}
 					return
 				}
@@ -61,64 +88,168 @@ func init() {
 	jsons = documents{
 		definitions: "definitions.json",
 		groups:      "groups.json",
+		rules:       "rules.json",
 	}
 }
 
-func ParseAllConfigs() {
+func (m *Manager) ParseAllConfigs() {
+	// Startup load: without a valid configuration there is nothing to serve
+	if _, err := m.LoadConfigs(ForceRemove()); err != nil {
+		log.Fatal(utils.StrToRed("Error loading configuration: "), err)
+	}
+	fmt.Println(utils.StrToGreen("Note: Reactive entities are managed via API endpoints.\n"))
+}
+
+// LoadConfigs parses, validates and reconciles definitions.json, groups.json and the optional rules.json with the database.
+// Nothing is written unless every document parses and validates and no removal is refused, so on error
+// the previously loaded configuration stays in place.
+func (m *Manager) LoadConfigs(force bool) (models.ReconcileReport, error) {
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+
+	report, err := m.loadConfigs(force)
+	if err != nil {
+		m.loadErr = err
+		return report, err
+	}
+	m.loadedAt, m.loadErr = time.Now().UTC(), nil
+	return report, nil
+}
+
+// LastLoad returns when the configuration was last loaded (zero before the first successful load) and the
+// error of the last attempt, if it failed. A failed reload keeps the previous configuration in place.
+func (m *Manager) LastLoad() (time.Time, error) {
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+	return m.loadedAt, m.loadErr
+}
+
+// loadConfigs is LoadConfigs without the lock (callers must hold loadMu)
+func (m *Manager) loadConfigs(force bool) (models.ReconcileReport, error) {
 	/*
 		Order matters! The hierarchy for validation is designed like so:
 		- Definitions are isolated objects that do not refer/link to any other config, so they can be parsed first
 		- Groups refer to definitions, so validation considers whether the model exists before comitting them
+		- Rules refer to definitions, groups and state labels, so they are validated last
 
 		For each config type, the three steps are executed:
 		1. Parse from JSON file
 		2. Validate the parsed data based on rules
-		3. Insert the validated data into the database
+		3. Reconcile the validated data with the database (upsert by Name, existing IDs are kept)
+
+		Step 3 only starts once step 1 and 2 passed for every config type. The same validate and
+		reconcile steps back the definitions and groups API (see manage.go).
 
 		Note: Reactive entities are managed via API and not loaded from static files.
 	*/
 
-	// --- --- --- --- --- --- Definitions --- --- --- --- --- ---
-	fmt.Println("\nParsing and validating Definition configuration...")
+	// --- --- --- --- --- --- Parse --- --- --- --- --- ---
+	fmt.Println("\nParsing configuration documents...")
 	djs, err := ParseDefinitions()
 	if err != nil {
-		log.Fatal(utils.StrToRed("Error parsing definition json: "), err)
+		return models.ReconcileReport{}, fmt.Errorf("%w: error parsing definition json: %v", ErrInvalidConfig, err)
 	}
 	fmt.Println(utils.StrToGreen("\tLoaded definition json"))
 
-	vms, err := ValidateDefinitions(djs)
+	gps, err := ParseGroups()
 	if err != nil {
-		log.Fatal(utils.StrToRed("Error validating definitions: "), err)
+		return models.ReconcileReport{}, fmt.Errorf("%w: error parsing groups.json: %v", ErrInvalidConfig, err)
 	}
-	fmt.Println(utils.StrToGreen("\tValidated definition json"))
+	fmt.Println(utils.StrToGreen("\tLoaded groups.json"))
 
-	_, err = persistence.InsertDefinitions(persistence.MongoClient, vms)
+	rjs, err := ParseRules()
 	if err != nil {
-		log.Fatal(utils.StrToRed("Error inserting definitions: "), err)
+		return models.ReconcileReport{}, fmt.Errorf("%w: error parsing rules.json: %v", ErrInvalidConfig, err)
 	}
-	fmt.Println(utils.StrToGreen("\tInserted definitions into persistence"))
+	fmt.Println(utils.StrToGreen("\tLoaded rules.json"))
 
-	// --- --- --- --- --- --- Groups --- --- --- --- --- ---
-	fmt.Println("\nParsing and validating Groups configuration...")
-	gps, err := ParseGroups()
+	return m.applyConfigs(djs, gps, rjs, force)
+}
+
+// applyConfigs validates definitions, groups and document rules and reconciles them with the database (callers must hold loadMu)
+func (m *Manager) applyConfigs(djs []models.DefinitionJs, gps []models.GroupJs, rjs []models.Rule, force bool) (models.ReconcileReport, error) {
+	report := models.ReconcileReport{}
+
+	// --- --- --- --- --- --- Definitions --- --- --- --- --- ---
+	fmt.Println("\nValidating Definition configuration...")
+	vms, err := ValidateDefinitions(djs)
 	if err != nil {
-		log.Fatal(utils.StrToRed("Error parsing groups.json: "), err)
+		return report, fmt.Errorf("%w: error validating definitions: %v", ErrInvalidConfig, err)
 	}
-	fmt.Println(utils.StrToGreen("\tLoaded groups.json"))
+	fmt.Println(utils.StrToGreen("\tValidated definition json"))
+
+	// --- --- --- --- --- --- Groups --- --- --- --- --- ---
+	fmt.Println("\nValidating Groups configuration...")
 	vgps, err := ValidateGroups(gps, vms)
 	if err != nil {
-		log.Fatal(utils.StrToRed("Error validating groups: "), err)
+		return report, fmt.Errorf("%w: error validating groups: %v", ErrInvalidConfig, err)
 	}
 	fmt.Println(utils.StrToGreen("\tValidated groups.json"))
-	_, err = persistence.InsertGroups(persistence.MongoClient, vgps)
+
+	// --- --- --- --- --- --- Rules --- --- --- --- --- ---
+	fmt.Println("\nValidating Rules configuration...")
+	vrls, err := ValidateRules(rjs, vms, vgps)
 	if err != nil {
-		log.Fatal(utils.StrToRed("Error inserting groups: "), err)
+		return report, fmt.Errorf("%w: error validating rules: %v", ErrInvalidConfig, err)
 	}
-	fmt.Println(utils.StrToGreen("\tInserted groups into persistence"))
+	fmt.Println(utils.StrToGreen("\tValidated rules.json"))
 
-	fmt.Println(utils.StrToGreen("\nAll configurations parsed, validated, and inserted successfully!\n"))
-	fmt.Println(utils.StrToGreen("Note: Reactive entities are managed via API endpoints.\n"))
+	// --- --- --- --- --- --- Reconcile --- --- --- --- --- ---
+	// Dry run everything first, so a refused removal of a group does not leave the definitions half applied
+	fmt.Println("\nReconciling configuration with persistence...")
+	if _, err := persistence.ReconcileDefinitions(m.store, vms, force, true); err != nil {
+		return report, err
+	}
+	// The dry run set the IDs of the existing definitions, which the allowed definitions of the groups are compared by
+	vgps, _ = ValidateGroups(gps, vms)
+	if _, err := persistence.ReconcileGroups(m.store, vgps, force, true); err != nil {
+		return report, err
+	}
+	if _, err := persistence.ReconcileRules(m.store, vrls, true); err != nil {
+		return report, err
+	}
+
+	report.Definitions, err = persistence.ReconcileDefinitions(m.store, vms, force, false)
+	if err != nil {
+		return report, fmt.Errorf("error reconciling definitions: %w", err)
+	}
+	fmt.Println(utils.StrToGreen("\tReconciled definitions with persistence"))
+	printDiff(report.Definitions)
 
+	// Groups are converted again now that every definition has its ID
+	vgps, _ = ValidateGroups(gps, vms)
+	report.Groups, err = persistence.ReconcileGroups(m.store, vgps, force, false)
+	if err != nil {
+		return report, fmt.Errorf("error reconciling groups: %w", err)
+	}
+	fmt.Println(utils.StrToGreen("\tReconciled groups with persistence"))
+	printDiff(report.Groups)
+
+	report.Rules, err = persistence.ReconcileRules(m.store, vrls, false)
+	if err != nil {
+		return report, fmt.Errorf("error reconciling rules: %w", err)
+	}
+	fmt.Println(utils.StrToGreen("\tReconciled rules with persistence"))
+	printDiff(report.Rules)
+
+	fmt.Println(utils.StrToGreen("\nAll configurations parsed, validated, and reconciled successfully!\n"))
+	return report, nil
+}
+
+func printDiff(diff models.ConfigDiff) {
+	if diff.Empty() {
+		fmt.Println("\t\tNo changes")
+		return
+	}
+	for _, name := range diff.Added {
+		fmt.Println(utils.StrToGreen("\t\t+ " + name))
+	}
+	for _, name := range diff.Changed {
+		fmt.Println(utils.StrToYellow("\t\t~ " + name))
+	}
+	for _, name := range diff.Removed {
+		fmt.Println(utils.StrToRed("\t\t- " + name))
+	}
 }
 
 func ParseDefinitions() ([]models.DefinitionJs, error) {
@@ -129,17 +260,21 @@ func ParseDefinitions() ([]models.DefinitionJs, error) {
 	// Open the file
 	file, err := os.Open(jsf)
 	if err != nil {
-		log.Fatal("Error opening groups.json:", err)
 		return nil, err
 	}
 	defer file.Close()
 
 	// Read the file
-	byteValue, _ := io.ReadAll(file)
+	byteValue, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
 
 	var definitions []models.DefinitionJs
 
-	json.Unmarshal(byteValue, &definitions)
+	if err := json.Unmarshal(byteValue, &definitions); err != nil {
+		return nil, err
+	}
 
 	// for i := 0; i < len(definitions); i++ {
 	// 	definitions[i].Print()
@@ -156,17 +291,21 @@ func ParseGroups() ([]models.GroupJs, error) {
 	// Open the file
 	file, err := os.Open(jsf)
 	if err != nil {
-		log.Fatal("Error opening groups.json:", err)
 		return nil, err
 	}
 	defer file.Close()
 
 	// Read the file
-	byteValue, _ := io.ReadAll(file)
+	byteValue, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
 
 	var groups []models.GroupJs
 
-	json.Unmarshal(byteValue, &groups)
+	if err := json.Unmarshal(byteValue, &groups); err != nil {
+		return nil, err
+	}
 
 	// for i := 0; i < len(groups); i++ {
 	// 	groups[i].Print()
@@ -176,3 +315,21 @@ func ParseGroups() ([]models.GroupJs, error) {
 
 }
 
+// ParseRules parses rules.json. The document is optional, without it there are no document rules.
+func ParseRules() ([]models.Rule, error) {
+	jsf := filepath.Join(path, jsons.rules)
+
+	byteValue, err := os.ReadFile(jsf)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rules []models.Rule
+	if err := json.Unmarshal(byteValue, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"databus/models"
+	"databus/utils"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+Hot reload re-runs parse -> validate -> reconcile while the server keeps running, either when
+the documents in DOCUMENTS_PATH change on disk or when triggered through the admin API.
+A failed reload leaves the current configuration in place.
+*/
+
+const configChangedTopic = "config/changed"
+
+/* The notification published on config/changed after a reload changed something */
+type configChanged struct {
+	Report    models.ReconcileReport `json:"Report"`
+	Timestamp time.Time              `json:"Timestamp"`
+}
+
+// ReloadConfigs reloads the configuration documents and announces the diff on config/changed
+func (m *Manager) ReloadConfigs() (models.ReconcileReport, error) {
+	report, err := m.LoadConfigs(ForceRemove())
+	if err != nil {
+		return report, err
+	}
+
+	m.announceConfigChange(report)
+	return report, nil
+}
+
+// announceConfigChange publishes the diff of a configuration change on config/changed, if anything changed
+func (m *Manager) announceConfigChange(report models.ReconcileReport) {
+	if report.Definitions.Empty() && report.Groups.Empty() && report.Rules.Empty() {
+		return
+	}
+
+	payload, err := json.Marshal(configChanged{Report: report, Timestamp: time.Now().UTC()})
+	if err != nil {
+		log.Printf("Error encoding config change: %v", err)
+		return
+	}
+	if err := m.publisher.Publish(configChangedTopic, payload); err != nil {
+		log.Printf("Error publishing config change: %v", err)
+	}
+}
+
+// WatchConfigs polls the configuration documents every interval and reloads them when they change,
+// until the process exits
+func (m *Manager) WatchConfigs(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := documentModTimes()
+	for range ticker.C {
+		current := documentModTimes()
+		if current == last {
+			continue
+		}
+		last = current
+
+		log.Println("Configuration documents changed, reloading...")
+		if _, err := m.ReloadConfigs(); err != nil {
+			log.Println(utils.StrToRed("Reload failed, keeping the current configuration: "), err)
+		}
+	}
+}
+
+// documentModTimes returns the modification times of definitions.json, groups.json and rules.json (zero if missing)
+func documentModTimes() [3]time.Time {
+	var times [3]time.Time
+	for i, name := range []string{jsons.definitions, jsons.groups, jsons.rules} {
+		if info, err := os.Stat(filepath.Join(path, name)); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
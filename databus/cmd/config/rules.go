@@ -0,0 +1,140 @@
+package config
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Rules come from rules.json (reconciled with the documents) or from the rules API. Rules created through the API
+are stored in the database only and validated against the current definitions and groups, with the same rules
+as rules.json. Rules of rules.json cannot be changed through the API.
+*/
+
+// ErrConfigReadOnly is returned when the API tries to change a rule managed by rules.json
+var ErrConfigReadOnly = errors.New("managed by rules.json")
+
+// CreateRule validates and stores a new rule
+func (m *Manager) CreateRule(rule models.Rule) (*models.Rule, error) {
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+
+	valid, err := m.ValidateCurrentRules([]models.Rule{rule})
+	if err != nil {
+		return nil, err
+	}
+	rule = valid[0]
+
+	if _, err := m.store.GetRuleByName(rule.Name); err == nil {
+		return nil, fmt.Errorf("rule '%s' %w", rule.Name, ErrConfigExists)
+	} else if !errors.Is(err, persistence.ErrNotFound) {
+		return nil, err
+	}
+
+	rule.ID = primitive.NilObjectID
+	rule.Origin = models.RuleOriginAPI
+	if err := m.store.InsertRule(&rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// UpdateRule replaces a rule created through the API (it cannot be renamed)
+func (m *Manager) UpdateRule(name string, rule models.Rule) (*models.Rule, error) {
+	if rule.Name == "" {
+		rule.Name = name
+	}
+	if rule.Name != name {
+		return nil, fmt.Errorf("%w: rule '%s' cannot be renamed", ErrInvalidConfig, name)
+	}
+
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+
+	current, err := m.getAPIRule(name)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := m.ValidateCurrentRules([]models.Rule{rule})
+	if err != nil {
+		return nil, err
+	}
+	rule = valid[0]
+	rule.ID = current.ID
+	rule.Origin = models.RuleOriginAPI
+	if err := m.store.ReplaceRule(&rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// DeleteRule removes a rule created through the API
+func (m *Manager) DeleteRule(name string) error {
+	m.loadMu.Lock()
+	defer m.loadMu.Unlock()
+
+	current, err := m.getAPIRule(name)
+	if err != nil {
+		return err
+	}
+	return m.store.DeleteRule(current.ID)
+}
+
+// ValidateCurrentRules validates rules against the definitions, groups and webhook subscriptions currently in the
+// database
+func (m *Manager) ValidateCurrentRules(rules []models.Rule) ([]models.Rule, error) {
+	definitions, err := m.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := m.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	valid, err := ValidateRules(rules, definitions, groups)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	if err := m.checkRuleWebhooks(valid); err != nil {
+		return nil, err
+	}
+	return valid, nil
+}
+
+// checkRuleWebhooks makes sure the webhook actions name existing subscriptions. Rules of rules.json are not
+// checked, they may be loaded before the subscriptions are created through the API.
+func (m *Manager) checkRuleWebhooks(rules []models.Rule) error {
+	for _, rule := range rules {
+		for _, action := range rule.Actions {
+			if action.Type != models.RuleActionWebhook {
+				continue
+			}
+			if _, err := m.store.GetWebhookByName(action.Webhook); errors.Is(err, persistence.ErrNotFound) {
+				return fmt.Errorf("%w: webhook '%s' of rule '%s' not found", ErrInvalidConfig, action.Webhook, rule.Name)
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Manager) getAPIRule(name string) (*models.Rule, error) {
+	current, err := m.store.GetRuleByName(name)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("rule '%s' %w", name, ErrConfigNotFound)
+		}
+		return nil, err
+	}
+	if current.Origin == models.RuleOriginDocument {
+		return nil, fmt.Errorf("rule '%s' is %w", name, ErrConfigReadOnly)
+	}
+	return current, nil
+}
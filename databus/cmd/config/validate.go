@@ -2,43 +2,78 @@ package config
 
 import (
 	"databus/models"
+	"databus/utils"
 	"fmt"
+	"regexp"
+	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func ValidateDefinitions(definitions []models.DefinitionJs) ([]models.DefinitionRaw, error) {
 	// Validate the definitions
-	// - verify all 'name' fields are unique
-	// - verify states field is not empty
-	// - verify states field contains unique states
+	// - verify all 'name' fields are set and unique
+	// - verify states and attributes fields are not both empty
+	// - verify states field contains valid, unique state hex values and non-empty, unique labels
+	// - verify attributes have unique names, a known type and consistent constraints
+	// - verify transitions only reference known states and every state is reachable from the first one
 
 	// Map to check for unique 'Name' fields across definitions
 	nameMap := make(map[string]struct{})
 
 	// Iterate through all definitions
 	for _, df := range definitions {
+		// Check that 'Name' is set
+		if df.Name == "" {
+			return nil, fmt.Errorf("definition name is required")
+		}
+
 		// Check for duplicate 'Name' fields
 		if _, exists := nameMap[df.Name]; exists {
 			return nil, fmt.Errorf("duplicate definition name detected: %s", df.Name)
 		}
 		nameMap[df.Name] = struct{}{}
 
-		// Check that 'States' field is not empty
-		if len(df.States) == 0 {
+		// Check that 'States' field is not empty (definitions made only of attributes, e.g. sensors, are fine)
+		if len(df.States) == 0 && len(df.Attributes) == 0 {
 			return nil, fmt.Errorf("definition '%s' has an empty states list", df.Name)
 		}
 
-		// Verify uniqueness of 'Hex' in States using a map
-		stateHexMap := make(map[string]struct{})
+		// Verify every 'Hex' parses and is unique in States using a map. States are also resolved by label
+		// (API, rules, schedules, transitions), so labels must be set and unique as well.
+		stateHexMap := make(map[uint16]struct{})
+		labelMap := make(map[string]struct{})
 		for _, state := range df.States {
-			if _, exists := stateHexMap[state.Hex]; exists {
+			val, err := utils.ParseHex(state.Hex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid state hex value '%s' in definition '%s'", state.Hex, df.Name)
+			}
+			if _, exists := stateHexMap[val]; exists {
 				return nil, fmt.Errorf(
-					"duplicate state hex value '%#02x' detected in definition '%s'",
+					"duplicate state hex value '%s' detected in definition '%s'",
 					state.Hex, df.Name,
 				)
 			}
-			stateHexMap[state.Hex] = struct{}{}
+			stateHexMap[val] = struct{}{}
+
+			if state.Label == "" {
+				return nil, fmt.Errorf("state '%s' in definition '%s' has no label", state.Hex, df.Name)
+			}
+			if _, exists := labelMap[state.Label]; exists {
+				return nil, fmt.Errorf("duplicate state label '%s' detected in definition '%s'", state.Label, df.Name)
+			}
+			labelMap[state.Label] = struct{}{}
+		}
+
+		// Verify the attributes
+		if err := validateAttributes(df.Name, df.Attributes); err != nil {
+			return nil, err
+		}
+
+		// Verify the transition graph
+		if err := validateTransitions(df); err != nil {
+			return nil, err
 		}
 	}
 
@@ -51,9 +86,112 @@ func ValidateDefinitions(definitions []models.DefinitionJs) ([]models.Definition
 	return valid_definitions, nil
 }
 
+// attributeNamePattern keeps attribute names usable as database field names and MQTT payload keys
+var attributeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateAttributes(definitionName string, attributes []models.AttributeDef) error {
+	attrNameMap := make(map[string]struct{})
+	for _, attr := range attributes {
+		if !attributeNamePattern.MatchString(attr.Name) {
+			return fmt.Errorf("invalid attribute name '%s' in definition '%s'", attr.Name, definitionName)
+		}
+		if _, exists := attrNameMap[attr.Name]; exists {
+			return fmt.Errorf("duplicate attribute '%s' detected in definition '%s'", attr.Name, definitionName)
+		}
+		attrNameMap[attr.Name] = struct{}{}
+
+		switch attr.Type {
+		case models.AttributeEnum:
+			if len(attr.Values) == 0 {
+				return fmt.Errorf("enum attribute '%s' in definition '%s' has no values", attr.Name, definitionName)
+			}
+			valueMap := make(map[string]struct{})
+			for _, v := range attr.Values {
+				if _, exists := valueMap[v]; exists {
+					return fmt.Errorf("duplicate value '%s' in attribute '%s' of definition '%s'", v, attr.Name, definitionName)
+				}
+				valueMap[v] = struct{}{}
+			}
+		case models.AttributeInteger, models.AttributeFloat:
+			if attr.Min != nil && attr.Max != nil && *attr.Min > *attr.Max {
+				return fmt.Errorf("attribute '%s' in definition '%s' has Min greater than Max", attr.Name, definitionName)
+			}
+			if attr.Step != nil && (attr.Type != models.AttributeInteger || *attr.Step <= 0) {
+				return fmt.Errorf("attribute '%s' in definition '%s' has an invalid Step", attr.Name, definitionName)
+			}
+		case models.AttributeBoolean, models.AttributeString:
+		default:
+			return fmt.Errorf("attribute '%s' in definition '%s' has unknown type '%s'", attr.Name, definitionName, attr.Type)
+		}
+	}
+	return nil
+}
+
+func validateTransitions(df models.DefinitionJs) error {
+	if len(df.Transitions) == 0 {
+		return nil
+	}
+	if len(df.States) == 0 {
+		return fmt.Errorf("definition '%s' declares transitions but no states", df.Name)
+	}
+
+	// Transitions reference states by label, unique ones (see ValidateDefinitions)
+	labelMap := make(map[string]struct{})
+	for _, state := range df.States {
+		labelMap[state.Label] = struct{}{}
+	}
+
+	// Several rules may leave the same state (with different MinDwell guards), each move is declared once
+	graph := make(map[string][]string)
+	for _, tr := range df.Transitions {
+		if _, exists := labelMap[tr.From]; !exists {
+			return fmt.Errorf("transition from unknown state '%s' in definition '%s'", tr.From, df.Name)
+		}
+		for _, to := range tr.To {
+			if _, exists := labelMap[to]; !exists {
+				return fmt.Errorf("transition from '%s' to unknown state '%s' in definition '%s'", tr.From, to, df.Name)
+			}
+			if utils.Contains(graph[tr.From], to) {
+				return fmt.Errorf("duplicate transition from '%s' to '%s' in definition '%s'", tr.From, to, df.Name)
+			}
+		}
+		if tr.MinDwell != "" {
+			if d, err := time.ParseDuration(tr.MinDwell); err != nil || d < 0 {
+				return fmt.Errorf("invalid MinDwell '%s' on transitions from '%s' in definition '%s'", tr.MinDwell, tr.From, df.Name)
+			}
+		}
+		graph[tr.From] = append(graph[tr.From], tr.To...)
+	}
+
+	// Walk the graph from the initial state, every state must be reachable
+	initial := df.States[0].Label
+	reached := map[string]struct{}{initial: {}}
+	queue := []string{initial}
+	for len(queue) > 0 {
+		label := queue[0]
+		queue = queue[1:]
+		for _, to := range graph[label] {
+			if _, seen := reached[to]; !seen {
+				reached[to] = struct{}{}
+				queue = append(queue, to)
+			}
+		}
+	}
+	for _, state := range df.States {
+		if _, ok := reached[state.Label]; !ok {
+			return fmt.Errorf("state '%s' of definition '%s' is unreachable from initial state '%s'", state.Label, df.Name, initial)
+		}
+	}
+	return nil
+}
+
+// groupNamePattern keeps group names a single MQTT topic level without wildcards (topics starting with '$' are
+// reserved by brokers)
+var groupNamePattern = regexp.MustCompile(`^[^$/+#][^/+#]*$`)
+
 func ValidateGroups(groups []models.GroupJs, validDefinitions []models.DefinitionRaw) ([]models.GroupRaw, error) {
 	// Validate the groups
-	// - verify all 'name' fields are unique
+	// - verify all 'name' fields are set, unique and usable as an MQTT topic level
 	// - verify definition tag referenced in 'AllowedModels' exists in definitions
 
 	// Map to track unique group names
@@ -71,6 +209,14 @@ func ValidateGroups(groups []models.GroupJs, validDefinitions []models.Definitio
 	// Validate groups
 	for _, group := range groups {
 
+		// Check that the group name is set and cannot widen the topics of the group (ACL, events and state)
+		if group.Name == "" {
+			return nil, fmt.Errorf("group name is required")
+		}
+		if !groupNamePattern.MatchString(group.Name) {
+			return nil, fmt.Errorf("invalid group name '%s', it cannot contain '/', '+' or '#' nor start with '$'", group.Name)
+		}
+
 		// Check for duplicate group names
 		if _, exists := groupNameMap[group.Name]; exists {
 			return nil, fmt.Errorf("duplicate group name detected: %s", group.Name)
@@ -113,5 +259,165 @@ func ValidateGroups(groups []models.GroupJs, validDefinitions []models.Definitio
 
 }
 
+// ruleEventTypes are the event types a rule can be triggered by
+var ruleEventTypes = []string{
+	models.EventCreated, models.EventUpdated, models.EventDeleted,
+	models.EventStateChanged, models.EventReported, models.EventAttributesChanged,
+}
+
+func ValidateRules(rules []models.Rule, validDefinitions []models.DefinitionRaw, validGroups []models.GroupRaw) ([]models.Rule, error) {
+	// Validate the rules
+	// - verify all 'name' fields are set, unique and usable in a URL
+	// - verify the trigger selects entities by hex, group or definition and only uses known event types
+	// - verify referenced groups, definitions and state labels exist, entity hexes parse
+	// - verify every rule has at least one action and each action is complete for its type
+
+	ruleNameMap := make(map[string]struct{})
+
+	groupNameMap := make(map[string]struct{})
+	for _, group := range validGroups {
+		groupNameMap[group.Name] = struct{}{}
+	}
+	definitionMap := make(map[string]models.DefinitionRaw)
+	for _, def := range validDefinitions {
+		definitionMap[def.Name] = def
+	}
+
+	validRules := make([]models.Rule, len(rules))
+	for i, rule := range rules {
+		if !attributeNamePattern.MatchString(rule.Name) {
+			return nil, fmt.Errorf("invalid rule name '%s'", rule.Name)
+		}
+		if _, exists := ruleNameMap[rule.Name]; exists {
+			return nil, fmt.Errorf("duplicate rule name detected: %s", rule.Name)
+		}
+		ruleNameMap[rule.Name] = struct{}{}
+
+		// --- Trigger ---
+		when := rule.When
+		if len(when.EntityHexes) == 0 && len(when.Groups) == 0 && len(when.Definitions) == 0 {
+			return nil, fmt.Errorf("rule '%s' must select EntityHexes, Groups or Definitions", rule.Name)
+		}
+		for _, eventType := range when.EventTypes {
+			if !utils.Contains(ruleEventTypes, eventType) {
+				return nil, fmt.Errorf("unknown event type '%s' in rule '%s'", eventType, rule.Name)
+			}
+		}
+		hexes := make([]string, len(when.EntityHexes))
+		for j, hex := range when.EntityHexes {
+			normalized, err := utils.NormalizeEntityHex(hex)
+			if err != nil {
+				return nil, fmt.Errorf("rule '%s': %v", rule.Name, err)
+			}
+			hexes[j] = normalized
+		}
+		when.EntityHexes = hexes
+		for _, group := range when.Groups {
+			if _, exists := groupNameMap[group]; !exists {
+				return nil, fmt.Errorf("invalid group reference '%s' in rule '%s', not found in groups", group, rule.Name)
+			}
+		}
+
+		// State labels must exist in the selected definitions, or in any definition when none are selected
+		candidates := validDefinitions
+		if len(when.Definitions) > 0 {
+			candidates = nil
+			for _, name := range when.Definitions {
+				def, exists := definitionMap[name]
+				if !exists {
+					return nil, fmt.Errorf("invalid definition reference '%s' in rule '%s', not found in definitions", name, rule.Name)
+				}
+				candidates = append(candidates, def)
+			}
+		}
+		for _, label := range []string{when.FromState, when.State} {
+			if label != "" && !hasStateLabel(candidates, label) {
+				return nil, fmt.Errorf("unknown state '%s' in the trigger of rule '%s'", label, rule.Name)
+			}
+		}
+		rule.When = when
+
+		// --- Conditions ---
+		conditions := make([]models.RuleCondition, len(rule.Conditions))
+		for j, cond := range rule.Conditions {
+			if (cond.EntityHex == "") == (cond.Group == "") {
+				return nil, fmt.Errorf("condition %d of rule '%s' needs either EntityHex or Group", j+1, rule.Name)
+			}
+			if cond.EntityHex != "" {
+				normalized, err := utils.NormalizeEntityHex(cond.EntityHex)
+				if err != nil {
+					return nil, fmt.Errorf("rule '%s': %v", rule.Name, err)
+				}
+				cond.EntityHex = normalized
+			}
+			if cond.Group != "" {
+				if _, exists := groupNameMap[cond.Group]; !exists {
+					return nil, fmt.Errorf("invalid group reference '%s' in rule '%s', not found in groups", cond.Group, rule.Name)
+				}
+			}
+			if cond.State == "" || !hasStateLabel(validDefinitions, cond.State) {
+				return nil, fmt.Errorf("unknown state '%s' in condition %d of rule '%s'", cond.State, j+1, rule.Name)
+			}
+			conditions[j] = cond
+		}
+		rule.Conditions = conditions
+
+		// --- Actions ---
+		if len(rule.Actions) == 0 {
+			return nil, fmt.Errorf("rule '%s' has no actions", rule.Name)
+		}
+		actions := make([]models.RuleAction, len(rule.Actions))
+		for j, action := range rule.Actions {
+			switch action.Type {
+			case models.RuleActionSetState:
+				if (action.EntityHex == "") == (len(action.Groups) == 0) {
+					return nil, fmt.Errorf("set_state action %d of rule '%s' needs either EntityHex or Groups", j+1, rule.Name)
+				}
+				if action.EntityHex != "" {
+					normalized, err := utils.NormalizeEntityHex(action.EntityHex)
+					if err != nil {
+						return nil, fmt.Errorf("rule '%s': %v", rule.Name, err)
+					}
+					action.EntityHex = normalized
+				}
+				for _, group := range action.Groups {
+					if _, exists := groupNameMap[group]; !exists {
+						return nil, fmt.Errorf("invalid group reference '%s' in rule '%s', not found in groups", group, rule.Name)
+					}
+				}
+				if action.State == "" || !hasStateLabel(validDefinitions, action.State) {
+					return nil, fmt.Errorf("unknown state '%s' in action %d of rule '%s'", action.State, j+1, rule.Name)
+				}
+			case models.RuleActionPublish:
+				if action.Topic == "" || strings.ContainsAny(action.Topic, "+#") {
+					return nil, fmt.Errorf("publish action %d of rule '%s' needs a Topic without wildcards", j+1, rule.Name)
+				}
+			case models.RuleActionWebhook:
+				if action.Webhook == "" {
+					return nil, fmt.Errorf("webhook action %d of rule '%s' needs the name of a Webhook subscription", j+1, rule.Name)
+				}
+			default:
+				return nil, fmt.Errorf("action %d of rule '%s' has unknown type '%s'", j+1, rule.Name, action.Type)
+			}
+			actions[j] = action
+		}
+		rule.Actions = actions
+
+		validRules[i] = rule
+	}
+
+	// If all validations pass, return the rules with normalized entity hexes
+	return validRules, nil
+}
+
+func hasStateLabel(definitions []models.DefinitionRaw, label string) bool {
+	for i := range definitions {
+		if _, ok := definitions[i].FindStateByLabel(label); ok {
+			return true
+		}
+	}
+	return false
+}
+
 // Note: Reactive entity validation is performed at API time when entities are created/updated
 // via API endpoints, not during initial configuration parsing.
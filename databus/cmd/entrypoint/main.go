@@ -2,30 +2,106 @@
 package main
 
 import (
+	"context"
 	"databus/cmd/api"
 	"databus/cmd/config"
+	"databus/events"
+	"databus/handlers"
+	"databus/ingest"
 	"databus/network"
 	"databus/persistence"
+	"databus/utils"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 // var mongoClient *mongo.Client
 
 func main() {
 
-	// Initialize MQTT client
-	network.InitMQTTClient()
+	// Open the storage backend (STORAGE_BACKEND, MongoDB by default)
+	store, err := persistence.Open()
+	if err != nil {
+		log.Fatal(utils.StrToRed("Error opening store: "), err)
+	}
+	defer store.Close()
+	if !store.AtomicOutbox() {
+		if !config.AllowStandaloneMongo() {
+			log.Fatal(utils.StrToRed("MongoDB is a standalone server without transactions, entity events could be lost on a crash. " +
+				"Run a (single-node) replica set, or set MONGODB_ALLOW_STANDALONE=true to accept the risk."))
+		}
+		log.Println(utils.StrToRed("WARNING: MongoDB is a standalone server without transactions. Outbox events are written " +
+			"after the entity changes and a crash in between loses them. Run a replica set in production."))
+	}
 
-	// Start the WebSocket client (listens for FCodes)
-	// go startWebSocketClient()
+	// Run the embedded MQTT broker (MQTT_EMBEDDED=true) or connect to MQTT_BROKER_URL
+	var client network.Client
+	if config.MQTTEmbedded() {
+		tlsConfig, err := config.MQTTEmbeddedTLS().ServerConfig()
+		if err != nil {
+			log.Fatal(utils.StrToRed("Error loading embedded MQTT broker TLS files: "), err)
+		}
+		adminUsername, adminPassword := config.MQTTEmbeddedAdmin()
+		broker, err := network.StartBroker(config.MQTTEmbeddedTCPAddress(), config.MQTTEmbeddedWSAddress(), tlsConfig,
+			ingest.NewDeviceACL(store, adminUsername, adminPassword))
+		if err != nil {
+			log.Fatal(utils.StrToRed("Error starting embedded MQTT broker: "), err)
+		}
+		defer broker.Close()
+		client = broker
+	} else {
+		tlsConfig, err := config.MQTTTLS().ClientConfig()
+		if err != nil {
+			log.Fatal(utils.StrToRed("Error loading MQTT TLS files: "), err)
+		}
+		username, password := config.MQTTCredentials()
+		client = network.InitMQTTClient(network.MQTTOptions{
+			Brokers:              config.MQTTBrokers(),
+			ClientID:             config.MQTTClientID(),
+			Username:             username,
+			Password:             password,
+			TLS:                  tlsConfig,
+			MaxReconnectInterval: config.MQTTMaxReconnectInterval(),
+			QueueSize:            config.MQTTPublishQueueSize(),
+		})
+	}
 
-	// Start the WebSocket server (sends notifications)
-	// go startWebSocketServer()
-	persistence.Connect()
-	defer persistence.Disconnect()
+	app := handlers.NewApp(store, client)
+
+	// Publish the entity events of the outbox on MQTT
+	events.StartOutboxDispatcher(store, client)
 
 	// Configuration parsing
-	config.ParseAllConfigs()
+	app.Config.ParseAllConfigs()
+	if interval := config.WatchInterval(); interval > 0 {
+		go app.Config.WatchConfigs(interval)
+	}
+
+	// Accept state-change commands over MQTT
+	if err := ingest.StartCommandListener(client, app.Services); err != nil {
+		log.Fatal(utils.StrToRed("Error starting MQTT command listener: "), err)
+	}
+
+	// Track the states devices report and publish the delta view
+	if err := ingest.StartReportedStateListener(client, app.Services); err != nil {
+		log.Fatal(utils.StrToRed("Error starting MQTT reported state listener: "), err)
+	}
+	go ingest.StartDeltaMonitor(client, app.Services, config.DeltaThreshold())
+
+	// React to entity events with the configured rules
+	app.Rules.Start()
+
+	// Run scheduled state changes
+	go app.Scheduler.Start(config.ScheduleMisfireGrace())
+
+	// Deliver entity events to the webhook subscriptions
+	app.Webhooks.Start(config.WebhookWorkers(), config.WebhookMaxAttempts(), config.WebhookTimeout())
 
-	// Initialize the router and routes
-	api.InitializeRoutes()
+	// Initialize the router and routes, served until SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	api.InitializeRoutes(ctx, app)
+	log.Println("Shut down")
 }
@@ -0,0 +1,57 @@
+// main.go
+package main
+
+import (
+	"databus/persistence"
+	"databus/utils"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+/*
+Copies every collection between storage backends, e.g. from MongoDB to a bbolt file for an edge deployment:
+
+	go run ./cmd/migrate -from mongo -to bolt -to-path /data/databus.db
+
+MongoDB is reached through MONGODB_URI. Stop the API server first, the embedded files can only be opened by one
+process at a time.
+*/
+func main() {
+	from := flag.String("from", "", "source backend (mongo, bolt or sqlite)")
+	fromPath := flag.String("from-path", "", "file of an embedded source backend")
+	to := flag.String("to", "", "target backend (mongo, bolt or sqlite)")
+	toPath := flag.String("to-path", "", "file of an embedded target backend")
+	overwrite := flag.Bool("overwrite", false, "replace the data of a target that is not empty")
+	flag.Parse()
+
+	if *from == "" || *to == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *from == *to && *fromPath == *toPath {
+		log.Fatal(utils.StrToRed("Source and target are the same store"))
+	}
+
+	source, err := persistence.OpenBackend(*from, *fromPath)
+	if err != nil {
+		log.Fatal(utils.StrToRed("Error opening source store: "), err)
+	}
+	defer source.Close()
+
+	target, err := persistence.OpenBackend(*to, *toPath)
+	if err != nil {
+		log.Fatal(utils.StrToRed("Error opening target store: "), err)
+	}
+	defer target.Close()
+
+	counts, err := persistence.Migrate(source, target, *overwrite)
+	if err != nil {
+		log.Fatal(utils.StrToRed("Migration failed: "), err)
+	}
+	for _, collection := range persistence.Collections {
+		fmt.Printf("%-20s %d documents\n", collection, counts[collection])
+	}
+	fmt.Println(utils.StrToGreen("Migration complete"))
+}
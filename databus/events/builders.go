@@ -0,0 +1,103 @@
+// builders.go
+package events
+
+import (
+	"databus/models"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Every event carries a snapshot of the entity before and/or after the change, and the source
+(REST, MQTT, scheduler, ...) that caused it.
+*/
+
+// NewCreatedEvent builds the event emitted when a reactive entity is created
+func NewCreatedEvent(entity *models.ReactiveEntityJs, definition *models.DefinitionRaw, source string) models.EntityEvent {
+	e := newEntityEvent(models.EventCreated, entity, source)
+	e.NewState = stateRef(definition, entity.Data.CurrentState)
+	e.After = entity
+	return e
+}
+
+// NewUpdatedEvent builds the event emitted when the metadata (description, location, definition, groups) of a reactive entity changes
+func NewUpdatedEvent(before *models.ReactiveEntityJs, after *models.ReactiveEntityJs, definition *models.DefinitionRaw, source string) models.EntityEvent {
+	e := newEntityEvent(models.EventUpdated, after, source)
+	e.NewState = stateRef(definition, after.Data.CurrentState)
+	e.Before = before
+	e.After = after
+	return e
+}
+
+// NewDeletedEvent builds the event emitted when a reactive entity is removed
+func NewDeletedEvent(entity *models.ReactiveEntityJs, definition *models.DefinitionRaw, source string) models.EntityEvent {
+	e := newEntityEvent(models.EventDeleted, entity, source)
+	e.OldState = stateRef(definition, entity.Data.CurrentState)
+	e.Before = entity
+	return e
+}
+
+// NewStateChangedEvent builds the event emitted when Data.CurrentState of a reactive entity changes
+func NewStateChangedEvent(before *models.ReactiveEntityJs, after *models.ReactiveEntityJs, definition *models.DefinitionRaw, source string) models.EntityEvent {
+	e := newEntityEvent(models.EventStateChanged, after, source)
+	e.OldState = stateRef(definition, before.Data.CurrentState)
+	e.NewState = stateRef(definition, after.Data.CurrentState)
+	e.Before = before
+	e.After = after
+	return e
+}
+
+// NewReportedEvent builds the event emitted when the state reported by a device changes.
+// OldState is omitted when the device had never reported before.
+func NewReportedEvent(before *models.ReactiveEntityJs, after *models.ReactiveEntityJs, definition *models.DefinitionRaw, source string) models.EntityEvent {
+	e := newEntityEvent(models.EventReported, after, source)
+	if before.Data.ReportedState != nil {
+		e.OldState = stateRef(definition, *before.Data.ReportedState)
+	}
+	if after.Data.ReportedState != nil {
+		e.NewState = stateRef(definition, *after.Data.ReportedState)
+	}
+	e.Before = before
+	e.After = after
+	return e
+}
+
+// NewAttributesChangedEvent builds the event emitted when attribute values of a reactive entity are written.
+// Attributes carries only the values that were written.
+func NewAttributesChangedEvent(before *models.ReactiveEntityJs, after *models.ReactiveEntityJs, values map[string]interface{}, source string) models.EntityEvent {
+	e := newEntityEvent(models.EventAttributesChanged, after, source)
+	e.Attributes = values
+	e.Before = before
+	e.After = after
+	return e
+}
+
+func newEntityEvent(eventType string, entity *models.ReactiveEntityJs, source string) models.EntityEvent {
+	return models.EntityEvent{
+		ID:         primitive.NewObjectID().Hex(),
+		Type:       eventType,
+		EntityHex:  entity.EntityHex,
+		Definition: entity.Definition,
+		Groups:     entity.Groups,
+		Source:     source,
+		Timestamp:  time.Now().UTC(),
+	}
+}
+
+// StateRef resolves a state hex to its hex/label reference within a definition
+func StateRef(definition *models.DefinitionRaw, hex int) *models.StateJs {
+	return stateRef(definition, hex)
+}
+
+func stateRef(definition *models.DefinitionRaw, hex int) *models.StateJs {
+	// Resolve the label from the definition, falling back to the bare hex if unknown
+	ref := &models.StateJs{Hex: fmt.Sprintf("%#02x", hex)}
+	if definition != nil {
+		if st, ok := definition.FindStateByHex(uint16(hex)); ok {
+			ref.Label = st.Label
+		}
+	}
+	return ref
+}
@@ -0,0 +1,117 @@
+// bus.go
+package events
+
+import (
+	"databus/models"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The event bus is the single source of entity events inside the databus.
+Every change to a reactive entity is published here once, and each sink
+(WebSocket, SSE, webhooks, etc.) subscribes to receive it, so the channels never disagree.
+MQTT and the history are fed from the outbox entry and the history row written with the change
+(see outbox.go), the bus only wakes the outbox dispatcher.
+
+The most recent events are also kept in a ring buffer so stream clients can resume
+from the last event they saw.
+*/
+
+// Handler receives every event published on the bus
+type Handler func(models.EntityEvent)
+
+// RecentEventsSize is the number of events kept in memory for resuming streams
+const RecentEventsSize = 1024
+
+type subscription struct {
+	id      int
+	handler Handler
+}
+
+var (
+	mu            sync.RWMutex
+	nextID        int
+	subscriptions []subscription
+
+	recent     = make([]models.EntityEvent, RecentEventsSize)
+	recentNext int
+	recentLen  int
+)
+
+// Subscribe registers a handler to receive all future events.
+// The returned function removes the handler again (e.g. when a client disconnects).
+func Subscribe(h Handler) func() {
+	_, unsubscribe := SubscribeSince("", h)
+	return unsubscribe
+}
+
+// SubscribeSince registers a handler like Subscribe and atomically returns the buffered events published after
+// lastID, so nothing is lost or duplicated between the backlog and live events. An empty lastID returns no backlog,
+// an ID no longer in the buffer returns the whole buffer.
+func SubscribeSince(lastID string, h Handler) ([]models.EntityEvent, func()) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var backlog []models.EntityEvent
+	if lastID != "" {
+		backlog = recentSince(lastID)
+	}
+
+	nextID++
+	id := nextID
+	subscriptions = append(subscriptions, subscription{id: id, handler: h})
+
+	return backlog, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, sub := range subscriptions {
+			if sub.id == id {
+				subscriptions = append(subscriptions[:i], subscriptions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish assigns the event an ID (unless it already has one), records it and fans it out to every subscribed handler.
+// Handlers run synchronously and must not block; slow consumers should buffer on their own.
+func Publish(e models.EntityEvent) {
+	mu.Lock()
+	if e.ID == "" {
+		e.ID = primitive.NewObjectID().Hex()
+	}
+	recent[recentNext] = e
+	recentNext = (recentNext + 1) % RecentEventsSize
+	if recentLen < RecentEventsSize {
+		recentLen++
+	}
+
+	subscribers := make([]Handler, len(subscriptions))
+	for i, sub := range subscriptions {
+		subscribers[i] = sub.handler
+	}
+	mu.Unlock()
+
+	for _, h := range subscribers {
+		h(e)
+	}
+}
+
+// recentSince returns the buffered events after lastID, oldest first (callers must hold mu)
+func recentSince(lastID string) []models.EntityEvent {
+	start := (recentNext - recentLen + RecentEventsSize) % RecentEventsSize
+
+	ordered := make([]models.EntityEvent, 0, recentLen)
+	for i := 0; i < recentLen; i++ {
+		ordered = append(ordered, recent[(start+i)%RecentEventsSize])
+	}
+
+	for i := range ordered {
+		if ordered[i].ID == lastID {
+			return ordered[i+1:]
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,77 @@
+// filter.go
+package events
+
+import (
+	"databus/models"
+	"databus/utils"
+	"strings"
+)
+
+// Filter selects events by entity hex, group name and definition name.
+// An empty list matches everything. Entity hexes and definitions match any of the listed values,
+// groups follow the byGroups endpoint and require the entity to belong to every listed group.
+type Filter struct {
+	EntityHexes []string `json:"EntityHexes,omitempty"`
+	Groups      []string `json:"Groups,omitempty"`
+	Definitions []string `json:"Definitions,omitempty"`
+}
+
+// NewFilter builds a filter from comma separated lists, as used in query strings
+// (e.g. ?entityHex=0x1a,1b&group=kitchen-lights&definition=ESP32)
+func NewFilter(entityHexes string, groups string, definitions string) (Filter, error) {
+	f := Filter{
+		EntityHexes: splitList(entityHexes),
+		Groups:      splitList(groups),
+		Definitions: splitList(definitions),
+	}
+	return f.Normalized()
+}
+
+// Normalized returns a copy of the filter with every entity hex in the format events carry
+func (f Filter) Normalized() (Filter, error) {
+	hexes := make([]string, 0, len(f.EntityHexes))
+	for _, hex := range f.EntityHexes {
+		normalized, err := utils.NormalizeEntityHex(hex)
+		if err != nil {
+			return Filter{}, err
+		}
+		hexes = append(hexes, normalized)
+	}
+	f.EntityHexes = hexes
+	return f, nil
+}
+
+// Matches reports whether an event passes the filter
+func (f *Filter) Matches(e models.EntityEvent) bool {
+	return f.matches(e.EntityHex, e.Definition, e.Groups)
+}
+
+// MatchesEntity reports whether an entity passes the filter
+func (f *Filter) MatchesEntity(entity *models.ReactiveEntityJs) bool {
+	return f.matches(entity.EntityHex, entity.Definition, entity.Groups)
+}
+
+func (f *Filter) matches(entityHex string, definition string, groups []string) bool {
+	if len(f.EntityHexes) > 0 && !utils.Contains(f.EntityHexes, entityHex) {
+		return false
+	}
+	if len(f.Definitions) > 0 && !utils.Contains(f.Definitions, definition) {
+		return false
+	}
+	for _, group := range f.Groups {
+		if !utils.Contains(groups, group) {
+			return false
+		}
+	}
+	return true
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
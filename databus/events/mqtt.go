@@ -0,0 +1,33 @@
+// mqtt.go
+package events
+
+import (
+	"databus/models"
+	"encoding/json"
+	"fmt"
+)
+
+// EventTopics returns every MQTT topic an event is announced on:
+// events/{entityHex} and groups/{groupName}/events for each group of the entity
+func EventTopics(e models.EntityEvent) []string {
+	topics := []string{"events/" + e.EntityHex}
+	for _, group := range e.Groups {
+		topics = append(topics, "groups/"+group+"/events")
+	}
+	return topics
+}
+
+// publishEvent publishes the JSON envelope of an event to all of its MQTT topics
+func (d *outboxDispatcher) publishEvent(e models.EntityEvent) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding event for entity %s: %v", e.EntityHex, err)
+	}
+
+	for _, topic := range EventTopics(e) {
+		if err := d.client.Publish(topic, payload); err != nil {
+			return fmt.Errorf("error publishing event to %s: %v", topic, err)
+		}
+	}
+	return nil
+}
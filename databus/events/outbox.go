@@ -0,0 +1,161 @@
+// outbox.go
+package events
+
+import (
+	"databus/models"
+	"databus/network"
+	"databus/persistence"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The outbox dispatcher publishes entity events on MQTT from the Outbox collection. The events are written there in
+the same transaction as the entity changes, so a crash between the database write and the publish neither loses
+an event nor publishes one for a change that was never committed.
+
+Entries are published one at a time, oldest first. When publishing fails (e.g. the broker is unreachable) the same
+entry is retried with exponential backoff before any later one, and pending entries are picked up again after a
+restart. Delivery is at-least-once: an event can be published twice, always with the same ID, which consumers use
+to drop duplicates. An entry is marked delivered only after the broker acknowledged it. The retained state topic of the entity is
+refreshed after each event, those of its groups after each batch.
+*/
+
+const (
+	outboxBatchSize    = 100
+	outboxPollInterval = 5 * time.Second
+	outboxMaxBackoff   = time.Minute
+	// outboxRetention is how long delivered entries are kept before they are removed
+	outboxRetention = 24 * time.Hour
+)
+
+/* The outbox dispatcher, publishing the entries of a store with an MQTT client */
+type outboxDispatcher struct {
+	store  persistence.Store
+	client network.Client
+	// wake tells the dispatcher that new entries were committed
+	wake chan struct{}
+	// members caches the entities of every group by group ID, see state.go
+	members map[primitive.ObjectID]map[uint16]models.ReactiveEntityRaw
+	// staleGroups are the groups whose retained state has not been published since their entities changed
+	staleGroups map[string]bool
+}
+
+// StartOutboxDispatcher publishes the pending outbox entries of the store with the client until the process exits
+func StartOutboxDispatcher(store persistence.Store, client network.Client) {
+	d := &outboxDispatcher{store: store, client: client, wake: make(chan struct{}, 1), staleGroups: make(map[string]bool)}
+	Subscribe(d.wakeUp)
+	go d.dispatch()
+}
+
+// wakeUp is the bus handler waking the dispatcher, events are only on the bus once their entry is committed.
+// It must not block.
+func (d *outboxDispatcher) wakeUp(models.EntityEvent) {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *outboxDispatcher) dispatch() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	var backoff time.Duration
+	var pruned time.Time
+	republished := false
+	for {
+		err := d.drain()
+		if err == nil && !republished {
+			// Once the pending events are out, bring every retained state topic up to date
+			err = d.republishStates()
+			republished = err == nil
+		}
+		if err != nil {
+			backoff = nextOutboxBackoff(backoff)
+			log.Printf("Error publishing outbox events, retrying in %s: %v", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if time.Since(pruned) > time.Hour {
+			if _, err := d.store.DeleteDeliveredOutboxEntries(time.Now().Add(-outboxRetention)); err != nil {
+				log.Printf("Error removing delivered outbox entries: %v", err)
+			}
+			pruned = time.Now()
+		}
+
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain publishes the pending entries in order until none are left, it stops at the first failure.
+// An entry is only marked delivered once the broker acknowledged every publish of its event: the MQTT client
+// publishes with QoS 1 and waits for the acknowledgement, and fails right away when the connection is down.
+func (d *outboxDispatcher) drain() error {
+	for {
+		// Skip the attempt (and the error recorded on the first entry) while disconnected
+		if !d.client.State().Connected {
+			return fmt.Errorf("mqtt client is not connected")
+		}
+
+		entries, err := d.store.GetPendingOutboxEntries(outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 && len(d.staleGroups) == 0 {
+			return nil
+		}
+
+		// Read once per batch for the state topics
+		definitions, err := d.store.GetAllDefinitions()
+		if err != nil {
+			return err
+		}
+		groups, err := d.store.GetAllGroups()
+		if err != nil {
+			return err
+		}
+
+		for i := range entries {
+			err := d.publishEvent(entries[i].Event)
+			if err == nil {
+				err = d.publishStates(entries[i].Event, definitions, groups)
+			}
+			if err != nil {
+				if err := d.store.SetOutboxEntryError(entries[i].ID, err.Error()); err != nil {
+					log.Printf("Error recording outbox failure of event %s: %v", entries[i].Event.ID, err)
+				}
+				return fmt.Errorf("event %s: %w", entries[i].Event.ID, err)
+			}
+			if err := d.store.MarkOutboxEntryDelivered(entries[i].ID, time.Now().UTC()); err != nil {
+				return err
+			}
+		}
+		if err := d.publishGroupStates(definitions, groups); err != nil {
+			return err
+		}
+
+		if len(entries) < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+// nextOutboxBackoff doubles the delay between attempts, from 1s up to outboxMaxBackoff
+func nextOutboxBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return time.Second
+	}
+	if backoff *= 2; backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,251 @@
+// state.go
+package events
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Retained state topics let a device or dashboard learn the current state as soon as it subscribes, without calling
+the REST API:
+
+	state/{entityHex}          the state, reported state and attributes of an entity
+	groups/{groupName}/state   the state of every entity of the group, by entity hex
+
+They are refreshed by the outbox dispatcher after the event of a change is published, from the store rather than
+from the event, so they always hold the committed state even when events are published again. The groups of the
+changed entities are published once per batch of events, from a membership cache kept up to date by the events,
+so a change to every entity of a group does not reread the group once per entity. The retained message of a
+deleted entity (or group), or of the old hex of a moved entity, is cleared. Every state topic is republished when
+the dispatcher starts.
+*/
+
+// StateTopic returns the retained state topic of an entity
+func StateTopic(entityHex string) string {
+	return "state/" + entityHex
+}
+
+// GroupStateTopic returns the retained state topic of a group
+func GroupStateTopic(groupName string) string {
+	return "groups/" + groupName + "/state"
+}
+
+// publishStates refreshes the retained state of the entity of an event, from the store, and marks the groups it
+// belongs or belonged to as stale. An entity moved to another hex has the retained message of its old hex cleared.
+func (d *outboxDispatcher) publishStates(e models.EntityEvent, definitions []models.DefinitionRaw, groups []models.GroupRaw) error {
+	entity, err := d.eventEntity(e.EntityHex)
+	switch {
+	case errors.Is(err, persistence.ErrNotFound):
+		// Deleted: clear the retained message
+		if err := d.clearEntityState(e.EntityHex); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if err := d.publishEntityState(entity, definitions, groups); err != nil {
+			return err
+		}
+		d.remember(entity)
+	}
+
+	if e.Before != nil && e.Before.EntityHex != e.EntityHex {
+		if err := d.clearEntityState(e.Before.EntityHex); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range eventGroups(e) {
+		d.staleGroups[name] = true
+	}
+	return nil
+}
+
+// publishGroupStates publishes the retained state of the stale groups from the cached membership, each group once
+// however many of its entities changed. The summary of a group that no longer exists is cleared.
+func (d *outboxDispatcher) publishGroupStates(definitions []models.DefinitionRaw, groups []models.GroupRaw) error {
+	if len(d.staleGroups) == 0 {
+		return nil
+	}
+	if d.members == nil {
+		entities, err := d.store.GetAllReactiveEntities()
+		if err != nil {
+			return err
+		}
+		d.members = groupMembers(entities)
+	}
+
+	for name := range d.staleGroups {
+		group := findGroup(groups, name)
+		if group == nil {
+			if err := d.client.PublishRetained(GroupStateTopic(name), nil); err != nil {
+				return fmt.Errorf("error clearing %s: %v", GroupStateTopic(name), err)
+			}
+		} else if err := d.publishGroupState(name, d.members[group.ID], definitions); err != nil {
+			return err
+		}
+		delete(d.staleGroups, name)
+	}
+	return nil
+}
+
+// republishStates publishes the retained state of every entity and group, and reloads the cached membership
+func (d *outboxDispatcher) republishStates() error {
+	definitions, err := d.store.GetAllDefinitions()
+	if err != nil {
+		return err
+	}
+	groups, err := d.store.GetAllGroups()
+	if err != nil {
+		return err
+	}
+	entities, err := d.store.GetAllReactiveEntities()
+	if err != nil {
+		return err
+	}
+
+	for i := range entities {
+		if err := d.publishEntityState(&entities[i], definitions, groups); err != nil {
+			return err
+		}
+	}
+	d.members = groupMembers(entities)
+	for _, group := range groups {
+		if err := d.publishGroupState(group.Name, d.members[group.ID], definitions); err != nil {
+			return err
+		}
+		delete(d.staleGroups, group.Name)
+	}
+	return nil
+}
+
+// groupMembers maps the ID of every group to its entities, by entity hex
+func groupMembers(entities []models.ReactiveEntityRaw) map[primitive.ObjectID]map[uint16]models.ReactiveEntityRaw {
+	members := make(map[primitive.ObjectID]map[uint16]models.ReactiveEntityRaw)
+	for i := range entities {
+		for _, id := range entities[i].Groups {
+			if members[id] == nil {
+				members[id] = make(map[uint16]models.ReactiveEntityRaw)
+			}
+			members[id][entities[i].EntityHex] = entities[i]
+		}
+	}
+	return members
+}
+
+// remember replaces an entity in the cached membership, it is left to the next load while nothing is cached
+func (d *outboxDispatcher) remember(entity *models.ReactiveEntityRaw) {
+	if d.members == nil {
+		return
+	}
+	d.forget(entity.EntityHex)
+	for _, id := range entity.Groups {
+		if d.members[id] == nil {
+			d.members[id] = make(map[uint16]models.ReactiveEntityRaw)
+		}
+		d.members[id][entity.EntityHex] = *entity
+	}
+}
+
+// forget removes an entity from every group of the cached membership
+func (d *outboxDispatcher) forget(hex uint16) {
+	for _, members := range d.members {
+		delete(members, hex)
+	}
+}
+
+// clearEntityState clears the retained state of an entity that was deleted or moved to another hex
+func (d *outboxDispatcher) clearEntityState(entityHex string) error {
+	if err := d.client.PublishRetained(StateTopic(entityHex), nil); err != nil {
+		return fmt.Errorf("error clearing %s: %v", StateTopic(entityHex), err)
+	}
+	if hex, err := utils.ParseEntityHex(entityHex); err == nil {
+		d.forget(hex)
+	}
+	return nil
+}
+
+func (d *outboxDispatcher) publishEntityState(entity *models.ReactiveEntityRaw, definitions []models.DefinitionRaw, groups []models.GroupRaw) error {
+	js := entity.ToJs(definitions, groups)
+	definition := findDefinition(definitions, entity.Definition)
+
+	msg := models.EntityStateMessage{
+		EntityHex:          js.EntityHex,
+		Definition:         js.Definition,
+		Groups:             js.Groups,
+		State:              stateRef(definition, entity.Data.CurrentState),
+		Attributes:         entity.Data.Attributes,
+		ReportedAttributes: entity.Data.ReportedAttributes,
+		LastUpdated:        entity.Data.LastUpdated,
+	}
+	if entity.Data.ReportedState != nil {
+		msg.ReportedState = stateRef(definition, *entity.Data.ReportedState)
+	}
+	return d.publishRetainedJSON(StateTopic(js.EntityHex), msg)
+}
+
+func (d *outboxDispatcher) publishGroupState(name string, members map[uint16]models.ReactiveEntityRaw, definitions []models.DefinitionRaw) error {
+	msg := models.GroupStateMessage{Group: name, States: make(map[string]models.StateJs, len(members)), Timestamp: time.Now().UTC()}
+	for _, entity := range members {
+		msg.States[fmt.Sprintf("%#02x", entity.EntityHex)] = *stateRef(findDefinition(definitions, entity.Definition), entity.Data.CurrentState)
+	}
+	return d.publishRetainedJSON(GroupStateTopic(name), msg)
+}
+
+func (d *outboxDispatcher) publishRetainedJSON(topic string, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %v", topic, err)
+	}
+	if err := d.client.PublishRetained(topic, payload); err != nil {
+		return fmt.Errorf("error publishing %s: %v", topic, err)
+	}
+	return nil
+}
+
+func (d *outboxDispatcher) eventEntity(entityHex string) (*models.ReactiveEntityRaw, error) {
+	hex, err := utils.ParseEntityHex(entityHex)
+	if err != nil {
+		return nil, err
+	}
+	return d.store.GetReactiveEntityByHex(hex)
+}
+
+// eventGroups returns the groups of the entity after the change, and those it was removed from
+func eventGroups(e models.EntityEvent) []string {
+	names := append([]string(nil), e.Groups...)
+	if e.Before != nil {
+		for _, name := range e.Before.Groups {
+			if !utils.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func findGroup(groups []models.GroupRaw, name string) *models.GroupRaw {
+	for i := range groups {
+		if groups[i].Name == name {
+			return &groups[i]
+		}
+	}
+	return nil
+}
+
+func findDefinition(definitions []models.DefinitionRaw, id primitive.ObjectID) *models.DefinitionRaw {
+	for i := range definitions {
+		if definitions[i].ID == id {
+			return &definitions[i]
+		}
+	}
+	return nil
+}
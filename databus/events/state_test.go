@@ -0,0 +1,153 @@
+package events
+
+import (
+	"databus/models"
+	"databus/network"
+	"databus/persistence"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* A client recording the retained messages, and how often each topic was published */
+type retainingClient struct {
+	mu       sync.Mutex
+	retained map[string][]byte
+	counts   map[string]int
+}
+
+func (c *retainingClient) Publish(topic string, payload []byte) error { return nil }
+
+func (c *retainingClient) PublishRetained(topic string, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.retained == nil {
+		c.retained, c.counts = make(map[string][]byte), make(map[string]int)
+	}
+	c.retained[topic] = payload
+	c.counts[topic]++
+	return nil
+}
+
+func (c *retainingClient) Subscribe(string, network.MessageHandler) error { return nil }
+
+func (c *retainingClient) State() network.ConnectionState {
+	return network.ConnectionState{Connected: true}
+}
+
+func (c *retainingClient) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts = make(map[string]int)
+}
+
+// newStateTestDispatcher returns a dispatcher on a store holding a group of three switches 0x01 to 0x03, all off
+func newStateTestDispatcher(t *testing.T) (*outboxDispatcher, *persistence.EmbeddedStore, *retainingClient) {
+	t.Helper()
+	store := persistence.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	definition := models.DefinitionRaw{Name: "Switch", States: []models.StateRaw{{Hex: 0x00, Label: "off"}, {Hex: 0x01, Label: "on"}}}
+	if err := store.InsertDefinition(&definition); err != nil {
+		t.Fatal(err)
+	}
+	group := models.GroupRaw{Name: "switches", AllowedDefinitions: []primitive.ObjectID{definition.ID}}
+	if err := store.InsertGroup(&group); err != nil {
+		t.Fatal(err)
+	}
+	var entities []models.ReactiveEntityRaw
+	for hex := uint16(1); hex <= 3; hex++ {
+		entities = append(entities, models.ReactiveEntityRaw{EntityHex: hex, Definition: definition.ID, Groups: []primitive.ObjectID{group.ID}})
+	}
+	if err := store.InsertReactiveEntities(entities); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &retainingClient{}
+	d := &outboxDispatcher{store: store, client: client, wake: make(chan struct{}, 1), staleGroups: make(map[string]bool)}
+	if err := d.republishStates(); err != nil {
+		t.Fatal(err)
+	}
+	client.reset()
+	return d, store, client
+}
+
+// stateEvent builds the outbox event of a write from the entity the store returns
+func stateEvent(store persistence.Store, build func(before *models.ReactiveEntityJs) models.EntityEvent) persistence.EventFunc {
+	definitions, _ := store.GetAllDefinitions()
+	groups, _ := store.GetAllGroups()
+	return func(entity *models.ReactiveEntityRaw) *models.EntityEvent {
+		e := build(entity.ToJs(definitions, groups))
+		return &e
+	}
+}
+
+func TestGroupStateIsPublishedOncePerBatch(t *testing.T) {
+	d, store, client := newStateTestDispatcher(t)
+
+	changes := []persistence.StateChange{{EntityHex: 0x01, State: 0x01}, {EntityHex: 0x02, State: 0x01}, {EntityHex: 0x03, State: 0x01}}
+	event := stateEvent(store, func(before *models.ReactiveEntityJs) models.EntityEvent {
+		return NewStateChangedEvent(before, before, nil, models.SourceREST)
+	})
+	if _, err := store.UpdateReactiveEntityStates(changes, time.Now().UTC(), event); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.drain(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := client.counts[GroupStateTopic("switches")]; n != 1 {
+		t.Fatalf("group state published %d times, want once", n)
+	}
+	var msg models.GroupStateMessage
+	if err := json.Unmarshal(client.retained[GroupStateTopic("switches")], &msg); err != nil {
+		t.Fatal(err)
+	}
+	for hex, state := range msg.States {
+		if state.Label != "on" {
+			t.Fatalf("entity %s in %+v, want on", hex, state)
+		}
+	}
+}
+
+func TestMovedEntityClearsItsOldState(t *testing.T) {
+	d, store, client := newStateTestDispatcher(t)
+
+	entity, err := store.GetReactiveEntityByHex(0x01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := *entity
+	moved.EntityHex = 0x04
+	var before *models.ReactiveEntityJs
+	definitions, _ := store.GetAllDefinitions()
+	groups, _ := store.GetAllGroups()
+	_, err = store.UpdateReactiveEntityMetadata(0x01, 0, &moved, func(updated *models.ReactiveEntityRaw) *models.EntityEvent {
+		before = entity.ToJs(definitions, groups)
+		e := NewUpdatedEvent(before, updated.ToJs(definitions, groups), nil, models.SourceREST)
+		return &e
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.drain(); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload, ok := client.retained[StateTopic("0x01")]; !ok || len(payload) != 0 {
+		t.Fatalf("state/0x01 holds %q, want it cleared", payload)
+	}
+	if len(client.retained[StateTopic("0x04")]) == 0 {
+		t.Fatal("state/0x04 was not published")
+	}
+	var msg models.GroupStateMessage
+	if err := json.Unmarshal(client.retained[GroupStateTopic("switches")], &msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.States["0x01"]; ok || len(msg.States) != 3 {
+		t.Fatalf("group state %+v, want 0x02 to 0x04", msg.States)
+	}
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// ReloadConfigHandler re-runs parse -> validate -> reconcile of definitions.json, groups.json and rules.json.
+// On failure the current configuration stays in place.
+func (a *App) ReloadConfigHandler(g *gin.Context) {
+	report, err := a.Config.ReloadConfigs()
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to reload configuration", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Configuration reloaded successfully",
+		"report":  report,
+	})
+}
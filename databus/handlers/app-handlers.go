@@ -5,22 +5,10 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func GetDataObjectHandler(c *gin.Context) {
+func (a *App) GetDataObjectHandler(c *gin.Context) {
 
 }
 
-func GetDataObjectsByGroupHandler(c *gin.Context) {
-
-}
-
-func UpdateDataObjectHandler(c *gin.Context) {
-
-}
-
-func UpdateDataObjectByEntityIdHandler(c *gin.Context) {
-
-}
-
-func UpdateDataObjectsByGroupHandler(c *gin.Context) {
+func (a *App) GetDataObjectsByGroupHandler(c *gin.Context) {
 
 }
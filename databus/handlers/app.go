@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"databus/cmd/config"
+	"databus/network"
+	"databus/persistence"
+	"databus/rules"
+	"databus/scheduler"
+	"databus/services"
+	"databus/webhooks"
+)
+
+/* The dependencies of the HTTP handlers, wired in main. Every handler is a method of App. */
+type App struct {
+	Store     persistence.Store
+	Publisher network.Publisher
+
+	Services  *services.Service
+	Config    *config.Manager
+	Rules     *rules.Engine
+	Scheduler *scheduler.Scheduler
+	Webhooks  *webhooks.Dispatcher
+}
+
+// NewApp returns the handlers using the given store and publisher. The rules engine, the scheduler and the
+// webhook dispatcher are built on the same store but not started, main starts them once the configuration is loaded.
+// The configuration announcements and rule actions are published through network.Queued.
+func NewApp(store persistence.Store, publisher network.Publisher) *App {
+	svc := services.NewService(store)
+	dispatcher := webhooks.NewDispatcher(store)
+	return &App{
+		Store:     store,
+		Publisher: publisher,
+		Services:  svc,
+		Config:    config.NewManager(store, network.Queued(publisher)),
+		Rules:     rules.NewEngine(store, svc, network.Queued(publisher), dispatcher),
+		Scheduler: scheduler.New(store, svc),
+		Webhooks:  dispatcher,
+	}
+}
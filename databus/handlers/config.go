@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"databus/cmd/config"
+	"databus/models"
+	"databus/persistence"
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateDefinitionHandler adds a definition, validated with the same rules as definitions.json.
+// ?writeBack=true|false overrides whether the documents on disk are updated too (CONFIG_WRITE_BACK).
+func (a *App) CreateDefinitionHandler(g *gin.Context) {
+	var definitionJs models.DefinitionJs
+	if err := g.ShouldBindJSON(&definitionJs); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	report, err := a.Config.CreateDefinition(definitionJs, writeBackParam(g))
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to create definition", "details": err.Error()})
+		return
+	}
+
+	g.JSON(201, gin.H{
+		"message":    "Definition created successfully",
+		"definition": definitionJs,
+		"report":     report,
+	})
+}
+
+// UpdateDefinitionHandler replaces the description and states of a definition
+func (a *App) UpdateDefinitionHandler(g *gin.Context) {
+	name := g.Param("definitionName")
+
+	var definitionJs models.DefinitionJs
+	if err := g.ShouldBindJSON(&definitionJs); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	report, err := a.Config.UpdateDefinition(name, definitionJs, writeBackParam(g))
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to update definition", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message":    "Definition updated successfully",
+		"definition": definitionJs,
+		"report":     report,
+	})
+}
+
+// DeleteDefinitionHandler removes a definition that no group allows and no reactive entity uses
+func (a *App) DeleteDefinitionHandler(g *gin.Context) {
+	name := g.Param("definitionName")
+
+	report, err := a.Config.DeleteDefinition(name, writeBackParam(g))
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to delete definition", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Definition deleted successfully",
+		"report":  report,
+	})
+}
+
+// CreateGroupHandler adds a group, validated with the same rules as groups.json
+func (a *App) CreateGroupHandler(g *gin.Context) {
+	var groupJs models.GroupJs
+	if err := g.ShouldBindJSON(&groupJs); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	report, err := a.Config.CreateGroup(groupJs, writeBackParam(g))
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to create group", "details": err.Error()})
+		return
+	}
+
+	g.JSON(201, gin.H{
+		"message": "Group created successfully",
+		"group":   groupJs,
+		"report":  report,
+	})
+}
+
+// UpdateGroupHandler replaces the description and allowed definitions of a group
+func (a *App) UpdateGroupHandler(g *gin.Context) {
+	name := g.Param("groupName")
+
+	var groupJs models.GroupJs
+	if err := g.ShouldBindJSON(&groupJs); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	report, err := a.Config.UpdateGroup(name, groupJs, writeBackParam(g))
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to update group", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Group updated successfully",
+		"group":   groupJs,
+		"report":  report,
+	})
+}
+
+// DeleteGroupHandler removes a group that no reactive entity belongs to
+func (a *App) DeleteGroupHandler(g *gin.Context) {
+	name := g.Param("groupName")
+
+	report, err := a.Config.DeleteGroup(name, writeBackParam(g))
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to delete group", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Group deleted successfully",
+		"report":  report,
+	})
+}
+
+func writeBackParam(g *gin.Context) bool {
+	if val, err := strconv.ParseBool(g.Query("writeBack")); err == nil {
+		return val
+	}
+	return config.WriteBack()
+}
+
+// configErrorStatus maps errors of the config package to HTTP status codes
+func configErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, config.ErrConfigNotFound):
+		return 404
+	case errors.Is(err, config.ErrInvalidConfig):
+		return 400
+	case errors.Is(err, config.ErrConfigExists), errors.Is(err, config.ErrConfigInUse), errors.Is(err, persistence.ErrStillReferenced),
+		errors.Is(err, persistence.ErrRuleNameTaken), errors.Is(err, config.ErrConfigReadOnly):
+		return 409
+	default:
+		return 500
+	}
+}
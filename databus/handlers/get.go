@@ -1,17 +1,20 @@
 package handlers
 
 import (
+	"databus/cmd/config"
 	"databus/models"
 	"databus/persistence"
-	"strconv"
+	"databus/utils"
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func GetAllDefinitionsHandler(g *gin.Context) {
+func (a *App) GetAllDefinitionsHandler(g *gin.Context) {
 
-	dfs, err := persistence.GetAllDefinitions()
+	dfs, err := a.Store.GetAllDefinitions()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -26,15 +29,15 @@ func GetAllDefinitionsHandler(g *gin.Context) {
 	g.JSON(200, dfs_dto)
 }
 
-func GetAllGroupsHandler(g *gin.Context) {
+func (a *App) GetAllGroupsHandler(g *gin.Context) {
 
-	groups, err := persistence.GetAllGroups()
+	groups, err := a.Store.GetAllGroups()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	dfRaw, err := persistence.GetAllDefinitions()
+	dfRaw, err := a.Store.GetAllDefinitions()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -48,21 +51,21 @@ func GetAllGroupsHandler(g *gin.Context) {
 	g.JSON(200, gps_dto)
 }
 
-func GetAllReactiveEntitiesHandler(g *gin.Context) {
+func (a *App) GetAllReactiveEntitiesHandler(g *gin.Context) {
 
-	reactiveEntities, err := persistence.GetAllReactiveEntities()
+	reactiveEntities, err := a.Store.GetAllReactiveEntities()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	definitions, err := persistence.GetAllDefinitions()
+	definitions, err := a.Store.GetAllDefinitions()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	groups, err := persistence.GetAllGroups()
+	groups, err := a.Store.GetAllGroups()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -76,11 +79,11 @@ func GetAllReactiveEntitiesHandler(g *gin.Context) {
 	g.JSON(200, entities_dto)
 }
 
-func GetDefinitionByNameHandler(g *gin.Context) {
+func (a *App) GetDefinitionByNameHandler(g *gin.Context) {
 
 	name := g.Param("definitionName")
 
-	def, err := persistence.GetDefinitionByName(name)
+	def, err := a.Store.GetDefinitionByName(name)
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -89,17 +92,43 @@ func GetDefinitionByNameHandler(g *gin.Context) {
 	g.JSON(200, def.ToJs())
 }
 
-func GetGroupByNameHandler(g *gin.Context) {
+// GetDefinitionTransitionsHandler lists the allowed next states of every state of a definition.
+// Definitions without declared transitions allow every state from every state.
+func (a *App) GetDefinitionTransitionsHandler(g *gin.Context) {
+	name := g.Param("definitionName")
+
+	def, err := a.Store.GetDefinitionByName(name)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			g.JSON(404, gin.H{"error": "Definition not found"})
+			return
+		}
+		g.JSON(500, gin.H{"error": "Failed to fetch definition", "details": err.Error()})
+		return
+	}
+
+	response := gin.H{
+		"definition":  def.Name,
+		"restricted":  def.HasTransitions(),
+		"transitions": def.StateTransitions(),
+	}
+	if def.HasTransitions() {
+		response["initial"] = def.States[0].ToJs()
+	}
+	g.JSON(200, response)
+}
+
+func (a *App) GetGroupByNameHandler(g *gin.Context) {
 
 	name := g.Param("groupName")
 
-	group, err := persistence.GetGroupByName(name)
+	group, err := a.Store.GetGroupByName(name)
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	dfRaw, err := persistence.GetAllDefinitions()
+	dfRaw, err := a.Store.GetAllDefinitions()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -108,31 +137,30 @@ func GetGroupByNameHandler(g *gin.Context) {
 	g.JSON(200, group.ToJs(dfRaw))
 }
 
-func GetReactiveEntityByHexHandler(g *gin.Context) {
+func (a *App) GetReactiveEntityByHexHandler(g *gin.Context) {
 
 	hex := g.Param("entityHex") // string
 
 	// string -> uint16
-	hexInt64, err := strconv.ParseUint(hex, 16, 16)
+	hexInt, err := utils.ParseEntityHex(hex)
 	if err != nil {
 		g.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	hexInt := uint16(hexInt64)
 
-	reactiveEntity, err := persistence.GetReactiveEntityByHex(hexInt)
+	reactiveEntity, err := a.Store.GetReactiveEntityByHex(hexInt)
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	definitions, err := persistence.GetAllDefinitions()
+	definitions, err := a.Store.GetAllDefinitions()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	groups, err := persistence.GetAllGroups()
+	groups, err := a.Store.GetAllGroups()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -141,24 +169,24 @@ func GetReactiveEntityByHexHandler(g *gin.Context) {
 	g.JSON(200, reactiveEntity.ToJs(definitions, groups))
 }
 
-func GetReactiveEntitiesByGroupHandler(g *gin.Context) {
+func (a *App) GetReactiveEntitiesByGroupHandler(g *gin.Context) {
 
 	gl := g.Param("groupList")
 	groupNames := strings.Split(gl, ",")
 
-	reactiveEntities, err := persistence.GetReactiveEntitiesByGroup(groupNames)
+	reactiveEntities, err := a.Store.GetReactiveEntitiesByGroup(groupNames)
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	definitions, err := persistence.GetAllDefinitions()
+	definitions, err := a.Store.GetAllDefinitions()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	groups, err := persistence.GetAllGroups()
+	groups, err := a.Store.GetAllGroups()
 	if err != nil {
 		g.JSON(500, gin.H{"error": err.Error()})
 		return
@@ -171,3 +199,43 @@ func GetReactiveEntitiesByGroupHandler(g *gin.Context) {
 
 	g.JSON(200, reactiveEntitiesJs)
 }
+
+// GetGroupViolationsHandler lists the entities of a group whose definition is not in the group's AllowedDefinitions
+func (a *App) GetGroupViolationsHandler(g *gin.Context) {
+
+	name := g.Param("groupName")
+
+	violations, err := a.Services.GetGroupViolations(name)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"group":      name,
+		"violations": violations,
+	})
+}
+
+// GetReactiveEntityDeltasHandler lists entities whose reported state has differed from the desired state
+// for longer than the delta threshold, which can be overridden with ?olderThan= (e.g. 5m)
+func (a *App) GetReactiveEntityDeltasHandler(g *gin.Context) {
+
+	olderThan := config.DeltaThreshold()
+	if val := g.Query("olderThan"); val != "" {
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			g.JSON(400, gin.H{"error": "Invalid olderThan duration", "details": err.Error()})
+			return
+		}
+		olderThan = d
+	}
+
+	deltas, err := a.Services.GetDeltas(olderThan)
+	if err != nil {
+		g.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	g.JSON(200, deltas)
+}
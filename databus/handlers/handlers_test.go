@@ -0,0 +1,499 @@
+package handlers_test
+
+import (
+	"bytes"
+	"databus/cmd/api"
+	"databus/handlers"
+	"databus/models"
+	"databus/network"
+	"databus/persistence"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+/* A publisher recording the messages instead of sending them to a broker */
+type fakePublisher struct {
+	mu       sync.Mutex
+	messages map[string][]byte
+}
+
+func (p *fakePublisher) Publish(topic string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.messages == nil {
+		p.messages = make(map[string][]byte)
+	}
+	p.messages[topic] = payload
+	return nil
+}
+
+func (p *fakePublisher) State() network.ConnectionState {
+	return network.ConnectionState{Connected: true, Broker: "fake"}
+}
+
+/* The API of an app on an in-memory store */
+type testAPI struct {
+	t      *testing.T
+	app    *handlers.App
+	router *gin.Engine
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	store := persistence.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+	app := handlers.NewApp(store, &fakePublisher{})
+	return &testAPI{t: t, app: app, router: api.NewRouter(app)}
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response into out, when given
+func (a *testAPI) do(method string, path string, body interface{}, out interface{}) int {
+	a.t.Helper()
+
+	var reader *bytes.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			a.t.Fatal(err)
+		}
+		reader = bytes.NewReader(payload)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	a.router.ServeHTTP(rec, req)
+
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			a.t.Fatalf("%s %s: decoding %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// expect fails the test when a request does not answer with the status
+func (a *testAPI) expect(status int, method string, path string, body interface{}, out interface{}) {
+	a.t.Helper()
+	if got := a.do(method, path, body, out); got != status {
+		a.t.Fatalf("%s %s: status %d, want %d", method, path, got, status)
+	}
+}
+
+// seed creates a switch definition and a group allowing it, without touching the documents on disk
+func (a *testAPI) seed() {
+	a.t.Helper()
+	a.expect(201, "POST", "/api/definitions?writeBack=false", models.DefinitionJs{
+		Name:   "Switch",
+		States: []models.StateJs{{Hex: "0x00", Label: "off"}, {Hex: "0x01", Label: "on"}, {Hex: "0x1a", Label: "blink"}},
+	}, nil)
+	a.expect(201, "POST", "/api/groups?writeBack=false", models.GroupJs{
+		Name:               "switches",
+		AllowedDefinitions: []string{"Switch"},
+	}, nil)
+}
+
+func (a *testAPI) createEntity(hex string) {
+	a.t.Helper()
+	a.expect(201, "POST", "/api/reactive-entities", models.ReactiveEntityJs{
+		EntityHex:  hex,
+		Definition: "Switch",
+		Groups:     []string{"switches"},
+	}, nil)
+}
+
+func TestHealthz(t *testing.T) {
+	a := newTestAPI(t)
+
+	var report models.HealthReport
+	a.expect(200, "GET", "/healthz", nil, &report)
+	if report.Status != models.HealthOK {
+		t.Fatalf("status %q, want %q", report.Status, models.HealthOK)
+	}
+}
+
+func TestReadyzWaitsForTheConfiguration(t *testing.T) {
+	a := newTestAPI(t)
+
+	var report models.HealthReport
+	a.expect(503, "GET", "/readyz", nil, &report)
+	if report.Checks["config"].Status != models.HealthFail {
+		t.Fatalf("config check %+v, want a failure before the first load", report.Checks["config"])
+	}
+	for _, name := range []string{"store", "mqtt", "outbox"} {
+		if report.Checks[name].Status != models.HealthOK {
+			t.Fatalf("%s check %+v, want ok", name, report.Checks[name])
+		}
+	}
+
+	if _, err := a.app.Config.LoadConfigs(false); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(200, "GET", "/readyz", nil, &report)
+}
+
+func TestCreateAndGetEntity(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.createEntity("0x1A")
+
+	var entity models.ReactiveEntityJs
+	a.expect(200, "GET", "/api/reactive-entities/byHex/0x1a", nil, &entity)
+	if entity.EntityHex != "0x1a" || entity.Definition != "Switch" || len(entity.Groups) != 1 {
+		t.Fatalf("entity %+v", entity)
+	}
+
+	a.expect(409, "POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: "0x1a", Definition: "Switch"}, nil)
+	a.expect(400, "POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: "0xzz", Definition: "Switch"}, nil)
+	a.expect(400, "POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: "0x1b", Definition: "Unknown"}, nil)
+	a.expect(400, "GET", "/api/reactive-entities/byHex/zz", nil, nil)
+}
+
+func TestSetEntityState(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.createEntity("0x01")
+
+	var body struct {
+		Entity models.ReactiveEntityJs `json:"entity"`
+	}
+	a.expect(200, "PATCH", "/api/reactive-entities/byHex/0x01/state", models.StateJs{Label: "on"}, &body)
+	if body.Entity.Data.CurrentState != 0x01 {
+		t.Fatalf("state %#02x, want 0x01", body.Entity.Data.CurrentState)
+	}
+
+	// State hexes are base 16
+	a.expect(200, "PATCH", "/api/reactive-entities/byHex/0x01/state", models.StateJs{Hex: "0x1a"}, &body)
+	if body.Entity.Data.CurrentState != 0x1a {
+		t.Fatalf("state %#02x, want 0x1a", body.Entity.Data.CurrentState)
+	}
+
+	a.expect(400, "PATCH", "/api/reactive-entities/byHex/0x01/state", models.StateJs{Label: "missing"}, nil)
+	a.expect(404, "PATCH", "/api/reactive-entities/byHex/0x02/state", models.StateJs{Label: "on"}, nil)
+}
+
+func TestSetGroupState(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.createEntity("0x01")
+	a.createEntity("0x02")
+
+	var body struct {
+		Entities []models.ReactiveEntityJs `json:"entities"`
+	}
+	a.expect(200, "PATCH", "/api/reactive-entities/byGroups/switches/state", models.StateJs{Label: "on"}, &body)
+	if len(body.Entities) != 2 {
+		t.Fatalf("%d entities updated, want 2", len(body.Entities))
+	}
+	for _, entity := range body.Entities {
+		if entity.Data.CurrentState != 0x01 {
+			t.Fatalf("entity %s in state %#02x, want 0x01", entity.EntityHex, entity.Data.CurrentState)
+		}
+	}
+
+	a.expect(404, "PATCH", "/api/reactive-entities/byGroups/unknown/state", models.StateJs{Label: "on"}, nil)
+}
+
+func TestUpdateEntityMetadata(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.createEntity("0x10")
+
+	a.expect(200, "PUT", "/api/reactive-entities/0x10", models.ReactiveEntityJs{
+		EntityHex:   "0x10",
+		Description: "Hall switch",
+		Definition:  "Switch",
+		Groups:      []string{"switches"},
+	}, nil)
+
+	var entity models.ReactiveEntityJs
+	a.expect(200, "GET", "/api/reactive-entities/byHex/0x10", nil, &entity)
+	if entity.Description != "Hall switch" {
+		t.Fatalf("description %q, want %q", entity.Description, "Hall switch")
+	}
+}
+
+func TestDeleteReferencedDefinition(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.createEntity("0x01")
+
+	a.expect(409, "DELETE", "/api/definitions/Switch?writeBack=false", nil, nil)
+
+	a.expect(200, "DELETE", "/api/reactive-entities/0x01", nil, nil)
+	a.expect(409, "DELETE", "/api/definitions/Switch?writeBack=false", nil, nil) // still allowed by the group
+	a.expect(200, "DELETE", "/api/groups/switches?writeBack=false", nil, nil)
+	a.expect(200, "DELETE", "/api/definitions/Switch?writeBack=false", nil, nil)
+
+	var definitions []models.DefinitionJs
+	a.expect(200, "GET", "/api/definitions", nil, &definitions)
+	if len(definitions) != 0 {
+		t.Fatalf("%d definitions left, want none", len(definitions))
+	}
+}
+
+func TestDeleteGroupTargetedByASchedule(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+
+	schedule := models.Schedule{Name: "nightly", Cron: "0 22 * * *", Groups: []string{"switches"}, State: "off"}
+	a.expect(201, "POST", "/api/schedules", schedule, nil)
+	a.expect(409, "DELETE", "/api/groups/switches?writeBack=false", nil, nil)
+
+	a.expect(200, "DELETE", "/api/schedules/nightly", nil, nil)
+	a.expect(200, "DELETE", "/api/groups/switches?writeBack=false", nil, nil)
+}
+
+func TestCreateEntitySecret(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.createEntity("0x01")
+
+	var body struct {
+		EntityHex string `json:"EntityHex"`
+		Secret    string `json:"Secret"`
+	}
+	a.expect(201, "POST", "/api/reactive-entities/byHex/0x01/secret", nil, &body)
+	if body.EntityHex != "0x01" || len(body.Secret) != 64 {
+		t.Fatalf("response %+v", body)
+	}
+
+	// Only the hash is stored, and never returned
+	stored, err := a.app.Store.GetReactiveEntityByHex(0x01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SecretHash == "" || stored.SecretHash == body.Secret {
+		t.Fatalf("stored hash %q", stored.SecretHash)
+	}
+	var entity map[string]interface{}
+	a.expect(200, "GET", "/api/reactive-entities/byHex/0x01", nil, &entity)
+	if _, ok := entity["SecretHash"]; ok {
+		t.Fatal("the secret hash is returned by the API")
+	}
+
+	a.expect(404, "POST", "/api/reactive-entities/byHex/0x02/secret", nil, nil)
+}
+
+func TestCreateEntityStartsInTheInitialState(t *testing.T) {
+	a := newTestAPI(t)
+	a.expect(201, "POST", "/api/definitions?writeBack=false", models.DefinitionJs{
+		Name:        "Pump",
+		States:      []models.StateJs{{Hex: "0x07", Label: "idle"}, {Hex: "0x00", Label: "running"}},
+		Transitions: []models.TransitionDef{{From: "running", To: []string{"idle"}}, {From: "idle", To: []string{"running"}}},
+	}, nil)
+	a.expect(201, "POST", "/api/definitions?writeBack=false", models.DefinitionJs{
+		Name:   "Valve",
+		States: []models.StateJs{{Hex: "0x05", Label: "closed"}, {Hex: "0x06", Label: "open"}},
+	}, nil)
+
+	for _, tt := range []struct {
+		hex        string
+		definition string
+		state      int
+	}{{"0x01", "Pump", 0x07}, {"0x02", "Valve", 0x05}} {
+		var body struct {
+			Entity models.ReactiveEntityJs `json:"entity"`
+		}
+		a.expect(201, "POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: tt.hex, Definition: tt.definition}, &body)
+		if body.Entity.Data.CurrentState != tt.state || body.Entity.Data.LastUpdated.IsZero() {
+			t.Fatalf("%s entity created in %+v, want state %#02x", tt.definition, body.Entity.Data, tt.state)
+		}
+	}
+}
+
+func TestStateChangeIsRecordedInTheHistory(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.createEntity("0x01")
+	a.expect(200, "PATCH", "/api/reactive-entities/byHex/0x01/state", models.StateJs{Label: "on"}, nil)
+
+	// Recorded with the change, nothing subscribes to the bus in this test
+	var history []models.EntityEvent
+	a.expect(200, "GET", "/api/reactive-entities/byHex/0x01/history", nil, &history)
+	if len(history) != 2 {
+		t.Fatalf("%d events recorded, want the creation and the state change", len(history))
+	}
+}
+
+func TestUpdateDefinitionInUse(t *testing.T) {
+	a := newTestAPI(t)
+	a.expect(201, "POST", "/api/definitions?writeBack=false", models.DefinitionJs{
+		Name:       "Dimmer",
+		States:     []models.StateJs{{Hex: "0x00", Label: "off"}, {Hex: "0x01", Label: "on"}},
+		Attributes: []models.AttributeDef{{Name: "brightness", Type: models.AttributeInteger}},
+	}, nil)
+	a.expect(201, "POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: "0x01", Definition: "Dimmer"}, nil)
+	a.expect(200, "PATCH", "/api/reactive-entities/byHex/0x01/state", models.StateJs{Label: "on"}, nil)
+
+	// The entity is in "on"
+	a.expect(409, "PUT", "/api/definitions/Dimmer?writeBack=false", models.DefinitionJs{
+		States:     []models.StateJs{{Hex: "0x00", Label: "off"}},
+		Attributes: []models.AttributeDef{{Name: "brightness", Type: models.AttributeInteger}},
+	}, nil)
+	// "off" is unused, and the entity holds no brightness yet
+	a.expect(200, "PUT", "/api/definitions/Dimmer?writeBack=false", models.DefinitionJs{
+		States:     []models.StateJs{{Hex: "0x01", Label: "on"}},
+		Attributes: []models.AttributeDef{{Name: "brightness", Type: models.AttributeFloat}},
+	}, nil)
+
+	// Once it does, the type is kept
+	a.expect(200, "PATCH", "/api/reactive-entities/byHex/0x01/attributes", map[string]interface{}{"brightness": 40.5}, nil)
+	a.expect(409, "PUT", "/api/definitions/Dimmer?writeBack=false", models.DefinitionJs{
+		States:     []models.StateJs{{Hex: "0x01", Label: "on"}},
+		Attributes: []models.AttributeDef{{Name: "brightness", Type: models.AttributeString}},
+	}, nil)
+}
+
+func TestGroupNameCannotWidenItsTopics(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+
+	for _, name := range []string{"#", "kitchen/+", "a+b", "$SYS", "lights/all"} {
+		a.expect(400, "POST", "/api/groups?writeBack=false", models.GroupJs{Name: name, AllowedDefinitions: []string{"Switch"}}, nil)
+	}
+	a.expect(201, "POST", "/api/groups?writeBack=false", models.GroupJs{Name: "kitchen.lights", AllowedDefinitions: []string{"Switch"}}, nil)
+}
+
+func TestConcurrentCreatesCannotDuplicateAHex(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- a.do("POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: "0x01", Definition: "Switch"}, nil)
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	created := 0
+	for status := range statuses {
+		switch status {
+		case 201:
+			created++
+		case 409:
+		default:
+			t.Fatalf("status %d, want 201 or 409", status)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("%d entities created with the same hex, want 1", created)
+	}
+
+	// Moving another entity onto the hex is refused, by the store too when the check of the service is raced
+	a.createEntity("0x02")
+	a.expect(409, "PATCH", "/api/reactive-entities/0x02", map[string]interface{}{"EntityHex": "0x01"}, nil)
+	entity, err := a.app.Store.GetReactiveEntityByHex(0x02)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := *entity
+	moved.EntityHex = 0x01
+	if _, err := a.app.Store.UpdateReactiveEntityMetadata(0x02, entity.Data.CurrentState, &moved, nil); !errors.Is(err, persistence.ErrDuplicateEntityHex) {
+		t.Fatalf("error %v, want ErrDuplicateEntityHex", err)
+	}
+}
+
+func TestUpdateGroupCannotDisallowTheDefinitionOfAMember(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.expect(201, "POST", "/api/definitions?writeBack=false", models.DefinitionJs{
+		Name:   "Valve",
+		States: []models.StateJs{{Hex: "0x00", Label: "closed"}, {Hex: "0x01", Label: "open"}},
+	}, nil)
+	a.expect(200, "PUT", "/api/groups/switches?writeBack=false", models.GroupJs{AllowedDefinitions: []string{"Switch", "Valve"}}, nil)
+	a.createEntity("0x01")
+
+	a.expect(409, "PUT", "/api/groups/switches?writeBack=false", models.GroupJs{AllowedDefinitions: []string{"Valve"}}, nil)
+	a.expect(200, "PUT", "/api/groups/switches?writeBack=false", models.GroupJs{AllowedDefinitions: []string{"Switch"}}, nil)
+}
+
+func TestDefinitionStateLabelsAreRequiredAndUnique(t *testing.T) {
+	a := newTestAPI(t)
+
+	for _, states := range [][]models.StateJs{
+		{{Hex: "0x00", Label: "off"}, {Hex: "0x01"}},
+		{{Hex: "0x00", Label: "off"}, {Hex: "0x01", Label: "off"}},
+	} {
+		a.expect(400, "POST", "/api/definitions?writeBack=false", models.DefinitionJs{Name: "Switch", States: states}, nil)
+	}
+}
+
+func TestDefinitionChangeMustFitTheDataOfTheEntity(t *testing.T) {
+	a := newTestAPI(t)
+	a.seed()
+	a.expect(201, "POST", "/api/definitions?writeBack=false", models.DefinitionJs{
+		Name:       "Dimmer",
+		States:     []models.StateJs{{Hex: "0x00", Label: "off"}, {Hex: "0x01", Label: "on"}, {Hex: "0x02", Label: "dim"}},
+		Attributes: []models.AttributeDef{{Name: "brightness", Type: models.AttributeInteger}},
+	}, nil)
+	a.expect(201, "POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: "0x01", Definition: "Dimmer"}, nil)
+	a.expect(201, "POST", "/api/reactive-entities", models.ReactiveEntityJs{EntityHex: "0x02", Definition: "Dimmer"}, nil)
+
+	// A Switch has no brightness
+	a.expect(200, "PATCH", "/api/reactive-entities/byHex/0x01/attributes", map[string]interface{}{"brightness": 40}, nil)
+	a.expect(409, "PATCH", "/api/reactive-entities/0x01", map[string]interface{}{"Definition": "Switch"}, nil)
+
+	// Nor a dim state, even when it is only reported
+	if _, err := a.app.Store.UpdateReactiveEntityReportedState(0x02, 0x02, time.Now().UTC(), nil); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(409, "PATCH", "/api/reactive-entities/0x02", map[string]interface{}{"Definition": "Switch"}, nil)
+	if _, err := a.app.Store.UpdateReactiveEntityReportedState(0x02, 0x01, time.Now().UTC(), nil); err != nil {
+		t.Fatal(err)
+	}
+	a.expect(200, "PATCH", "/api/reactive-entities/0x02", map[string]interface{}{"Definition": "Switch"}, nil)
+}
+
+func TestWebSocketOnlyAcceptsAllowedOrigins(t *testing.T) {
+	a := newTestAPI(t)
+	server := httptest.NewServer(a.router)
+	defer server.Close()
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://dashboard.example.com/")
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+	for origin, allowed := range map[string]bool{
+		"":                              true,
+		server.URL:                      true,
+		"https://dashboard.example.com": true,
+		"https://evil.example.com":      false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if allowed {
+			if err != nil {
+				t.Fatalf("origin %q refused: %v", origin, err)
+			}
+			conn.Close()
+			continue
+		}
+		if err == nil {
+			conn.Close()
+			t.Fatalf("origin %q accepted", origin)
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("origin %q: %v, want 403", origin, err)
+		}
+	}
+}
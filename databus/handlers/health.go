@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"databus/cmd/config"
+	"databus/models"
+	"databus/network"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Probes for the compose healthcheck and Kubernetes:
+	/healthz  the process is up and serving HTTP (liveness)
+	/readyz   every dependency works (readiness): the store answers, MQTT is connected, the configuration
+	          is loaded and the outbox backlog is under READY_OUTBOX_BACKLOG
+Both answer 200 when healthy and 503 otherwise, with the detail of each check.
+*/
+
+var started = time.Now()
+
+// HealthzHandler reports that the process is up, without checking any dependency
+func (a *App) HealthzHandler(g *gin.Context) {
+	g.JSON(200, models.HealthReport{
+		Status:    models.HealthOK,
+		Uptime:    time.Since(started).Round(time.Second).String(),
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+// ReadyzHandler checks every dependency and reports each one with its latency
+func (a *App) ReadyzHandler(g *gin.Context) {
+	report := models.HealthReport{
+		Status: models.HealthOK,
+		Checks: map[string]models.DependencyCheck{
+			"store":  runCheck(a.checkStore),
+			"mqtt":   runCheck(a.checkMQTT),
+			"config": runCheck(a.checkConfig),
+			"outbox": runCheck(a.checkOutbox),
+		},
+		Timestamp: time.Now().UTC(),
+	}
+
+	status := 200
+	for _, check := range report.Checks {
+		if check.Status != models.HealthOK {
+			report.Status = models.HealthFail
+			status = 503
+		}
+	}
+	g.JSON(status, report)
+}
+
+// runCheck times a check, which returns its details and the reason it failed
+func runCheck(check func() (interface{}, error)) models.DependencyCheck {
+	start := time.Now()
+	details, err := check()
+
+	result := models.DependencyCheck{
+		Status:    models.HealthOK,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+		Details:   details,
+	}
+	if err != nil {
+		result.Status = models.HealthFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkStore pings the store. A store without transactions is reported without failing the check,
+// the server only runs on one when MONGODB_ALLOW_STANDALONE is set.
+func (a *App) checkStore() (interface{}, error) {
+	if err := a.Store.Ping(); err != nil {
+		return nil, err
+	}
+	if !a.Store.AtomicOutbox() {
+		return gin.H{"AtomicOutbox": false, "Warning": "no transactions, events of changes made right before a crash can be lost"}, nil
+	}
+	return nil, nil
+}
+
+func (a *App) checkMQTT() (interface{}, error) {
+	reporter, ok := a.Publisher.(network.StateReporter)
+	if !ok {
+		return nil, fmt.Errorf("mqtt client is not initialized")
+	}
+	state := reporter.State()
+	if !state.Connected {
+		return state, fmt.Errorf("not connected to the broker")
+	}
+	return state, nil
+}
+
+func (a *App) checkConfig() (interface{}, error) {
+	loadedAt, err := a.Config.LastLoad()
+	if loadedAt.IsZero() {
+		if err == nil {
+			err = fmt.Errorf("not loaded yet")
+		}
+		return nil, err
+	}
+
+	// A failed reload keeps the loaded configuration, it is reported without failing the check
+	details := gin.H{"LoadedAt": loadedAt}
+	if err != nil {
+		details["LastReloadError"] = err.Error()
+	}
+	return details, nil
+}
+
+func (a *App) checkOutbox() (interface{}, error) {
+	pending, err := a.Store.CountPendingOutboxEntries()
+	if err != nil {
+		return nil, err
+	}
+	threshold := config.ReadyOutboxBacklog()
+	details := gin.H{"Pending": pending, "Threshold": threshold}
+	if pending >= int64(threshold) {
+		return details, fmt.Errorf("%d events waiting to be published", pending)
+	}
+	return details, nil
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"databus/utils"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// GetReactiveEntityHistoryHandler lists the recorded events of an entity, newest first.
+// Supports ?from= and ?to= (RFC 3339) and ?limit= (default 100, max 1000).
+func (a *App) GetReactiveEntityHistoryHandler(g *gin.Context) {
+	entityHex, err := utils.NormalizeEntityHex(g.Param("entityHex"))
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid hex format", "details": err.Error()})
+		return
+	}
+
+	from, to, limit, err := parseHistoryQuery(g)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid history query", "details": err.Error()})
+		return
+	}
+
+	history, err := a.Store.GetEntityEventsByHex(entityHex, from, to, limit)
+	if err != nil {
+		g.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	g.JSON(200, history)
+}
+
+// GetGroupHistoryHandler lists the recorded events of every entity in a group, newest first.
+// Supports the same query parameters as GetReactiveEntityHistoryHandler.
+func (a *App) GetGroupHistoryHandler(g *gin.Context) {
+	name := g.Param("groupName")
+
+	from, to, limit, err := parseHistoryQuery(g)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid history query", "details": err.Error()})
+		return
+	}
+
+	history, err := a.Store.GetEntityEventsByGroup(name, from, to, limit)
+	if err != nil {
+		g.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	g.JSON(200, history)
+}
+
+func parseHistoryQuery(g *gin.Context) (time.Time, time.Time, int64, error) {
+	var from, to time.Time
+	var err error
+
+	if val := g.Query("from"); val != "" {
+		if from, err = time.Parse(time.RFC3339, val); err != nil {
+			return from, to, 0, fmt.Errorf("from: %v", err)
+		}
+	}
+	if val := g.Query("to"); val != "" {
+		if to, err = time.Parse(time.RFC3339, val); err != nil {
+			return from, to, 0, fmt.Errorf("to: %v", err)
+		}
+	}
+
+	limit := int64(defaultHistoryLimit)
+	if val := g.Query("limit"); val != "" {
+		limit, err = strconv.ParseInt(val, 10, 64)
+		if err != nil || limit <= 0 {
+			return from, to, 0, fmt.Errorf("limit must be a positive integer")
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+	}
+
+	return from, to, limit, nil
+}
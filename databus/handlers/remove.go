@@ -1,26 +1,63 @@
 package handlers
 
 import (
+	"databus/events"
+	"databus/models"
 	"databus/persistence"
-	"strconv"
+	"databus/utils"
+	"errors"
 
 	"github.com/gin-gonic/gin"
 )
 
 // DeleteReactiveEntityHandler deletes a reactive entity by its hex ID
-func DeleteReactiveEntityHandler(g *gin.Context) {
+func (a *App) DeleteReactiveEntityHandler(g *gin.Context) {
 	hex := g.Param("entityHex") // string
 
 	// string -> uint16
-	hexInt64, err := strconv.ParseUint(hex, 16, 16)
+	hexInt, err := utils.ParseEntityHex(hex)
 	if err != nil {
 		g.JSON(400, gin.H{"error": "Invalid hex format", "details": err.Error()})
 		return
 	}
-	hexInt := uint16(hexInt64)
 
-	// Delete the reactive entity
-	deletedCount, err := persistence.DeleteReactiveEntityByHex(hexInt)
+	// Fetch the entity first to find its definition for the event announcing the removal
+	reactiveEntity, err := a.Store.GetReactiveEntityByHex(hexInt)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			g.JSON(404, gin.H{"error": "Reactive entity not found"})
+			return
+		}
+		g.JSON(500, gin.H{"error": "Failed to fetch reactive entity", "details": err.Error()})
+		return
+	}
+
+	definitions, err := a.Store.GetAllDefinitions()
+	if err != nil {
+		g.JSON(500, gin.H{"error": "Failed to fetch definitions", "details": err.Error()})
+		return
+	}
+
+	groups, err := a.Store.GetAllGroups()
+	if err != nil {
+		g.JSON(500, gin.H{"error": "Failed to fetch groups", "details": err.Error()})
+		return
+	}
+
+	var definition *models.DefinitionRaw
+	for i := range definitions {
+		if definitions[i].ID == reactiveEntity.Definition {
+			definition = &definitions[i]
+			break
+		}
+	}
+
+	// Delete the reactive entity, together with the outbox event announcing its removal
+	var event models.EntityEvent
+	deletedCount, err := a.Store.DeleteReactiveEntityByHex(hexInt, func(deleted *models.ReactiveEntityRaw) *models.EntityEvent {
+		event = events.NewDeletedEvent(deleted.ToJs(definitions, groups), definition, models.SourceREST)
+		return &event
+	})
 	if err != nil {
 		g.JSON(500, gin.H{"error": "Failed to delete reactive entity", "details": err.Error()})
 		return
@@ -31,5 +68,8 @@ func DeleteReactiveEntityHandler(g *gin.Context) {
 		return
 	}
 
+	// Announce the removal on the event bus
+	events.Publish(event)
+
 	g.JSON(200, gin.H{"message": "Reactive entity deleted successfully", "entityHex": hex})
 }
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/rules"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAllRulesHandler lists every rule, from rules.json and the API
+func (a *App) GetAllRulesHandler(g *gin.Context) {
+	rls, err := a.Store.GetAllRules()
+	if err != nil {
+		g.JSON(500, gin.H{"error": "Failed to fetch rules", "details": err.Error()})
+		return
+	}
+	if rls == nil {
+		rls = []models.Rule{}
+	}
+
+	g.JSON(200, rls)
+}
+
+// GetRuleByNameHandler returns a single rule
+func (a *App) GetRuleByNameHandler(g *gin.Context) {
+	name := g.Param("ruleName")
+
+	rule, err := a.Store.GetRuleByName(name)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			g.JSON(404, gin.H{"error": "Rule not found"})
+			return
+		}
+		g.JSON(500, gin.H{"error": "Failed to fetch rule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, rule)
+}
+
+// CreateRuleHandler adds a rule, validated with the same rules as rules.json
+func (a *App) CreateRuleHandler(g *gin.Context) {
+	var rule models.Rule
+	if err := g.ShouldBindJSON(&rule); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	created, err := a.Config.CreateRule(rule)
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to create rule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(201, gin.H{
+		"message": "Rule created successfully",
+		"rule":    created,
+	})
+}
+
+// UpdateRuleHandler replaces a rule created through the API
+func (a *App) UpdateRuleHandler(g *gin.Context) {
+	name := g.Param("ruleName")
+
+	var rule models.Rule
+	if err := g.ShouldBindJSON(&rule); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	updated, err := a.Config.UpdateRule(name, rule)
+	if err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to update rule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Rule updated successfully",
+		"rule":    updated,
+	})
+}
+
+// DeleteRuleHandler removes a rule created through the API
+func (a *App) DeleteRuleHandler(g *gin.Context) {
+	name := g.Param("ruleName")
+
+	if err := a.Config.DeleteRule(name); err != nil {
+		g.JSON(configErrorStatus(err), gin.H{"error": "Failed to delete rule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{"message": "Rule deleted successfully"})
+}
+
+// DryRunRulesHandler evaluates the rules against a hypothetical state change, e.g. {"EntityHex": "0x1a", "State": "open"},
+// without executing any action. Candidate "Rules" can be given to test them before they are stored.
+func (a *App) DryRunRulesHandler(g *gin.Context) {
+	var req models.RuleDryRunRequest
+	if err := g.ShouldBindJSON(&req); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	if len(req.Rules) > 0 {
+		valid, err := a.Config.ValidateCurrentRules(req.Rules)
+		if err != nil {
+			g.JSON(configErrorStatus(err), gin.H{"error": "Invalid rules", "details": err.Error()})
+			return
+		}
+		req.Rules = valid
+	}
+
+	result, err := a.Rules.DryRun(req)
+	if err != nil {
+		status := serviceErrorStatus(err)
+		if errors.Is(err, rules.ErrInvalidDryRun) {
+			status = 400
+		}
+		g.JSON(status, gin.H{"error": "Failed to evaluate rules", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, result)
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/scheduler"
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAllSchedulesHandler lists every schedule with its next and last run
+func (a *App) GetAllSchedulesHandler(g *gin.Context) {
+	schedules, err := a.Store.GetAllSchedules()
+	if err != nil {
+		g.JSON(500, gin.H{"error": "Failed to fetch schedules", "details": err.Error()})
+		return
+	}
+	if schedules == nil {
+		schedules = []models.Schedule{}
+	}
+
+	g.JSON(200, schedules)
+}
+
+// GetScheduleByNameHandler returns a single schedule
+func (a *App) GetScheduleByNameHandler(g *gin.Context) {
+	name := g.Param("scheduleName")
+
+	schedule, err := a.Store.GetScheduleByName(name)
+	if err != nil {
+		g.JSON(scheduleErrorStatus(err), gin.H{"error": "Failed to fetch schedule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, schedule)
+}
+
+// CreateScheduleHandler adds a schedule, e.g. {"Name": "lights-on", "Cron": "0 6 * * *", "Timezone": "Europe/Berlin",
+// "Groups": ["greenhouse-lights"], "State": "on"}
+func (a *App) CreateScheduleHandler(g *gin.Context) {
+	var schedule models.Schedule
+	if err := g.ShouldBindJSON(&schedule); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	created, err := a.Scheduler.CreateSchedule(schedule)
+	if err != nil {
+		g.JSON(scheduleErrorStatus(err), gin.H{"error": "Failed to create schedule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(201, gin.H{
+		"message":  "Schedule created successfully",
+		"schedule": created,
+	})
+}
+
+// UpdateScheduleHandler replaces a schedule, its next run is computed again
+func (a *App) UpdateScheduleHandler(g *gin.Context) {
+	name := g.Param("scheduleName")
+
+	var schedule models.Schedule
+	if err := g.ShouldBindJSON(&schedule); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	updated, err := a.Scheduler.UpdateSchedule(name, schedule)
+	if err != nil {
+		g.JSON(scheduleErrorStatus(err), gin.H{"error": "Failed to update schedule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message":  "Schedule updated successfully",
+		"schedule": updated,
+	})
+}
+
+// DeleteScheduleHandler removes a schedule
+func (a *App) DeleteScheduleHandler(g *gin.Context) {
+	name := g.Param("scheduleName")
+
+	if err := a.Scheduler.DeleteSchedule(name); err != nil {
+		g.JSON(scheduleErrorStatus(err), gin.H{"error": "Failed to delete schedule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{"message": "Schedule deleted successfully"})
+}
+
+// GetScheduleNextRunsHandler previews the upcoming runs of a stored schedule (?count=, default 5, max 100)
+func (a *App) GetScheduleNextRunsHandler(g *gin.Context) {
+	a.previewRuns(g, g.Param("scheduleName"), models.Schedule{})
+}
+
+// PreviewScheduleHandler previews the upcoming runs of an unsaved schedule, only its Cron, At and Timezone are used
+func (a *App) PreviewScheduleHandler(g *gin.Context) {
+	var schedule models.Schedule
+	if err := g.ShouldBindJSON(&schedule); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+	a.previewRuns(g, "", schedule)
+}
+
+func (a *App) previewRuns(g *gin.Context, name string, schedule models.Schedule) {
+	count := 5
+	if val := g.Query("count"); val != "" {
+		parsed, err := strconv.Atoi(val)
+		if err != nil || parsed < 1 {
+			g.JSON(400, gin.H{"error": "Invalid count", "details": "count must be a positive integer"})
+			return
+		}
+		count = parsed
+	}
+
+	runs, err := a.Scheduler.PreviewRuns(name, schedule, count)
+	if err != nil {
+		g.JSON(scheduleErrorStatus(err), gin.H{"error": "Failed to preview schedule", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{"nextRuns": runs})
+}
+
+// scheduleErrorStatus maps errors of the scheduler to HTTP status codes
+func scheduleErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, scheduler.ErrScheduleNotFound), errors.Is(err, persistence.ErrNotFound):
+		return 404
+	case errors.Is(err, scheduler.ErrInvalidSchedule):
+		return 400
+	case errors.Is(err, scheduler.ErrScheduleExists):
+		return 409
+	default:
+		return 500
+	}
+}
@@ -1,16 +1,19 @@
 package handlers
 
 import (
+	"databus/events"
 	"databus/models"
 	"databus/persistence"
-	"fmt"
+	"databus/services"
+	"databus/utils"
+	"errors"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // CreateReactiveEntityHandler creates a new reactive entity
-func CreateReactiveEntityHandler(g *gin.Context) {
+func (a *App) CreateReactiveEntityHandler(g *gin.Context) {
 	var reactiveEntityJs models.ReactiveEntityJs
 
 	// Bind JSON to the model
@@ -29,63 +32,70 @@ func CreateReactiveEntityHandler(g *gin.Context) {
 		return
 	}
 
-	// Check if entity with this hex already exists
-	existingEntity, _ := persistence.GetReactiveEntityByHex(parseEntityHex(reactiveEntityJs.EntityHex))
+	entityHex, err := utils.ParseEntityHex(reactiveEntityJs.EntityHex)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid EntityHex", "details": err.Error()})
+		return
+	}
+
+	// Check if entity with this hex already exists (checked again by the store, when inserting)
+	existingEntity, err := a.Store.GetReactiveEntityByHex(entityHex)
+	if err != nil && !errors.Is(err, persistence.ErrNotFound) {
+		g.JSON(500, gin.H{"error": "Failed to check the EntityHex", "details": err.Error()})
+		return
+	}
 	if existingEntity != nil {
 		g.JSON(409, gin.H{"error": "Reactive entity with this EntityHex already exists"})
 		return
 	}
 
 	// Fetch definitions and groups for conversion
-	definitions, err := persistence.GetAllDefinitions()
+	definitions, err := a.Store.GetAllDefinitions()
 	if err != nil {
 		g.JSON(500, gin.H{"error": "Failed to fetch definitions", "details": err.Error()})
 		return
 	}
 
-	groups, err := persistence.GetAllGroups()
+	groups, err := a.Store.GetAllGroups()
 	if err != nil {
 		g.JSON(500, gin.H{"error": "Failed to fetch groups", "details": err.Error()})
 		return
 	}
 
-	// Validate that the definition exists
-	definitionExists := false
-	for _, def := range definitions {
-		if def.Name == reactiveEntityJs.Definition {
-			definitionExists = true
-			break
-		}
-	}
-	if !definitionExists {
-		g.JSON(400, gin.H{"error": fmt.Sprintf("Definition '%s' not found", reactiveEntityJs.Definition)})
+	// Validate that the definition and all groups exist
+	definition, err := services.ValidateEntityReferences(&reactiveEntityJs, definitions, groups)
+	if err != nil {
+		g.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Validate that all groups exist
-	groupMap := make(map[string]primitive.ObjectID)
-	for _, group := range groups {
-		groupMap[group.Name] = group.ID
-	}
-	for _, groupName := range reactiveEntityJs.Groups {
-		if _, exists := groupMap[groupName]; !exists {
-			g.JSON(400, gin.H{"error": fmt.Sprintf("Group '%s' not found", groupName)})
-			return
-		}
-	}
-
-	// Convert to Raw format
+	// Convert to Raw format, new entities start in the initial state of their definition
 	reactiveEntityRaw := reactiveEntityJs.ToRaw(definitions, groups)
+	if initial, ok := definition.InitialState(); ok {
+		reactiveEntityRaw.Data.CurrentState = int(initial.Hex)
+		reactiveEntityRaw.Data.LastUpdated = time.Now().UTC()
+	}
 
-	// Insert into database
-	_, err = persistence.InsertReactiveEntity(reactiveEntityRaw)
+	// Insert into database, together with the outbox event announcing it
+	var createdEntity *models.ReactiveEntityJs
+	var event models.EntityEvent
+	err = a.Store.InsertReactiveEntity(reactiveEntityRaw, func(inserted *models.ReactiveEntityRaw) *models.EntityEvent {
+		// Convert back to Js for response
+		createdEntity = inserted.ToJs(definitions, groups)
+		event = events.NewCreatedEvent(createdEntity, definition, models.SourceREST)
+		return &event
+	})
+	if errors.Is(err, persistence.ErrDuplicateEntityHex) {
+		g.JSON(409, gin.H{"error": "Reactive entity with this EntityHex already exists"})
+		return
+	}
 	if err != nil {
 		g.JSON(500, gin.H{"error": "Failed to create reactive entity", "details": err.Error()})
 		return
 	}
 
-	// Convert back to Js for response
-	createdEntity := reactiveEntityRaw.ToJs(definitions, groups)
+	// Announce the new entity on the event bus
+	events.Publish(event)
 
 	g.JSON(201, gin.H{
 		"message": "Reactive entity created successfully",
@@ -93,14 +103,27 @@ func CreateReactiveEntityHandler(g *gin.Context) {
 	})
 }
 
-// Helper function to parse entity hex
-func parseEntityHex(hexStr string) uint16 {
-	// Remove "0x" prefix if present
-	if len(hexStr) > 2 && hexStr[0:2] == "0x" {
-		hexStr = hexStr[2:]
+// CreateEntitySecretHandler generates the secret the device of a reactive entity authenticates with on the
+// embedded broker. The secret is only returned in this response, a new one replaces the previous secret.
+func (a *App) CreateEntitySecretHandler(g *gin.Context) {
+	hex := g.Param("entityHex") // string
+
+	// string -> uint16
+	hexInt, err := utils.ParseEntityHex(hex)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid hex format", "details": err.Error()})
+		return
 	}
-	
-	var result uint16
-	fmt.Sscanf(hexStr, "%x", &result)
-	return result
+
+	secret, err := a.Services.GenerateEntitySecret(hexInt)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), gin.H{"error": "Failed to generate secret", "details": err.Error()})
+		return
+	}
+
+	g.JSON(201, gin.H{
+		"message":   "Secret generated successfully, it cannot be retrieved again",
+		"EntityHex": utils.FormatHex(hexInt),
+		"Secret":    secret,
+	})
 }
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"databus/events"
+	"databus/models"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sseSendBufferSize = 64
+	sseKeepAlive      = 15 * time.Second
+)
+
+// EventStreamHandler streams entity events as Server-Sent Events, for clients behind proxies that break WebSockets.
+//
+// It accepts the same filters as the WebSocket endpoint (?entityHex=&group=&definition=) and resumes after the
+// Last-Event-ID header (or ?lastEventId=) from the in-memory buffer of recent events.
+// Clients that cannot keep up with their send buffer are disconnected.
+func (a *App) EventStreamHandler(g *gin.Context) {
+	filter, err := events.NewFilter(g.Query("entityHex"), g.Query("group"), g.Query("definition"))
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid filter", "details": err.Error()})
+		return
+	}
+
+	lastEventID := g.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = g.Query("lastEventId")
+	}
+
+	send := make(chan models.EntityEvent, sseSendBufferSize)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+
+	backlog, unsubscribe := events.SubscribeSince(lastEventID, func(e models.EntityEvent) {
+		if !filter.Matches(e) {
+			return
+		}
+		select {
+		case send <- e:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribe()
+
+	g.Header("Cache-Control", "no-cache")
+	g.Header("Connection", "keep-alive")
+	g.Header("X-Accel-Buffering", "no")
+
+	// Replay the missed events first
+	for _, e := range backlog {
+		if filter.Matches(e) {
+			renderEvent(g, e)
+		}
+	}
+	g.Writer.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	g.Stream(func(w io.Writer) bool {
+		select {
+		case <-g.Request.Context().Done():
+			return false
+		case <-overflow:
+			log.Printf("Disconnecting slow SSE client %s", g.ClientIP())
+			return false
+		case e := <-send:
+			renderEvent(g, e)
+			return true
+		case <-keepAlive.C:
+			// Comment lines keep proxies from closing idle streams
+			w.Write([]byte(": keep-alive\n\n"))
+			return true
+		}
+	})
+}
+
+func renderEvent(g *gin.Context, e models.EntityEvent) {
+	g.Render(-1, sse.Event{
+		Id:    e.ID,
+		Event: e.Type,
+		Data:  e,
+	})
+}
@@ -1 +1,199 @@
 package handlers
+
+import (
+	"databus/models"
+	"databus/services"
+	"databus/utils"
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpdateDataObjectByEntityIdHandler sets the state of a single reactive entity by its hex ID.
+// The body references the new state by hex and/or label, e.g. {"Hex": "0x01"} or {"Label": "on"}.
+func (a *App) UpdateDataObjectByEntityIdHandler(g *gin.Context) {
+	hex := g.Param("entityHex") // string
+
+	// string -> uint16
+	hexInt, err := utils.ParseEntityHex(hex)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid hex format", "details": err.Error()})
+		return
+	}
+
+	var stateJs models.StateJs
+	if err := g.ShouldBindJSON(&stateJs); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	entity, err := a.Services.SetEntityState(hexInt, stateJs, models.SourceREST)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), stateErrorBody(err))
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "State updated successfully",
+		"entity":  entity,
+	})
+}
+
+// UpdateDataObjectsByGroupHandler sets the state of every reactive entity belonging to all the listed groups
+func (a *App) UpdateDataObjectsByGroupHandler(g *gin.Context) {
+	gl := g.Param("groupList")
+	groupNames := strings.Split(gl, ",")
+
+	var stateJs models.StateJs
+	if err := g.ShouldBindJSON(&stateJs); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	entities, err := a.Services.SetGroupState(groupNames, stateJs, models.SourceREST)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), stateErrorBody(err))
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message":  "State updated successfully",
+		"entities": entities,
+	})
+}
+
+// UpdateAttributesByEntityIdHandler writes typed attribute values of a single reactive entity,
+// e.g. {"brightness": 80, "color": "warm"}. Attributes that are not given keep their value.
+func (a *App) UpdateAttributesByEntityIdHandler(g *gin.Context) {
+	hex := g.Param("entityHex") // string
+
+	// string -> uint16
+	hexInt, err := utils.ParseEntityHex(hex)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid hex format", "details": err.Error()})
+		return
+	}
+
+	var values map[string]interface{}
+	if err := g.ShouldBindJSON(&values); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	entity, err := a.Services.SetEntityAttributes(hexInt, values, models.SourceREST)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), gin.H{"error": "Failed to update attributes", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Attributes updated successfully",
+		"entity":  entity,
+	})
+}
+
+// UpdateAttributesByGroupHandler writes typed attribute values of every reactive entity belonging to all the listed groups
+func (a *App) UpdateAttributesByGroupHandler(g *gin.Context) {
+	gl := g.Param("groupList")
+	groupNames := strings.Split(gl, ",")
+
+	var values map[string]interface{}
+	if err := g.ShouldBindJSON(&values); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	entities, err := a.Services.SetGroupAttributes(groupNames, values, models.SourceREST)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), gin.H{"error": "Failed to update attributes", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message":  "Attributes updated successfully",
+		"entities": entities,
+	})
+}
+
+// UpdateReactiveEntityHandler replaces the metadata of a reactive entity (description, location, definition, groups)
+func (a *App) UpdateReactiveEntityHandler(g *gin.Context) {
+	hex := g.Param("entityHex") // string
+
+	// string -> uint16
+	hexInt, err := utils.ParseEntityHex(hex)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid hex format", "details": err.Error()})
+		return
+	}
+
+	var reactiveEntityJs models.ReactiveEntityJs
+	if err := g.ShouldBindJSON(&reactiveEntityJs); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	entity, err := a.Services.UpdateEntity(hexInt, reactiveEntityJs, models.SourceREST)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), gin.H{"error": "Failed to update reactive entity", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Reactive entity updated successfully",
+		"entity":  entity,
+	})
+}
+
+// PatchReactiveEntityHandler applies a JSON merge patch (RFC 7386) to the metadata of a reactive entity
+func (a *App) PatchReactiveEntityHandler(g *gin.Context) {
+	hex := g.Param("entityHex") // string
+
+	// string -> uint16
+	hexInt, err := utils.ParseEntityHex(hex)
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid hex format", "details": err.Error()})
+		return
+	}
+
+	patch, err := g.GetRawData()
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	entity, err := a.Services.PatchEntity(hexInt, patch, models.SourceREST)
+	if err != nil {
+		g.JSON(serviceErrorStatus(err), gin.H{"error": "Failed to update reactive entity", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Reactive entity updated successfully",
+		"entity":  entity,
+	})
+}
+
+// serviceErrorStatus maps errors of the services package to HTTP status codes
+func serviceErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrEntityNotFound), errors.Is(err, services.ErrGroupNotFound):
+		return 404
+	case errors.Is(err, services.ErrInvalidState), errors.Is(err, services.ErrInvalidEntity), errors.Is(err, services.ErrInvalidAttribute):
+		return 400
+	case errors.Is(err, services.ErrEntityExists), errors.Is(err, services.ErrStateConflict), errors.Is(err, services.ErrTransitionNotAllowed):
+		return 409
+	default:
+		return 500
+	}
+}
+
+// stateErrorBody describes a failed state update, including the allowed next states when a transition was refused
+func stateErrorBody(err error) gin.H {
+	body := gin.H{"error": "Failed to update state", "details": err.Error()}
+	var transitionErr *services.TransitionError
+	if errors.As(err, &transitionErr) {
+		body["allowedStates"] = transitionErr.Allowed
+	}
+	return body
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/webhooks"
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAllWebhooksHandler lists every webhook subscription, without secrets
+func (a *App) GetAllWebhooksHandler(g *gin.Context) {
+	subscriptions, err := a.Store.GetAllWebhooks()
+	if err != nil {
+		g.JSON(500, gin.H{"error": "Failed to fetch webhooks", "details": err.Error()})
+		return
+	}
+
+	redacted := make([]models.WebhookSubscription, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		redacted = append(redacted, sub.Redacted())
+	}
+	g.JSON(200, redacted)
+}
+
+// GetWebhookByNameHandler returns a single webhook subscription, without its secret
+func (a *App) GetWebhookByNameHandler(g *gin.Context) {
+	sub, err := a.Webhooks.GetWebhook(g.Param("webhookName"))
+	if err != nil {
+		g.JSON(webhookErrorStatus(err), gin.H{"error": "Failed to fetch webhook", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, sub.Redacted())
+}
+
+// CreateWebhookHandler adds a webhook subscription, e.g. {"Name": "erp", "URL": "https://erp.example.com/hooks/databus",
+// "EventTypes": ["state_changed"], "Groups": ["kitchen-lights"]}. The response is the only one containing the secret.
+func (a *App) CreateWebhookHandler(g *gin.Context) {
+	var sub models.WebhookSubscription
+	if err := g.ShouldBindJSON(&sub); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	created, err := a.Webhooks.CreateWebhook(sub)
+	if err != nil {
+		g.JSON(webhookErrorStatus(err), gin.H{"error": "Failed to create webhook", "details": err.Error()})
+		return
+	}
+
+	g.JSON(201, gin.H{
+		"message": "Webhook created successfully",
+		"webhook": created,
+	})
+}
+
+// UpdateWebhookHandler replaces a webhook subscription, the secret is kept unless a new one is given
+func (a *App) UpdateWebhookHandler(g *gin.Context) {
+	name := g.Param("webhookName")
+
+	var sub models.WebhookSubscription
+	if err := g.ShouldBindJSON(&sub); err != nil {
+		g.JSON(400, gin.H{"error": "Invalid request body", "details": err.Error()})
+		return
+	}
+
+	updated, err := a.Webhooks.UpdateWebhook(name, sub)
+	if err != nil {
+		g.JSON(webhookErrorStatus(err), gin.H{"error": "Failed to update webhook", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{
+		"message": "Webhook updated successfully",
+		"webhook": updated.Redacted(),
+	})
+}
+
+// DeleteWebhookHandler removes a webhook subscription
+func (a *App) DeleteWebhookHandler(g *gin.Context) {
+	if err := a.Webhooks.DeleteWebhook(g.Param("webhookName")); err != nil {
+		g.JSON(webhookErrorStatus(err), gin.H{"error": "Failed to delete webhook", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, gin.H{"message": "Webhook deleted successfully"})
+}
+
+// GetWebhookDeliveriesHandler returns the latest delivery attempts of a subscription (?limit=, default 50)
+func (a *App) GetWebhookDeliveriesHandler(g *gin.Context) {
+	sub, limit, ok := a.webhookLogRequest(g)
+	if !ok {
+		return
+	}
+
+	deliveries, err := a.Store.GetWebhookDeliveries(sub.Name, limit)
+	if err != nil {
+		g.JSON(500, gin.H{"error": "Failed to fetch deliveries", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, deliveries)
+}
+
+// GetWebhookDeadLettersHandler returns the latest events a subscription gave up on (?limit=, default 50)
+func (a *App) GetWebhookDeadLettersHandler(g *gin.Context) {
+	sub, limit, ok := a.webhookLogRequest(g)
+	if !ok {
+		return
+	}
+
+	deadLetters, err := a.Store.GetWebhookDeadLetters(sub.Name, limit)
+	if err != nil {
+		g.JSON(500, gin.H{"error": "Failed to fetch dead letters", "details": err.Error()})
+		return
+	}
+
+	g.JSON(200, deadLetters)
+}
+
+func (a *App) webhookLogRequest(g *gin.Context) (*models.WebhookSubscription, int64, bool) {
+	var limit int64 = 50
+	if val := g.Query("limit"); val != "" {
+		parsed, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || parsed < 1 {
+			g.JSON(400, gin.H{"error": "Invalid limit", "details": "limit must be a positive integer"})
+			return nil, 0, false
+		}
+		limit = parsed
+	}
+
+	sub, err := a.Webhooks.GetWebhook(g.Param("webhookName"))
+	if err != nil {
+		g.JSON(webhookErrorStatus(err), gin.H{"error": "Failed to fetch webhook", "details": err.Error()})
+		return nil, 0, false
+	}
+	return sub, limit, true
+}
+
+// webhookErrorStatus maps errors of the webhooks package to HTTP status codes
+func webhookErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, webhooks.ErrWebhookNotFound), errors.Is(err, persistence.ErrNotFound):
+		return 404
+	case errors.Is(err, webhooks.ErrInvalidWebhook):
+		return 400
+	case errors.Is(err, webhooks.ErrWebhookExists), errors.Is(err, webhooks.ErrWebhookInUse):
+		return 409
+	default:
+		return 500
+	}
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"databus/cmd/config"
+	"databus/events"
+	"databus/models"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsSendBufferSize = 64
+	wsWriteTimeout   = 10 * time.Second
+	wsPongTimeout    = 60 * time.Second
+	wsPingInterval   = (wsPongTimeout * 9) / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin lets pages of the API's own origin and of the WS_ALLOWED_ORIGINS open a socket, so any other web page
+// cannot read the feed with the credentials of its visitor. Clients sending no Origin are not browsers.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range config.WebSocketAllowedOrigins() {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsClient is a single WebSocket connection with its own subscription filter and bounded send buffer
+type wsClient struct {
+	conn *websocket.Conn
+	send chan models.StreamFrame
+
+	mu     sync.RWMutex
+	filter events.Filter
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// WebSocketHandler streams entity events to browser dashboards.
+//
+// The initial filter is taken from the query (?entityHex=&group=&definition=, comma separated) and can be
+// replaced at any time by sending a JSON filter frame: {"EntityHexes": [...], "Groups": [...], "Definitions": [...]}.
+// The first frame is a snapshot of all matching entities, followed by one frame per matching event.
+// Clients that cannot keep up with their send buffer are disconnected.
+func (a *App) WebSocketHandler(g *gin.Context) {
+	filter, err := events.NewFilter(g.Query("entityHex"), g.Query("group"), g.Query("definition"))
+	if err != nil {
+		g.JSON(400, gin.H{"error": "Invalid filter", "details": err.Error()})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(g.Writer, g.Request, nil)
+	if err != nil {
+		// The upgrader has already replied to the client
+		log.Printf("WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	client := &wsClient{
+		conn:   conn,
+		send:   make(chan models.StreamFrame, wsSendBufferSize),
+		filter: filter,
+		done:   make(chan struct{}),
+	}
+
+	// Subscribe before taking the snapshot so no event between the two is lost
+	unsubscribe := events.Subscribe(client.onEvent)
+	defer unsubscribe()
+
+	snapshot, err := a.snapshotFrame(filter)
+	if err != nil {
+		log.Printf("Error building WebSocket snapshot: %v", err)
+		conn.Close()
+		return
+	}
+	// The snapshot must precede any event, so it is written directly before the writer starts
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := conn.WriteJSON(snapshot); err != nil {
+		conn.Close()
+		return
+	}
+
+	go client.writePump()
+	client.readPump()
+}
+
+// onEvent queues matching events without ever blocking the event bus
+func (c *wsClient) onEvent(e models.EntityEvent) {
+	c.mu.RLock()
+	matches := c.filter.Matches(e)
+	c.mu.RUnlock()
+	if !matches {
+		return
+	}
+
+	select {
+	case <-c.done:
+	case c.send <- models.StreamFrame{Type: models.FrameEvent, Event: &e}:
+	default:
+		log.Printf("Disconnecting slow WebSocket client %s", c.conn.RemoteAddr())
+		c.close()
+	}
+}
+
+// readPump handles filter frames and pongs until the connection is closed
+func (c *wsClient) readPump() {
+	defer c.close()
+
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		var requested events.Filter
+		if err := c.conn.ReadJSON(&requested); err != nil {
+			return
+		}
+
+		filter, err := requested.Normalized()
+		if err != nil {
+			log.Printf("Ignoring invalid WebSocket filter from %s: %v", c.conn.RemoteAddr(), err)
+			continue
+		}
+
+		c.mu.Lock()
+		c.filter = filter
+		c.mu.Unlock()
+	}
+}
+
+// writePump sends queued frames and keepalive pings until the connection is closed
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	defer c.close()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(frame); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// snapshotFrame builds the frame listing every entity matching the filter
+func (a *App) snapshotFrame(filter events.Filter) (models.StreamFrame, error) {
+	reactiveEntities, err := a.Store.GetAllReactiveEntities()
+	if err != nil {
+		return models.StreamFrame{}, err
+	}
+	definitions, err := a.Store.GetAllDefinitions()
+	if err != nil {
+		return models.StreamFrame{}, err
+	}
+	groups, err := a.Store.GetAllGroups()
+	if err != nil {
+		return models.StreamFrame{}, err
+	}
+
+	entities := make([]models.ReactiveEntityJs, 0, len(reactiveEntities))
+	for i := range reactiveEntities {
+		entity := reactiveEntities[i].ToJs(definitions, groups)
+		if filter.MatchesEntity(entity) {
+			entities = append(entities, *entity)
+		}
+	}
+	return models.StreamFrame{Type: models.FrameSnapshot, Entities: entities}, nil
+}
@@ -0,0 +1,189 @@
+// acl.go
+package ingest
+
+import (
+	"crypto/subtle"
+	"databus/events"
+	"databus/models"
+	"databus/network"
+	"databus/persistence"
+	"databus/services"
+	"databus/utils"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The access rules of the embedded broker, derived from the reactive entities and their groups.
+
+A device authenticates either
+	with its entity hex ("0x1a") as username and the secret generated for the entity as password, or
+	with a client certificate whose common name is its entity hex, when the broker requires mutual TLS.
+It may then
+	publish state/{entityHex}/reported, cmd/{entityHex}/set and cmd/groups/{groupName}/set (and their /bin variant)
+	subscribe to events/{entityHex}, state/{entityHex}, cmd/{entityHex}/+, groups/{groupName}/events,
+	groups/{groupName}/state and cmd/groups/{groupName}/+
+for its own hex and the groups it belongs to. The admin credentials, when configured, may use every topic.
+Everyone else is refused, in particular clients presenting no credential at all.
+
+Credentials are checked against the store on every connection, so a new secret takes effect immediately. The
+topics are cached and reloaded after entity events, or at the latest after aclMaxAge.
+*/
+
+const aclMaxAge = time.Minute
+
+// adminIdentity is the identity of the admin, it cannot collide with an entity hex
+const adminIdentity = "$admin"
+
+/* The network.Authorizer of the embedded broker */
+type DeviceACL struct {
+	store         persistence.Store
+	adminUsername string
+	adminPassword string
+
+	stale  atomic.Bool
+	mu     sync.Mutex
+	loaded time.Time
+	topics map[string]deviceTopics // by entity hex
+}
+
+/* The topic filters a device may publish and subscribe to */
+type deviceTopics struct {
+	publish   []string
+	subscribe []string
+}
+
+// NewDeviceACL returns the access rules of the embedded broker for the entities of the store, an empty admin
+// username disables the admin
+func NewDeviceACL(store persistence.Store, adminUsername string, adminPassword string) *DeviceACL {
+	acl := &DeviceACL{store: store, adminUsername: adminUsername, adminPassword: adminPassword}
+	acl.stale.Store(true)
+	events.Subscribe(acl.invalidate)
+	return acl
+}
+
+// Authenticate accepts the admin and the devices of known entities presenting their secret or certificate, and
+// returns their identity: the normalized entity hex of a device
+func (a *DeviceACL) Authenticate(credentials network.Credentials) (string, bool) {
+	if a.isAdmin(credentials.Username, credentials.Password) {
+		return adminIdentity, true
+	}
+
+	// A verified certificate names the device, a username is then ignored
+	if credentials.CertCN != "" {
+		hex, err := utils.ParseEntityHex(credentials.CertCN)
+		if err != nil {
+			return "", false
+		}
+		if _, err := a.store.GetReactiveEntityByHex(hex); err != nil {
+			return "", false
+		}
+		return utils.FormatHex(hex), true
+	}
+
+	hex, err := utils.ParseEntityHex(credentials.Username)
+	if err != nil {
+		return "", false
+	}
+	entity, err := a.store.GetReactiveEntityByHex(hex)
+	if err != nil {
+		if !errors.Is(err, persistence.ErrNotFound) {
+			log.Printf("Error authenticating MQTT client %s: %v", credentials.ClientID, err)
+		}
+		return "", false
+	}
+	if !services.SecretMatches(entity.SecretHash, credentials.Password) {
+		return "", false
+	}
+	return utils.FormatHex(hex), true
+}
+
+// Allowed reports whether the client authenticated as identity may publish to (write) or subscribe to a topic
+func (a *DeviceACL) Allowed(identity string, topic string, write bool) bool {
+	if identity == adminIdentity {
+		return true
+	}
+
+	topics, ok := a.device(identity)
+	if !ok {
+		return false
+	}
+	filters := topics.subscribe
+	if write {
+		filters = topics.publish
+	}
+	for _, filter := range filters {
+		if network.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *DeviceACL) isAdmin(username string, password []byte) bool {
+	return a.adminUsername != "" && username == a.adminUsername &&
+		subtle.ConstantTimeCompare(password, []byte(a.adminPassword)) == 1
+}
+
+// device returns the topics of the device with the entity hex
+func (a *DeviceACL) device(hex string) (deviceTopics, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stale.Swap(false) || time.Since(a.loaded) > aclMaxAge {
+		if err := a.load(); err != nil {
+			// Keep the previous rules and retry on the next check
+			a.stale.Store(true)
+			log.Printf("Error loading the MQTT access rules: %v", err)
+		}
+	}
+	topics, ok := a.topics[hex]
+	return topics, ok
+}
+
+func (a *DeviceACL) load() error {
+	entities, err := a.store.GetAllReactiveEntities()
+	if err != nil {
+		return err
+	}
+	groups, err := a.store.GetAllGroups()
+	if err != nil {
+		return err
+	}
+	groupNames := make(map[primitive.ObjectID]string, len(groups))
+	for _, group := range groups {
+		groupNames[group.ID] = group.Name
+	}
+
+	a.topics = make(map[string]deviceTopics, len(entities))
+	for _, entity := range entities {
+		hex := utils.FormatHex(entity.EntityHex)
+		topics := deviceTopics{
+			publish:   []string{"state/" + hex + "/reported", "state/" + hex + "/reported/bin", "cmd/" + hex + "/set", "cmd/" + hex + "/set/bin"},
+			subscribe: []string{"events/" + hex, "state/" + hex, "cmd/" + hex + "/+"},
+		}
+		for _, id := range entity.Groups {
+			name, ok := groupNames[id]
+			if !ok {
+				continue
+			}
+			topics.publish = append(topics.publish, "cmd/groups/"+name+"/set", "cmd/groups/"+name+"/set/bin")
+			topics.subscribe = append(topics.subscribe, "groups/"+name+"/events", "groups/"+name+"/state", "cmd/groups/"+name+"/+")
+		}
+		a.topics[hex] = topics
+	}
+	a.loaded = time.Now()
+	return nil
+}
+
+// invalidate is the bus handler marking the rules for reload when entities are created, changed or deleted
+func (a *DeviceACL) invalidate(e models.EntityEvent) {
+	switch e.Type {
+	case models.EventCreated, models.EventUpdated, models.EventDeleted:
+		a.stale.Store(true)
+	}
+}
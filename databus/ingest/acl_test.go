@@ -0,0 +1,82 @@
+package ingest
+
+import (
+	"databus/models"
+	"databus/network"
+	"databus/persistence"
+	"databus/services"
+	"testing"
+)
+
+func newTestACL(t *testing.T) (*DeviceACL, *services.Service) {
+	t.Helper()
+	store := persistence.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{{EntityHex: 0x1a}, {EntityHex: 0x2b}}); err != nil {
+		t.Fatal(err)
+	}
+	return NewDeviceACL(store, "admin", "admin-password"), services.NewService(store)
+}
+
+func TestAuthenticateRequiresACredential(t *testing.T) {
+	acl, svc := newTestACL(t)
+	secret, err := svc.GenerateEntitySecret(0x1a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		credentials network.Credentials
+		identity    string
+	}{
+		{"secret", network.Credentials{Username: "0x1A", Password: []byte(secret)}, "0x1a"},
+		{"certificate", network.Credentials{CertCN: "0x2b"}, "0x2b"},
+		{"certificate wins over username", network.Credentials{Username: "0x1a", CertCN: "0x2b"}, "0x2b"},
+		{"admin", network.Credentials{Username: "admin", Password: []byte("admin-password")}, adminIdentity},
+		{"no credential", network.Credentials{Username: "0x1a"}, ""},
+		{"client ID only", network.Credentials{ClientID: "0x1a"}, ""},
+		{"wrong secret", network.Credentials{Username: "0x1a", Password: []byte("guess")}, ""},
+		{"entity without secret", network.Credentials{Username: "0x2b", Password: []byte(secret)}, ""},
+		{"unknown certificate", network.Credentials{CertCN: "0x3c"}, ""},
+		{"wrong admin password", network.Credentials{Username: "admin", Password: []byte("guess")}, ""},
+	}
+	for _, tt := range tests {
+		identity, ok := acl.Authenticate(tt.credentials)
+		if ok != (tt.identity != "") || identity != tt.identity {
+			t.Errorf("%s: got %q %v, want %q", tt.name, identity, ok, tt.identity)
+		}
+	}
+
+	// A new secret replaces the previous one
+	if _, err := svc.GenerateEntitySecret(0x1a); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := acl.Authenticate(network.Credentials{Username: "0x1a", Password: []byte(secret)}); ok {
+		t.Error("the previous secret is still accepted")
+	}
+}
+
+func TestAllowedTopics(t *testing.T) {
+	acl, _ := newTestACL(t)
+
+	tests := []struct {
+		identity string
+		topic    string
+		write    bool
+		allowed  bool
+	}{
+		{"0x1a", "state/0x1a/reported", true, true},
+		{"0x1a", "cmd/0x1a/+", false, true},
+		{"0x1a", "state/0x2b/reported", true, false},
+		{"0x1a", "events/0x1a", true, false},
+		{"0x3c", "state/0x3c/reported", true, false},
+		{adminIdentity, "state/0x2b/reported", true, true},
+	}
+	for _, tt := range tests {
+		if got := acl.Allowed(tt.identity, tt.topic, tt.write); got != tt.allowed {
+			t.Errorf("%s on %s (write %v): got %v, want %v", tt.identity, tt.topic, tt.write, got, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// commands.go
+package ingest
+
+import (
+	"databus/models"
+	"databus/network"
+	"databus/services"
+	"databus/utils"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+/*
+Command ingestion lets devices and controllers change entity states over MQTT instead of HTTP.
+
+Topics:
+	cmd/{entityHex}/set[/bin]           -> ack on cmd/{entityHex}/ack
+	cmd/groups/{groupName}/set[/bin]    -> ack on cmd/groups/{groupName}/ack
+
+Payloads on the set topics are JSON ({"Hex": "0x01"} or {"Label": "on"}, and/or typed attribute values
+{"Attributes": {"brightness": 80}}, with an optional "CorrelationID"). Constrained clients publish a
+compact binary frame on the set/bin topics instead:
+	[state hi][state lo][correlation id bytes...]
+The state is a big-endian uint16, the optional trailing bytes are echoed back as the CorrelationID.
+The topic tells the formats apart, any binary state is a valid frame.
+*/
+
+const (
+	entityCommandTopic = "cmd/+/set"
+	groupCommandTopic  = "cmd/groups/+/set"
+
+	// binarySuffix marks the topics carrying compact binary frames (commands and reports)
+	binarySuffix = "/bin"
+)
+
+/* The MQTT listeners of the databus: commands, reported states and the delta view */
+type listener struct {
+	client   network.Client
+	services *services.Service
+}
+
+// StartCommandListener subscribes to the entity and group command topics with the client, the commands are
+// applied through the services
+func StartCommandListener(client network.Client, svc *services.Service) error {
+	l := &listener{client: client, services: svc}
+	for _, topic := range []string{entityCommandTopic, entityCommandTopic + binarySuffix} {
+		if err := client.Subscribe(topic, l.handleEntityCommand); err != nil {
+			return err
+		}
+	}
+	for _, topic := range []string{groupCommandTopic, groupCommandTopic + binarySuffix} {
+		if err := client.Subscribe(topic, l.handleGroupCommand); err != nil {
+			return err
+		}
+	}
+	log.Printf("Listening for commands on %s and %s (and %s)", entityCommandTopic, groupCommandTopic, binarySuffix)
+	return nil
+}
+
+func (l *listener) handleEntityCommand(topic string, payload []byte) {
+	// cmd/{entityHex}/set[/bin]
+	parts := strings.Split(topic, "/")
+	ackTopic := commandAckTopic(topic)
+
+	cmd, err := ParseCommand(topic, payload)
+	if err != nil {
+		l.publishAck(ackTopic, failedAck(cmd.CorrelationID, models.CommandErrInvalidPayload, err))
+		return
+	}
+
+	hex, err := utils.ParseEntityHex(parts[1])
+	if err != nil {
+		l.publishAck(ackTopic, failedAck(cmd.CorrelationID, models.CommandErrInvalidPayload, err))
+		return
+	}
+
+	entity, err := l.applyEntityCommand(hex, cmd)
+	if err != nil {
+		l.publishAck(ackTopic, failedAck(cmd.CorrelationID, commandErrorCode(err), err))
+		return
+	}
+
+	l.publishAck(ackTopic, models.CommandAck{
+		CorrelationID: cmd.CorrelationID,
+		Success:       true,
+		Entities:      []string{entity.EntityHex},
+		State:         &models.StateJs{Hex: fmt.Sprintf("%#02x", entity.Data.CurrentState)},
+	})
+}
+
+func (l *listener) handleGroupCommand(topic string, payload []byte) {
+	// cmd/groups/{groupName}/set[/bin]
+	parts := strings.Split(topic, "/")
+	ackTopic := commandAckTopic(topic)
+
+	cmd, err := ParseCommand(topic, payload)
+	if err != nil {
+		l.publishAck(ackTopic, failedAck(cmd.CorrelationID, models.CommandErrInvalidPayload, err))
+		return
+	}
+
+	entities, err := l.applyGroupCommand(parts[2], cmd)
+	if err != nil {
+		l.publishAck(ackTopic, failedAck(cmd.CorrelationID, commandErrorCode(err), err))
+		return
+	}
+
+	hexes := make([]string, len(entities))
+	for i := range entities {
+		hexes[i] = entities[i].EntityHex
+	}
+	l.publishAck(ackTopic, models.CommandAck{
+		CorrelationID: cmd.CorrelationID,
+		Success:       true,
+		Entities:      hexes,
+	})
+}
+
+// applyEntityCommand sets the state and/or the attributes carried by a command on a single entity
+func (l *listener) applyEntityCommand(hex uint16, cmd models.CommandJs) (*models.ReactiveEntityJs, error) {
+	var entity *models.ReactiveEntityJs
+	var err error
+
+	if cmd.HasState() {
+		if entity, err = l.services.SetEntityState(hex, cmd.ToStateJs(), models.SourceMQTT); err != nil {
+			return nil, err
+		}
+	}
+	if len(cmd.Attributes) > 0 {
+		if entity, err = l.services.SetEntityAttributes(hex, cmd.Attributes, models.SourceMQTT); err != nil {
+			return nil, err
+		}
+	}
+	return entity, nil
+}
+
+// applyGroupCommand sets the state and/or the attributes carried by a command on every entity of a group
+func (l *listener) applyGroupCommand(groupName string, cmd models.CommandJs) ([]models.ReactiveEntityJs, error) {
+	var entities []models.ReactiveEntityJs
+	var err error
+
+	if cmd.HasState() {
+		if entities, err = l.services.SetGroupState([]string{groupName}, cmd.ToStateJs(), models.SourceMQTT); err != nil {
+			return nil, err
+		}
+	}
+	if len(cmd.Attributes) > 0 {
+		if entities, err = l.services.SetGroupAttributes([]string{groupName}, cmd.Attributes, models.SourceMQTT); err != nil {
+			return nil, err
+		}
+	}
+	return entities, nil
+}
+
+// commandAckTopic returns the ack topic of a command topic (JSON or binary)
+func commandAckTopic(topic string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(topic, binarySuffix), "/set") + "/ack"
+}
+
+// ParseCommand decodes the payload of a command or report topic: a compact binary frame on the topics ending
+// in /bin, JSON on the others
+func ParseCommand(topic string, payload []byte) (models.CommandJs, error) {
+	var cmd models.CommandJs
+
+	if !strings.HasSuffix(topic, binarySuffix) {
+		if err := json.Unmarshal(payload, &cmd); err != nil {
+			return cmd, fmt.Errorf("invalid JSON command: %v", err)
+		}
+		if !cmd.HasState() && len(cmd.Attributes) == 0 {
+			return cmd, errors.New("command requires Hex, Label or Attributes")
+		}
+		return cmd, nil
+	}
+
+	// Compact binary frame
+	if len(payload) < 2 {
+		return cmd, fmt.Errorf("binary command must be at least 2 bytes, got %d", len(payload))
+	}
+	cmd.Hex = fmt.Sprintf("%#02x", binary.BigEndian.Uint16(payload[:2]))
+	cmd.CorrelationID = string(payload[2:])
+	return cmd, nil
+}
+
+func commandErrorCode(err error) string {
+	switch {
+	case errors.Is(err, services.ErrEntityNotFound), errors.Is(err, services.ErrGroupNotFound):
+		return models.CommandErrNotFound
+	case errors.Is(err, services.ErrInvalidState):
+		return models.CommandErrInvalidState
+	case errors.Is(err, services.ErrInvalidAttribute):
+		return models.CommandErrInvalidAttr
+	case errors.Is(err, services.ErrStateConflict), errors.Is(err, services.ErrTransitionNotAllowed):
+		return models.CommandErrConflict
+	default:
+		return models.CommandErrInternal
+	}
+}
+
+func failedAck(correlationID string, code string, err error) models.CommandAck {
+	return models.CommandAck{
+		CorrelationID: correlationID,
+		Success:       false,
+		Error: &models.CommandError{
+			Code:    code,
+			Message: err.Error(),
+		},
+	}
+}
+
+func (l *listener) publishAck(topic string, ack models.CommandAck) {
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		log.Printf("Error encoding command ack for %s: %v", topic, err)
+		return
+	}
+	// An ack waits for the connection when it is down, it is not kept anywhere else
+	if err := network.Queued(l.client).Publish(topic, payload); err != nil {
+		log.Printf("Error publishing command ack to %s: %v", topic, err)
+	}
+}
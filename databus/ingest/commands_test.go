@@ -0,0 +1,57 @@
+package ingest
+
+import (
+	"testing"
+)
+
+func TestParseCommandReadsThePayloadTheTopicAnnounces(t *testing.T) {
+	tests := []struct {
+		name          string
+		topic         string
+		payload       []byte
+		hex           string
+		label         string
+		correlationID string
+		wantErr       bool
+	}{
+		{name: "JSON label", topic: "cmd/0x1a/set", payload: []byte(`{"Label": "on", "CorrelationID": "abc"}`), label: "on", correlationID: "abc"},
+		{name: "JSON with leading whitespace", topic: "cmd/groups/switches/set", payload: []byte(" \n{\"Hex\": \"0x01\"}"), hex: "0x01"},
+		{name: "JSON report", topic: "state/0x1a/reported", payload: []byte(`{"Hex": "0x02"}`), hex: "0x02"},
+		{name: "binary frame", topic: "cmd/0x1a/set/bin", payload: []byte{0x00, 0x01, 'a', 'b'}, hex: "0x01", correlationID: "ab"},
+		{name: "binary frame starting with an opening brace", topic: "cmd/0x1a/set/bin", payload: []byte{'{', '"'}, hex: "0x7b22"},
+		{name: "binary frame starting with whitespace", topic: "state/0x1a/reported/bin", payload: []byte{' ', '{', 'x'}, hex: "0x207b", correlationID: "x"},
+		{name: "binary frame on a JSON topic", topic: "cmd/0x1a/set", payload: []byte{0x00, 0x01}, wantErr: true},
+		{name: "JSON without state or attributes", topic: "cmd/0x1a/set", payload: []byte(`{"CorrelationID": "abc"}`), wantErr: true},
+		{name: "short binary frame", topic: "cmd/0x1a/set/bin", payload: []byte{0x01}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseCommand(tt.topic, tt.payload)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", cmd)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cmd.Hex != tt.hex || cmd.Label != tt.label || cmd.CorrelationID != tt.correlationID {
+				t.Errorf("got %+v, want Hex %q, Label %q, CorrelationID %q", cmd, tt.hex, tt.label, tt.correlationID)
+			}
+		})
+	}
+}
+
+func TestCommandAckTopic(t *testing.T) {
+	for topic, want := range map[string]string{
+		"cmd/0x1a/set":                "cmd/0x1a/ack",
+		"cmd/0x1a/set/bin":            "cmd/0x1a/ack",
+		"cmd/groups/switches/set/bin": "cmd/groups/switches/ack",
+	} {
+		if got := commandAckTopic(topic); got != want {
+			t.Errorf("commandAckTopic(%q) = %q, want %q", topic, got, want)
+		}
+	}
+}
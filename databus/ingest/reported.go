@@ -0,0 +1,94 @@
+// reported.go
+package ingest
+
+import (
+	"databus/models"
+	"databus/network"
+	"databus/services"
+	"databus/utils"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+Devices report the state they are actually in on state/{entityHex}/reported, using the same
+JSON payload as commands (or the compact binary frame, on state/{entityHex}/reported/bin). Reports only
+update the reported side of the entity.
+
+Entities whose reported state differs from the desired state for longer than the delta
+threshold are periodically published as a JSON list on state/delta.
+*/
+
+const (
+	reportedStateTopic = "state/+/reported"
+	deltaTopic         = "state/delta"
+)
+
+// StartReportedStateListener subscribes to the device-reported state topic with the client, the reports are
+// recorded through the services
+func StartReportedStateListener(client network.Client, svc *services.Service) error {
+	l := &listener{client: client, services: svc}
+	for _, topic := range []string{reportedStateTopic, reportedStateTopic + binarySuffix} {
+		if err := client.Subscribe(topic, l.handleReportedState); err != nil {
+			return err
+		}
+	}
+	log.Printf("Listening for reported states on %s (and %s)", reportedStateTopic, binarySuffix)
+	return nil
+}
+
+// StartDeltaMonitor publishes the delta view on state/delta every threshold until the process exits
+func StartDeltaMonitor(client network.Client, svc *services.Service, threshold time.Duration) {
+	ticker := time.NewTicker(threshold)
+	defer ticker.Stop()
+	publisher := network.Queued(client)
+
+	for range ticker.C {
+		deltas, err := svc.GetDeltas(threshold)
+		if err != nil {
+			log.Printf("Error computing state deltas: %v", err)
+			continue
+		}
+
+		payload, err := json.Marshal(deltas)
+		if err != nil {
+			log.Printf("Error encoding state deltas: %v", err)
+			continue
+		}
+		if err := publisher.Publish(deltaTopic, payload); err != nil {
+			log.Printf("Error publishing state deltas: %v", err)
+		}
+	}
+}
+
+func (l *listener) handleReportedState(topic string, payload []byte) {
+	// state/{entityHex}/reported[/bin]
+	parts := strings.Split(topic, "/")
+
+	hex, err := utils.ParseEntityHex(parts[1])
+	if err != nil {
+		log.Printf("Ignoring reported state on %s: %v", topic, err)
+		return
+	}
+
+	report, err := ParseCommand(topic, payload)
+	if err != nil {
+		log.Printf("Ignoring reported state on %s: %v", topic, err)
+		return
+	}
+
+	if report.HasState() {
+		if _, err := l.services.ReportEntityState(hex, report.ToStateJs(), models.SourceMQTT); err != nil {
+			log.Printf("Error recording reported state on %s: %v", topic, err)
+		}
+	}
+
+	// Readings (temperature, humidity, ...) are reported as attribute values, kept apart from the desired ones
+	if len(report.Attributes) > 0 {
+		if _, err := l.services.ReportEntityAttributes(hex, report.Attributes, models.SourceMQTT); err != nil {
+			log.Printf("Error recording reported attributes on %s: %v", topic, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// command-models.go
+package models
+
+/* Error codes returned in command acknowledgements */
+const (
+	CommandErrInvalidPayload = "invalid_payload"
+	CommandErrNotFound       = "not_found"
+	CommandErrInvalidState   = "invalid_state"
+	CommandErrInvalidAttr    = "invalid_attribute"
+	CommandErrConflict       = "conflict"
+	CommandErrInternal       = "internal"
+)
+
+/* The state-change command received over MQTT on cmd/{entityHex}/set or cmd/groups/{groupName}/set */
+type CommandJs struct {
+	Hex           string                 `json:"Hex,omitempty"`
+	Label         string                 `json:"Label,omitempty"`
+	Attributes    map[string]interface{} `json:"Attributes,omitempty"`
+	CorrelationID string                 `json:"CorrelationID,omitempty"`
+}
+
+/* The structured error of a failed command */
+type CommandError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+}
+
+/* The acknowledgement published on cmd/{entityHex}/ack or cmd/groups/{groupName}/ack */
+type CommandAck struct {
+	CorrelationID string        `json:"CorrelationID,omitempty"`
+	Success       bool          `json:"Success"`
+	Entities      []string      `json:"Entities,omitempty"`
+	State         *StateJs      `json:"State,omitempty"`
+	Error         *CommandError `json:"Error,omitempty"`
+}
+
+// HasState reports whether the command references a state (it may carry only attributes)
+func (c *CommandJs) HasState() bool {
+	return c.Hex != "" || c.Label != ""
+}
+
+// ToStateJs returns the state reference carried by the command
+func (c *CommandJs) ToStateJs() StateJs {
+	return StateJs{
+		Hex:   c.Hex,
+		Label: c.Label,
+	}
+}
@@ -0,0 +1,21 @@
+// config-models.go
+package models
+
+/* The names added, changed and removed when reconciling a config collection with its JSON document */
+type ConfigDiff struct {
+	Added   []string `json:"Added"`
+	Changed []string `json:"Changed"`
+	Removed []string `json:"Removed"`
+}
+
+/* The outcome of reconciling definitions.json, groups.json and rules.json with the database */
+type ReconcileReport struct {
+	Definitions ConfigDiff `json:"Definitions"`
+	Groups      ConfigDiff `json:"Groups"`
+	Rules       ConfigDiff `json:"Rules"`
+}
+
+// Empty reports whether nothing was added, changed or removed
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Changed) == 0 && len(d.Removed) == 0
+}
@@ -2,9 +2,11 @@
 package models
 
 import (
+	"databus/utils"
 	"fmt"
 	"log"
-	"strconv"
+	"math"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -21,6 +23,58 @@ type StateRaw struct {
 	Label string `bson:"Label" json:"Label"`
 }
 
+/* Attribute types a definition can declare */
+const (
+	AttributeEnum    = "enum"
+	AttributeInteger = "integer"
+	AttributeFloat   = "float"
+	AttributeBoolean = "boolean"
+	AttributeString  = "string"
+)
+
+/*
+A typed attribute declared by a definition, for values beyond the single state (brightness, temperature, ...).
+Same shape in definitions.json, the database and the API.
+  - enum:    Values lists the allowed labels
+  - integer: optional Min, Max and Step (multiples of Step from Min, or from 0 without Min)
+  - float:   optional Min, Max and Unit
+  - boolean, string
+*/
+type AttributeDef struct {
+	Name   string   `bson:"Name" json:"Name"`
+	Type   string   `bson:"Type" json:"Type"`
+	Values []string `bson:"Values,omitempty" json:"Values,omitempty"`
+	Min    *float64 `bson:"Min,omitempty" json:"Min,omitempty"`
+	Max    *float64 `bson:"Max,omitempty" json:"Max,omitempty"`
+	Step   *float64 `bson:"Step,omitempty" json:"Step,omitempty"`
+	Unit   string   `bson:"Unit,omitempty" json:"Unit,omitempty"`
+}
+
+/*
+A transition rule declared by a definition: the states an entity may move to from the state From.
+States are referenced by label. Once a definition declares transitions, only the declared moves are
+allowed and the first state of the definition is its initial state.
+MinDwell optionally guards the moves of the rule: the entity must have been in From at least that long
+(e.g. "10m"). Several rules may leave the same state, so every move can have its own MinDwell.
+*/
+type TransitionDef struct {
+	From     string   `bson:"From" json:"From"`
+	To       []string `bson:"To" json:"To"`
+	MinDwell string   `bson:"MinDwell,omitempty" json:"MinDwell,omitempty"`
+}
+
+/* The allowed next states of one state, as exposed by the API */
+type StateTransitionsJs struct {
+	From StateJs       `json:"From"`
+	To   []NextStateJs `json:"To"`
+}
+
+/* A state an entity may move to, with the time it must have spent in the previous state first */
+type NextStateJs struct {
+	StateJs
+	MinDwell string `json:"MinDwell,omitempty"`
+}
+
 /* The state object for the API */
 // type StateDTO struct {
 // 	Hex   string `bson:"Hex" json:"Hex"`
@@ -29,9 +83,11 @@ type StateRaw struct {
 
 /* The definition object for JSON, defined in definitions.json */
 type DefinitionJs struct {
-	Name        string    `bson:"Name" json:"Name"`
-	Description string    `bson:"Description,omitempty" json:"Description,omitempty"`
-	States      []StateJs `bson:"States" json:"States"`
+	Name        string          `bson:"Name" json:"Name"`
+	Description string          `bson:"Description,omitempty" json:"Description,omitempty"`
+	States      []StateJs       `bson:"States" json:"States"`
+	Attributes  []AttributeDef  `bson:"Attributes,omitempty" json:"Attributes,omitempty"`
+	Transitions []TransitionDef `bson:"Transitions,omitempty" json:"Transitions,omitempty"`
 }
 
 /* The definition object for database and internal use */
@@ -40,6 +96,8 @@ type DefinitionRaw struct {
 	Name        string             `bson:"Name" json:"Name"`
 	Description string             `bson:"Description,omitempty" json:"Description,omitempty"`
 	States      []StateRaw         `bson:"States" json:"States"`
+	Attributes  []AttributeDef     `bson:"Attributes,omitempty" json:"Attributes,omitempty"`
+	Transitions []TransitionDef    `bson:"Transitions,omitempty" json:"Transitions,omitempty"`
 }
 
 // --------------------- Conversion functions ---------------------
@@ -55,12 +113,12 @@ func (m *DefinitionJs) ToRaw() DefinitionRaw {
 	for i, st := range m.States {
 
 		// Parse the hex string (e.g. "0x00", "0x01", etc.)
-		val, err := strconv.ParseUint(st.Hex, 0, 16)
+		val, err := utils.ParseHex(st.Hex)
 		if err != nil {
 			log.Fatalf("invalid hex value: %q, error: %v", st.Hex, err)
 		}
 		states[i] = StateRaw{
-			Hex:   uint16(val),
+			Hex:   val,
 			Label: st.Label,
 		}
 	}
@@ -69,6 +127,8 @@ func (m *DefinitionJs) ToRaw() DefinitionRaw {
 		Name:        m.Name,
 		Description: m.Description,
 		States:      states,
+		Attributes:  m.Attributes,
+		Transitions: m.Transitions,
 	}
 }
 
@@ -76,17 +136,210 @@ func (m *DefinitionRaw) ToJs() DefinitionJs {
 	// Convert states
 	states := make([]StateJs, len(m.States))
 	for i, st := range m.States {
-		states[i] = StateJs{
-			Hex:   fmt.Sprintf("%#02x", st.Hex),
-			Label: st.Label,
-		}
+		states[i] = st.ToJs()
 	}
 
 	return DefinitionJs{
 		Name:        m.Name,
 		Description: m.Description,
 		States:      states,
+		Attributes:  m.Attributes,
+		Transitions: m.Transitions,
+	}
+}
+
+func (s *StateRaw) ToJs() StateJs {
+	return StateJs{
+		Hex:   fmt.Sprintf("%#02x", s.Hex),
+		Label: s.Label,
+	}
+}
+
+// --------------------- Lookup functions ---------------------
+
+// FindStateByHex returns the state of the definition matching the given hex value
+func (m *DefinitionRaw) FindStateByHex(hex uint16) (StateRaw, bool) {
+	for _, st := range m.States {
+		if st.Hex == hex {
+			return st, true
+		}
+	}
+	return StateRaw{}, false
+}
+
+// FindStateByLabel returns the state of the definition matching the given label
+func (m *DefinitionRaw) FindStateByLabel(label string) (StateRaw, bool) {
+	for _, st := range m.States {
+		if st.Label == label {
+			return st, true
+		}
+	}
+	return StateRaw{}, false
+}
+
+// FindAttribute returns the attribute of the definition with the given name
+func (m *DefinitionRaw) FindAttribute(name string) (AttributeDef, bool) {
+	for _, attr := range m.Attributes {
+		if attr.Name == name {
+			return attr, true
+		}
+	}
+	return AttributeDef{}, false
+}
+
+// HasTransitions reports whether the definition restricts the moves between its states
+func (m *DefinitionRaw) HasTransitions() bool {
+	return len(m.Transitions) > 0
+}
+
+// InitialState returns the state new entities of the definition start in, the first one
+func (m *DefinitionRaw) InitialState() (StateRaw, bool) {
+	if len(m.States) == 0 {
+		return StateRaw{}, false
+	}
+	return m.States[0], true
+}
+
+// FindTransition returns the transition rule of the definition allowing the move between the states with the given labels
+func (m *DefinitionRaw) FindTransition(fromLabel string, toLabel string) (TransitionDef, bool) {
+	for _, tr := range m.Transitions {
+		if tr.From == fromLabel && utils.Contains(tr.To, toLabel) {
+			return tr, true
+		}
 	}
+	return TransitionDef{}, false
+}
+
+// NextStates returns the states an entity of this definition may move to from the given state.
+// Without declared transitions every state is allowed.
+func (m *DefinitionRaw) NextStates(from uint16) []StateRaw {
+	if !m.HasTransitions() {
+		return m.States
+	}
+	current, ok := m.FindStateByHex(from)
+	if !ok {
+		return nil
+	}
+	var next []StateRaw
+	for _, tr := range m.Transitions {
+		if tr.From != current.Label {
+			continue
+		}
+		for _, label := range tr.To {
+			if st, ok := m.FindStateByLabel(label); ok {
+				next = append(next, st)
+			}
+		}
+	}
+	return next
+}
+
+// StateTransitions returns the allowed next states of every state of the definition
+func (m *DefinitionRaw) StateTransitions() []StateTransitionsJs {
+	transitions := make([]StateTransitionsJs, len(m.States))
+	for i, st := range m.States {
+		next := m.NextStates(st.Hex)
+		to := make([]NextStateJs, len(next))
+		for j := range next {
+			to[j] = NextStateJs{StateJs: next[j].ToJs()}
+			if tr, ok := m.FindTransition(st.Label, next[j].Label); ok {
+				to[j].MinDwell = tr.MinDwell
+			}
+		}
+		transitions[i] = StateTransitionsJs{From: st.ToJs(), To: to}
+	}
+	return transitions
+}
+
+// --------------------- Validation functions ---------------------
+
+// ValidateValue checks a value (as decoded from JSON) against the attribute's type and constraints.
+// The value is returned normalized for storage (e.g. integers as int64).
+func (a *AttributeDef) ValidateValue(value interface{}) (interface{}, error) {
+	switch a.Type {
+	case AttributeEnum:
+		label, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("attribute '%s' expects one of %v", a.Name, a.Values)
+		}
+		for _, v := range a.Values {
+			if v == label {
+				return label, nil
+			}
+		}
+		return nil, fmt.Errorf("attribute '%s' expects one of %v, got %q", a.Name, a.Values, label)
+
+	case AttributeInteger:
+		num, ok := toFloat(value)
+		if !ok || num != math.Trunc(num) {
+			return nil, fmt.Errorf("attribute '%s' expects an integer", a.Name)
+		}
+		if err := a.checkRange(num); err != nil {
+			return nil, err
+		}
+		if a.Step != nil {
+			base := 0.0
+			if a.Min != nil {
+				base = *a.Min
+			}
+			if steps := (num - base) / *a.Step; steps != math.Trunc(steps) {
+				return nil, fmt.Errorf("attribute '%s' expects a multiple of %v from %v", a.Name, *a.Step, base)
+			}
+		}
+		return int64(num), nil
+
+	case AttributeFloat:
+		num, ok := toFloat(value)
+		if !ok {
+			return nil, fmt.Errorf("attribute '%s' expects a number", a.Name)
+		}
+		if err := a.checkRange(num); err != nil {
+			return nil, err
+		}
+		return num, nil
+
+	case AttributeBoolean:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("attribute '%s' expects a boolean", a.Name)
+		}
+		return b, nil
+
+	case AttributeString:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("attribute '%s' expects a string", a.Name)
+		}
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("attribute '%s' has unknown type '%s'", a.Name, a.Type)
+}
+
+func (a *AttributeDef) checkRange(num float64) error {
+	if a.Min != nil && num < *a.Min {
+		return fmt.Errorf("attribute '%s' must be >= %v", a.Name, *a.Min)
+	}
+	if a.Max != nil && num > *a.Max {
+		return fmt.Errorf("attribute '%s' must be <= %v", a.Name, *a.Max)
+	}
+	return nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
 }
 
 // --------------------- Print functions ---------------------
@@ -100,5 +353,17 @@ func (a *DefinitionJs) Print() {
 		fmt.Println("\tHex: " + fmt.Sprintf("%#02x", a.States[i].Hex))
 		fmt.Println("\tLabel: " + a.States[i].Label + "\n")
 	}
+	if len(a.Attributes) > 0 {
+		fmt.Println("Attributes: ")
+		for _, attr := range a.Attributes {
+			fmt.Println("\t" + attr.Name + " (" + attr.Type + ")")
+		}
+	}
+	if len(a.Transitions) > 0 {
+		fmt.Println("Transitions: ")
+		for _, tr := range a.Transitions {
+			fmt.Println("\t" + tr.From + " -> " + strings.Join(tr.To, ", "))
+		}
+	}
 	fmt.Println("------------")
 }
@@ -0,0 +1,89 @@
+// event-models.go
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* Event types emitted whenever a reactive entity changes */
+const (
+	EventCreated           = "created"
+	EventUpdated           = "updated"
+	EventDeleted           = "deleted"
+	EventStateChanged      = "state_changed"
+	EventReported          = "reported"
+	EventAttributesChanged = "attributes_changed"
+)
+
+/* Sources of an entity change */
+const (
+	SourceREST      = "rest"
+	SourceMQTT      = "mqtt"
+	SourceScheduler = "scheduler"
+	SourceRule      = "rule"
+)
+
+/* The event envelope published on the bus (MQTT, etc.) for every reactive entity change */
+type EntityEvent struct {
+	ID         string                 `bson:"ID" json:"ID"`
+	Type       string                 `bson:"Type" json:"Type"`
+	EntityHex  string                 `bson:"EntityHex" json:"EntityHex"`
+	Definition string                 `bson:"Definition" json:"Definition"`
+	Groups     []string               `bson:"Groups" json:"Groups"`
+	OldState   *StateJs               `bson:"OldState,omitempty" json:"OldState,omitempty"`
+	NewState   *StateJs               `bson:"NewState,omitempty" json:"NewState,omitempty"`
+	Attributes map[string]interface{} `bson:"Attributes,omitempty" json:"Attributes,omitempty"`
+	Source     string                 `bson:"Source" json:"Source"`
+	RuleChain  []string               `bson:"RuleChain,omitempty" json:"RuleChain,omitempty"` // the rules whose actions made the change
+	Before     *ReactiveEntityJs      `bson:"Before,omitempty" json:"Before,omitempty"`
+	After      *ReactiveEntityJs      `bson:"After,omitempty" json:"After,omitempty"`
+	Timestamp  time.Time              `bson:"Timestamp" json:"Timestamp"`
+}
+
+/*
+An event waiting to be published on MQTT, kept in the Outbox collection. It is written in the same transaction as
+the entity change that caused it and keyed by the event ID, so every committed change is published at least once,
+in order, even across broker outages and restarts.
+*/
+type OutboxEntry struct {
+	ID          primitive.ObjectID `bson:"_id" json:"ID"`
+	Event       EntityEvent        `bson:"Event" json:"Event"`
+	CreatedAt   time.Time          `bson:"CreatedAt" json:"CreatedAt"`
+	Attempts    int                `bson:"Attempts" json:"Attempts"`
+	LastError   string             `bson:"LastError,omitempty" json:"LastError,omitempty"`
+	DeliveredAt *time.Time         `bson:"DeliveredAt,omitempty" json:"DeliveredAt,omitempty"`
+}
+
+/* The retained message on state/{entityHex}: the current state of a reactive entity */
+type EntityStateMessage struct {
+	EntityHex          string                 `json:"EntityHex"`
+	Definition         string                 `json:"Definition"`
+	Groups             []string               `json:"Groups"`
+	State              *StateJs               `json:"State"`
+	ReportedState      *StateJs               `json:"ReportedState,omitempty"`
+	Attributes         map[string]interface{} `json:"Attributes,omitempty"`
+	ReportedAttributes map[string]interface{} `json:"ReportedAttributes,omitempty"`
+	LastUpdated        time.Time              `json:"LastUpdated"`
+}
+
+/* The retained message on groups/{groupName}/state: the current state of every entity of a group, by entity hex */
+type GroupStateMessage struct {
+	Group     string             `json:"Group"`
+	States    map[string]StateJs `json:"States"`
+	Timestamp time.Time          `json:"Timestamp"`
+}
+
+/* Frame types pushed to live (WebSocket, SSE) clients */
+const (
+	FrameSnapshot = "snapshot"
+	FrameEvent    = "event"
+)
+
+/* A frame pushed to live clients: either a snapshot of the matching entities or a single event */
+type StreamFrame struct {
+	Type     string             `json:"Type"`
+	Entities []ReactiveEntityJs `json:"Entities,omitempty"`
+	Event    *EntityEvent       `json:"Event,omitempty"`
+}
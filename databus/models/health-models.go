@@ -0,0 +1,26 @@
+// health-models.go
+package models
+
+import "time"
+
+/* Status of a health check */
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+/* The result of the check of one dependency in /readyz */
+type DependencyCheck struct {
+	Status    string      `json:"Status"`
+	LatencyMs float64     `json:"LatencyMs"`
+	Error     string      `json:"Error,omitempty"`
+	Details   interface{} `json:"Details,omitempty"`
+}
+
+/* The body of /healthz and /readyz. Status is fail as soon as one of the checks fails. */
+type HealthReport struct {
+	Status    string                     `json:"Status"`
+	Uptime    string                     `json:"Uptime,omitempty"`
+	Checks    map[string]DependencyCheck `json:"Checks,omitempty"`
+	Timestamp time.Time                  `json:"Timestamp"`
+}
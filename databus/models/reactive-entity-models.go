@@ -2,17 +2,41 @@
 package models
 
 import (
+	"databus/utils"
 	"fmt"
-	"strconv"
+	"sort"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-/* The data object, default/empty data to be added to the reactive entity object on creation */
+/*
+The data object, default/empty data to be added to the reactive entity object on creation.
+CurrentState/LastUpdated hold the desired state (what was last requested through the API or a command),
+ReportedState/ReportedUpdated hold what the device itself last reported, and are unset until it does.
+Attributes hold the desired value of each typed attribute declared by the definition (set through the API or
+a command), ReportedAttributes the values the device last reported (readings, or the value it actually applied).
+*/
 type DataObj struct {
-	CurrentState int       `bson:"CurrentState" json:"CurrentState"`
-	LastUpdated  time.Time `bson:"LastUpdated" json:"LastUpdated"`
+	CurrentState              int                    `bson:"CurrentState" json:"CurrentState"`
+	LastUpdated               time.Time              `bson:"LastUpdated" json:"LastUpdated"`
+	ReportedState             *int                   `bson:"ReportedState,omitempty" json:"ReportedState,omitempty"`
+	ReportedUpdated           *time.Time             `bson:"ReportedUpdated,omitempty" json:"ReportedUpdated,omitempty"`
+	Attributes                map[string]interface{} `bson:"Attributes,omitempty" json:"Attributes,omitempty"`
+	AttributesUpdated         *time.Time             `bson:"AttributesUpdated,omitempty" json:"AttributesUpdated,omitempty"`
+	ReportedAttributes        map[string]interface{} `bson:"ReportedAttributes,omitempty" json:"ReportedAttributes,omitempty"`
+	ReportedAttributesUpdated *time.Time             `bson:"ReportedAttributesUpdated,omitempty" json:"ReportedAttributesUpdated,omitempty"`
+}
+
+/* An entity whose reported state or attribute values differ from the desired ones */
+type EntityDelta struct {
+	EntityHex          string                 `json:"EntityHex"`
+	Definition         string                 `json:"Definition"`
+	Desired            *StateJs               `json:"Desired"`
+	Reported           *StateJs               `json:"Reported"`
+	DesiredAttributes  map[string]interface{} `json:"DesiredAttributes,omitempty"`
+	ReportedAttributes map[string]interface{} `json:"ReportedAttributes,omitempty"`
+	OutOfSyncSince     time.Time              `json:"OutOfSyncSince"`
 }
 
 /* The location object, for reactive entities */
@@ -42,6 +66,7 @@ type ReactiveEntityRaw struct {
 	Definition  primitive.ObjectID   `bson:"Definition" json:"Definition"`
 	Groups      []primitive.ObjectID `bson:"Groups" json:"Groups"`
 	Data        DataObj              `bson:"Data" json:"Data"`
+	SecretHash  string               `bson:"SecretHash,omitempty" json:"-"` // SHA-256 of the device secret for the embedded broker
 }
 
 // --------------------- Conversion functions ---------------------
@@ -69,14 +94,14 @@ func (e *ReactiveEntityJs) ToRaw(definitions []DefinitionRaw, groups []GroupRaw)
 	}
 
 	// Convert EntityHex from string to uint16
-	val, err := strconv.ParseUint(e.EntityHex, 0, 16)
+	val, err := utils.ParseEntityHex(e.EntityHex)
 	if err != nil {
 		fmt.Printf("Error parsing EntityHex: %v\n", err)
 	}
 
 	// Initialize the raw reactive entity
 	raw := &ReactiveEntityRaw{
-		EntityHex:   uint16(val),
+		EntityHex:   val,
 		Description: e.Description,
 		Location:    e.Location,
 		Data:        DataObj{},
@@ -146,6 +171,39 @@ func (e *ReactiveEntityRaw) ToJs(definitions []DefinitionRaw, groups []GroupRaw)
 	return js
 }
 
+// --------------------- State functions ---------------------
+
+// InSync reports whether the device has reported the desired state and attribute values (what it never reported is
+// considered in sync)
+func (d *DataObj) InSync() bool {
+	return (d.ReportedState == nil || *d.ReportedState == d.CurrentState) && len(d.AttributeDeltas()) == 0
+}
+
+// AttributeDeltas lists the attributes with both a desired and a reported value, and where the two differ. Readings
+// only the device reports have no desired value and are never a delta.
+func (d *DataObj) AttributeDeltas() []string {
+	var names []string
+	for name, reported := range d.ReportedAttributes {
+		// Compare the printed values, the numeric type may differ after a round trip through the store
+		if desired, ok := d.Attributes[name]; ok && fmt.Sprint(desired) != fmt.Sprint(reported) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OutOfSyncSince returns when desired and reported data last diverged, i.e. the latest change to either side
+func (d *DataObj) OutOfSyncSince() time.Time {
+	since := d.LastUpdated
+	for _, t := range []*time.Time{d.ReportedUpdated, d.AttributesUpdated, d.ReportedAttributesUpdated} {
+		if t != nil && t.After(since) {
+			since = *t
+		}
+	}
+	return since
+}
+
 // --------------------- Print functions ---------------------
 
 func (e *ReactiveEntityJs) Print() {
@@ -166,4 +224,8 @@ func (e *ReactiveEntityJs) Print() {
 func (d *DataObj) Print() {
 	fmt.Println("CurrentState: " + fmt.Sprintf("%d", d.CurrentState))
 	fmt.Println("LastUpdated: " + d.LastUpdated.String())
+	if d.ReportedState != nil {
+		fmt.Println("ReportedState: " + fmt.Sprintf("%d", *d.ReportedState))
+		fmt.Println("ReportedUpdated: " + d.ReportedUpdated.String())
+	}
 }
@@ -0,0 +1,102 @@
+// rule-models.go
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* Where a rule is managed: rules.json or the rules API */
+const (
+	RuleOriginDocument = "document"
+	RuleOriginAPI      = "api"
+)
+
+/* Actions a rule can take */
+const (
+	RuleActionSetState = "set_state"
+	RuleActionPublish  = "publish"
+	RuleActionWebhook  = "webhook"
+)
+
+/*
+A rule, defined in rules.json or through the API. Same shape in the document, the database and the API,
+entities, groups, definitions and states are referenced by hex, name and label.
+When an event matches the trigger and every condition holds, the actions are executed in order.
+*/
+type Rule struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"ID,omitempty"`
+	Name        string             `bson:"Name" json:"Name"`
+	Description string             `bson:"Description,omitempty" json:"Description,omitempty"`
+	Disabled    bool               `bson:"Disabled,omitempty" json:"Disabled,omitempty"`
+	When        RuleTrigger        `bson:"When" json:"When"`
+	Conditions  []RuleCondition    `bson:"Conditions,omitempty" json:"Conditions,omitempty"`
+	Actions     []RuleAction       `bson:"Actions" json:"Actions"`
+	Origin      string             `bson:"Origin" json:"Origin,omitempty"`
+}
+
+/*
+The events a rule reacts to. Each non-empty list must match (any of its values):
+  - EventTypes defaults to state_changed and reported
+  - EntityHexes, Groups and Definitions select the entity the event is about
+  - FromState and State optionally require the old and new state label of the event
+*/
+type RuleTrigger struct {
+	EventTypes  []string `bson:"EventTypes,omitempty" json:"EventTypes,omitempty"`
+	EntityHexes []string `bson:"EntityHexes,omitempty" json:"EntityHexes,omitempty"`
+	Groups      []string `bson:"Groups,omitempty" json:"Groups,omitempty"`
+	Definitions []string `bson:"Definitions,omitempty" json:"Definitions,omitempty"`
+	FromState   string   `bson:"FromState,omitempty" json:"FromState,omitempty"`
+	State       string   `bson:"State,omitempty" json:"State,omitempty"`
+}
+
+/* A state condition on another entity, or on every entity of a group, checked when the trigger matches */
+type RuleCondition struct {
+	EntityHex string `bson:"EntityHex,omitempty" json:"EntityHex,omitempty"`
+	Group     string `bson:"Group,omitempty" json:"Group,omitempty"`
+	State     string `bson:"State" json:"State"`
+}
+
+/*
+An action of a rule:
+  - set_state: set State (label) on EntityHex or on every entity belonging to all Groups
+  - publish:   publish Payload (the triggering event when empty) on the MQTT Topic
+  - webhook:   deliver the rule name and the triggering event as JSON to the URL of the webhook subscription
+               named Webhook, signed and retried like the event deliveries of the subscription
+*/
+type RuleAction struct {
+	Type      string   `bson:"Type" json:"Type"`
+	EntityHex string   `bson:"EntityHex,omitempty" json:"EntityHex,omitempty"`
+	Groups    []string `bson:"Groups,omitempty" json:"Groups,omitempty"`
+	State     string   `bson:"State,omitempty" json:"State,omitempty"`
+	Topic     string   `bson:"Topic,omitempty" json:"Topic,omitempty"`
+	Payload   string   `bson:"Payload,omitempty" json:"Payload,omitempty"`
+	Webhook   string   `bson:"Webhook,omitempty" json:"Webhook,omitempty"`
+}
+
+/* A hypothetical event to evaluate the rules against, without executing anything */
+type RuleDryRunRequest struct {
+	EventType string `json:"EventType,omitempty"`
+	EntityHex string `json:"EntityHex"`
+	State     string `json:"State"`
+	Rules     []Rule `json:"Rules,omitempty"`
+}
+
+/* One rule evaluation of a dry run, in the order the engine would perform it */
+type RuleEvaluation struct {
+	Depth   int          `json:"Depth"`
+	Rule    string       `json:"Rule"`
+	Event   EntityEvent  `json:"Event"`
+	Matched bool         `json:"Matched"`
+	Reason  string       `json:"Reason,omitempty"`
+	Actions []RuleAction `json:"Actions,omitempty"`
+	Errors  []string     `json:"Errors,omitempty"`
+}
+
+/* The outcome of a dry run */
+type RuleDryRunResult struct {
+	Evaluations []RuleEvaluation `json:"Evaluations"`
+	Loops       []string         `json:"Loops,omitempty"`
+	Timestamp   time.Time        `json:"Timestamp"`
+}
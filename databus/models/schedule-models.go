@@ -0,0 +1,35 @@
+// schedule-models.go
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+A scheduled state change, stored in the Schedules collection. Either Cron (a standard 5 field expression,
+evaluated in Timezone, UTC by default) for recurring runs, or At for a single run.
+The target is EntityHex or every entity belonging to all Groups, the new state is referenced by label.
+
+NextRun, LastRun and LastError are maintained by the scheduler. A one-shot schedule has no NextRun once it ran.
+While a run executes, ClaimedRun holds its due time until ClaimExpiresAt; a claim still there once it expired
+belongs to a run that was interrupted (e.g. the process died) and is run again.
+*/
+type Schedule struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"ID,omitempty"`
+	Name      string             `bson:"Name" json:"Name"`
+	Cron      string             `bson:"Cron,omitempty" json:"Cron,omitempty"`
+	At        *time.Time         `bson:"At,omitempty" json:"At,omitempty"`
+	Timezone  string             `bson:"Timezone,omitempty" json:"Timezone,omitempty"`
+	EntityHex string             `bson:"EntityHex,omitempty" json:"EntityHex,omitempty"`
+	Groups    []string           `bson:"Groups,omitempty" json:"Groups,omitempty"`
+	State     string             `bson:"State" json:"State"`
+	Disabled  bool               `bson:"Disabled,omitempty" json:"Disabled,omitempty"`
+	NextRun   *time.Time         `bson:"NextRun,omitempty" json:"NextRun,omitempty"`
+	LastRun   *time.Time         `bson:"LastRun,omitempty" json:"LastRun,omitempty"`
+	LastError string             `bson:"LastError,omitempty" json:"LastError,omitempty"`
+
+	ClaimedRun     *time.Time `bson:"ClaimedRun,omitempty" json:"ClaimedRun,omitempty"`
+	ClaimExpiresAt *time.Time `bson:"ClaimExpiresAt,omitempty" json:"ClaimExpiresAt,omitempty"`
+}
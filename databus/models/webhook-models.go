@@ -0,0 +1,76 @@
+// webhook-models.go
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+A webhook subscription: every entity event passing the filter is POSTed to URL as the same JSON envelope
+that is published on MQTT. An empty list matches everything, groups require the entity to belong to every
+listed group (like the event streams).
+
+The body is signed with HMAC-SHA256 using Secret. The secret is generated when none is given and is only
+returned when the subscription is created.
+*/
+type WebhookSubscription struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"ID,omitempty"`
+	Name        string             `bson:"Name" json:"Name"`
+	URL         string             `bson:"URL" json:"URL"`
+	Secret      string             `bson:"Secret" json:"Secret,omitempty"`
+	EventTypes  []string           `bson:"EventTypes,omitempty" json:"EventTypes,omitempty"`
+	EntityHexes []string           `bson:"EntityHexes,omitempty" json:"EntityHexes,omitempty"`
+	Groups      []string           `bson:"Groups,omitempty" json:"Groups,omitempty"`
+	Definitions []string           `bson:"Definitions,omitempty" json:"Definitions,omitempty"`
+	Disabled    bool               `bson:"Disabled,omitempty" json:"Disabled,omitempty"`
+	CreatedAt   time.Time          `bson:"CreatedAt" json:"CreatedAt"`
+}
+
+/* One delivery attempt of an event to a webhook subscription, kept in the WebhookDeliveries collection */
+type WebhookDelivery struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"ID,omitempty"`
+	Subscription string             `bson:"Subscription" json:"Subscription"`
+	EventID      string             `bson:"EventID" json:"EventID"`
+	EventType    string             `bson:"EventType" json:"EventType"`
+	EntityHex    string             `bson:"EntityHex" json:"EntityHex"`
+	Attempt      int                `bson:"Attempt" json:"Attempt"`
+	Success      bool               `bson:"Success" json:"Success"`
+	StatusCode   int                `bson:"StatusCode,omitempty" json:"StatusCode,omitempty"`
+	Error        string             `bson:"Error,omitempty" json:"Error,omitempty"`
+	DurationMs   int64              `bson:"DurationMs" json:"DurationMs"`
+	Timestamp    time.Time          `bson:"Timestamp" json:"Timestamp"`
+}
+
+/*
+A delivery waiting for its next attempt, kept in the WebhookRetries collection from before its first attempt so
+pending deliveries survive a restart. Payload is the body of the first attempt, every attempt sends (and signs) the same bytes.
+*/
+type WebhookRetry struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"ID,omitempty"`
+	SubscriptionID primitive.ObjectID `bson:"SubscriptionID" json:"SubscriptionID"`
+	Subscription   string             `bson:"Subscription" json:"Subscription"`
+	Event          EntityEvent        `bson:"Event" json:"Event"`
+	Payload        []byte             `bson:"Payload" json:"-"`
+	Attempt        int                `bson:"Attempt" json:"Attempt"` // number of the next attempt
+	LastError      string             `bson:"LastError" json:"LastError"`
+	NextAttemptAt  time.Time          `bson:"NextAttemptAt" json:"NextAttemptAt"`
+}
+
+/* An event that could not be delivered to a subscription after every attempt, kept in the WebhookDeadLetters collection */
+type WebhookDeadLetter struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"ID,omitempty"`
+	Subscription string             `bson:"Subscription" json:"Subscription"`
+	URL          string             `bson:"URL" json:"URL"`
+	Event        EntityEvent        `bson:"Event" json:"Event"`
+	Attempts     int                `bson:"Attempts" json:"Attempts"`
+	LastError    string             `bson:"LastError" json:"LastError"`
+	FailedAt     time.Time          `bson:"FailedAt" json:"FailedAt"`
+}
+
+// Redacted returns a copy of the subscription without its secret, for API responses
+func (w WebhookSubscription) Redacted() WebhookSubscription {
+	w.Secret = ""
+	return w
+}
@@ -0,0 +1,260 @@
+// broker.go
+package network
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+/*
+The embedded broker runs an MQTT 3.1.1/5 broker inside the databus process, for single-box installs without
+Mosquitto. Devices connect to its TCP and WebSocket listeners as they would to Mosquitto, while the databus itself
+publishes and subscribes in memory: messages are injected into the broker directly, and messages published by
+clients are handed to the subscribers from a broker hook, without a loopback connection.
+
+Who may connect, publish and subscribe is decided by an Authorizer. It authenticates a client once, when it
+connects, and the identity it returns is what the topics of the client are checked against. Messages published
+by the databus itself are not checked.
+*/
+
+// Authorizer decides which clients may connect to the embedded broker and which topics they may use.
+// Authenticate returns the identity of an accepted client, Allowed is asked with that identity. For
+// subscriptions, topic is the requested topic filter.
+type Authorizer interface {
+	Authenticate(credentials Credentials) (string, bool)
+	Allowed(identity string, topic string, write bool) bool
+}
+
+/* What a client presented when connecting to the embedded broker */
+type Credentials struct {
+	ClientID string
+	Username string
+	Password []byte
+	CertCN   string // common name of the verified client certificate, empty without mutual TLS
+}
+
+// brokerQueueSize is the number of messages a subscription of the databus can have waiting for its handler
+const brokerQueueSize = 256
+
+/* The embedded broker, it is both the Publisher and the subscriber of the databus */
+type Broker struct {
+	server  *mqtt.Server
+	started time.Time
+
+	mu            sync.RWMutex
+	subscriptions []*brokerSubscription
+	dropped       atomic.Int64 // messages not handed to a subscription whose queue was full
+}
+
+/* A topic filter the databus subscribed to, with the queue feeding its handler */
+type brokerSubscription struct {
+	filter string
+	queue  chan message
+}
+
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// StartBroker starts the embedded broker with a TCP listener on tcpAddress and a WebSocket listener on wsAddress.
+// An empty address disables the listener. With a TLS configuration both listeners only accept TLS (mqtts, wss).
+func StartBroker(tcpAddress string, wsAddress string, tlsConfig *tls.Config, auth Authorizer) (*Broker, error) {
+	b := &Broker{server: mqtt.New(nil), started: time.Now().UTC()}
+
+	if err := b.server.AddHook(&brokerHook{broker: b, auth: auth}, nil); err != nil {
+		return nil, err
+	}
+	if tcpAddress != "" {
+		if err := b.server.AddListener(listeners.NewTCP("tcp", tcpAddress, &listeners.Config{TLSConfig: tlsConfig})); err != nil {
+			return nil, fmt.Errorf("mqtt listener on %s: %w", tcpAddress, err)
+		}
+	}
+	if wsAddress != "" {
+		if err := b.server.AddListener(listeners.NewWebsocket("ws", wsAddress, &listeners.Config{TLSConfig: tlsConfig})); err != nil {
+			return nil, fmt.Errorf("mqtt websocket listener on %s: %w", wsAddress, err)
+		}
+	}
+	if err := b.server.Serve(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Embedded MQTT broker listening on %s (tcp) and %s (websocket)", tcpAddress, wsAddress)
+	return b, nil
+}
+
+// Publish sends a payload (QoS 1, not retained) to a topic through the broker, without a connection
+func (b *Broker) Publish(topic string, payload []byte) error {
+	return b.server.Publish(topic, payload, false, 1)
+}
+
+// PublishRetained sends a retained payload (QoS 1) to a topic through the broker, an empty payload clears it
+func (b *Broker) PublishRetained(topic string, payload []byte) error {
+	return b.server.Publish(topic, payload, true, 1)
+}
+
+// Subscribe registers a handler for a topic filter. Like the MQTT client subscriptions, messages are handed
+// to the handler one at a time, in order, from a dedicated goroutine. Messages arriving while brokerQueueSize
+// of them are waiting for the handler are dropped and counted in the state of the broker.
+func (b *Broker) Subscribe(topicFilter string, handler MessageHandler) error {
+	if !mqtt.IsValidFilter(topicFilter, false) {
+		return fmt.Errorf("invalid topic filter %q", topicFilter)
+	}
+
+	sub := &brokerSubscription{filter: topicFilter, queue: make(chan message, brokerQueueSize)}
+	go func() {
+		for msg := range sub.queue {
+			handler(msg.topic, msg.payload)
+		}
+	}()
+
+	b.mu.Lock()
+	b.subscriptions = append(b.subscriptions, sub)
+	b.mu.Unlock()
+	return nil
+}
+
+// State reports the embedded broker as always connected, the databus publishes to it in memory
+func (b *Broker) State() ConnectionState {
+	return ConnectionState{Connected: true, Broker: "embedded", Since: b.started, Dropped: b.dropped.Load()}
+}
+
+// Close disconnects the clients and stops the listeners
+func (b *Broker) Close() error {
+	return b.server.Close()
+}
+
+// deliver hands a published message to the matching subscriptions of the databus. It runs in the broker's
+// publish path, so a subscription that is not keeping up loses the message instead of stalling every client.
+func (b *Broker) deliver(topic string, payload []byte) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, sub := range b.subscriptions {
+		if !MatchTopic(sub.filter, topic) {
+			continue
+		}
+		select {
+		case sub.queue <- message{topic: topic, payload: append([]byte(nil), payload...)}:
+		default:
+			if b.dropped.Add(1)%100 == 1 {
+				log.Printf("Embedded broker subscription %s is full, dropped a message on %s (%d dropped so far)", sub.filter, topic, b.dropped.Load())
+			}
+		}
+	}
+}
+
+/* The hook connecting the broker to the Authorizer and to the subscriptions of the databus */
+type brokerHook struct {
+	mqtt.HookBase
+	broker *Broker
+	auth   Authorizer
+
+	identities sync.Map // *mqtt.Client -> identity returned by the Authorizer
+}
+
+func (h *brokerHook) ID() string {
+	return "databus"
+}
+
+func (h *brokerHook) Provides(b byte) bool {
+	return b == mqtt.OnConnectAuthenticate || b == mqtt.OnACLCheck || b == mqtt.OnPublished || b == mqtt.OnDisconnect
+}
+
+func (h *brokerHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
+	identity, ok := h.auth.Authenticate(Credentials{
+		ClientID: pk.Connect.ClientIdentifier,
+		Username: string(pk.Connect.Username),
+		Password: pk.Connect.Password,
+		CertCN:   certCommonName(cl.Net.Conn),
+	})
+	if !ok {
+		return false
+	}
+	h.identities.Store(cl, identity)
+	return true
+}
+
+func (h *brokerHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	identity, ok := h.identities.Load(cl)
+	if !ok {
+		return false
+	}
+	return h.auth.Allowed(identity.(string), topic, write)
+}
+
+func (h *brokerHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.identities.Delete(cl)
+}
+
+func (h *brokerHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.broker.deliver(pk.TopicName, pk.Payload)
+}
+
+// certCommonName returns the common name of the client certificate verified on a TLS connection, or "" when
+// the connection is not TLS or the client presented no certificate
+func certCommonName(conn net.Conn) string {
+	tlsConn, ok := tlsConnOf(conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// tlsConnOf returns the TLS connection under a client connection. The WebSocket listener hands the broker its
+// own (unexported) connection type, which embeds the TLS connection of wss as its net.Conn field "Conn".
+func tlsConnOf(conn net.Conn) (*tls.Conn, bool) {
+	for depth := 0; depth < 4 && conn != nil; depth++ {
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			return tlsConn, true
+		}
+		v := reflect.ValueOf(conn)
+		if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+			return nil, false
+		}
+		field := v.Elem().FieldByName("Conn")
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, false
+		}
+		conn, _ = field.Interface().(net.Conn)
+	}
+	return nil, false
+}
+
+// MatchTopic reports whether a topic filter matches a topic. When the topic is itself a filter, it only matches
+// if every topic it can stand for does, so MatchTopic also tells whether one filter covers another.
+func MatchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || topicLevels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDeliverDropsWhenASubscriptionIsFull(t *testing.T) {
+	b := &Broker{}
+	release := make(chan struct{})
+	defer close(release)
+	if err := b.Subscribe("state/+/reported", func(topic string, payload []byte) { <-release }); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < brokerQueueSize+10; i++ {
+			b.deliver("state/0x1a/reported", []byte("{}"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliver blocked on a full subscription")
+	}
+	// The handler holds one message, the queue the next brokerQueueSize
+	if dropped := b.State().Dropped; dropped < 9 {
+		t.Fatalf("%d messages dropped, want at least 9", dropped)
+	}
+}
+
+// issue returns a certificate for the common name, signed by the parent (self-signed without one)
+func issue(t *testing.T, cn string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+/* Stands for the connection type of the WebSocket listener, embedding the TLS connection */
+type wrappedConn struct {
+	net.Conn
+}
+
+func TestCertCommonNameUnderAWebSocketConnection(t *testing.T) {
+	ca := issue(t, "ca", nil)
+	server, client := issue(t, "broker", &ca), issue(t, "0x1a", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	serverConn := tls.Server(serverSide, &tls.Config{Certificates: []tls.Certificate{server}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert})
+	clientConn := tls.Client(clientSide, &tls.Config{Certificates: []tls.Certificate{client}, RootCAs: pool, ServerName: "broker", InsecureSkipVerify: true})
+	go clientConn.Handshake()
+	if err := serverConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cn := certCommonName(serverConn); cn != "0x1a" {
+		t.Fatalf("common name %q over TCP, want 0x1a", cn)
+	}
+	if cn := certCommonName(&wrappedConn{Conn: serverConn}); cn != "0x1a" {
+		t.Fatalf("common name %q over WebSocket, want 0x1a", cn)
+	}
+	if cn := certCommonName(&wrappedConn{Conn: serverSide}); cn != "" {
+		t.Fatalf("common name %q without TLS, want none", cn)
+	}
+}
@@ -1,34 +1,381 @@
 package network
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
-	"os"
+	"net/url"
+	"sync"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
-var MqttClient MQTT.Client
+// Publisher sends payloads to MQTT topics
+type Publisher interface {
+	Publish(topic string, payload []byte) error
+}
+
+// Subscriber receives the messages of MQTT topics. The MQTT client and the embedded broker are both
+// a Publisher and a Subscriber.
+type Subscriber interface {
+	Subscribe(topicFilter string, handler MessageHandler) error
+}
 
-func InitMQTTClient() {
-	brokerURL := os.Getenv("MQTT_BROKER_URL")
-	if brokerURL == "" {
-		brokerURL = "tcp://localhost:1883"
+// RetainedPublisher keeps the last payload of a topic on the broker, handed to every new subscriber.
+// An empty payload clears the retained message of the topic.
+type RetainedPublisher interface {
+	PublishRetained(topic string, payload []byte) error
+}
+
+// QueueingPublisher is a Publisher able to hold messages while the connection to the broker is down, see Queued
+type QueueingPublisher interface {
+	Queued() Publisher
+}
+
+// Queued returns the publisher of the messages that have no other copy (command acks, the delta view, rule actions,
+// configuration announcements): while the connection is down they wait in a bounded queue instead of failing, and
+// are sent in order once it is back. Publishers that never disconnect, like the embedded broker, are returned as is.
+// Entity events must not use it, they wait in the outbox instead.
+func Queued(p Publisher) Publisher {
+	if q, ok := p.(QueueingPublisher); ok {
+		return q.Queued()
+	}
+	return p
+}
+
+// StateReporter reports the state of the connection to the broker, for the health checks
+type StateReporter interface {
+	State() ConnectionState
+}
+
+// Client is the MQTT side of the databus, opened in main and handed to the parts that publish or subscribe.
+// The MQTT client (MQTTPublisher) and the embedded broker (Broker) are both a Client.
+type Client interface {
+	Publisher
+	RetainedPublisher
+	Subscriber
+	StateReporter
+}
+
+/* The state of the connection to the broker, reported by the health checks */
+type ConnectionState struct {
+	Connected  bool      `json:"Connected"`
+	Broker     string    `json:"Broker,omitempty"`
+	ClientID   string    `json:"ClientID,omitempty"`
+	Since      time.Time `json:"Since"` // when the connection was established or lost
+	LastError  string    `json:"LastError,omitempty"`
+	Reconnects int       `json:"Reconnects"`        // attempts to reconnect since the start
+	Queued     int       `json:"Queued,omitempty"`  // messages of the publish queue waiting for the connection
+	Dropped    int64     `json:"Dropped,omitempty"` // messages dropped because a subscription of the embedded broker or the publish queue was full
+}
+
+// ErrNotConnected is returned when a message is published while the connection to the broker is down
+var ErrNotConnected = errors.New("mqtt client is not connected")
+
+/* Options of the MQTT client */
+type MQTTOptions struct {
+	// Brokers are tried in order, on the first connection and after the connection is lost
+	Brokers  []string
+	ClientID string
+	Username string
+	Password string
+	// TLS is used for ssl:// and wss:// brokers, nil verifies them against the system roots
+	TLS *tls.Config
+	// MaxReconnectInterval caps the backoff between connection attempts
+	MaxReconnectInterval time.Duration
+	// QueueSize bounds the messages of Queued waiting for the connection, the oldest is dropped beyond it
+	QueueSize int
+}
+
+/*
+The Publisher backed by a paho MQTT client. It never gives up on the broker: the first connection is retried
+in the background, lost connections are re-established with backoff (failing over between the brokers), and every
+subscription is made again on each connection. Publish does not queue: publishing while disconnected fails with
+ErrNotConnected, and a publish only succeeds once the broker acknowledged it, so entity events wait in the outbox
+on disk until the connection is back. The publisher returned by Queued holds up to QueueSize messages in memory
+instead, they are lost when the process stops before the connection is back.
+*/
+type MQTTPublisher struct {
+	client  MQTT.Client
+	options MQTTOptions
+
+	mu            sync.Mutex
+	subscriptions []clientSubscription
+	attempted     string // the broker of the last connection attempt
+	state         ConnectionState
+	pending       []*queuedMessage // the messages of Queued waiting for the connection, oldest first
+	flushing      bool             // whether a goroutine is sending the pending messages
+	dropLogged    bool             // whether a dropped message was logged since the connection was lost
+}
+
+/* A message of Queued waiting for the connection */
+type queuedMessage struct {
+	topic   string
+	payload []byte
+}
+
+/* A subscription of the databus, made again on every connection */
+type clientSubscription struct {
+	filter  string
+	handler MQTT.MessageHandler
+}
+
+// InitMQTTClient starts connecting to the brokers and returns a publisher using the connection.
+// It returns right away, the connection is made (and re-made) in the background.
+func InitMQTTClient(options MQTTOptions) *MQTTPublisher {
+	p := &MQTTPublisher{options: options}
+	p.state.ClientID = options.ClientID
+	p.state.Since = time.Now().UTC()
+
+	opts := MQTT.NewClientOptions()
+	for _, broker := range options.Brokers {
+		opts.AddBroker(broker)
+	}
+	opts.SetClientID(options.ClientID)
+	opts.SetUsername(options.Username)
+	opts.SetPassword(options.Password)
+	if options.TLS != nil {
+		opts.SetTLSConfig(options.TLS)
 	}
-	opts := MQTT.NewClientOptions().AddBroker(brokerURL)
-	opts.SetClientID("go_mqtt_client")
 	opts.SetCleanSession(true)
 	opts.SetConnectTimeout(10 * time.Second)
 	opts.SetKeepAlive(60 * time.Second)
-	opts.SetPingTimeout(1 * time.Second)
-	opts.OnConnectionLost = func(client MQTT.Client, err error) {
-		log.Printf("MQTT connection lost: %v", err)
+	opts.SetPingTimeout(10 * time.Second)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(options.MaxReconnectInterval)
+	opts.SetConnectionAttemptHandler(p.connectionAttempt)
+	opts.SetOnConnectHandler(p.connected)
+	opts.SetConnectionLostHandler(p.connectionLost)
+	opts.SetReconnectingHandler(func(client MQTT.Client, opts *MQTT.ClientOptions) {
+		p.mu.Lock()
+		p.state.Reconnects++
+		p.mu.Unlock()
+	})
+
+	p.client = MQTT.NewClient(opts)
+	go p.connect()
+	return p
+}
+
+// connect makes the first connection, retrying with backoff. Once connected, paho reconnects on its own.
+func (p *MQTTPublisher) connect() {
+	backoff := time.Second
+	for {
+		token := p.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+
+		p.mu.Lock()
+		p.state.LastError = token.Error().Error()
+		p.mu.Unlock()
+		log.Printf("Error connecting to MQTT broker, retrying in %s: %v", backoff, token.Error())
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.options.MaxReconnectInterval {
+			backoff = p.options.MaxReconnectInterval
+		}
+	}
+}
+
+func (p *MQTTPublisher) connectionAttempt(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+	p.mu.Lock()
+	p.attempted = broker.Redacted()
+	p.mu.Unlock()
+	return tlsCfg
+}
+
+// connected runs after every (re)connection: it subscribes again
+func (p *MQTTPublisher) connected(client MQTT.Client) {
+	p.mu.Lock()
+	p.state.Connected = true
+	p.state.Broker = p.attempted
+	p.state.Since = time.Now().UTC()
+	p.state.LastError = ""
+	subscriptions := append([]clientSubscription(nil), p.subscriptions...)
+	p.mu.Unlock()
+	log.Printf("Connected to MQTT broker %s as %s", p.attempted, p.options.ClientID)
+
+	for _, sub := range subscriptions {
+		if err := p.subscribe(sub); err != nil {
+			log.Printf("Error subscribing to %s: %v", sub.filter, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.dropLogged = false
+	p.mu.Unlock()
+	p.startFlush()
+}
+
+func (p *MQTTPublisher) connectionLost(client MQTT.Client, err error) {
+	p.mu.Lock()
+	p.state.Connected = false
+	p.state.Since = time.Now().UTC()
+	p.state.LastError = err.Error()
+	p.mu.Unlock()
+	log.Printf("MQTT connection lost, reconnecting: %v", err)
+}
+
+// State returns the state of the connection
+func (p *MQTTPublisher) State() ConnectionState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	state := p.state
+	state.Connected = state.Connected && p.client.IsConnectionOpen()
+	state.Queued = len(p.pending)
+	return state
+}
+
+// Publish sends a payload (QoS 1, not retained) to a topic and waits for the broker to acknowledge it.
+// It fails with ErrNotConnected while disconnected.
+func (p *MQTTPublisher) Publish(topic string, payload []byte) error {
+	return p.publish(topic, payload, false)
+}
+
+// PublishRetained sends a retained payload (QoS 1) to a topic and waits for the acknowledgement, like Publish
+func (p *MQTTPublisher) PublishRetained(topic string, payload []byte) error {
+	return p.publish(topic, payload, true)
+}
+
+func (p *MQTTPublisher) publish(topic string, payload []byte, retain bool) error {
+	if !p.client.IsConnectionOpen() {
+		return fmt.Errorf("%w, message to %s not sent", ErrNotConnected, topic)
 	}
-	opts.OnConnect = func(client MQTT.Client) {
-		log.Println("Connected to MQTT broker")
+	token := p.client.Publish(topic, 1, retain, payload)
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("timed out publishing to %s", topic)
 	}
-	MqttClient = MQTT.NewClient(opts)
-	if token := MqttClient.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Error connecting to MQTT broker: %v", token.Error())
+	return token.Error()
+}
+
+// Queued returns a publisher sending payloads like Publish while connected, and queuing them while disconnected
+func (p *MQTTPublisher) Queued() Publisher {
+	return queuedPublisher{p}
+}
+
+/* The view of an MQTTPublisher queuing messages while disconnected, see Queued */
+type queuedPublisher struct {
+	p *MQTTPublisher
+}
+
+// Publish sends a payload (QoS 1, not retained) right away when connected and nothing waits before it, otherwise it
+// is queued and nil returned
+func (q queuedPublisher) Publish(topic string, payload []byte) error {
+	p := q.p
+	p.mu.Lock()
+	waiting := len(p.pending) > 0
+	p.mu.Unlock()
+
+	if !waiting {
+		err := p.publish(topic, payload, false)
+		if !errors.Is(err, ErrNotConnected) {
+			return err
+		}
+	}
+	p.enqueue(topic, payload)
+	return nil
+}
+
+// enqueue adds a message to the queue, dropping the oldest one when it is full, and sends the queue when connected
+func (p *MQTTPublisher) enqueue(topic string, payload []byte) {
+	p.mu.Lock()
+	p.pending = append(p.pending, &queuedMessage{topic: topic, payload: payload})
+	if len(p.pending) > p.options.QueueSize {
+		dropped := p.pending[0]
+		p.pending = p.pending[1:]
+		p.state.Dropped++
+		if !p.dropLogged {
+			p.dropLogged = true
+			log.Printf("MQTT publish queue full (%d messages), dropping the oldest ones, e.g. to %s", p.options.QueueSize, dropped.topic)
+		}
+	}
+	p.mu.Unlock()
+
+	// The connection may be back already, with the queue sent before this message was added
+	p.startFlush()
+}
+
+// startFlush sends the pending messages from a goroutine, unless one already does or the connection is down
+func (p *MQTTPublisher) startFlush() {
+	p.mu.Lock()
+	start := !p.flushing && len(p.pending) > 0 && p.client.IsConnectionOpen()
+	if start {
+		p.flushing = true
+	}
+	p.mu.Unlock()
+
+	if start {
+		go p.flush()
+	}
+}
+
+// flush sends the pending messages in order until the queue is empty or a publish fails, which leaves the message
+// at the head of the queue for the next connection
+func (p *MQTTPublisher) flush() {
+	for {
+		p.mu.Lock()
+		if len(p.pending) == 0 {
+			p.flushing = false
+			p.mu.Unlock()
+			return
+		}
+		msg := p.pending[0]
+		p.mu.Unlock()
+
+		if err := p.publish(msg.topic, msg.payload, false); err != nil {
+			log.Printf("Error sending the MQTT publish queue, %d messages kept: %v", p.State().Queued, err)
+			p.mu.Lock()
+			p.flushing = false
+			p.mu.Unlock()
+			return
+		}
+
+		// The message may have been dropped from a full queue in the meantime
+		p.mu.Lock()
+		if len(p.pending) > 0 && p.pending[0] == msg {
+			p.pending = p.pending[1:]
+		}
+		p.mu.Unlock()
+	}
+}
+
+// MessageHandler processes a message received on a subscribed topic
+type MessageHandler func(topic string, payload []byte)
+
+// Subscribe registers a handler for a topic filter (QoS 1) on the MQTT client. The subscription is made right away
+// when connected, and again on every connection.
+// Messages are handed to the handler one at a time, in order, from a dedicated goroutine so a
+// handler may itself publish (and wait) without blocking the client's network loop.
+func (p *MQTTPublisher) Subscribe(topicFilter string, handler MessageHandler) error {
+	queue := make(chan MQTT.Message, 256)
+	go func() {
+		for msg := range queue {
+			handler(msg.Topic(), msg.Payload())
+		}
+	}()
+
+	sub := clientSubscription{filter: topicFilter, handler: func(client MQTT.Client, msg MQTT.Message) {
+		queue <- msg
+	}}
+	p.mu.Lock()
+	p.subscriptions = append(p.subscriptions, sub)
+	p.mu.Unlock()
+
+	if !p.client.IsConnectionOpen() {
+		return nil
+	}
+	return p.subscribe(sub)
+}
+
+func (p *MQTTPublisher) subscribe(sub clientSubscription) error {
+	token := p.client.Subscribe(sub.filter, 1, sub.handler)
+	if !token.WaitTimeout(5 * time.Second) {
+		return fmt.Errorf("timed out subscribing to %s", sub.filter)
 	}
+	return token.Error()
 }
@@ -0,0 +1,82 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* An authorizer of the embedded broker letting every client use every topic */
+type allowAll struct{}
+
+func (allowAll) Authenticate(Credentials) (string, bool) { return "test", true }
+func (allowAll) Allowed(string, string, bool) bool       { return true }
+
+// freeAddress returns a local TCP address nothing listens on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestQueuedMessagesAreSentOnceConnected(t *testing.T) {
+	address := freeAddress(t)
+	p := InitMQTTClient(MQTTOptions{Brokers: []string{"tcp://" + address}, ClientID: "queue-test", MaxReconnectInterval: time.Second, QueueSize: 2})
+	defer p.client.Disconnect(0)
+
+	if err := p.Publish("cmd/0x1a/ack", []byte("lost")); !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("Publish while disconnected returned %v, want %v", err, ErrNotConnected)
+	}
+	queued := p.Queued()
+	for _, payload := range []string{"1", "2", "3"} {
+		if err := queued.Publish("cmd/0x1a/ack", []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if state := p.State(); state.Queued != 2 || state.Dropped != 1 {
+		t.Fatalf("%d queued and %d dropped, want 2 and 1", state.Queued, state.Dropped)
+	}
+
+	broker, err := StartBroker(address, "", nil, allowAll{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+
+	var mu sync.Mutex
+	var received []string
+	if err := broker.Subscribe("cmd/+/ack", func(topic string, payload []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, string(payload))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		got := append([]string(nil), received...)
+		mu.Unlock()
+		if len(got) == 2 {
+			// The oldest message was dropped, the others arrive in order
+			if got[0] != "2" || got[1] != "3" {
+				t.Fatalf("received %v, want [2 3]", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %v once connected, want [2 3]", got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if queued := p.State().Queued; queued != 0 {
+		t.Fatalf("%d messages left in the queue", queued)
+	}
+}
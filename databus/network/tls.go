@@ -0,0 +1,87 @@
+// tls.go
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+/* The PEM files securing an MQTT connection (the client) or listener (the embedded broker) */
+type TLSFiles struct {
+	// CAFile verifies the peer: the broker's certificate for the client, the client certificates for the broker
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify accepts any broker certificate, for labs with self-signed brokers (client only)
+	InsecureSkipVerify bool
+}
+
+// Enabled reports whether any TLS option is set
+func (f TLSFiles) Enabled() bool {
+	return f.CAFile != "" || f.CertFile != "" || f.KeyFile != "" || f.InsecureSkipVerify
+}
+
+// ClientConfig returns the TLS configuration of the MQTT client, nil when no option is set (ssl:// and wss://
+// brokers are then verified against the system roots). A certificate and key make it mutual TLS.
+func (f TLSFiles) ClientConfig() (*tls.Config, error) {
+	if !f.Enabled() {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: f.InsecureSkipVerify}
+	if f.CAFile != "" {
+		pool, err := loadCAFile(f.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if f.CertFile != "" || f.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ServerConfig returns the TLS configuration of the embedded broker's listeners, nil when no option is set.
+// The certificate and key are required; with a CA file, clients must present a certificate signed by it.
+func (f TLSFiles) ServerConfig() (*tls.Config, error) {
+	if !f.Enabled() {
+		return nil, nil
+	}
+	if f.CertFile == "" || f.KeyFile == "" {
+		return nil, fmt.Errorf("the broker needs both a certificate and a key file for TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading broker certificate: %w", err)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if f.CAFile != "" {
+		pool, err := loadCAFile(f.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func loadCAFile(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
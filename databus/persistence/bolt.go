@@ -0,0 +1,87 @@
+// bolt.go
+package persistence
+
+import (
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/* An engine keeping every collection in a bucket of a bbolt file */
+type boltEngine struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// OpenBolt opens (or creates) the bbolt file at path. Only one process can open it at a time.
+func OpenBolt(path string) (*EmbeddedStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &EmbeddedStore{engine: &boltEngine{db: db}}, nil
+}
+
+func (e *boltEngine) view(fn func(tx engineTx) error) error {
+	return e.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (e *boltEngine) update(fn func(tx engineTx) error) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (e *boltEngine) close() error {
+	return e.db.Close()
+}
+
+func (tx *boltTx) get(collection string, key string) ([]byte, error) {
+	bucket := tx.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil, nil
+	}
+	doc := bucket.Get([]byte(key))
+	if doc == nil {
+		return nil, nil
+	}
+	return append([]byte(nil), doc...), nil
+}
+
+func (tx *boltTx) put(collection string, key string, doc []byte) error {
+	bucket, err := tx.tx.CreateBucketIfNotExists([]byte(collection))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), doc)
+}
+
+func (tx *boltTx) delete(collection string, key string) error {
+	bucket := tx.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(key))
+}
+
+func (tx *boltTx) each(collection string, fn func(key string, doc []byte) error) error {
+	bucket := tx.tx.Bucket([]byte(collection))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(key []byte, doc []byte) error {
+		return fn(string(key), doc)
+	})
+}
+
+func (tx *boltTx) clear(collection string) error {
+	if tx.tx.Bucket([]byte(collection)) == nil {
+		return nil
+	}
+	return tx.tx.DeleteBucket([]byte(collection))
+}
@@ -0,0 +1,1000 @@
+// embedded.go
+package persistence
+
+import (
+	"databus/models"
+	"databus/utils"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The Store of the embedded backends (bbolt, SQLite, memory). Documents are stored as BSON, keyed by their ObjectID
+(entity events by their event ID), and queried by scanning their collection, which is fine for the few hundred
+devices of an edge deployment. The queries behave like their MongoDB counterparts, including the $all semantics
+of GetReactiveEntitiesByGroup.
+*/
+type EmbeddedStore struct {
+	engine engine
+}
+
+// errStop ends a scan early
+var errStop = errors.New("stop")
+
+// NewMemoryStore returns an empty store kept in process memory
+func NewMemoryStore() *EmbeddedStore {
+	return &EmbeddedStore{engine: newMemoryEngine()}
+}
+
+// Close closes the file of the store
+func (s *EmbeddedStore) Close() error {
+	return s.engine.close()
+}
+
+// Ping runs an empty read transaction
+func (s *EmbeddedStore) Ping() error {
+	return s.engine.view(func(tx engineTx) error { return nil })
+}
+
+// AtomicOutbox is always true, every write of the embedded engines is one transaction
+func (s *EmbeddedStore) AtomicOutbox() bool {
+	return true
+}
+
+// ------------------------------ Definitions and groups ------------------------------
+
+func (s *EmbeddedStore) GetAllDefinitions() ([]models.DefinitionRaw, error) {
+	return viewAll[models.DefinitionRaw](s, definitionsCollection, nil)
+}
+
+func (s *EmbeddedStore) GetDefinitionByID(id primitive.ObjectID) (*models.DefinitionRaw, error) {
+	return viewByKey[models.DefinitionRaw](s, definitionsCollection, id.Hex())
+}
+
+func (s *EmbeddedStore) GetDefinitionByName(name string) (*models.DefinitionRaw, error) {
+	return viewOne(s, definitionsCollection, func(d *models.DefinitionRaw) bool { return d.Name == name })
+}
+
+func (s *EmbeddedStore) InsertDefinition(definition *models.DefinitionRaw) error {
+	return s.insert(definitionsCollection, &definition.ID, definition)
+}
+
+func (s *EmbeddedStore) ReplaceDefinition(definition *models.DefinitionRaw) error {
+	return s.replace(definitionsCollection, definition.ID, definition)
+}
+
+func (s *EmbeddedStore) DeleteDefinitions(ids []primitive.ObjectID) error {
+	return s.deleteByID(definitionsCollection, ids...)
+}
+
+func (s *EmbeddedStore) GetAllGroups() ([]models.GroupRaw, error) {
+	return viewAll[models.GroupRaw](s, groupsCollection, nil)
+}
+
+func (s *EmbeddedStore) GetGroupByID(id primitive.ObjectID) (*models.GroupRaw, error) {
+	return viewByKey[models.GroupRaw](s, groupsCollection, id.Hex())
+}
+
+func (s *EmbeddedStore) GetGroupByName(name string) (*models.GroupRaw, error) {
+	return viewOne(s, groupsCollection, func(g *models.GroupRaw) bool { return g.Name == name })
+}
+
+func (s *EmbeddedStore) GetGroupIDMap() (map[string]primitive.ObjectID, error) {
+	groups, err := s.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+	groupNameToID := make(map[string]primitive.ObjectID, len(groups))
+	for _, group := range groups {
+		groupNameToID[group.Name] = group.ID
+	}
+	return groupNameToID, nil
+}
+
+func (s *EmbeddedStore) InsertGroup(group *models.GroupRaw) error {
+	return s.insert(groupsCollection, &group.ID, group)
+}
+
+func (s *EmbeddedStore) ReplaceGroup(group *models.GroupRaw) error {
+	return s.replace(groupsCollection, group.ID, group)
+}
+
+// DeleteGroups removes the groups and, in the same transaction, their references held by reactive entities
+func (s *EmbeddedStore) DeleteGroups(ids []primitive.ObjectID) error {
+	return s.engine.update(func(tx engineTx) error {
+		for _, id := range ids {
+			if err := tx.delete(groupsCollection, id.Hex()); err != nil {
+				return err
+			}
+		}
+
+		entities, err := loadAll(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+			return utils.ContainsAny(e.Groups, ids)
+		})
+		if err != nil {
+			return err
+		}
+		for i := range entities {
+			var kept []primitive.ObjectID
+			for _, id := range entities[i].Groups {
+				if !utils.Contains(ids, id) {
+					kept = append(kept, id)
+				}
+			}
+			entities[i].Groups = kept
+			if err := putDoc(tx, reactiveEntitiesCollection, entities[i].ID.Hex(), &entities[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ------------------------------ Reactive entities ------------------------------
+
+func (s *EmbeddedStore) GetAllReactiveEntities() ([]models.ReactiveEntityRaw, error) {
+	return viewAll[models.ReactiveEntityRaw](s, reactiveEntitiesCollection, nil)
+}
+
+func (s *EmbeddedStore) GetReactiveEntityByID(id primitive.ObjectID) (*models.ReactiveEntityRaw, error) {
+	return viewByKey[models.ReactiveEntityRaw](s, reactiveEntitiesCollection, id.Hex())
+}
+
+func (s *EmbeddedStore) GetReactiveEntityByHex(hex uint16) (*models.ReactiveEntityRaw, error) {
+	return viewOne(s, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool { return e.EntityHex == hex })
+}
+
+// GetReactiveEntitiesByGroup returns the entities belonging to every one of the named groups that exist.
+// Like {$all: [...]} in MongoDB, no entity matches when none of the groups exist.
+func (s *EmbeddedStore) GetReactiveEntitiesByGroup(groupsParam []string) ([]models.ReactiveEntityRaw, error) {
+	var results []models.ReactiveEntityRaw
+	err := s.engine.view(func(tx engineTx) error {
+		groups, err := loadAll(tx, groupsCollection, func(g *models.GroupRaw) bool { return utils.Contains(groupsParam, g.Name) })
+		if err != nil || len(groups) == 0 {
+			return err
+		}
+
+		results, err = loadAll(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+			for _, group := range groups {
+				if !utils.Contains(e.Groups, group.ID) {
+					return false
+				}
+			}
+			return true
+		})
+		return err
+	})
+	return results, err
+}
+
+func (s *EmbeddedStore) GetOutOfSyncReactiveEntities() ([]models.ReactiveEntityRaw, error) {
+	return viewAll(s, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+		return !e.Data.InSync()
+	})
+}
+
+func (s *EmbeddedStore) CountReactiveEntitiesByDefinition(id primitive.ObjectID) (int64, error) {
+	entities, err := viewAll(s, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool { return e.Definition == id })
+	return int64(len(entities)), err
+}
+
+func (s *EmbeddedStore) CountReactiveEntitiesByGroup(id primitive.ObjectID) (int64, error) {
+	entities, err := viewAll(s, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool { return utils.Contains(e.Groups, id) })
+	return int64(len(entities)), err
+}
+
+// InsertReactiveEntities replaces every reactive entity and populates the IDs of the inserted ones
+func (s *EmbeddedStore) InsertReactiveEntities(reactiveEntities []models.ReactiveEntityRaw) error {
+	return s.engine.update(func(tx engineTx) error {
+		if err := tx.clear(reactiveEntitiesCollection); err != nil {
+			return err
+		}
+		hexes := make(map[uint16]bool, len(reactiveEntities))
+		for i := range reactiveEntities {
+			if hexes[reactiveEntities[i].EntityHex] {
+				return ErrDuplicateEntityHex
+			}
+			hexes[reactiveEntities[i].EntityHex] = true
+			if reactiveEntities[i].ID.IsZero() {
+				reactiveEntities[i].ID = primitive.NewObjectID()
+			}
+			if err := putDoc(tx, reactiveEntitiesCollection, reactiveEntities[i].ID.Hex(), &reactiveEntities[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *EmbeddedStore) InsertReactiveEntity(reactiveEntity *models.ReactiveEntityRaw, event EventFunc) error {
+	if reactiveEntity.ID.IsZero() {
+		reactiveEntity.ID = primitive.NewObjectID()
+	}
+	err := s.engine.update(func(tx engineTx) error {
+		existing, err := tx.get(reactiveEntitiesCollection, reactiveEntity.ID.Hex())
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("duplicate key %s in %s", reactiveEntity.ID.Hex(), reactiveEntitiesCollection)
+		}
+		if err := checkEntityHexFree(tx, reactiveEntity.EntityHex, reactiveEntity.ID); err != nil {
+			return err
+		}
+		if err := putDoc(tx, reactiveEntitiesCollection, reactiveEntity.ID.Hex(), reactiveEntity); err != nil {
+			return err
+		}
+		return putEvent(tx, event, reactiveEntity)
+	})
+	if errors.Is(err, ErrDuplicateEntityHex) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error inserting reactive entity: %v", err)
+	}
+	return nil
+}
+
+func (s *EmbeddedStore) DeleteReactiveEntityByHex(hex uint16, event EventFunc) (int64, error) {
+	var deleted int64
+	err := s.engine.update(func(tx engineTx) error {
+		entity, err := loadOne(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool { return e.EntityHex == hex })
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		deleted = 1
+		if err := tx.delete(reactiveEntitiesCollection, entity.ID.Hex()); err != nil {
+			return err
+		}
+		return putEvent(tx, event, entity)
+	})
+	return deleted, err
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntityState(hex uint16, state int, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	previous, _, err := s.updateEntity(hex, nil, false, event, func(e *models.ReactiveEntityRaw) {
+		e.Data.CurrentState = state
+		e.Data.LastUpdated = updatedAt
+	})
+	return previous, err
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntityStateFrom(hex uint16, expectedState int, state int, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	previous, _, err := s.updateEntity(hex, &expectedState, false, event, func(e *models.ReactiveEntityRaw) {
+		e.Data.CurrentState = state
+		e.Data.LastUpdated = updatedAt
+	})
+	return previous, err
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntityReportedState(hex uint16, state int, reportedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	previous, _, err := s.updateEntity(hex, nil, false, event, func(e *models.ReactiveEntityRaw) {
+		e.Data.ReportedState = &state
+		e.Data.ReportedUpdated = &reportedAt
+	})
+	return previous, err
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntityAttributes(hex uint16, values map[string]interface{}, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	previous, _, err := s.updateEntity(hex, nil, false, event, func(e *models.ReactiveEntityRaw) {
+		if e.Data.Attributes == nil {
+			e.Data.Attributes = make(map[string]interface{}, len(values))
+		}
+		for name, value := range values {
+			e.Data.Attributes[name] = value
+		}
+		e.Data.AttributesUpdated = &updatedAt
+	})
+	return previous, err
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntityReportedAttributes(hex uint16, values map[string]interface{}, reportedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	previous, _, err := s.updateEntity(hex, nil, false, event, func(e *models.ReactiveEntityRaw) {
+		if e.Data.ReportedAttributes == nil {
+			e.Data.ReportedAttributes = make(map[string]interface{}, len(values))
+		}
+		for name, value := range values {
+			e.Data.ReportedAttributes[name] = value
+		}
+		e.Data.ReportedAttributesUpdated = &reportedAt
+	})
+	return previous, err
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntityMetadata(hex uint16, expectedState int, entity *models.ReactiveEntityRaw, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	_, updated, err := s.updateEntity(hex, &expectedState, true, event, func(e *models.ReactiveEntityRaw) {
+		e.EntityHex = entity.EntityHex
+		e.Description = entity.Description
+		e.Location = entity.Location
+		e.Definition = entity.Definition
+		e.Groups = entity.Groups
+	})
+	return updated, err
+}
+
+func (s *EmbeddedStore) SetReactiveEntitySecret(hex uint16, secretHash string) error {
+	return s.engine.update(func(tx engineTx) error {
+		entity, err := loadOne(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+			return e.EntityHex == hex
+		})
+		if err != nil {
+			return err
+		}
+		entity.SecretHash = secretHash
+		return putDoc(tx, reactiveEntitiesCollection, entity.ID.Hex(), entity)
+	})
+}
+
+// updateEntity changes an entity in one transaction, optionally only while it is still in expectedState,
+// and returns it as it was before and after. The outbox event is built from the entity after the change when
+// eventAfter is set, before the change otherwise. ErrNotFound is returned when no entity matches.
+func (s *EmbeddedStore) updateEntity(hex uint16, expectedState *int, eventAfter bool, event EventFunc, change func(*models.ReactiveEntityRaw)) (*models.ReactiveEntityRaw, *models.ReactiveEntityRaw, error) {
+	var previous, updated *models.ReactiveEntityRaw
+	err := s.engine.update(func(tx engineTx) error {
+		entity, err := loadOne(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+			return e.EntityHex == hex && (expectedState == nil || e.Data.CurrentState == *expectedState)
+		})
+		if err != nil {
+			return err
+		}
+		previous = entity
+
+		// A second copy to change, previous must not share the attributes map
+		if entity, err = getDoc[models.ReactiveEntityRaw](tx, reactiveEntitiesCollection, previous.ID.Hex()); err != nil {
+			return err
+		}
+		change(entity)
+		updated = entity
+		if entity.EntityHex != previous.EntityHex {
+			if err := checkEntityHexFree(tx, entity.EntityHex, entity.ID); err != nil {
+				return err
+			}
+		}
+		if err := putDoc(tx, reactiveEntitiesCollection, entity.ID.Hex(), entity); err != nil {
+			return err
+		}
+		if eventAfter {
+			return putEvent(tx, event, updated)
+		}
+		return putEvent(tx, event, previous)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return previous, updated, nil
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntityStates(changes []StateChange, updatedAt time.Time, event EventFunc) ([]models.ReactiveEntityRaw, error) {
+	var previous []models.ReactiveEntityRaw
+	err := s.engine.update(func(tx engineTx) error {
+		for _, change := range changes {
+			entity, err := loadOne(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+				return e.EntityHex == change.EntityHex && (change.ExpectedState == nil || e.Data.CurrentState == *change.ExpectedState)
+			})
+			if err != nil {
+				return fmt.Errorf("entity %#02x: %w", change.EntityHex, err)
+			}
+			previous = append(previous, *entity)
+
+			updated := *entity
+			updated.Data.CurrentState = change.State
+			updated.Data.LastUpdated = updatedAt
+			if err := putDoc(tx, reactiveEntitiesCollection, updated.ID.Hex(), &updated); err != nil {
+				return err
+			}
+			if err := putEvent(tx, event, entity); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+func (s *EmbeddedStore) UpdateReactiveEntitiesAttributes(changes []AttributeChange, updatedAt time.Time, event EventFunc) ([]models.ReactiveEntityRaw, error) {
+	var previous []models.ReactiveEntityRaw
+	err := s.engine.update(func(tx engineTx) error {
+		for _, change := range changes {
+			entity, err := loadOne(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+				return e.EntityHex == change.EntityHex
+			})
+			if err != nil {
+				return fmt.Errorf("entity %#02x: %w", change.EntityHex, err)
+			}
+			previous = append(previous, *entity)
+
+			// A new attribute map, the previous entity keeps its values
+			updated := *entity
+			updated.Data.Attributes = make(map[string]interface{}, len(entity.Data.Attributes)+len(change.Values))
+			for name, value := range entity.Data.Attributes {
+				updated.Data.Attributes[name] = value
+			}
+			for name, value := range change.Values {
+				updated.Data.Attributes[name] = value
+			}
+			updated.Data.AttributesUpdated = &updatedAt
+			if err := putDoc(tx, reactiveEntitiesCollection, updated.ID.Hex(), &updated); err != nil {
+				return err
+			}
+			if err := putEvent(tx, event, entity); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// ------------------------------ Outbox ------------------------------
+
+// putEvent adds the event built from the entity to the Outbox and the history, within the transaction of the entity change
+func putEvent(tx engineTx, event EventFunc, entity *models.ReactiveEntityRaw) error {
+	if event == nil {
+		return nil
+	}
+	e := event(entity)
+	if e == nil {
+		return nil
+	}
+	entry, err := newOutboxEntry(e)
+	if err != nil {
+		return err
+	}
+	if err := putDoc(tx, outboxCollection, entry.ID.Hex(), entry); err != nil {
+		return err
+	}
+	return putDoc(tx, entityEventsCollection, e.ID, e)
+}
+
+// GetPendingOutboxEntries returns the entries not delivered yet, oldest first (the keys are the ObjectIDs of the events)
+func (s *EmbeddedStore) GetPendingOutboxEntries(limit int64) ([]models.OutboxEntry, error) {
+	var entries []models.OutboxEntry
+	err := s.engine.view(func(tx engineTx) error {
+		return tx.each(outboxCollection, func(key string, data []byte) error {
+			var entry models.OutboxEntry
+			if err := bson.Unmarshal(data, &entry); err != nil {
+				return fmt.Errorf("error decoding %s/%s: %v", outboxCollection, key, err)
+			}
+			if entry.DeliveredAt != nil {
+				return nil
+			}
+			entries = append(entries, entry)
+			if limit > 0 && int64(len(entries)) >= limit {
+				return errStop
+			}
+			return nil
+		})
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *EmbeddedStore) CountPendingOutboxEntries() (int64, error) {
+	var count int64
+	err := s.engine.view(func(tx engineTx) error {
+		return tx.each(outboxCollection, func(key string, data []byte) error {
+			var entry models.OutboxEntry
+			if err := bson.Unmarshal(data, &entry); err != nil {
+				return fmt.Errorf("error decoding %s/%s: %v", outboxCollection, key, err)
+			}
+			if entry.DeliveredAt == nil {
+				count++
+			}
+			return nil
+		})
+	})
+	return count, err
+}
+
+func (s *EmbeddedStore) MarkOutboxEntryDelivered(id primitive.ObjectID, deliveredAt time.Time) error {
+	return s.updateOutboxEntry(id, func(entry *models.OutboxEntry) {
+		entry.Attempts++
+		entry.LastError = ""
+		entry.DeliveredAt = &deliveredAt
+	})
+}
+
+func (s *EmbeddedStore) SetOutboxEntryError(id primitive.ObjectID, message string) error {
+	return s.updateOutboxEntry(id, func(entry *models.OutboxEntry) {
+		entry.Attempts++
+		entry.LastError = message
+	})
+}
+
+func (s *EmbeddedStore) DeleteDeliveredOutboxEntries(before time.Time) (int64, error) {
+	var deleted int64
+	err := s.engine.update(func(tx engineTx) error {
+		entries, err := loadAll(tx, outboxCollection, func(entry *models.OutboxEntry) bool {
+			return entry.DeliveredAt != nil && entry.DeliveredAt.Before(before)
+		})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := tx.delete(outboxCollection, entry.ID.Hex()); err != nil {
+				return err
+			}
+		}
+		deleted = int64(len(entries))
+		return nil
+	})
+	return deleted, err
+}
+
+// updateOutboxEntry changes an entry in one transaction, nothing happens when it does not exist
+func (s *EmbeddedStore) updateOutboxEntry(id primitive.ObjectID, change func(*models.OutboxEntry)) error {
+	return s.engine.update(func(tx engineTx) error {
+		entry, err := getDoc[models.OutboxEntry](tx, outboxCollection, id.Hex())
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		change(entry)
+		return putDoc(tx, outboxCollection, id.Hex(), entry)
+	})
+}
+
+// ------------------------------ Event history ------------------------------
+
+func (s *EmbeddedStore) GetEntityEventsByHex(entityHex string, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error) {
+	return s.findEntityEvents(func(e *models.EntityEvent) bool { return e.EntityHex == entityHex }, from, to, limit)
+}
+
+func (s *EmbeddedStore) GetEntityEventsByGroup(groupName string, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error) {
+	return s.findEntityEvents(func(e *models.EntityEvent) bool { return utils.Contains(e.Groups, groupName) }, from, to, limit)
+}
+
+func (s *EmbeddedStore) findEntityEvents(match func(*models.EntityEvent) bool, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error) {
+	results, err := viewAll(s, entityEventsCollection, func(e *models.EntityEvent) bool {
+		return match(e) && (from.IsZero() || !e.Timestamp.Before(from)) && (to.IsZero() || !e.Timestamp.After(to))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = make([]models.EntityEvent, 0)
+	}
+
+	// Newest first
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Timestamp.After(results[j].Timestamp) })
+	return limitResults(results, limit), nil
+}
+
+// ------------------------------ Rules ------------------------------
+
+func (s *EmbeddedStore) GetAllRules() ([]models.Rule, error) {
+	return viewAll[models.Rule](s, rulesCollection, nil)
+}
+
+func (s *EmbeddedStore) GetRulesByOrigin(origin string) ([]models.Rule, error) {
+	return viewAll(s, rulesCollection, func(r *models.Rule) bool { return r.Origin == origin })
+}
+
+func (s *EmbeddedStore) GetRuleByName(name string) (*models.Rule, error) {
+	return viewOne(s, rulesCollection, func(r *models.Rule) bool { return r.Name == name })
+}
+
+func (s *EmbeddedStore) InsertRule(rule *models.Rule) error {
+	return s.insert(rulesCollection, &rule.ID, rule)
+}
+
+func (s *EmbeddedStore) ReplaceRule(rule *models.Rule) error {
+	return s.replace(rulesCollection, rule.ID, rule)
+}
+
+func (s *EmbeddedStore) DeleteRule(id primitive.ObjectID) error {
+	return s.deleteByID(rulesCollection, id)
+}
+
+func (s *EmbeddedStore) DeleteRules(ids []primitive.ObjectID) error {
+	return s.deleteByID(rulesCollection, ids...)
+}
+
+// ------------------------------ Schedules ------------------------------
+
+func (s *EmbeddedStore) GetAllSchedules() ([]models.Schedule, error) {
+	return viewAll[models.Schedule](s, schedulesCollection, nil)
+}
+
+func (s *EmbeddedStore) GetDueSchedules(now time.Time) ([]models.Schedule, error) {
+	results, err := viewAll(s, schedulesCollection, func(sc *models.Schedule) bool {
+		return !sc.Disabled && sc.NextRun != nil && !sc.NextRun.After(now)
+	})
+	sort.SliceStable(results, func(i, j int) bool { return results[i].NextRun.Before(*results[j].NextRun) })
+	return results, err
+}
+
+func (s *EmbeddedStore) GetScheduleByName(name string) (*models.Schedule, error) {
+	return viewOne(s, schedulesCollection, func(sc *models.Schedule) bool { return sc.Name == name })
+}
+
+func (s *EmbeddedStore) InsertSchedule(schedule *models.Schedule) error {
+	return s.insert(schedulesCollection, &schedule.ID, schedule)
+}
+
+func (s *EmbeddedStore) ReplaceSchedule(schedule *models.Schedule) error {
+	return s.replace(schedulesCollection, schedule.ID, schedule)
+}
+
+func (s *EmbeddedStore) DeleteSchedule(id primitive.ObjectID) error {
+	return s.deleteByID(schedulesCollection, id)
+}
+
+func (s *EmbeddedStore) ClaimScheduleRun(id primitive.ObjectID, due time.Time, next *time.Time, claimedAt time.Time, expiresAt time.Time) (bool, error) {
+	claimed := false
+	err := s.updateSchedule(id, runDue(due), func(sc *models.Schedule) {
+		sc.LastRun = &claimedAt
+		sc.NextRun = next
+		sc.ClaimedRun = &due
+		sc.ClaimExpiresAt = &expiresAt
+		claimed = true
+	})
+	return claimed, err
+}
+
+func (s *EmbeddedStore) SkipScheduleRun(id primitive.ObjectID, due time.Time, next *time.Time) error {
+	return s.updateSchedule(id, runDue(due), func(sc *models.Schedule) {
+		sc.NextRun = next
+	})
+}
+
+func (s *EmbeddedStore) GetExpiredScheduleClaims(now time.Time) ([]models.Schedule, error) {
+	results, err := viewAll(s, schedulesCollection, func(sc *models.Schedule) bool {
+		return sc.ClaimExpiresAt != nil && !sc.ClaimExpiresAt.After(now)
+	})
+	sort.SliceStable(results, func(i, j int) bool { return results[i].ClaimExpiresAt.Before(*results[j].ClaimExpiresAt) })
+	return results, err
+}
+
+func (s *EmbeddedStore) RenewScheduleClaim(id primitive.ObjectID, run time.Time, expiresAt time.Time, newExpiresAt time.Time) (bool, error) {
+	renewed := false
+	err := s.updateSchedule(id, func(sc *models.Schedule) bool {
+		return claimed(sc, run) && sc.ClaimExpiresAt != nil && sc.ClaimExpiresAt.Equal(expiresAt)
+	}, func(sc *models.Schedule) {
+		sc.ClaimExpiresAt = &newExpiresAt
+		renewed = true
+	})
+	return renewed, err
+}
+
+func (s *EmbeddedStore) CompleteScheduleRun(id primitive.ObjectID, run time.Time, message string) error {
+	return s.updateSchedule(id, func(sc *models.Schedule) bool { return claimed(sc, run) }, func(sc *models.Schedule) {
+		sc.ClaimedRun = nil
+		sc.ClaimExpiresAt = nil
+		sc.LastError = message
+	})
+}
+
+// runDue matches a schedule whose next run is still due
+func runDue(due time.Time) func(*models.Schedule) bool {
+	return func(sc *models.Schedule) bool { return sc.NextRun != nil && sc.NextRun.Equal(due) }
+}
+
+func claimed(sc *models.Schedule, run time.Time) bool {
+	return sc.ClaimedRun != nil && sc.ClaimedRun.Equal(run)
+}
+
+// updateSchedule changes a schedule in one transaction, only while it matches. Like an UpdateOne matching nothing,
+// a missing or already moved schedule is not an error.
+func (s *EmbeddedStore) updateSchedule(id primitive.ObjectID, match func(*models.Schedule) bool, change func(*models.Schedule)) error {
+	return s.engine.update(func(tx engineTx) error {
+		schedule, err := getDoc[models.Schedule](tx, schedulesCollection, id.Hex())
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !match(schedule) {
+			return nil
+		}
+		change(schedule)
+		return putDoc(tx, schedulesCollection, id.Hex(), schedule)
+	})
+}
+
+// ------------------------------ Webhooks ------------------------------
+
+func (s *EmbeddedStore) GetAllWebhooks() ([]models.WebhookSubscription, error) {
+	return viewAll[models.WebhookSubscription](s, webhooksCollection, nil)
+}
+
+func (s *EmbeddedStore) GetWebhookByName(name string) (*models.WebhookSubscription, error) {
+	return viewOne(s, webhooksCollection, func(w *models.WebhookSubscription) bool { return w.Name == name })
+}
+
+func (s *EmbeddedStore) InsertWebhook(webhook *models.WebhookSubscription) error {
+	return s.insert(webhooksCollection, &webhook.ID, webhook)
+}
+
+func (s *EmbeddedStore) ReplaceWebhook(webhook *models.WebhookSubscription) error {
+	return s.replace(webhooksCollection, webhook.ID, webhook)
+}
+
+func (s *EmbeddedStore) DeleteWebhook(id primitive.ObjectID) error {
+	return s.deleteByID(webhooksCollection, id)
+}
+
+func (s *EmbeddedStore) InsertWebhookDelivery(delivery *models.WebhookDelivery) error {
+	return s.insert(webhookDeliveriesCollection, &delivery.ID, delivery)
+}
+
+func (s *EmbeddedStore) GetWebhookDeliveries(subscription string, limit int64) ([]models.WebhookDelivery, error) {
+	results, err := viewAll(s, webhookDeliveriesCollection, func(d *models.WebhookDelivery) bool { return d.Subscription == subscription })
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = make([]models.WebhookDelivery, 0)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Timestamp.After(results[j].Timestamp) })
+	return limitResults(results, limit), nil
+}
+
+func (s *EmbeddedStore) InsertWebhookDeadLetter(deadLetter *models.WebhookDeadLetter) error {
+	return s.insert(webhookDeadLettersCollection, &deadLetter.ID, deadLetter)
+}
+
+func (s *EmbeddedStore) GetWebhookDeadLetters(subscription string, limit int64) ([]models.WebhookDeadLetter, error) {
+	results, err := viewAll(s, webhookDeadLettersCollection, func(d *models.WebhookDeadLetter) bool { return d.Subscription == subscription })
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = make([]models.WebhookDeadLetter, 0)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].FailedAt.After(results[j].FailedAt) })
+	return limitResults(results, limit), nil
+}
+
+func (s *EmbeddedStore) SaveWebhookRetry(retry *models.WebhookRetry) error {
+	if retry.ID.IsZero() {
+		retry.ID = primitive.NewObjectID()
+	}
+	return s.engine.update(func(tx engineTx) error {
+		return putDoc(tx, webhookRetriesCollection, retry.ID.Hex(), retry)
+	})
+}
+
+func (s *EmbeddedStore) GetDueWebhookRetries(now time.Time, limit int64) ([]models.WebhookRetry, error) {
+	results, err := viewAll(s, webhookRetriesCollection, func(r *models.WebhookRetry) bool { return !r.NextAttemptAt.After(now) })
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].NextAttemptAt.Before(results[j].NextAttemptAt) })
+	return limitResults(results, limit), nil
+}
+
+func (s *EmbeddedStore) DeleteWebhookRetry(id primitive.ObjectID) error {
+	return s.deleteByID(webhookRetriesCollection, id)
+}
+
+// ------------------------------ Migration ------------------------------
+
+// ExportCollection calls fn with every document of a collection
+func (s *EmbeddedStore) ExportCollection(collection string, fn func(doc bson.Raw) error) error {
+	return s.engine.view(func(tx engineTx) error {
+		return tx.each(collection, func(key string, doc []byte) error {
+			return fn(append(bson.Raw{}, doc...))
+		})
+	})
+}
+
+// ImportCollection replaces the documents of a collection. Documents are keyed by their _id,
+// entity events (which have none outside MongoDB) by their event ID.
+func (s *EmbeddedStore) ImportCollection(collection string, docs []bson.Raw) error {
+	return s.engine.update(func(tx engineTx) error {
+		if err := tx.clear(collection); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			key := documentKey(collection, doc)
+			if collection == entityEventsCollection {
+				// MongoDB adds an _id of its own to events, it has no meaning here
+				stripped := bson.D{}
+				if err := bson.Unmarshal(doc, &stripped); err != nil {
+					return err
+				}
+				for i := range stripped {
+					if stripped[i].Key == "_id" {
+						stripped = append(stripped[:i], stripped[i+1:]...)
+						break
+					}
+				}
+				var err error
+				if doc, err = bson.Marshal(stripped); err != nil {
+					return err
+				}
+			}
+			if err := tx.put(collection, key, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func documentKey(collection string, doc bson.Raw) string {
+	if collection == entityEventsCollection {
+		if id, ok := doc.Lookup("ID").StringValueOK(); ok && id != "" {
+			return id
+		}
+	}
+	if id, ok := doc.Lookup("_id").ObjectIDOK(); ok {
+		return id.Hex()
+	}
+	if id, ok := doc.Lookup("_id").StringValueOK(); ok {
+		return id
+	}
+	return primitive.NewObjectID().Hex()
+}
+
+// ------------------------------ Helpers ------------------------------
+
+// insert stores a new document, assigning its ObjectID when it has none
+func (s *EmbeddedStore) insert(collection string, id *primitive.ObjectID, doc interface{}) error {
+	if id.IsZero() {
+		*id = primitive.NewObjectID()
+	}
+	return s.engine.update(func(tx engineTx) error {
+		existing, err := tx.get(collection, id.Hex())
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("duplicate key %s in %s", id.Hex(), collection)
+		}
+		return putDoc(tx, collection, id.Hex(), doc)
+	})
+}
+
+// replace overwrites an existing document, like ReplaceOne nothing happens when it does not exist
+func (s *EmbeddedStore) replace(collection string, id primitive.ObjectID, doc interface{}) error {
+	return s.engine.update(func(tx engineTx) error {
+		existing, err := tx.get(collection, id.Hex())
+		if err != nil || existing == nil {
+			return err
+		}
+		return putDoc(tx, collection, id.Hex(), doc)
+	})
+}
+
+func (s *EmbeddedStore) deleteByID(collection string, ids ...primitive.ObjectID) error {
+	return s.engine.update(func(tx engineTx) error {
+		for _, id := range ids {
+			if err := tx.delete(collection, id.Hex()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// checkEntityHexFree returns ErrDuplicateEntityHex when an entity other than id has the hex, in the transaction
+// about to write it (the unique index of MongoStore)
+func checkEntityHexFree(tx engineTx, hex uint16, id primitive.ObjectID) error {
+	_, err := loadOne(tx, reactiveEntitiesCollection, func(e *models.ReactiveEntityRaw) bool {
+		return e.EntityHex == hex && e.ID != id
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ErrDuplicateEntityHex
+}
+
+func putDoc(tx engineTx, collection string, key string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return tx.put(collection, key, data)
+}
+
+func getDoc[T any](tx engineTx, collection string, key string) (*T, error) {
+	data, err := tx.get(collection, key)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrNotFound
+	}
+	var doc T
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error decoding %s/%s: %v", collection, key, err)
+	}
+	return &doc, nil
+}
+
+// loadAll decodes the documents of a collection accepted by match (every document when match is nil)
+func loadAll[T any](tx engineTx, collection string, match func(*T) bool) ([]T, error) {
+	var results []T
+	err := tx.each(collection, func(key string, data []byte) error {
+		var doc T
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error decoding %s/%s: %v", collection, key, err)
+		}
+		if match == nil || match(&doc) {
+			results = append(results, doc)
+		}
+		return nil
+	})
+	return results, err
+}
+
+// loadOne decodes the first document of a collection accepted by match, or returns ErrNotFound
+func loadOne[T any](tx engineTx, collection string, match func(*T) bool) (*T, error) {
+	var result *T
+	err := tx.each(collection, func(key string, data []byte) error {
+		var doc T
+		if err := bson.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("error decoding %s/%s: %v", collection, key, err)
+		}
+		if match(&doc) {
+			result = &doc
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrNotFound
+	}
+	return result, nil
+}
+
+func viewAll[T any](s *EmbeddedStore, collection string, match func(*T) bool) ([]T, error) {
+	var results []T
+	err := s.engine.view(func(tx engineTx) error {
+		var err error
+		results, err = loadAll(tx, collection, match)
+		return err
+	})
+	return results, err
+}
+
+func viewOne[T any](s *EmbeddedStore, collection string, match func(*T) bool) (*T, error) {
+	var result *T
+	err := s.engine.view(func(tx engineTx) error {
+		var err error
+		result, err = loadOne(tx, collection, match)
+		return err
+	})
+	return result, err
+}
+
+func viewByKey[T any](s *EmbeddedStore, collection string, key string) (*T, error) {
+	var result *T
+	err := s.engine.view(func(tx engineTx) error {
+		var err error
+		result, err = getDoc[T](tx, collection, key)
+		return err
+	})
+	return result, err
+}
+
+func limitResults[T any](results []T, limit int64) []T {
+	if limit > 0 && int64(len(results)) > limit {
+		return results[:limit]
+	}
+	return results
+}
@@ -0,0 +1,334 @@
+package persistence
+
+import (
+	"bytes"
+	"databus/models"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/* The embedded engines, every test of this file runs against each of them */
+var embeddedEngines = []string{BackendMemory, BackendBolt, BackendSQLite}
+
+// openEngine returns an empty store of an embedded engine, the file backed ones in a temporary directory
+func openEngine(t *testing.T, backend string) *EmbeddedStore {
+	t.Helper()
+	var store *EmbeddedStore
+	var err error
+	switch backend {
+	case BackendBolt:
+		store, err = OpenBolt(filepath.Join(t.TempDir(), "databus.db"))
+	case BackendSQLite:
+		store, err = OpenSQLite(filepath.Join(t.TempDir(), "databus.sqlite"))
+	default:
+		store = NewMemoryStore()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func forEachEngine(t *testing.T, test func(t *testing.T, store *EmbeddedStore)) {
+	for _, backend := range embeddedEngines {
+		backend := backend
+		t.Run(backend, func(t *testing.T) {
+			test(t, openEngine(t, backend))
+		})
+	}
+}
+
+// newEvent returns an event builder for the entity changes, events get increasing IDs
+func newEvent(entity *models.ReactiveEntityRaw) *models.EntityEvent {
+	return &models.EntityEvent{ID: primitive.NewObjectID().Hex(), Type: models.EventStateChanged, EntityHex: "x"}
+}
+
+func TestGroupStateUpdateIsAllOrNothing(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, store *EmbeddedStore) {
+		if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{
+			{EntityHex: 0x01, Groups: []primitive.ObjectID{}},
+			{EntityHex: 0x02, Groups: []primitive.ObjectID{}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// 0x02 is not in the expected state, 0x01 is left alone
+		off, on := 0, 1
+		changes := []StateChange{
+			{EntityHex: 0x01, ExpectedState: &off, State: on},
+			{EntityHex: 0x02, ExpectedState: &on, State: off},
+		}
+		if _, err := store.UpdateReactiveEntityStates(changes, time.Now().UTC(), newEvent); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("error %v, want ErrNotFound", err)
+		}
+		if entity, err := store.GetReactiveEntityByHex(0x01); err != nil || entity.Data.CurrentState != off {
+			t.Fatalf("entity 0x01 %+v (%v) changed by a failed group update", entity, err)
+		}
+		if pending, _ := store.CountPendingOutboxEntries(); pending != 0 {
+			t.Fatalf("%d outbox entries left by a failed group update", pending)
+		}
+
+		changes[1].ExpectedState = &off
+		changes[1].State = on
+		previous, err := store.UpdateReactiveEntityStates(changes, time.Now().UTC(), newEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(previous) != 2 || previous[0].Data.CurrentState != off || previous[1].Data.CurrentState != off {
+			t.Fatalf("previous entities %+v, want both off", previous)
+		}
+		for _, hex := range []uint16{0x01, 0x02} {
+			if entity, err := store.GetReactiveEntityByHex(hex); err != nil || entity.Data.CurrentState != on {
+				t.Fatalf("entity %#02x %+v (%v), want on", hex, entity, err)
+			}
+		}
+		if pending, _ := store.CountPendingOutboxEntries(); pending != 2 {
+			t.Fatalf("%d outbox entries, want 2", pending)
+		}
+	})
+}
+
+func TestOutboxEntriesArePendingInEventOrder(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, store *EmbeddedStore) {
+		if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{{EntityHex: 0x01, Groups: []primitive.ObjectID{}}}); err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for state := 1; state <= 5; state++ {
+			_, err := store.UpdateReactiveEntityState(0x01, state, time.Now().UTC(), func(entity *models.ReactiveEntityRaw) *models.EntityEvent {
+				e := newEvent(entity)
+				ids = append(ids, e.ID)
+				return e
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		entries, err := store.GetPendingOutboxEntries(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("%d pending entries, want the limit of 3", len(entries))
+		}
+		for i, entry := range entries {
+			if entry.Event.ID != ids[i] {
+				t.Fatalf("entry %d is event %s, want %s", i, entry.Event.ID, ids[i])
+			}
+		}
+
+		// Delivered entries leave the pending ones, the rest keep their order
+		if err := store.MarkOutboxEntryDelivered(entries[0].ID, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetOutboxEntryError(entries[1].ID, "not connected"); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err = store.GetPendingOutboxEntries(0); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 4 || entries[0].Event.ID != ids[1] || entries[0].Attempts != 1 || entries[0].LastError != "not connected" {
+			t.Fatalf("pending entries %+v, want the 4 undelivered ones, the failed one first", entries)
+		}
+		if pending, _ := store.CountPendingOutboxEntries(); pending != 4 {
+			t.Fatalf("%d pending entries counted, want 4", pending)
+		}
+		if deleted, err := store.DeleteDeliveredOutboxEntries(time.Now().Add(time.Minute)); err != nil || deleted != 1 {
+			t.Fatalf("%d delivered entries deleted (%v), want 1", deleted, err)
+		}
+
+		// Every event is in the history too
+		history, err := store.GetEntityEventsByHex("x", time.Time{}, time.Now().Add(time.Minute), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 5 {
+			t.Fatalf("%d events in the history, want 5", len(history))
+		}
+	})
+}
+
+func TestScheduleRunIsClaimedOnce(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, store *EmbeddedStore) {
+		// Stored times have millisecond precision, claims are matched by equality
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		due := now.Add(-time.Second)
+		next := now.Add(time.Hour)
+		schedule := models.Schedule{Name: "lights-off", Cron: "0 * * * *", State: "off", NextRun: &due}
+		if err := store.InsertSchedule(&schedule); err != nil {
+			t.Fatal(err)
+		}
+
+		if schedules, err := store.GetDueSchedules(now); err != nil || len(schedules) != 1 {
+			t.Fatalf("%d due schedules (%v), want 1", len(schedules), err)
+		}
+		expiresAt := now.Add(30 * time.Second)
+		if claimed, err := store.ClaimScheduleRun(schedule.ID, due, &next, now, expiresAt); err != nil || !claimed {
+			t.Fatalf("claimed %v (%v), want the first claim to win", claimed, err)
+		}
+		if claimed, err := store.ClaimScheduleRun(schedule.ID, due, &next, now, expiresAt); err != nil || claimed {
+			t.Fatalf("claimed %v (%v), want the second claim to lose", claimed, err)
+		}
+		if schedules, _ := store.GetDueSchedules(now); len(schedules) != 0 {
+			t.Fatal("claimed schedule still due")
+		}
+
+		// A renewal only succeeds for the current lease
+		renewedAt := expiresAt.Add(30 * time.Second)
+		if renewed, err := store.RenewScheduleClaim(schedule.ID, due, expiresAt, renewedAt); err != nil || !renewed {
+			t.Fatalf("renewed %v (%v), want the lease renewed", renewed, err)
+		}
+		if renewed, _ := store.RenewScheduleClaim(schedule.ID, due, expiresAt, renewedAt); renewed {
+			t.Fatal("an outdated lease was renewed")
+		}
+		if expired, err := store.GetExpiredScheduleClaims(expiresAt); err != nil || len(expired) != 0 {
+			t.Fatalf("%d expired claims (%v) before the renewed lease ended", len(expired), err)
+		}
+		if expired, _ := store.GetExpiredScheduleClaims(renewedAt); len(expired) != 1 || !expired[0].ClaimedRun.Equal(due) {
+			t.Fatalf("expired claims %+v, want the run due at %s", expired, due)
+		}
+
+		if err := store.CompleteScheduleRun(schedule.ID, due, "failed"); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := store.GetScheduleByName("lights-off")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.ClaimedRun != nil || stored.ClaimExpiresAt != nil || stored.LastError != "failed" || !stored.NextRun.Equal(next) {
+			t.Fatalf("schedule %+v after the run", stored)
+		}
+	})
+}
+
+// mongoDocuments returns documents as MongoDB exports them: integers as int32, times as DateTime, and events
+// with an _id of their own next to their ID
+func mongoDocuments() map[string][]bson.D {
+	definitionID := primitive.NewObjectID()
+	groupID := primitive.NewObjectID()
+	updated := primitive.NewDateTimeFromTime(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	return map[string][]bson.D{
+		definitionsCollection: {{
+			{Key: "_id", Value: definitionID},
+			{Key: "Name", Value: "Switch"},
+			{Key: "States", Value: bson.A{
+				bson.D{{Key: "Hex", Value: int32(0)}, {Key: "Label", Value: "off"}},
+				bson.D{{Key: "Hex", Value: int32(1)}, {Key: "Label", Value: "on"}},
+			}},
+		}},
+		groupsCollection: {{
+			{Key: "_id", Value: groupID},
+			{Key: "Name", Value: "switches"},
+		}},
+		reactiveEntitiesCollection: {{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "EntityHex", Value: int32(0x1a)},
+			{Key: "Location", Value: bson.D{{Key: "Name", Value: "hall"}}},
+			{Key: "Definition", Value: definitionID},
+			{Key: "Groups", Value: bson.A{groupID}},
+			{Key: "Data", Value: bson.D{
+				{Key: "CurrentState", Value: int32(1)},
+				{Key: "LastUpdated", Value: updated},
+			}},
+		}},
+		entityEventsCollection: {{
+			{Key: "_id", Value: primitive.NewObjectID()},
+			{Key: "ID", Value: primitive.NewObjectID().Hex()},
+			{Key: "Type", Value: models.EventStateChanged},
+			{Key: "EntityHex", Value: "0x1a"},
+			{Key: "Definition", Value: "Switch"},
+			{Key: "Groups", Value: bson.A{"switches"}},
+			{Key: "Source", Value: models.SourceREST},
+			{Key: "Timestamp", Value: updated},
+		}},
+	}
+}
+
+// exportAll returns the documents of every collection of a store
+func exportAll(t *testing.T, store Store) map[string][]bson.Raw {
+	t.Helper()
+	docs := make(map[string][]bson.Raw)
+	for _, collection := range Collections {
+		err := store.ExportCollection(collection, func(doc bson.Raw) error {
+			docs[collection] = append(docs[collection], doc)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return docs
+}
+
+func TestMigrateRoundTripsMongoDocuments(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, store *EmbeddedStore) {
+		source := NewMemoryStore()
+		t.Cleanup(func() { source.Close() })
+		for collection, docs := range mongoDocuments() {
+			raw := make([]bson.Raw, len(docs))
+			for i, doc := range docs {
+				data, err := bson.Marshal(doc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw[i] = data
+			}
+			if err := source.ImportCollection(collection, raw); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		counts, err := Migrate(source, store, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[reactiveEntitiesCollection] != 1 || counts[entityEventsCollection] != 1 {
+			t.Fatalf("counts %v, want one entity and one event", counts)
+		}
+		if _, err := Migrate(source, store, false); !errors.Is(err, ErrTargetNotEmpty) {
+			t.Fatalf("error %v migrating into a store with data, want ErrTargetNotEmpty", err)
+		}
+
+		// The documents are read by the queries of the engine
+		entity, err := store.GetReactiveEntityByHex(0x1a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		definition, err := store.GetDefinitionByID(entity.Definition)
+		if err != nil || definition.Name != "Switch" || entity.Data.CurrentState != 1 || entity.Location.Name != "hall" {
+			t.Fatalf("entity %+v of definition %+v (%v)", entity, definition, err)
+		}
+		if entities, err := store.GetReactiveEntitiesByGroup([]string{"switches"}); err != nil || len(entities) != 1 {
+			t.Fatalf("%d entities in the group (%v), want 1", len(entities), err)
+		}
+		events, err := store.GetEntityEventsByHex("0x1a", time.Time{}, time.Now(), 0)
+		if err != nil || len(events) != 1 || events[0].Source != models.SourceREST {
+			t.Fatalf("events %+v (%v), want the imported one", events, err)
+		}
+
+		// And migrate back unchanged
+		back := NewMemoryStore()
+		t.Cleanup(func() { back.Close() })
+		if _, err := Migrate(store, back, false); err != nil {
+			t.Fatal(err)
+		}
+		want, got := exportAll(t, source), exportAll(t, back)
+		for _, collection := range Collections {
+			if len(got[collection]) != len(want[collection]) {
+				t.Fatalf("%d documents in %s after the round trip, want %d", len(got[collection]), collection, len(want[collection]))
+			}
+			for i := range want[collection] {
+				if !bytes.Equal(got[collection][i], want[collection][i]) {
+					t.Errorf("%s document changed by the round trip:\n got %s\nwant %s", collection, got[collection][i], want[collection][i])
+				}
+			}
+		}
+	})
+}
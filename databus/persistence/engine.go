@@ -0,0 +1,125 @@
+// engine.go
+package persistence
+
+import (
+	"sort"
+	"sync"
+)
+
+/*
+The embedded backends keep every collection as a set of BSON documents by key, in a file (bbolt, SQLite) or in
+memory. EmbeddedStore implements the queries on top of an engine; every write it makes, e.g. a state update
+checking the current state first, runs in a single engine transaction.
+*/
+type engine interface {
+	// view runs fn in a read-only transaction
+	view(fn func(tx engineTx) error) error
+	// update runs fn in a read-write transaction, committed only when fn returns nil
+	update(fn func(tx engineTx) error) error
+	close() error
+}
+
+/* A transaction of an engine. Documents passed to each are only valid during the call. */
+type engineTx interface {
+	// get returns nil when the document does not exist
+	get(collection string, key string) ([]byte, error)
+	put(collection string, key string, doc []byte) error
+	delete(collection string, key string) error
+	// each calls fn with every document of a collection, in key order
+	each(collection string, fn func(key string, doc []byte) error) error
+	clear(collection string) error
+}
+
+/* An engine keeping the collections in process memory. Transactions copy the collections they write. */
+type memoryEngine struct {
+	mu          sync.RWMutex
+	collections map[string]map[string][]byte
+}
+
+type memoryTx struct {
+	engine *memoryEngine
+	dirty  map[string]map[string][]byte
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{collections: make(map[string]map[string][]byte)}
+}
+
+func (e *memoryEngine) view(fn func(tx engineTx) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return fn(&memoryTx{engine: e})
+}
+
+func (e *memoryEngine) update(fn func(tx engineTx) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tx := &memoryTx{engine: e, dirty: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for name, docs := range tx.dirty {
+		e.collections[name] = docs
+	}
+	return nil
+}
+
+func (e *memoryEngine) close() error {
+	return nil
+}
+
+func (tx *memoryTx) collection(name string) map[string][]byte {
+	if docs, ok := tx.dirty[name]; ok {
+		return docs
+	}
+	return tx.engine.collections[name]
+}
+
+// writable returns the copy of a collection the transaction writes to
+func (tx *memoryTx) writable(name string) map[string][]byte {
+	if docs, ok := tx.dirty[name]; ok {
+		return docs
+	}
+	docs := make(map[string][]byte, len(tx.engine.collections[name]))
+	for key, doc := range tx.engine.collections[name] {
+		docs[key] = doc
+	}
+	tx.dirty[name] = docs
+	return docs
+}
+
+func (tx *memoryTx) get(collection string, key string) ([]byte, error) {
+	return tx.collection(collection)[key], nil
+}
+
+func (tx *memoryTx) put(collection string, key string, doc []byte) error {
+	tx.writable(collection)[key] = append([]byte(nil), doc...)
+	return nil
+}
+
+func (tx *memoryTx) delete(collection string, key string) error {
+	delete(tx.writable(collection), key)
+	return nil
+}
+
+func (tx *memoryTx) each(collection string, fn func(key string, doc []byte) error) error {
+	docs := tx.collection(collection)
+	keys := make([]string, 0, len(docs))
+	for key := range docs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(key, docs[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) clear(collection string) error {
+	tx.dirty[collection] = make(map[string][]byte)
+	return nil
+}
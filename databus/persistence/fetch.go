@@ -4,10 +4,13 @@ package persistence
 import (
 	"databus/models"
 	"context"
+	"errors"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Assuming these are the collection names you are using:
@@ -15,14 +18,17 @@ const (
 	definitionsCollection     = "Definitions"
 	groupsCollection          = "Groups"
 	reactiveEntitiesCollection = "ReactiveEntities"
+	entityEventsCollection     = "EntityEvents"
+	rulesCollection            = "Rules"
+	schedulesCollection        = "Schedules"
 )
 
 // GetAllDefinitions retrieves all models from the MongoDB collection "Models".
-func GetAllDefinitions() ([]models.DefinitionRaw, error) {
+func (s *MongoStore) GetAllDefinitions() ([]models.DefinitionRaw, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(definitionsCollection)
+	collection := s.database().Collection(definitionsCollection)
 	cursor, err := collection.Find(ctx, bson.D{})
 	if err != nil {
 		return nil, err
@@ -37,11 +43,11 @@ func GetAllDefinitions() ([]models.DefinitionRaw, error) {
 }
 
 // GetDefinitionByID retrieves a single model by its ID from the MongoDB collection "Definitions".
-func GetDefinitionByID(id primitive.ObjectID) (*models.DefinitionRaw, error) {
+func (s *MongoStore) GetDefinitionByID(id primitive.ObjectID) (*models.DefinitionRaw, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(definitionsCollection)
+	collection := s.database().Collection(definitionsCollection)
 	var result models.DefinitionRaw
 	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&result)
 	if err != nil {
@@ -51,11 +57,11 @@ func GetDefinitionByID(id primitive.ObjectID) (*models.DefinitionRaw, error) {
 }
 
 // GetDefinitionByName retrieves a single model by its name from the MongoDB collection "Definitions".
-func GetDefinitionByName(name string) (*models.DefinitionRaw, error) {
+func (s *MongoStore) GetDefinitionByName(name string) (*models.DefinitionRaw, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(definitionsCollection)
+	collection := s.database().Collection(definitionsCollection)
 	var result models.DefinitionRaw
 	err := collection.FindOne(ctx, bson.M{"Name": name}).Decode(&result)
 	if err != nil {
@@ -65,12 +71,12 @@ func GetDefinitionByName(name string) (*models.DefinitionRaw, error) {
 }
 
 // GetAllGroups retrieves all groups from the MongoDB collection "Groups".
-func GetAllGroups() ([]models.GroupRaw, error) {
+func (s *MongoStore) GetAllGroups() ([]models.GroupRaw, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(groupsCollection)
+	collection := s.database().Collection(groupsCollection)
 	cursor, err := collection.Find(ctx, bson.D{})
 	if err != nil {
 		return nil, err
@@ -85,11 +91,11 @@ func GetAllGroups() ([]models.GroupRaw, error) {
 }
 
 // GetGroupByID retrieves a group by its ID from the MongoDB collection "Groups".
-func GetGroupByID(id primitive.ObjectID) (*models.GroupRaw, error) {
+func (s *MongoStore) GetGroupByID(id primitive.ObjectID) (*models.GroupRaw, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(groupsCollection)
+	collection := s.database().Collection(groupsCollection)
 	var result models.GroupRaw
 	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&result)
 	if err != nil {
@@ -99,11 +105,11 @@ func GetGroupByID(id primitive.ObjectID) (*models.GroupRaw, error) {
 }
 
 // GetGroupByName retrieves a group by its name from the MongoDB collection "Groups".
-func GetGroupByName(name string) (*models.GroupRaw, error) {
+func (s *MongoStore) GetGroupByName(name string) (*models.GroupRaw, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(groupsCollection)
+	collection := s.database().Collection(groupsCollection)
 	var result models.GroupRaw
 	err := collection.FindOne(ctx, bson.M{"Name": name}).Decode(&result)
 	if err != nil {
@@ -113,12 +119,12 @@ func GetGroupByName(name string) (*models.GroupRaw, error) {
 }
 
 // GetAllReactiveEntities retrieves all reactive entities from the MongoDB collection "ReactiveEntities".
-func GetAllReactiveEntities() ([]models.ReactiveEntityRaw, error) {
+func (s *MongoStore) GetAllReactiveEntities() ([]models.ReactiveEntityRaw, error) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(reactiveEntitiesCollection)
+	collection := s.database().Collection(reactiveEntitiesCollection)
 	cursor, err := collection.Find(ctx, bson.D{})
 	if err != nil {
 		return nil, err
@@ -133,11 +139,11 @@ func GetAllReactiveEntities() ([]models.ReactiveEntityRaw, error) {
 }
 
 // GetReactiveEntityByID retrieves a reactive entity by its ID from the MongoDB collection "ReactiveEntities".
-func GetReactiveEntityByID(id primitive.ObjectID) (*models.ReactiveEntityRaw, error) {
+func (s *MongoStore) GetReactiveEntityByID(id primitive.ObjectID) (*models.ReactiveEntityRaw, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(reactiveEntitiesCollection)
+	collection := s.database().Collection(reactiveEntitiesCollection)
 	var result models.ReactiveEntityRaw
 	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&result)
 	if err != nil {
@@ -146,13 +152,13 @@ func GetReactiveEntityByID(id primitive.ObjectID) (*models.ReactiveEntityRaw, er
 	return &result, nil
 }
 
-func GetReactiveEntityByHex(hex uint16) (*models.ReactiveEntityRaw, error) {
+func (s *MongoStore) GetReactiveEntityByHex(hex uint16) (*models.ReactiveEntityRaw, error) {
 	// retrieves a reactive entity by its hex ID from the MongoDB collection "ReactiveEntities".
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(reactiveEntitiesCollection)
+	collection := s.database().Collection(reactiveEntitiesCollection)
 	var result models.ReactiveEntityRaw
 	err := collection.FindOne(ctx, bson.M{"EntityHex": hex}).Decode(&result)
 	if err != nil {
@@ -161,7 +167,7 @@ func GetReactiveEntityByHex(hex uint16) (*models.ReactiveEntityRaw, error) {
 	return &result, nil
 }
 
-func GetReactiveEntitiesByGroup(groupsParam []string) ([]models.ReactiveEntityRaw, error) {
+func (s *MongoStore) GetReactiveEntitiesByGroup(groupsParam []string) ([]models.ReactiveEntityRaw, error) {
 	// GetReactiveEntitiesByGroup retrieves all reactive entities that belong to the specified group(s).
 	// groupsParam is a list of group names.
 
@@ -169,7 +175,7 @@ func GetReactiveEntitiesByGroup(groupsParam []string) ([]models.ReactiveEntityRa
 	defer cancel()
 
 	// Step 1: Retrieve group IDs corresponding to the provided group names
-	groupCollection := MongoClient.Database("databus").Collection("Groups")
+	groupCollection := s.database().Collection("Groups")
 	groupCursor, err := groupCollection.Find(ctx, bson.M{"Name": bson.M{"$in": groupsParam}})
 	if err != nil {
 		return nil, err
@@ -187,7 +193,7 @@ func GetReactiveEntitiesByGroup(groupsParam []string) ([]models.ReactiveEntityRa
 	}
 
 	// Step 2: Query the reactive entities collection to find entities that belong to any of the retrieved group IDs
-	reactiveEntityCollection := MongoClient.Database("databus").Collection("ReactiveEntities")
+	reactiveEntityCollection := s.database().Collection("ReactiveEntities")
 	reactiveEntityCursor, err := reactiveEntityCollection.Find(ctx, bson.M{"Groups": bson.M{"$all": groupIDs}})
 	if err != nil {
 		return nil, err
@@ -201,15 +207,107 @@ func GetReactiveEntitiesByGroup(groupsParam []string) ([]models.ReactiveEntityRa
 	return results, nil
 }
 
-// DeleteReactiveEntityByHex deletes a reactive entity by its hex ID
-func DeleteReactiveEntityByHex(hex uint16) (int64, error) {
+// GetOutOfSyncReactiveEntities retrieves all reactive entities whose reported state differs from the desired (current) state,
+// and those with reported attribute values (which the caller compares to the desired ones, see DataObj.InSync)
+func (s *MongoStore) GetOutOfSyncReactiveEntities() ([]models.ReactiveEntityRaw, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	collection := MongoClient.Database("databus").Collection(reactiveEntitiesCollection)
-	result, err := collection.DeleteOne(ctx, bson.M{"EntityHex": hex})
+	collection := s.database().Collection(reactiveEntitiesCollection)
+	filter := bson.M{"$or": bson.A{
+		bson.M{
+			"Data.ReportedState": bson.M{"$exists": true},
+			"$expr":              bson.M{"$ne": bson.A{"$Data.CurrentState", "$Data.ReportedState"}},
+		},
+		bson.M{"Data.ReportedAttributes": bson.M{"$exists": true}},
+	}}
+	cursor, err := collection.Find(ctx, filter)
 	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []models.ReactiveEntityRaw
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// DeleteReactiveEntityByHex deletes a reactive entity by its hex ID
+func (s *MongoStore) DeleteReactiveEntityByHex(hex uint16, event EventFunc) (int64, error) {
+	_, err := s.withOutbox(5*time.Second, event, func(ctx context.Context) (*models.ReactiveEntityRaw, error) {
+		var deleted models.ReactiveEntityRaw
+		err := s.database().Collection(reactiveEntitiesCollection).FindOneAndDelete(ctx, bson.M{"EntityHex": hex}).Decode(&deleted)
+		if err != nil {
+			return nil, err
+		}
+		return &deleted, nil
+	})
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	} else if err != nil {
 		return 0, err
 	}
-	return result.DeletedCount, nil
+	return 1, nil
+}
+
+// GetEntityEventsByHex retrieves the recorded events of a single entity (e.g. "0x1a"), newest first.
+// Zero from/to times leave that side of the time range open.
+func (s *MongoStore) GetEntityEventsByHex(entityHex string, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error) {
+	return s.findEntityEvents(bson.M{"EntityHex": entityHex}, from, to, limit)
+}
+
+// GetEntityEventsByGroup retrieves the recorded events of every entity that belonged to the group at the time, newest first
+func (s *MongoStore) GetEntityEventsByGroup(groupName string, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error) {
+	return s.findEntityEvents(bson.M{"Groups": groupName}, from, to, limit)
+}
+
+func (s *MongoStore) findEntityEvents(filter bson.M, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	timeRange := bson.M{}
+	if !from.IsZero() {
+		timeRange["$gte"] = from
+	}
+	if !to.IsZero() {
+		timeRange["$lte"] = to
+	}
+	if len(timeRange) > 0 {
+		filter["Timestamp"] = timeRange
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "Timestamp", Value: -1}}).SetLimit(limit)
+
+	collection := s.database().Collection(entityEventsCollection)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	results := make([]models.EntityEvent, 0)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// CountReactiveEntitiesByDefinition counts the reactive entities using a definition
+func (s *MongoStore) CountReactiveEntitiesByDefinition(id primitive.ObjectID) (int64, error) {
+	return s.countReactiveEntities(bson.M{"Definition": id})
+}
+
+// CountReactiveEntitiesByGroup counts the reactive entities belonging to a group
+func (s *MongoStore) CountReactiveEntitiesByGroup(id primitive.ObjectID) (int64, error) {
+	return s.countReactiveEntities(bson.M{"Groups": id})
+}
+
+func (s *MongoStore) countReactiveEntities(filter bson.M) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(reactiveEntitiesCollection)
+	return collection.CountDocuments(ctx, filter)
 }
@@ -13,132 +13,77 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func InsertDefinitions(client *mongo.Client, definitions []models.DefinitionRaw) (*mongo.InsertManyResult, error) {
+// InsertReactiveEntities replaces the whole ReactiveEntities collection (fresh start from an incoming file)
+// and populates the IDs of the inserted entities
+func (s *MongoStore) InsertReactiveEntities(reactiveEntities []models.ReactiveEntityRaw) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	definitionCollection := MongoClient.Database("databus").Collection("Definitions")
+	reactiveEntityCollection := s.database().Collection("ReactiveEntities")
 
-	// Drop the collection (fresh start from incoming file)
-	err := definitionCollection.Drop(ctx)
-	if err != nil {
-		log.Println("Error dropping dataObjectCollection:", err)
-	}
-
-	definitionInterface := make([]interface{}, len(definitions))
-	for i, def := range definitions {
-		definitionInterface[i] = def
-	}
-	// Insert definitions into the collection
-	result, err := definitionCollection.InsertMany(ctx, definitionInterface)
-	if err != nil {
-		return nil, fmt.Errorf("error inserting definitions: %v", err)
-	}
-
-	// Iterate through the inserted IDs and populate ModelIdMap
-	for i, id := range result.InsertedIDs {
-		objectID, ok := id.(primitive.ObjectID)
-		if !ok {
-			return nil, fmt.Errorf("unexpected ID type for definition at index %d", i)
-		}
-
-		definitions[i].ID = objectID
-	}
-
-	return result, nil
-}
-
-func InsertGroups(client *mongo.Client, groups []models.GroupRaw) (*mongo.InsertManyResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	groupCollection := MongoClient.Database("databus").Collection("Groups")
-
-	// Drop the collection (fresh start from incoming file)
-	err := groupCollection.Drop(ctx)
-	if err != nil {
-		log.Println("Error dropping dataObjectCollection:", err)
-	}
-
-	groupInterfaces := make([]interface{}, len(groups))
-	for i, group := range groups {
-		groupInterfaces[i] = group
-	}
-	result, err := groupCollection.InsertMany(ctx, groupInterfaces)
-
-	if err != nil {
-		log.Fatal("Error inserting sample data:", err)
-	}
-
-	// Iterate through the inserted IDs and populate ModelIdMap
-	for i, id := range result.InsertedIDs {
-		objectID, ok := id.(primitive.ObjectID)
-		if !ok {
-			return nil, fmt.Errorf("unexpected ID type for definition at index %d", i)
-		}
-
-		groups[i].ID = objectID
-	}
-
-	return result, nil
-}
-
-func InsertReactiveEntities(client *mongo.Client, reactiveEntities []models.ReactiveEntityRaw) (*mongo.InsertManyResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	reactiveEntityCollection := MongoClient.Database("databus").Collection("ReactiveEntities")
-
-	// Drop the collection (fresh start from incoming file)
+	// Drop the collection (fresh start from incoming file), with its indexes
 	err := reactiveEntityCollection.Drop(ctx)
 	if err != nil {
 		log.Println("Error dropping reactiveEntityCollection:", err)
 	}
+	if err := s.ensureIndexes(reactiveEntitiesCollection); err != nil {
+		return err
+	}
+	if len(reactiveEntities) == 0 {
+		return nil
+	}
 
 	reactiveEntityInterfaces := make([]interface{}, len(reactiveEntities))
 	for i, reactiveEntity := range reactiveEntities {
 		reactiveEntityInterfaces[i] = reactiveEntity
 	}
 	result, err := reactiveEntityCollection.InsertMany(ctx, reactiveEntityInterfaces)
-
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateEntityHex
+	}
 	if err != nil {
-		log.Fatal("Error inserting reactive entities:", err)
+		return fmt.Errorf("error inserting reactive entities: %v", err)
 	}
 
 	// Iterate through the inserted IDs and populate IDs
 	for i, id := range result.InsertedIDs {
 		objectID, ok := id.(primitive.ObjectID)
 		if !ok {
-			return nil, fmt.Errorf("unexpected ID type for reactive entity at index %d", i)
+			return fmt.Errorf("unexpected ID type for reactive entity at index %d", i)
 		}
 
 		reactiveEntities[i].ID = objectID
 	}
-	return result, nil
+	return nil
 }
 
-// InsertReactiveEntity inserts a single reactive entity into the database (used by API)
-func InsertReactiveEntity(reactiveEntity *models.ReactiveEntityRaw) (*mongo.InsertOneResult, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	reactiveEntityCollection := MongoClient.Database("databus").Collection("ReactiveEntities")
-
-	result, err := reactiveEntityCollection.InsertOne(ctx, reactiveEntity)
-	if err != nil {
-		return nil, fmt.Errorf("error inserting reactive entity: %v", err)
+// InsertReactiveEntity inserts a single reactive entity into the database (used by API) and sets its ID
+func (s *MongoStore) InsertReactiveEntity(reactiveEntity *models.ReactiveEntityRaw, event EventFunc) error {
+	// The ID is set before inserting, a retried transaction must insert the same entity
+	if reactiveEntity.ID.IsZero() {
+		reactiveEntity.ID = primitive.NewObjectID()
 	}
 
-	// Update the ID field with the inserted ID
-	if insertedID, ok := result.InsertedID.(primitive.ObjectID); ok {
-		reactiveEntity.ID = insertedID
-	}
+	_, err := s.withOutbox(5*time.Second, event, func(ctx context.Context) (*models.ReactiveEntityRaw, error) {
+		reactiveEntityCollection := s.database().Collection("ReactiveEntities")
 
-	return result, nil
+		if _, err := reactiveEntityCollection.InsertOne(ctx, reactiveEntity); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				return nil, ErrDuplicateEntityHex
+			}
+			return nil, fmt.Errorf("error inserting reactive entity: %v", err)
+		}
+		return reactiveEntity, nil
+	})
+	return err
 }
 
-func GetGroupIDMap(ctx context.Context, client *mongo.Client) (map[string]primitive.ObjectID, error) {
-	groupCollection := client.Database("databus").Collection("groups")
+// GetGroupIDMap maps the name of every group to its ID
+func (s *MongoStore) GetGroupIDMap() (map[string]primitive.ObjectID, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	groupCollection := s.database().Collection(groupsCollection)
 
 	cursor, err := groupCollection.Find(ctx, bson.M{})
 	if err != nil {
@@ -157,3 +102,29 @@ func GetGroupIDMap(ctx context.Context, client *mongo.Client) (map[string]primit
 
 	return groupNameToID, nil
 }
+
+// InsertDefinition inserts a definition and sets its ID
+func (s *MongoStore) InsertDefinition(definition *models.DefinitionRaw) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := s.database().Collection(definitionsCollection).InsertOne(ctx, definition)
+	if err != nil {
+		return err
+	}
+	definition.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// InsertGroup inserts a group and sets its ID
+func (s *MongoStore) InsertGroup(group *models.GroupRaw) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := s.database().Collection(groupsCollection).InsertOne(ctx, group)
+	if err != nil {
+		return err
+	}
+	group.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
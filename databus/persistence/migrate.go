@@ -0,0 +1,65 @@
+// migrate.go
+package persistence
+
+import (
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Collections lists every collection a Store keeps, in the order they are migrated
+var Collections = []string{
+	definitionsCollection,
+	groupsCollection,
+	reactiveEntitiesCollection,
+	entityEventsCollection,
+	outboxCollection,
+	rulesCollection,
+	schedulesCollection,
+	webhooksCollection,
+	webhookDeliveriesCollection,
+	webhookDeadLettersCollection,
+	webhookRetriesCollection,
+}
+
+// ErrTargetNotEmpty is returned when a migration would overwrite data without being allowed to
+var ErrTargetNotEmpty = errors.New("target store is not empty")
+
+// Migrate copies every collection from one store to another, documents keep their IDs so references between them
+// stay valid. The collections of the target are replaced; unless overwrite is set, a target holding any document
+// is refused before anything is written. The number of documents copied per collection is returned.
+func Migrate(from Store, to Store, overwrite bool) (map[string]int, error) {
+	if !overwrite {
+		for _, collection := range Collections {
+			empty := true
+			err := to.ExportCollection(collection, func(doc bson.Raw) error {
+				empty = false
+				return errStop
+			})
+			if err != nil && !errors.Is(err, errStop) {
+				return nil, err
+			}
+			if !empty {
+				return nil, fmt.Errorf("%w: %s has documents", ErrTargetNotEmpty, collection)
+			}
+		}
+	}
+
+	counts := make(map[string]int, len(Collections))
+	for _, collection := range Collections {
+		var docs []bson.Raw
+		err := from.ExportCollection(collection, func(doc bson.Raw) error {
+			docs = append(docs, doc)
+			return nil
+		})
+		if err != nil {
+			return counts, fmt.Errorf("error reading %s: %v", collection, err)
+		}
+		if err := to.ImportCollection(collection, docs); err != nil {
+			return counts, fmt.Errorf("error writing %s: %v", collection, err)
+		}
+		counts[collection] = len(docs)
+	}
+	return counts, nil
+}
@@ -3,46 +3,170 @@ package persistence
 import (
 	"context"
 	"fmt"
-	"log"
-	"os"
 	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var MongoClient *mongo.Client
+/* The Store backed by the "databus" MongoDB database */
+type MongoStore struct {
+	client *mongo.Client
+	// transactions is set when the deployment supports multi-document transactions (not a standalone server)
+	transactions bool
+}
 
-func Connect() {
-	// Set up MongoDB connection
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// NewMongoStore returns a Store using an open MongoDB connection
+func NewMongoStore(client *mongo.Client) *MongoStore {
+	s := &MongoStore{client: client}
+	s.transactions = s.supportsTransactions()
+	return s
+}
+
+// supportsTransactions reports whether the server is a member of a replica set or a mongos router
+func (s *MongoStore) supportsTransactions() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	mongoURI := os.Getenv("MONGODB_URI")
-	if mongoURI == "" {
-		mongoURI = "mongodb://localhost:27017"
+	var hello bson.M
+	if err := s.client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&hello); err != nil {
+		return false
 	}
+	_, replicaSet := hello["setName"]
+	return replicaSet || hello["msg"] == "isdbgrid"
+}
 
-	var err error
-	clientOptions := options.Client().ApplyURI(mongoURI)
-	MongoClient, err = mongo.Connect(ctx, clientOptions)
+func (s *MongoStore) database() *mongo.Database {
+	return s.client.Database("databus")
+}
+
+// ConnectMongo opens a MongoDB connection, checks it with a ping and returns the store using it
+func ConnectMongo(mongoURI string) (*MongoStore, error) {
+	// Set up MongoDB connection
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
 	if err != nil {
-		log.Fatal("Error connecting to MongoDB:", err)
+		return nil, fmt.Errorf("error connecting to MongoDB: %v", err)
 	}
 	// Ping the database
-	err = MongoClient.Ping(ctx, nil)
-	if err != nil {
-		log.Fatal("Error pinging MongoDB:", err)
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("error pinging MongoDB: %v", err)
 	}
 	fmt.Println("Connected to MongoDB!")
+
+	store := NewMongoStore(client)
+	if err := store.ensureIndexes(Collections...); err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("error creating MongoDB indexes: %v", err)
+	}
+	return store, nil
+}
+
+// indexes are the indexes of the queries run on every event, probe or tick, by collection. Without them those
+// queries scan collections that only grow, like the EntityEvents history.
+var indexes = map[string][]mongo.IndexModel{
+	// Also the only guard against two entities with the same hex, see ErrDuplicateEntityHex
+	reactiveEntitiesCollection: {
+		{Keys: bson.D{{Key: "EntityHex", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	entityEventsCollection: {
+		{Keys: bson.D{{Key: "EntityHex", Value: 1}, {Key: "Timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "Groups", Value: 1}, {Key: "Timestamp", Value: -1}}},
+		{Keys: bson.D{{Key: "Timestamp", Value: -1}}},
+	},
+	// Pending entries have no DeliveredAt, they are read oldest (_id) first
+	outboxCollection: {
+		{Keys: bson.D{{Key: "DeliveredAt", Value: 1}, {Key: "_id", Value: 1}}},
+	},
+	schedulesCollection: {
+		{Keys: bson.D{{Key: "NextRun", Value: 1}}},
+		{Keys: bson.D{{Key: "ClaimExpiresAt", Value: 1}}},
+	},
+	webhookRetriesCollection: {
+		{Keys: bson.D{{Key: "NextAttemptAt", Value: 1}}},
+	},
+}
+
+// ensureIndexes creates the indexes of the given collections, existing ones are left as they are
+func (s *MongoStore) ensureIndexes(collections ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	for _, collection := range collections {
+		collectionIndexes := indexes[collection]
+		if len(collectionIndexes) == 0 {
+			continue
+		}
+		if _, err := s.database().Collection(collection).Indexes().CreateMany(ctx, collectionIndexes); err != nil {
+			return fmt.Errorf("%s: %w", collection, err)
+		}
+	}
+	return nil
+}
+
+// Ping checks that the MongoDB server answers
+func (s *MongoStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return s.client.Ping(ctx, nil)
+}
+
+// AtomicOutbox reports whether the deployment supports multi-document transactions
+func (s *MongoStore) AtomicOutbox() bool {
+	return s.transactions
 }
 
-func Disconnect() {
+// Close disconnects from MongoDB
+func (s *MongoStore) Close() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	err := MongoClient.Disconnect(ctx)
+	return s.client.Disconnect(ctx)
+}
+
+// ExportCollection calls fn with every document of a collection
+func (s *MongoStore) ExportCollection(collection string, fn func(doc bson.Raw) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	cursor, err := s.database().Collection(collection).Find(ctx, bson.D{})
 	if err != nil {
-		log.Fatal("Error disconnecting from MongoDB:", err)
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		if err := fn(append(bson.Raw{}, cursor.Current...)); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// ImportCollection replaces the documents of a collection
+func (s *MongoStore) ImportCollection(collection string, docs []bson.Raw) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	// Dropping the collection drops its indexes, they are created again before the documents are inserted
+	coll := s.database().Collection(collection)
+	if err := coll.Drop(ctx); err != nil {
+		return err
+	}
+	if err := s.ensureIndexes(collection); err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+
+	batch := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		batch[i] = doc
 	}
-	fmt.Println("Disconnected from MongoDB!")
+	_, err := coll.InsertMany(ctx, batch)
+	return err
 }
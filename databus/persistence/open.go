@@ -0,0 +1,48 @@
+// open.go
+package persistence
+
+import (
+	"fmt"
+	"os"
+)
+
+/* Storage backends selectable with STORAGE_BACKEND */
+const (
+	BackendMongo  = "mongo"
+	BackendBolt   = "bolt"
+	BackendSQLite = "sqlite"
+	BackendMemory = "memory"
+)
+
+// Open opens the storage backend selected by STORAGE_BACKEND (mongo, bolt or sqlite, default mongo).
+// MongoDB is reached through MONGODB_URI, the embedded backends keep their file at STORAGE_PATH.
+func Open() (Store, error) {
+	return OpenBackend(os.Getenv("STORAGE_BACKEND"), os.Getenv("STORAGE_PATH"))
+}
+
+// OpenBackend opens a storage backend by name. path is the file of the embedded backends,
+// an empty path uses databus.db (bolt) or databus.sqlite (sqlite) in the working directory.
+func OpenBackend(backend string, path string) (Store, error) {
+	switch backend {
+	case "", BackendMongo:
+		mongoURI := os.Getenv("MONGODB_URI")
+		if mongoURI == "" {
+			mongoURI = "mongodb://localhost:27017"
+		}
+		return ConnectMongo(mongoURI)
+	case BackendBolt:
+		if path == "" {
+			path = "databus.db"
+		}
+		return OpenBolt(path)
+	case BackendSQLite:
+		if path == "" {
+			path = "databus.sqlite"
+		}
+		return OpenSQLite(path)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q (mongo, bolt or sqlite)", backend)
+	}
+}
@@ -0,0 +1,173 @@
+// outbox.go
+package persistence
+
+import (
+	"context"
+	"databus/models"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const outboxCollection = "Outbox"
+
+/*
+EventFunc builds the event of a change to a reactive entity, from the entity the write returns (as it was before
+the change for the state, reported state and attribute updates, after the change for UpdateReactiveEntityMetadata,
+the inserted or deleted entity). The event is added to the Outbox and to the EntityEvents history in the same
+transaction as the change; a nil EventFunc or a nil event adds nothing. It may be called more than once when a transaction is retried, the last
+call describes the committed change.
+*/
+type EventFunc func(entity *models.ReactiveEntityRaw) *models.EntityEvent
+
+/* The new state of one entity of UpdateReactiveEntityStates, only applied while the entity is in ExpectedState when set */
+type StateChange struct {
+	EntityHex     uint16
+	ExpectedState *int
+	State         int
+}
+
+/* The attribute values of one entity of UpdateReactiveEntitiesAttributes, other attributes keep their value */
+type AttributeChange struct {
+	EntityHex uint16
+	Values    map[string]interface{}
+}
+
+// withOutbox runs a write of a reactive entity and adds the event built from its result to the Outbox and the
+// history, in one transaction when the deployment supports them (replica sets, sharded clusters). A standalone
+// server has no multi-document transactions, the event is then added right after the write.
+func (s *MongoStore) withOutbox(timeout time.Duration, event EventFunc, write func(ctx context.Context) (*models.ReactiveEntityRaw, error)) (*models.ReactiveEntityRaw, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	run := func(ctx context.Context) (*models.ReactiveEntityRaw, error) {
+		entity, err := write(ctx)
+		if err != nil || event == nil {
+			return entity, err
+		}
+		if e := event(entity); e != nil {
+			if err := s.recordEvent(ctx, e); err != nil {
+				return nil, err
+			}
+		}
+		return entity, nil
+	}
+	if event == nil || !s.transactions {
+		return run(ctx)
+	}
+
+	var result *models.ReactiveEntityRaw
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = run(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// inTransaction runs fn in a multi-document transaction, which is retried on transient errors
+func (s *MongoStore) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// recordEvent adds an event to the Outbox, to be published, and to the EntityEvents history
+func (s *MongoStore) recordEvent(ctx context.Context, event *models.EntityEvent) error {
+	entry, err := newOutboxEntry(event)
+	if err != nil {
+		return err
+	}
+	if _, err := s.database().Collection(outboxCollection).InsertOne(ctx, entry); err != nil {
+		return fmt.Errorf("error inserting outbox entry: %v", err)
+	}
+	if _, err := s.database().Collection(entityEventsCollection).InsertOne(ctx, event); err != nil {
+		return fmt.Errorf("error inserting entity event: %v", err)
+	}
+	return nil
+}
+
+func newOutboxEntry(event *models.EntityEvent) (*models.OutboxEntry, error) {
+	id, err := primitive.ObjectIDFromHex(event.ID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event ID %q: %v", event.ID, err)
+	}
+	return &models.OutboxEntry{ID: id, Event: *event, CreatedAt: time.Now().UTC()}, nil
+}
+
+// GetPendingOutboxEntries returns the entries not delivered yet, oldest first
+func (s *MongoStore) GetPendingOutboxEntries(limit int64) ([]models.OutboxEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(limit)
+	cursor, err := s.database().Collection(outboxCollection).Find(ctx, bson.M{"DeliveredAt": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []models.OutboxEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// CountPendingOutboxEntries returns how many entries are not delivered yet
+func (s *MongoStore) CountPendingOutboxEntries() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.database().Collection(outboxCollection).CountDocuments(ctx, bson.M{"DeliveredAt": bson.M{"$exists": false}})
+}
+
+// MarkOutboxEntryDelivered records that the event of an entry was published
+func (s *MongoStore) MarkOutboxEntryDelivered(id primitive.ObjectID, deliveredAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.database().Collection(outboxCollection).UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"DeliveredAt": deliveredAt}, "$inc": bson.M{"Attempts": 1}, "$unset": bson.M{"LastError": ""}},
+	)
+	return err
+}
+
+// SetOutboxEntryError records a failed attempt to publish the event of an entry
+func (s *MongoStore) SetOutboxEntryError(id primitive.ObjectID, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.database().Collection(outboxCollection).UpdateOne(ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"LastError": message}, "$inc": bson.M{"Attempts": 1}},
+	)
+	return err
+}
+
+// DeleteDeliveredOutboxEntries removes the entries delivered before the given time
+func (s *MongoStore) DeleteDeliveredOutboxEntries(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	result, err := s.database().Collection(outboxCollection).DeleteMany(ctx, bson.M{"DeliveredAt": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
@@ -0,0 +1,303 @@
+// reconcile.go
+package persistence
+
+import (
+	"databus/models"
+	"databus/utils"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Reconciliation upserts definitions and groups by Name instead of dropping and re-inserting them,
+so their ObjectIDs stay stable across restarts and the references held by reactive entities stay valid.
+
+Removing a definition or group that is still referenced by reactive entities is refused unless force is set, and
+so is a change that would strand them: a definition dropping a state they are in or changing the type of an attribute
+they hold a value for, a group no longer allowing the definition of one of its members. A dry run plans the changes and reports the diff (or the refusal) without writing anything.
+*/
+
+// ErrStillReferenced is returned when reconciliation would remove a definition or group that reactive entities still use
+var ErrStillReferenced = errors.New("still referenced by reactive entities")
+
+// ReconcileDefinitions makes the Definitions collection match the given definitions, keeping the IDs of existing ones.
+// The ID of every given definition is set on return.
+func ReconcileDefinitions(store Store, definitions []models.DefinitionRaw, force bool, dryRun bool) (models.ConfigDiff, error) {
+	diff := models.ConfigDiff{}
+
+	existing, err := store.GetAllDefinitions()
+	if err != nil {
+		return diff, err
+	}
+	existingByName := make(map[string]models.DefinitionRaw)
+	for _, def := range existing {
+		existingByName[def.Name] = def
+	}
+
+	// Plan the changes first, so nothing is written when a removal or change is refused
+	incoming := make(map[string]struct{})
+	var entities []models.ReactiveEntityRaw
+	for i := range definitions {
+		incoming[definitions[i].Name] = struct{}{}
+		if current, exists := existingByName[definitions[i].Name]; exists {
+			definitions[i].ID = current.ID
+			if current.Description != definitions[i].Description ||
+				!equalSlices(current.States, definitions[i].States) ||
+				!equalDeep(current.Attributes, definitions[i].Attributes) ||
+				!equalDeep(current.Transitions, definitions[i].Transitions) {
+				diff.Changed = append(diff.Changed, definitions[i].Name)
+
+				if entities == nil {
+					if entities, err = store.GetAllReactiveEntities(); err != nil {
+						return diff, err
+					}
+				}
+				if problems := strandedByDefinition(entities, &current, &definitions[i]); len(problems) > 0 {
+					if !force {
+						return diff, fmt.Errorf("refusing to change definition '%s', %w: %s", current.Name, ErrStillReferenced, strings.Join(problems, ", "))
+					}
+					if !dryRun {
+						log.Printf("Force changing definition '%s': %s", current.Name, strings.Join(problems, ", "))
+					}
+				}
+			}
+		} else {
+			diff.Added = append(diff.Added, definitions[i].Name)
+		}
+	}
+
+	var removedIDs []primitive.ObjectID
+	for _, def := range existing {
+		if _, kept := incoming[def.Name]; kept {
+			continue
+		}
+		refs, err := store.CountReactiveEntitiesByDefinition(def.ID)
+		if err != nil {
+			return diff, err
+		}
+		if refs > 0 {
+			if !force {
+				return diff, fmt.Errorf("refusing to remove definition '%s', %w (%d)", def.Name, ErrStillReferenced, refs)
+			}
+			if !dryRun {
+				log.Printf("Force removing definition '%s' referenced by %d reactive entities", def.Name, refs)
+			}
+		}
+		diff.Removed = append(diff.Removed, def.Name)
+		removedIDs = append(removedIDs, def.ID)
+	}
+
+	if dryRun {
+		return diff, nil
+	}
+
+	// Apply
+	for i := range definitions {
+		if definitions[i].ID.IsZero() {
+			if err := store.InsertDefinition(&definitions[i]); err != nil {
+				return diff, fmt.Errorf("error inserting definition '%s': %v", definitions[i].Name, err)
+			}
+		} else if utils.Contains(diff.Changed, definitions[i].Name) {
+			if err := store.ReplaceDefinition(&definitions[i]); err != nil {
+				return diff, fmt.Errorf("error updating definition '%s': %v", definitions[i].Name, err)
+			}
+		}
+	}
+	if len(removedIDs) > 0 {
+		if err := store.DeleteDefinitions(removedIDs); err != nil {
+			return diff, fmt.Errorf("error removing definitions '%s': %v", strings.Join(diff.Removed, "', '"), err)
+		}
+	}
+
+	return diff, nil
+}
+
+// ReconcileGroups makes the Groups collection match the given groups, keeping the IDs of existing ones.
+// The ID of every given group is set on return.
+func ReconcileGroups(store Store, groups []models.GroupRaw, force bool, dryRun bool) (models.ConfigDiff, error) {
+	diff := models.ConfigDiff{}
+
+	existing, err := store.GetAllGroups()
+	if err != nil {
+		return diff, err
+	}
+	existingByName := make(map[string]models.GroupRaw)
+	for _, group := range existing {
+		existingByName[group.Name] = group
+	}
+
+	// Plan the changes first, so nothing is written when a removal or change is refused
+	incoming := make(map[string]struct{})
+	for i := range groups {
+		incoming[groups[i].Name] = struct{}{}
+		if current, exists := existingByName[groups[i].Name]; exists {
+			groups[i].ID = current.ID
+			if current.Description != groups[i].Description || !equalSlices(current.AllowedDefinitions, groups[i].AllowedDefinitions) {
+				diff.Changed = append(diff.Changed, groups[i].Name)
+
+				if problems, err := strandedByGroup(store, &current, &groups[i]); err != nil {
+					return diff, err
+				} else if len(problems) > 0 {
+					if !force {
+						return diff, fmt.Errorf("refusing to change group '%s', %w: %s", current.Name, ErrStillReferenced, strings.Join(problems, ", "))
+					}
+					if !dryRun {
+						log.Printf("Force changing group '%s': %s", current.Name, strings.Join(problems, ", "))
+					}
+				}
+			}
+		} else {
+			diff.Added = append(diff.Added, groups[i].Name)
+		}
+	}
+
+	var removedIDs []primitive.ObjectID
+	for _, group := range existing {
+		if _, kept := incoming[group.Name]; kept {
+			continue
+		}
+		refs, err := store.CountReactiveEntitiesByGroup(group.ID)
+		if err != nil {
+			return diff, err
+		}
+		if refs > 0 {
+			if !force {
+				return diff, fmt.Errorf("refusing to remove group '%s', %w (%d)", group.Name, ErrStillReferenced, refs)
+			}
+			if !dryRun {
+				log.Printf("Force removing group '%s' referenced by %d reactive entities", group.Name, refs)
+			}
+		}
+		diff.Removed = append(diff.Removed, group.Name)
+		removedIDs = append(removedIDs, group.ID)
+	}
+
+	if dryRun {
+		return diff, nil
+	}
+
+	// Apply
+	for i := range groups {
+		if groups[i].ID.IsZero() {
+			if err := store.InsertGroup(&groups[i]); err != nil {
+				return diff, fmt.Errorf("error inserting group '%s': %v", groups[i].Name, err)
+			}
+		} else if utils.Contains(diff.Changed, groups[i].Name) {
+			if err := store.ReplaceGroup(&groups[i]); err != nil {
+				return diff, fmt.Errorf("error updating group '%s': %v", groups[i].Name, err)
+			}
+		}
+	}
+	if len(removedIDs) > 0 {
+		if err := store.DeleteGroups(removedIDs); err != nil {
+			return diff, fmt.Errorf("error removing groups '%s': %v", strings.Join(diff.Removed, "', '"), err)
+		}
+	}
+
+	return diff, nil
+}
+
+// strandedByDefinition lists the reactive entities of a definition a change would strand: in (or reporting) a state
+// the updated definition drops, or holding a value for an attribute whose type changes
+func strandedByDefinition(entities []models.ReactiveEntityRaw, current *models.DefinitionRaw, updated *models.DefinitionRaw) []string {
+	dropped := make(map[int]string)
+	for _, state := range current.States {
+		if _, kept := updated.FindStateByHex(state.Hex); !kept {
+			dropped[int(state.Hex)] = state.Label
+		}
+	}
+	retyped := make(map[string]bool)
+	for _, attr := range current.Attributes {
+		for _, next := range updated.Attributes {
+			if next.Name == attr.Name && next.Type != attr.Type {
+				retyped[attr.Name] = true
+			}
+		}
+	}
+	if len(dropped) == 0 && len(retyped) == 0 {
+		return nil
+	}
+
+	var problems []string
+	for _, entity := range entities {
+		if entity.Definition != current.ID {
+			continue
+		}
+		hex := utils.FormatHex(entity.EntityHex)
+		if label, ok := dropped[entity.Data.CurrentState]; ok {
+			problems = append(problems, fmt.Sprintf("entity %s is in state '%s'", hex, label))
+		}
+		if reported := entity.Data.ReportedState; reported != nil && *reported != entity.Data.CurrentState {
+			if label, ok := dropped[*reported]; ok {
+				problems = append(problems, fmt.Sprintf("entity %s reports state '%s'", hex, label))
+			}
+		}
+		for attr := range entity.Data.Attributes {
+			if retyped[attr] {
+				problems = append(problems, fmt.Sprintf("entity %s holds a value for attribute '%s'", hex, attr))
+			}
+		}
+		for attr := range entity.Data.ReportedAttributes {
+			if retyped[attr] && entity.Data.Attributes[attr] == nil {
+				problems = append(problems, fmt.Sprintf("entity %s reports a value for attribute '%s'", hex, attr))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// strandedByGroup lists the members of a group whose definition the updated group no longer allows. Members are
+// only loaded when the change drops an allowed definition and the group has any.
+func strandedByGroup(store Store, current *models.GroupRaw, updated *models.GroupRaw) ([]string, error) {
+	dropped := false
+	for _, id := range current.AllowedDefinitions {
+		if !utils.Contains(updated.AllowedDefinitions, id) {
+			dropped = true
+		}
+	}
+	if !dropped {
+		return nil, nil
+	}
+	if members, err := store.CountReactiveEntitiesByGroup(current.ID); err != nil || members == 0 {
+		return nil, err
+	}
+
+	entities, err := store.GetAllReactiveEntities()
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, entity := range entities {
+		if utils.Contains(entity.Groups, current.ID) && !utils.Contains(updated.AllowedDefinitions, entity.Definition) {
+			problems = append(problems, fmt.Sprintf("the definition of entity %s is no longer allowed", utils.FormatHex(entity.EntityHex)))
+		}
+	}
+	sort.Strings(problems)
+	return problems, nil
+}
+
+func equalSlices[T comparable](a []T, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalDeep[T any](a []T, b []T) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
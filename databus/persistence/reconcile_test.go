@@ -0,0 +1,84 @@
+package persistence
+
+import (
+	"databus/models"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReconcileRefusesADefinitionChangeStrandingEntities(t *testing.T) {
+	store := NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	dimmer := models.DefinitionRaw{
+		Name:       "Dimmer",
+		States:     []models.StateRaw{{Hex: 0x00, Label: "off"}, {Hex: 0x01, Label: "on"}},
+		Attributes: []models.AttributeDef{{Name: "brightness", Type: models.AttributeInteger}},
+	}
+	if err := store.InsertDefinition(&dimmer); err != nil {
+		t.Fatal(err)
+	}
+	entity := models.ReactiveEntityRaw{EntityHex: 0x01, Definition: dimmer.ID, Groups: []primitive.ObjectID{}}
+	entity.Data.CurrentState = 0x01
+	entity.Data.Attributes = map[string]interface{}{"brightness": 40}
+	if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{entity}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, change := range []models.DefinitionRaw{
+		{Name: "Dimmer", States: []models.StateRaw{{Hex: 0x00, Label: "off"}}, Attributes: dimmer.Attributes},
+		{Name: "Dimmer", States: dimmer.States, Attributes: []models.AttributeDef{{Name: "brightness", Type: models.AttributeString}}},
+	} {
+		if _, err := ReconcileDefinitions(store, []models.DefinitionRaw{change}, false, false); !errors.Is(err, ErrStillReferenced) {
+			t.Fatalf("error %v, want ErrStillReferenced", err)
+		}
+	}
+	stored, err := store.GetDefinitionByName("Dimmer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.States) != 2 || stored.Attributes[0].Type != models.AttributeInteger {
+		t.Fatalf("definition %+v changed by a refused reconciliation", stored)
+	}
+
+	// Unused states can go, and the change can be forced
+	unused := models.DefinitionRaw{Name: "Dimmer", States: []models.StateRaw{{Hex: 0x01, Label: "on"}}, Attributes: dimmer.Attributes}
+	if _, err := ReconcileDefinitions(store, []models.DefinitionRaw{unused}, false, false); err != nil {
+		t.Fatal(err)
+	}
+	forced := models.DefinitionRaw{Name: "Dimmer", States: []models.StateRaw{{Hex: 0x02, Label: "dim"}}}
+	if _, err := ReconcileDefinitions(store, []models.DefinitionRaw{forced}, true, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconcileRefusesAGroupDisallowingTheDefinitionOfAMember(t *testing.T) {
+	store := NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	switchDef, valve := models.DefinitionRaw{Name: "Switch"}, models.DefinitionRaw{Name: "Valve"}
+	for _, def := range []*models.DefinitionRaw{&switchDef, &valve} {
+		if err := store.InsertDefinition(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	group := models.GroupRaw{Name: "mixed", AllowedDefinitions: []primitive.ObjectID{switchDef.ID, valve.ID}}
+	if err := store.InsertGroup(&group); err != nil {
+		t.Fatal(err)
+	}
+	entity := models.ReactiveEntityRaw{EntityHex: 0x01, Definition: switchDef.ID, Groups: []primitive.ObjectID{group.ID}}
+	if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{entity}); err != nil {
+		t.Fatal(err)
+	}
+
+	narrowed := models.GroupRaw{Name: "mixed", AllowedDefinitions: []primitive.ObjectID{valve.ID}}
+	if _, err := ReconcileGroups(store, []models.GroupRaw{narrowed}, false, false); !errors.Is(err, ErrStillReferenced) {
+		t.Fatalf("error %v, want ErrStillReferenced", err)
+	}
+	narrowed.AllowedDefinitions = []primitive.ObjectID{switchDef.ID}
+	if _, err := ReconcileGroups(store, []models.GroupRaw{narrowed}, false, false); err != nil {
+		t.Fatal(err)
+	}
+}
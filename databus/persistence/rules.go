@@ -0,0 +1,183 @@
+// rules.go
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"databus/models"
+	"databus/utils"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Rules live in the Rules collection. Rules from rules.json (Origin "document") are reconciled by Name like
+definitions and groups, rules created through the API (Origin "api") are never touched by reconciliation.
+*/
+
+// ErrRuleNameTaken is returned when a rule name is already used by a rule of the other origin
+var ErrRuleNameTaken = errors.New("rule name already taken")
+
+// GetAllRules retrieves every rule, from rules.json and the API
+func (s *MongoStore) GetAllRules() ([]models.Rule, error) {
+	return s.findRules(bson.M{})
+}
+
+// GetRulesByOrigin retrieves the rules managed by rules.json (models.RuleOriginDocument) or the API (models.RuleOriginAPI)
+func (s *MongoStore) GetRulesByOrigin(origin string) ([]models.Rule, error) {
+	return s.findRules(bson.M{"Origin": origin})
+}
+
+// GetRuleByName retrieves a single rule by its name
+func (s *MongoStore) GetRuleByName(name string) (*models.Rule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(rulesCollection)
+	var result models.Rule
+	err := collection.FindOne(ctx, bson.M{"Name": name}).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// InsertRule inserts a rule and sets its ID
+func (s *MongoStore) InsertRule(rule *models.Rule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(rulesCollection)
+	result, err := collection.InsertOne(ctx, rule)
+	if err != nil {
+		return err
+	}
+	rule.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ReplaceRule replaces the rule with the given ID
+func (s *MongoStore) ReplaceRule(rule *models.Rule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(rulesCollection)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": rule.ID}, rule)
+	return err
+}
+
+// DeleteRule removes the rule with the given ID
+func (s *MongoStore) DeleteRule(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(rulesCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// DeleteRules removes the rules with the given IDs
+func (s *MongoStore) DeleteRules(ids []primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(rulesCollection)
+	_, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// ReconcileRules makes the rules from rules.json in the Rules collection match the given rules, keeping the IDs
+// of existing ones. The ID of every given rule is set on return.
+func ReconcileRules(store Store, rules []models.Rule, dryRun bool) (models.ConfigDiff, error) {
+	diff := models.ConfigDiff{}
+
+	existing, err := store.GetAllRules()
+	if err != nil {
+		return diff, err
+	}
+	existingByName := make(map[string]models.Rule)
+	for _, rule := range existing {
+		existingByName[rule.Name] = rule
+	}
+
+	// Plan the changes first, so nothing is written when a name is taken
+	incoming := make(map[string]struct{})
+	for i := range rules {
+		rules[i].Origin = models.RuleOriginDocument
+		incoming[rules[i].Name] = struct{}{}
+		if current, exists := existingByName[rules[i].Name]; exists {
+			if current.Origin != models.RuleOriginDocument {
+				return diff, fmt.Errorf("rule '%s' of rules.json: %w by an API rule", rules[i].Name, ErrRuleNameTaken)
+			}
+			rules[i].ID = current.ID
+			if !equalRules(current, rules[i]) {
+				diff.Changed = append(diff.Changed, rules[i].Name)
+			}
+		} else {
+			diff.Added = append(diff.Added, rules[i].Name)
+		}
+	}
+
+	var removedIDs []primitive.ObjectID
+	for _, rule := range existing {
+		if _, kept := incoming[rule.Name]; kept || rule.Origin != models.RuleOriginDocument {
+			continue
+		}
+		diff.Removed = append(diff.Removed, rule.Name)
+		removedIDs = append(removedIDs, rule.ID)
+	}
+
+	if dryRun {
+		return diff, nil
+	}
+
+	// Apply
+	for i := range rules {
+		if rules[i].ID.IsZero() {
+			if err := store.InsertRule(&rules[i]); err != nil {
+				return diff, fmt.Errorf("error inserting rule '%s': %v", rules[i].Name, err)
+			}
+		} else if utils.Contains(diff.Changed, rules[i].Name) {
+			if err := store.ReplaceRule(&rules[i]); err != nil {
+				return diff, fmt.Errorf("error updating rule '%s': %v", rules[i].Name, err)
+			}
+		}
+	}
+	if len(removedIDs) > 0 {
+		if err := store.DeleteRules(removedIDs); err != nil {
+			return diff, fmt.Errorf("error removing rules '%s': %v", strings.Join(diff.Removed, "', '"), err)
+		}
+	}
+
+	return diff, nil
+}
+
+func (s *MongoStore) findRules(filter bson.M) ([]models.Rule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(rulesCollection)
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []models.Rule
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// equalRules compares rules in their stored form, so empty and missing lists are the same
+func equalRules(a models.Rule, b models.Rule) bool {
+	encodedA, errA := bson.Marshal(a)
+	encodedB, errB := bson.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
@@ -0,0 +1,170 @@
+// schedules.go
+package persistence
+
+import (
+	"context"
+	"databus/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GetAllSchedules retrieves every schedule
+func (s *MongoStore) GetAllSchedules() ([]models.Schedule, error) {
+	return s.findSchedules(bson.M{}, nil)
+}
+
+// GetDueSchedules retrieves the enabled schedules whose next run is at or before now, earliest first
+func (s *MongoStore) GetDueSchedules(now time.Time) ([]models.Schedule, error) {
+	filter := bson.M{
+		"Disabled": bson.M{"$ne": true},
+		"NextRun":  bson.M{"$lte": now},
+	}
+	return s.findSchedules(filter, options.Find().SetSort(bson.D{{Key: "NextRun", Value: 1}}))
+}
+
+// GetScheduleByName retrieves a single schedule by its name
+func (s *MongoStore) GetScheduleByName(name string) (*models.Schedule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(schedulesCollection)
+	var result models.Schedule
+	err := collection.FindOne(ctx, bson.M{"Name": name}).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// InsertSchedule inserts a schedule and sets its ID
+func (s *MongoStore) InsertSchedule(schedule *models.Schedule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(schedulesCollection)
+	result, err := collection.InsertOne(ctx, schedule)
+	if err != nil {
+		return err
+	}
+	schedule.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ReplaceSchedule replaces the schedule with the given ID
+func (s *MongoStore) ReplaceSchedule(schedule *models.Schedule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(schedulesCollection)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": schedule.ID}, schedule)
+	return err
+}
+
+// DeleteSchedule removes the schedule with the given ID
+func (s *MongoStore) DeleteSchedule(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(schedulesCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// ClaimScheduleRun atomically moves a schedule from its due run to the next one (nil for none), and reports whether
+// this caller won the run. Only one caller (or process) can claim a run, so it is never executed twice. The run
+// stays claimed until CompleteScheduleRun, or until expiresAt when it is interrupted.
+func (s *MongoStore) ClaimScheduleRun(id primitive.ObjectID, due time.Time, next *time.Time, claimedAt time.Time, expiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	set := bson.M{"LastRun": claimedAt, "ClaimedRun": due, "ClaimExpiresAt": expiresAt}
+	update := bson.M{"$set": set}
+	if next != nil {
+		set["NextRun"] = *next
+	} else {
+		update["$unset"] = bson.M{"NextRun": ""}
+	}
+
+	collection := s.database().Collection(schedulesCollection)
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id, "NextRun": due}, update)
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// SkipScheduleRun atomically moves a schedule from a missed run to the next one (nil for none) without running it
+func (s *MongoStore) SkipScheduleRun(id primitive.ObjectID, due time.Time, next *time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$unset": bson.M{"NextRun": ""}}
+	if next != nil {
+		update = bson.M{"$set": bson.M{"NextRun": *next}}
+	}
+
+	collection := s.database().Collection(schedulesCollection)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id, "NextRun": due}, update)
+	return err
+}
+
+// GetExpiredScheduleClaims retrieves the schedules whose claimed run expired before it completed, oldest first
+func (s *MongoStore) GetExpiredScheduleClaims(now time.Time) ([]models.Schedule, error) {
+	filter := bson.M{"ClaimExpiresAt": bson.M{"$lte": now}}
+	return s.findSchedules(filter, options.Find().SetSort(bson.D{{Key: "ClaimExpiresAt", Value: 1}}))
+}
+
+// RenewScheduleClaim atomically extends a claim while it still expires at expiresAt, and reports whether this caller
+// won it. The running process keeps its claim this way, and only one caller can take over an interrupted run.
+func (s *MongoStore) RenewScheduleClaim(id primitive.ObjectID, run time.Time, expiresAt time.Time, newExpiresAt time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(schedulesCollection)
+	filter := bson.M{"_id": id, "ClaimedRun": run, "ClaimExpiresAt": expiresAt}
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"ClaimExpiresAt": newExpiresAt}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// CompleteScheduleRun releases the claim of a run once it executed and records its error (empty when it
+// succeeded). A claim replaced by a later run is left alone, that run reports its own result.
+func (s *MongoStore) CompleteScheduleRun(id primitive.ObjectID, run time.Time, message string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	unset := bson.M{"ClaimedRun": "", "ClaimExpiresAt": ""}
+	update := bson.M{"$unset": unset}
+	if message != "" {
+		update["$set"] = bson.M{"LastError": message}
+	} else {
+		unset["LastError"] = ""
+	}
+
+	collection := s.database().Collection(schedulesCollection)
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id, "ClaimedRun": run}, update)
+	return err
+}
+
+func (s *MongoStore) findSchedules(filter bson.M, opts *options.FindOptions) ([]models.Schedule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(schedulesCollection)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []models.Schedule
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,115 @@
+// sqlite.go
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+/*
+An engine keeping every document as a row (collection, key, doc) of a single SQLite table.
+The driver is pure Go, so the application still builds with CGO_ENABLED=0. A single connection is used:
+transactions are serialized, like the writers of bbolt.
+*/
+type sqliteEngine struct {
+	db *sql.DB
+}
+
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+// OpenSQLite opens (or creates) the SQLite database at path
+func OpenSQLite(path string) (*EmbeddedStore, error) {
+	dsn := "file:" + (&url.URL{Path: path}).EscapedPath() + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS documents (
+		collection TEXT NOT NULL,
+		key        TEXT NOT NULL,
+		doc        BLOB NOT NULL,
+		PRIMARY KEY (collection, key)
+	) WITHOUT ROWID`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &EmbeddedStore{engine: &sqliteEngine{db: db}}, nil
+}
+
+func (e *sqliteEngine) view(fn func(tx engineTx) error) error {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(&sqliteTx{tx: tx})
+}
+
+func (e *sqliteEngine) update(fn func(tx engineTx) error) error {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(&sqliteTx{tx: tx}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (e *sqliteEngine) close() error {
+	return e.db.Close()
+}
+
+func (tx *sqliteTx) get(collection string, key string) ([]byte, error) {
+	var doc []byte
+	err := tx.tx.QueryRow(`SELECT doc FROM documents WHERE collection = ? AND key = ?`, collection, key).Scan(&doc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return doc, err
+}
+
+func (tx *sqliteTx) put(collection string, key string, doc []byte) error {
+	_, err := tx.tx.Exec(`INSERT INTO documents (collection, key, doc) VALUES (?, ?, ?)
+		ON CONFLICT (collection, key) DO UPDATE SET doc = excluded.doc`, collection, key, doc)
+	return err
+}
+
+func (tx *sqliteTx) delete(collection string, key string) error {
+	_, err := tx.tx.Exec(`DELETE FROM documents WHERE collection = ? AND key = ?`, collection, key)
+	return err
+}
+
+func (tx *sqliteTx) each(collection string, fn func(key string, doc []byte) error) error {
+	rows, err := tx.tx.Query(`SELECT key, doc FROM documents WHERE collection = ? ORDER BY key`, collection)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var doc []byte
+		if err := rows.Scan(&key, &doc); err != nil {
+			return err
+		}
+		if err := fn(key, doc); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (tx *sqliteTx) clear(collection string) error {
+	_, err := tx.tx.Exec(`DELETE FROM documents WHERE collection = ?`, collection)
+	return err
+}
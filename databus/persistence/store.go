@@ -0,0 +1,129 @@
+// store.go
+package persistence
+
+import (
+	"databus/models"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+A Store keeps everything the application persists: definitions, groups, reactive entities and their event history,
+rules, schedules and webhooks.
+
+MongoStore keeps them in MongoDB. EmbeddedStore keeps them in a file next to the application (bbolt or SQLite,
+for edge deployments without a database server) or in process memory (NewMemoryStore, e.g. to run the handlers
+with httptest). The backend is selected with STORAGE_BACKEND, see Open.
+
+The store is opened in main and handed to every part of the application that needs it: the HTTP handlers
+(handlers.App), the services, the rules engine, the scheduler, the webhook dispatcher and the outbox dispatcher.
+*/
+type Store interface {
+	// Definitions and groups
+	GetAllDefinitions() ([]models.DefinitionRaw, error)
+	GetDefinitionByID(id primitive.ObjectID) (*models.DefinitionRaw, error)
+	GetDefinitionByName(name string) (*models.DefinitionRaw, error)
+	InsertDefinition(definition *models.DefinitionRaw) error
+	ReplaceDefinition(definition *models.DefinitionRaw) error
+	DeleteDefinitions(ids []primitive.ObjectID) error
+
+	GetAllGroups() ([]models.GroupRaw, error)
+	GetGroupByID(id primitive.ObjectID) (*models.GroupRaw, error)
+	GetGroupByName(name string) (*models.GroupRaw, error)
+	GetGroupIDMap() (map[string]primitive.ObjectID, error)
+	InsertGroup(group *models.GroupRaw) error
+	ReplaceGroup(group *models.GroupRaw) error
+	DeleteGroups(ids []primitive.ObjectID) error
+
+	// Reactive entities
+	GetAllReactiveEntities() ([]models.ReactiveEntityRaw, error)
+	GetReactiveEntityByID(id primitive.ObjectID) (*models.ReactiveEntityRaw, error)
+	GetReactiveEntityByHex(hex uint16) (*models.ReactiveEntityRaw, error)
+	GetReactiveEntitiesByGroup(groupsParam []string) ([]models.ReactiveEntityRaw, error)
+	GetOutOfSyncReactiveEntities() ([]models.ReactiveEntityRaw, error)
+	CountReactiveEntitiesByDefinition(id primitive.ObjectID) (int64, error)
+	CountReactiveEntitiesByGroup(id primitive.ObjectID) (int64, error)
+	InsertReactiveEntities(reactiveEntities []models.ReactiveEntityRaw) error
+	InsertReactiveEntity(reactiveEntity *models.ReactiveEntityRaw, event EventFunc) error
+	DeleteReactiveEntityByHex(hex uint16, event EventFunc) (int64, error)
+
+	UpdateReactiveEntityState(hex uint16, state int, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error)
+	UpdateReactiveEntityStateFrom(hex uint16, expectedState int, state int, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error)
+	UpdateReactiveEntityReportedState(hex uint16, state int, reportedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error)
+	UpdateReactiveEntityAttributes(hex uint16, values map[string]interface{}, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error)
+	UpdateReactiveEntityReportedAttributes(hex uint16, values map[string]interface{}, reportedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error)
+	UpdateReactiveEntityMetadata(hex uint16, expectedState int, entity *models.ReactiveEntityRaw, event EventFunc) (*models.ReactiveEntityRaw, error)
+	UpdateReactiveEntityStates(changes []StateChange, updatedAt time.Time, event EventFunc) ([]models.ReactiveEntityRaw, error)
+	UpdateReactiveEntitiesAttributes(changes []AttributeChange, updatedAt time.Time, event EventFunc) ([]models.ReactiveEntityRaw, error)
+	SetReactiveEntitySecret(hex uint16, secretHash string) error
+
+	// Outbox of the events to publish on MQTT
+	GetPendingOutboxEntries(limit int64) ([]models.OutboxEntry, error)
+	CountPendingOutboxEntries() (int64, error)
+	MarkOutboxEntryDelivered(id primitive.ObjectID, deliveredAt time.Time) error
+	SetOutboxEntryError(id primitive.ObjectID, message string) error
+	DeleteDeliveredOutboxEntries(before time.Time) (int64, error)
+
+	// Event history, recorded with the outbox entries
+	GetEntityEventsByHex(entityHex string, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error)
+	GetEntityEventsByGroup(groupName string, from time.Time, to time.Time, limit int64) ([]models.EntityEvent, error)
+
+	// Rules
+	GetAllRules() ([]models.Rule, error)
+	GetRulesByOrigin(origin string) ([]models.Rule, error)
+	GetRuleByName(name string) (*models.Rule, error)
+	InsertRule(rule *models.Rule) error
+	ReplaceRule(rule *models.Rule) error
+	DeleteRule(id primitive.ObjectID) error
+	DeleteRules(ids []primitive.ObjectID) error
+
+	// Schedules
+	GetAllSchedules() ([]models.Schedule, error)
+	GetDueSchedules(now time.Time) ([]models.Schedule, error)
+	GetScheduleByName(name string) (*models.Schedule, error)
+	InsertSchedule(schedule *models.Schedule) error
+	ReplaceSchedule(schedule *models.Schedule) error
+	DeleteSchedule(id primitive.ObjectID) error
+	ClaimScheduleRun(id primitive.ObjectID, due time.Time, next *time.Time, claimedAt time.Time, expiresAt time.Time) (bool, error)
+	SkipScheduleRun(id primitive.ObjectID, due time.Time, next *time.Time) error
+	GetExpiredScheduleClaims(now time.Time) ([]models.Schedule, error)
+	RenewScheduleClaim(id primitive.ObjectID, run time.Time, expiresAt time.Time, newExpiresAt time.Time) (bool, error)
+	CompleteScheduleRun(id primitive.ObjectID, run time.Time, message string) error
+
+	// Webhooks
+	GetAllWebhooks() ([]models.WebhookSubscription, error)
+	GetWebhookByName(name string) (*models.WebhookSubscription, error)
+	InsertWebhook(webhook *models.WebhookSubscription) error
+	ReplaceWebhook(webhook *models.WebhookSubscription) error
+	DeleteWebhook(id primitive.ObjectID) error
+	InsertWebhookDelivery(delivery *models.WebhookDelivery) error
+	GetWebhookDeliveries(subscription string, limit int64) ([]models.WebhookDelivery, error)
+	InsertWebhookDeadLetter(deadLetter *models.WebhookDeadLetter) error
+	GetWebhookDeadLetters(subscription string, limit int64) ([]models.WebhookDeadLetter, error)
+	SaveWebhookRetry(retry *models.WebhookRetry) error
+	GetDueWebhookRetries(now time.Time, limit int64) ([]models.WebhookRetry, error)
+	DeleteWebhookRetry(id primitive.ObjectID) error
+
+	// Migration between backends: every document of a collection, as stored
+	ExportCollection(collection string, fn func(doc bson.Raw) error) error
+	ImportCollection(collection string, docs []bson.Raw) error
+
+	// Ping checks that the storage answers, for the readiness probe
+	Ping() error
+	// AtomicOutbox reports whether entity changes and their outbox events are committed in one transaction.
+	// Only a standalone MongoDB server lacks them: a crash between the two writes then loses the event.
+	AtomicOutbox() bool
+	Close() error
+}
+
+// ErrNotFound is returned by every Store when a document does not exist. Callers check errors.Is(err, ErrNotFound),
+// only the persistence package knows it is mongo.ErrNoDocuments.
+var ErrNotFound = mongo.ErrNoDocuments
+
+// ErrDuplicateEntityHex is returned when a write would give a reactive entity the EntityHex of another one. MongoStore
+// enforces it with a unique index, EmbeddedStore in the write transaction, so concurrent writes cannot both succeed.
+var ErrDuplicateEntityHex = errors.New("duplicate EntityHex")
@@ -0,0 +1,56 @@
+package persistence
+
+import (
+	"databus/models"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestGroupAttributeUpdateIsAllOrNothing(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, store *EmbeddedStore) {
+		entities := []models.ReactiveEntityRaw{
+			{EntityHex: 0x01, Groups: []primitive.ObjectID{}},
+			{EntityHex: 0x02, Groups: []primitive.ObjectID{}},
+		}
+		if err := store.InsertReactiveEntities(entities); err != nil {
+			t.Fatal(err)
+		}
+		event := func(entity *models.ReactiveEntityRaw) *models.EntityEvent {
+			return &models.EntityEvent{ID: primitive.NewObjectID().Hex(), EntityHex: "x"}
+		}
+
+		// 0x03 does not exist, 0x01 is left alone
+		changes := []AttributeChange{
+			{EntityHex: 0x01, Values: map[string]interface{}{"brightness": int64(40)}},
+			{EntityHex: 0x03, Values: map[string]interface{}{"brightness": int64(40)}},
+		}
+		if _, err := store.UpdateReactiveEntitiesAttributes(changes, time.Now().UTC(), event); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("error %v, want ErrNotFound", err)
+		}
+		entity, err := store.GetReactiveEntityByHex(0x01)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entity.Data.Attributes) != 0 || entity.Data.AttributesUpdated != nil {
+			t.Fatalf("entity 0x01 %+v updated by a failed group update", entity.Data)
+		}
+		if pending, _ := store.CountPendingOutboxEntries(); pending != 0 {
+			t.Fatalf("%d outbox entries left by a failed group update", pending)
+		}
+
+		changes[1].EntityHex = 0x02
+		previous, err := store.UpdateReactiveEntitiesAttributes(changes, time.Now().UTC(), event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(previous) != 2 || len(previous[0].Data.Attributes) != 0 {
+			t.Fatalf("previous entities %+v, want both without attributes", previous)
+		}
+		if pending, _ := store.CountPendingOutboxEntries(); pending != 2 {
+			t.Fatalf("%d outbox entries, want 2", pending)
+		}
+	})
+}
@@ -1,2 +1,317 @@
 // update.go
 package persistence
+
+import (
+	"context"
+	"databus/models"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UpdateReactiveEntityState atomically sets Data.CurrentState and Data.LastUpdated of a reactive entity.
+// The entity is returned as it was before the update so callers can see the previous state.
+func (s *MongoStore) UpdateReactiveEntityState(hex uint16, state int, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	update := bson.M{"$set": bson.M{
+		"Data.CurrentState": state,
+		"Data.LastUpdated":  updatedAt,
+	}}
+	return s.findOneAndUpdateEntity(bson.M{"EntityHex": hex}, update, options.Before, event)
+}
+
+// UpdateReactiveEntityStateFrom is UpdateReactiveEntityState, but only applied while the entity is still in expectedState.
+// mongo.ErrNoDocuments is returned when the entity does not exist or its state changed in the meantime.
+func (s *MongoStore) UpdateReactiveEntityStateFrom(hex uint16, expectedState int, state int, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	filter := bson.M{"EntityHex": hex, "Data.CurrentState": expectedState}
+	update := bson.M{"$set": bson.M{
+		"Data.CurrentState": state,
+		"Data.LastUpdated":  updatedAt,
+	}}
+	return s.findOneAndUpdateEntity(filter, update, options.Before, event)
+}
+
+// UpdateReactiveEntityStates sets the state of several reactive entities (e.g. a group) at once, with the event of
+// each entity written to the Outbox. Either every change is applied or none is: mongo.ErrNoDocuments is returned
+// when an entity does not exist or is no longer in its expected state. The entities are returned as they were
+// before the update, in the order of the changes.
+//
+// Without transactions (a standalone server) the changes are applied one by one, and those already applied are
+// reverted, with their outbox entries and history, when a later one fails.
+func (s *MongoStore) UpdateReactiveEntityStates(changes []StateChange, updatedAt time.Time, event EventFunc) ([]models.ReactiveEntityRaw, error) {
+	writes := make([]entityWrite, len(changes))
+	for i, change := range changes {
+		filter := bson.M{"EntityHex": change.EntityHex}
+		if change.ExpectedState != nil {
+			filter["Data.CurrentState"] = *change.ExpectedState
+		}
+		writes[i] = entityWrite{hex: change.EntityHex, filter: filter, update: bson.M{"$set": bson.M{
+			"Data.CurrentState": change.State,
+			"Data.LastUpdated":  updatedAt,
+		}}}
+	}
+
+	// An entity changed again in the meantime is left alone
+	revert := func(i int, entity *models.ReactiveEntityRaw) (bson.M, bson.M) {
+		filter := bson.M{"EntityHex": entity.EntityHex, "Data.CurrentState": changes[i].State, "Data.LastUpdated": updatedAt}
+		return filter, bson.M{"$set": bson.M{
+			"Data.CurrentState": entity.Data.CurrentState,
+			"Data.LastUpdated":  entity.Data.LastUpdated,
+		}}
+	}
+	return s.updateEntities(writes, event, revert)
+}
+
+// UpdateReactiveEntitiesAttributes sets attribute values of several reactive entities (e.g. a group) at once, like
+// UpdateReactiveEntityStates: either every change is applied with its event or none is, mongo.ErrNoDocuments is
+// returned when an entity does not exist. The entities are returned as they were before the update.
+func (s *MongoStore) UpdateReactiveEntitiesAttributes(changes []AttributeChange, updatedAt time.Time, event EventFunc) ([]models.ReactiveEntityRaw, error) {
+	writes := make([]entityWrite, len(changes))
+	for i, change := range changes {
+		set := bson.M{"Data.AttributesUpdated": updatedAt}
+		for name, value := range change.Values {
+			set["Data.Attributes."+name] = value
+		}
+		writes[i] = entityWrite{hex: change.EntityHex, filter: bson.M{"EntityHex": change.EntityHex}, update: bson.M{"$set": set}}
+	}
+
+	// The values are put back (or removed when the entity had none), unless the entity was updated again
+	revert := func(i int, entity *models.ReactiveEntityRaw) (bson.M, bson.M) {
+		set, unset := bson.M{}, bson.M{}
+		for name := range changes[i].Values {
+			if value, ok := entity.Data.Attributes[name]; ok {
+				set["Data.Attributes."+name] = value
+			} else {
+				unset["Data.Attributes."+name] = ""
+			}
+		}
+		if entity.Data.AttributesUpdated != nil {
+			set["Data.AttributesUpdated"] = *entity.Data.AttributesUpdated
+		} else {
+			unset["Data.AttributesUpdated"] = ""
+		}
+		update := bson.M{}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if len(unset) > 0 {
+			update["$unset"] = unset
+		}
+		return bson.M{"EntityHex": entity.EntityHex, "Data.AttributesUpdated": updatedAt}, update
+	}
+	return s.updateEntities(writes, event, revert)
+}
+
+/* One write of updateEntities: the filter selecting a reactive entity and the update applied to it */
+type entityWrite struct {
+	hex    uint16
+	filter bson.M
+	update bson.M
+}
+
+// updateEntities applies writes to several reactive entities, with their events, in one transaction. Without
+// transactions the writes already applied when one fails are undone with the filter and update revert returns
+// for the entity as it was before write i, and their outbox entries and history are removed.
+func (s *MongoStore) updateEntities(writes []entityWrite, event EventFunc, revert func(i int, entity *models.ReactiveEntityRaw) (bson.M, bson.M)) ([]models.ReactiveEntityRaw, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var previous []models.ReactiveEntityRaw
+	var eventIDs []primitive.ObjectID
+	apply := func(ctx context.Context) error {
+		// A retried transaction starts over
+		previous, eventIDs = previous[:0], eventIDs[:0]
+		for _, write := range writes {
+			var entity models.ReactiveEntityRaw
+			if err := s.database().Collection(reactiveEntitiesCollection).FindOneAndUpdate(ctx, write.filter, write.update).Decode(&entity); err != nil {
+				return fmt.Errorf("entity %#02x: %w", write.hex, err)
+			}
+			previous = append(previous, entity)
+
+			if event == nil {
+				continue
+			}
+			if e := event(&entity); e != nil {
+				if err := s.recordEvent(ctx, e); err != nil {
+					return err
+				}
+				id, _ := primitive.ObjectIDFromHex(e.ID)
+				eventIDs = append(eventIDs, id)
+			}
+		}
+		return nil
+	}
+
+	if s.transactions {
+		if err := s.inTransaction(ctx, apply); err != nil {
+			return nil, err
+		}
+		return previous, nil
+	}
+	if err := apply(ctx); err != nil {
+		s.revertWrites(previous, eventIDs, revert)
+		return nil, err
+	}
+	return previous, nil
+}
+
+// revertWrites undoes the writes of a failed updateEntities on a standalone server
+func (s *MongoStore) revertWrites(previous []models.ReactiveEntityRaw, eventIDs []primitive.ObjectID, revert func(i int, entity *models.ReactiveEntityRaw) (bson.M, bson.M)) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for i := range previous {
+		filter, update := revert(i, &previous[i])
+		if _, err := s.database().Collection(reactiveEntitiesCollection).UpdateOne(ctx, filter, update); err != nil {
+			log.Printf("Error reverting the update of entity %#02x: %v", previous[i].EntityHex, err)
+		}
+	}
+	if len(eventIDs) > 0 {
+		if _, err := s.database().Collection(outboxCollection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": eventIDs}}); err != nil {
+			log.Printf("Error removing the outbox entries of reverted updates: %v", err)
+		}
+		hexIDs := make([]string, len(eventIDs))
+		for i, id := range eventIDs {
+			hexIDs[i] = id.Hex()
+		}
+		if _, err := s.database().Collection(entityEventsCollection).DeleteMany(ctx, bson.M{"ID": bson.M{"$in": hexIDs}}); err != nil {
+			log.Printf("Error removing the history of reverted updates: %v", err)
+		}
+	}
+}
+
+// UpdateReactiveEntityReportedState atomically sets Data.ReportedState and Data.ReportedUpdated of a reactive entity,
+// i.e. the state the device says it is in. The entity is returned as it was before the update.
+func (s *MongoStore) UpdateReactiveEntityReportedState(hex uint16, state int, reportedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	update := bson.M{"$set": bson.M{
+		"Data.ReportedState":   state,
+		"Data.ReportedUpdated": reportedAt,
+	}}
+	return s.findOneAndUpdateEntity(bson.M{"EntityHex": hex}, update, options.Before, event)
+}
+
+// UpdateReactiveEntityAttributes atomically sets the given attribute values (leaving other attributes untouched)
+// and Data.AttributesUpdated of a reactive entity. The entity is returned as it was before the update.
+func (s *MongoStore) UpdateReactiveEntityAttributes(hex uint16, values map[string]interface{}, updatedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	set := bson.M{"Data.AttributesUpdated": updatedAt}
+	for name, value := range values {
+		set["Data.Attributes."+name] = value
+	}
+	return s.findOneAndUpdateEntity(bson.M{"EntityHex": hex}, bson.M{"$set": set}, options.Before, event)
+}
+
+// UpdateReactiveEntityReportedAttributes atomically sets the given reported attribute values (leaving the desired ones
+// and other reported ones untouched) and Data.ReportedAttributesUpdated of a reactive entity. The entity is returned
+// as it was before the update.
+func (s *MongoStore) UpdateReactiveEntityReportedAttributes(hex uint16, values map[string]interface{}, reportedAt time.Time, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	set := bson.M{"Data.ReportedAttributesUpdated": reportedAt}
+	for name, value := range values {
+		set["Data.ReportedAttributes."+name] = value
+	}
+	return s.findOneAndUpdateEntity(bson.M{"EntityHex": hex}, bson.M{"$set": set}, options.Before, event)
+}
+
+// UpdateReactiveEntityMetadata replaces the metadata (hex, description, location, definition, groups) of a reactive entity,
+// leaving its Data untouched. The update only applies while the entity is still in expectedState, so a definition change
+// validated against that state can never race with a state update. The updated entity is returned, ErrDuplicateEntityHex
+// when another entity has the new hex.
+func (s *MongoStore) UpdateReactiveEntityMetadata(hex uint16, expectedState int, entity *models.ReactiveEntityRaw, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	filter := bson.M{
+		"EntityHex":         hex,
+		"Data.CurrentState": expectedState,
+	}
+	update := bson.M{"$set": bson.M{
+		"EntityHex":   entity.EntityHex,
+		"Description": entity.Description,
+		"Location":    entity.Location,
+		"Definition":  entity.Definition,
+		"Groups":      entity.Groups,
+	}}
+	return s.findOneAndUpdateEntity(filter, update, options.After, event)
+}
+
+// SetReactiveEntitySecret replaces the hash of the secret a device authenticates with on the embedded broker.
+// No event is written, the credential is not part of the entity seen by clients. ErrNotFound is returned when
+// no entity has the hex.
+func (s *MongoStore) SetReactiveEntitySecret(hex uint16, secretHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	result, err := s.database().Collection(reactiveEntitiesCollection).UpdateOne(ctx, bson.M{"EntityHex": hex}, bson.M{"$set": bson.M{"SecretHash": secretHash}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// findOneAndUpdateEntity updates a reactive entity together with its outbox event and returns it as it was
+// before or after the update
+func (s *MongoStore) findOneAndUpdateEntity(filter bson.M, update bson.M, returnDocument options.ReturnDocument, event EventFunc) (*models.ReactiveEntityRaw, error) {
+	return s.withOutbox(5*time.Second, event, func(ctx context.Context) (*models.ReactiveEntityRaw, error) {
+		opts := options.FindOneAndUpdate().SetReturnDocument(returnDocument)
+
+		var entity models.ReactiveEntityRaw
+		err := s.database().Collection(reactiveEntitiesCollection).FindOneAndUpdate(ctx, filter, update, opts).Decode(&entity)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrDuplicateEntityHex
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &entity, nil
+	})
+}
+
+// ReplaceDefinition replaces the definition with the given ID
+func (s *MongoStore) ReplaceDefinition(definition *models.DefinitionRaw) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.database().Collection(definitionsCollection).ReplaceOne(ctx, bson.M{"_id": definition.ID}, definition)
+	return err
+}
+
+// DeleteDefinitions removes the definitions with the given IDs
+func (s *MongoStore) DeleteDefinitions(ids []primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.database().Collection(definitionsCollection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// ReplaceGroup replaces the group with the given ID
+func (s *MongoStore) ReplaceGroup(group *models.GroupRaw) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := s.database().Collection(groupsCollection).ReplaceOne(ctx, bson.M{"_id": group.ID}, group)
+	return err
+}
+
+// DeleteGroups removes the groups with the given IDs and their references held by reactive entities,
+// so forced removals do not leave dangling group references behind
+func (s *MongoStore) DeleteGroups(ids []primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := s.database().Collection(groupsCollection).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return err
+	}
+
+	_, err := s.database().Collection(reactiveEntitiesCollection).UpdateMany(ctx,
+		bson.M{"Groups": bson.M{"$in": ids}},
+		bson.M{"$pull": bson.M{"Groups": bson.M{"$in": ids}}},
+	)
+	if err != nil {
+		return fmt.Errorf("error removing group references from reactive entities: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// webhooks.go
+package persistence
+
+import (
+	"context"
+	"databus/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	webhooksCollection           = "Webhooks"
+	webhookDeliveriesCollection  = "WebhookDeliveries"
+	webhookDeadLettersCollection = "WebhookDeadLetters"
+	webhookRetriesCollection     = "WebhookRetries"
+)
+
+// GetAllWebhooks retrieves every webhook subscription
+func (s *MongoStore) GetAllWebhooks() ([]models.WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhooksCollection)
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []models.WebhookSubscription
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetWebhookByName retrieves a single webhook subscription by its name
+func (s *MongoStore) GetWebhookByName(name string) (*models.WebhookSubscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhooksCollection)
+	var result models.WebhookSubscription
+	err := collection.FindOne(ctx, bson.M{"Name": name}).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// InsertWebhook inserts a webhook subscription and sets its ID
+func (s *MongoStore) InsertWebhook(webhook *models.WebhookSubscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhooksCollection)
+	result, err := collection.InsertOne(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	webhook.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// ReplaceWebhook replaces the webhook subscription with the given ID
+func (s *MongoStore) ReplaceWebhook(webhook *models.WebhookSubscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhooksCollection)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": webhook.ID}, webhook)
+	return err
+}
+
+// DeleteWebhook removes the webhook subscription with the given ID
+func (s *MongoStore) DeleteWebhook(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhooksCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// InsertWebhookDelivery records a delivery attempt in the WebhookDeliveries collection
+func (s *MongoStore) InsertWebhookDelivery(delivery *models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhookDeliveriesCollection)
+	_, err := collection.InsertOne(ctx, delivery)
+	return err
+}
+
+// GetWebhookDeliveries retrieves the latest delivery attempts of a subscription, newest first
+func (s *MongoStore) GetWebhookDeliveries(subscription string, limit int64) ([]models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "Timestamp", Value: -1}}).SetLimit(limit)
+
+	collection := s.database().Collection(webhookDeliveriesCollection)
+	cursor, err := collection.Find(ctx, bson.M{"Subscription": subscription}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	results := make([]models.WebhookDelivery, 0)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// InsertWebhookDeadLetter records an event that could not be delivered in the WebhookDeadLetters collection
+func (s *MongoStore) InsertWebhookDeadLetter(deadLetter *models.WebhookDeadLetter) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhookDeadLettersCollection)
+	_, err := collection.InsertOne(ctx, deadLetter)
+	return err
+}
+
+// GetWebhookDeadLetters retrieves the latest dead letters of a subscription, newest first
+func (s *MongoStore) GetWebhookDeadLetters(subscription string, limit int64) ([]models.WebhookDeadLetter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "FailedAt", Value: -1}}).SetLimit(limit)
+
+	collection := s.database().Collection(webhookDeadLettersCollection)
+	cursor, err := collection.Find(ctx, bson.M{"Subscription": subscription}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	results := make([]models.WebhookDeadLetter, 0)
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SaveWebhookRetry inserts a pending retry, or replaces it when it is scheduled again, and sets its ID
+func (s *MongoStore) SaveWebhookRetry(retry *models.WebhookRetry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if retry.ID.IsZero() {
+		retry.ID = primitive.NewObjectID()
+	}
+	collection := s.database().Collection(webhookRetriesCollection)
+	_, err := collection.ReplaceOne(ctx, bson.M{"_id": retry.ID}, retry, options.Replace().SetUpsert(true))
+	return err
+}
+
+// GetDueWebhookRetries retrieves the retries whose next attempt is at or before now, earliest first
+func (s *MongoStore) GetDueWebhookRetries(now time.Time, limit int64) ([]models.WebhookRetry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "NextAttemptAt", Value: 1}}).SetLimit(limit)
+
+	collection := s.database().Collection(webhookRetriesCollection)
+	cursor, err := collection.Find(ctx, bson.M{"NextAttemptAt": bson.M{"$lte": now}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var results []models.WebhookRetry
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// DeleteWebhookRetry removes a retry once its delivery succeeded or was given up
+func (s *MongoStore) DeleteWebhookRetry(id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	collection := s.database().Collection(webhookRetriesCollection)
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
@@ -0,0 +1,15 @@
+// actions.go
+package rules
+
+import (
+	"databus/models"
+	"encoding/json"
+)
+
+// publishPayload returns the payload of a publish action, the triggering event envelope unless one is configured
+func publishPayload(action *models.RuleAction, e *models.EntityEvent) ([]byte, error) {
+	if action.Payload != "" {
+		return []byte(action.Payload), nil
+	}
+	return json.Marshal(e)
+}
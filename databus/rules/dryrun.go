@@ -0,0 +1,184 @@
+// dryrun.go
+package rules
+
+import (
+	"databus/events"
+	"databus/models"
+	"databus/services"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+A dry run evaluates the rules against a hypothetical state change without executing any action.
+The set_state actions of matching rules are simulated on an in-memory copy of the entities, and the
+resulting state changes are evaluated in turn, so chains of rules and loops show up as they would live.
+*/
+
+// ErrInvalidDryRun is returned when the hypothetical event of a dry run cannot be built
+var ErrInvalidDryRun = errors.New("invalid dry run")
+
+// maxDryRunEvaluations bounds the size of a dry run report
+const maxDryRunEvaluations = 1000
+
+const dryRunSource = "dry_run"
+
+// DryRun evaluates the stored rules, or the given candidate rules, against a hypothetical event of an entity
+func (r *Engine) DryRun(req models.RuleDryRunRequest) (*models.RuleDryRunResult, error) {
+	rules := req.Rules
+	if len(rules) == 0 {
+		var err error
+		if rules, err = r.store.GetAllRules(); err != nil {
+			return nil, err
+		}
+	}
+
+	eventType := req.EventType
+	if eventType == "" {
+		eventType = models.EventStateChanged
+	}
+	if eventType != models.EventStateChanged && eventType != models.EventReported {
+		return nil, fmt.Errorf("%w: EventType must be %s or %s", ErrInvalidDryRun, models.EventStateChanged, models.EventReported)
+	}
+
+	view := &snapshot{store: r.store}
+	if err := view.load(); err != nil {
+		return nil, err
+	}
+	entity := view.entity(req.EntityHex)
+	if entity == nil {
+		return nil, fmt.Errorf("%w: %s", services.ErrEntityNotFound, req.EntityHex)
+	}
+	definition := view.definition(entity)
+	if definition == nil {
+		return nil, fmt.Errorf("definition of entity %#02x not found", entity.EntityHex)
+	}
+	state, err := services.ResolveState(definition, models.StateJs{Label: req.State})
+	if err != nil {
+		return nil, err
+	}
+
+	type pending struct {
+		event models.EntityEvent
+		chain []string
+	}
+	queue := []pending{{event: view.simulate(entity, state, eventType, dryRunSource)}}
+	result := &models.RuleDryRunResult{Evaluations: []models.RuleEvaluation{}, Timestamp: time.Now().UTC()}
+
+	for len(queue) > 0 && len(result.Evaluations) < maxDryRunEvaluations {
+		current := queue[0]
+		queue = queue[1:]
+
+		for i := range rules {
+			rule := &rules[i]
+			matched, reason, err := evaluate(rule, &current.event, current.chain, view)
+			if err != nil {
+				return nil, err
+			}
+			if !matched && (rule.Disabled || !triggerMatches(&rule.When, &current.event)) {
+				continue
+			}
+
+			eval := models.RuleEvaluation{
+				Depth:   len(current.chain),
+				Rule:    rule.Name,
+				Event:   withoutSnapshots(current.event),
+				Matched: matched,
+				Reason:  reason,
+			}
+			if !matched {
+				if strings.HasPrefix(reason, loopReason) {
+					result.Loops = append(result.Loops, reason)
+				}
+				result.Evaluations = append(result.Evaluations, eval)
+				continue
+			}
+
+			eval.Actions = rule.Actions
+			chain := append(append([]string{}, current.chain...), rule.Name)
+			for j := range rule.Actions {
+				changes, err := view.simulateAction(&rule.Actions[j])
+				if err != nil {
+					eval.Errors = append(eval.Errors, fmt.Sprintf("action %d: %v", j+1, err))
+					continue
+				}
+				for _, e := range changes {
+					queue = append(queue, pending{event: e, chain: chain})
+				}
+			}
+			result.Evaluations = append(result.Evaluations, eval)
+		}
+	}
+	return result, nil
+}
+
+// simulateAction applies a set_state action to the snapshot and returns the resulting state change events.
+// Like services.SetGroupState, nothing is applied when the state is refused for any of the entities.
+func (s *snapshot) simulateAction(action *models.RuleAction) ([]models.EntityEvent, error) {
+	if action.Type != models.RuleActionSetState {
+		return nil, nil
+	}
+
+	var targets []*models.ReactiveEntityRaw
+	if action.EntityHex != "" {
+		entity := s.entity(action.EntityHex)
+		if entity == nil {
+			return nil, fmt.Errorf("%w: %s", services.ErrEntityNotFound, action.EntityHex)
+		}
+		targets = append(targets, entity)
+	} else {
+		targets = s.groupEntities(action.Groups)
+	}
+
+	now := time.Now().UTC()
+	states := make([]models.StateRaw, len(targets))
+	for i, entity := range targets {
+		definition := s.definition(entity)
+		if definition == nil {
+			return nil, fmt.Errorf("definition of entity %#02x not found", entity.EntityHex)
+		}
+		state, err := services.ResolveState(definition, models.StateJs{Label: action.State})
+		if err != nil {
+			return nil, fmt.Errorf("entity %#02x: %w", entity.EntityHex, err)
+		}
+		if err := services.CheckTransition(entity, definition, state, now); err != nil {
+			return nil, err
+		}
+		states[i] = state
+	}
+
+	var changes []models.EntityEvent
+	for i, entity := range targets {
+		// Only actual changes of state are published, and can trigger further rules
+		if entity.Data.CurrentState != int(states[i].Hex) {
+			changes = append(changes, s.simulate(entity, states[i], models.EventStateChanged, models.SourceRule))
+		}
+	}
+	return changes, nil
+}
+
+// simulate changes the desired (state_changed) or reported state of an entity of the snapshot and returns the event
+func (s *snapshot) simulate(entity *models.ReactiveEntityRaw, state models.StateRaw, eventType string, source string) models.EntityEvent {
+	definition := s.definition(entity)
+	before := entity.ToJs(s.definitions, s.groups)
+
+	now := time.Now().UTC()
+	if eventType == models.EventReported {
+		reported := int(state.Hex)
+		entity.Data.ReportedState = &reported
+		entity.Data.ReportedUpdated = &now
+		return events.NewReportedEvent(before, entity.ToJs(s.definitions, s.groups), definition, source)
+	}
+	entity.Data.CurrentState = int(state.Hex)
+	entity.Data.LastUpdated = now
+	return events.NewStateChangedEvent(before, entity.ToJs(s.definitions, s.groups), definition, source)
+}
+
+// withoutSnapshots drops the entity snapshots of an event to keep dry run reports short
+func withoutSnapshots(e models.EntityEvent) models.EntityEvent {
+	e.Before = nil
+	e.After = nil
+	return e
+}
@@ -0,0 +1,187 @@
+// engine.go
+package rules
+
+import (
+	"databus/events"
+	"databus/models"
+	"databus/network"
+	"databus/persistence"
+	"databus/services"
+	"databus/utils"
+	"databus/webhooks"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The rules engine subscribes to the event bus and, for every event, runs the actions of the rules it matches.
+
+Events are queued and evaluated by a single worker, in the order they were published. A full queue makes the
+publisher wait (up to enqueueTimeout) instead of losing the event. State changes made by rule actions are published
+with the "rule" source and carry the chain of rules that caused them in their RuleChain, so a rule that would be
+re-triggered by its own consequences (a loop) is detected and skipped instead of executed again. They are published
+by the worker itself, which evaluates them right after the event that caused them rather than waiting on its own
+queue. Chains end after MaxChainDepth rules, so these are bounded too.
+
+Webhook actions are handed to the webhook dispatcher, which stores, signs, delivers and retries them like the event
+deliveries of the subscription, so a slow endpoint does not hold up the other rules.
+*/
+
+// MaxChainDepth is the longest chain of rules triggering each other before evaluation stops
+const MaxChainDepth = 8
+
+const (
+	queueSize = 1024
+	// enqueueTimeout is how long a publisher waits for room in a full queue before the event is dropped
+	enqueueTimeout = 5 * time.Second
+)
+
+/* An event waiting for evaluation, with the rules that led to it (empty for external changes) */
+type trigger struct {
+	event models.EntityEvent
+	chain []string
+}
+
+/*
+The rules engine, built in main from the store, the services applying set_state actions, the MQTT publisher and the
+webhook dispatcher
+*/
+type Engine struct {
+	store     persistence.Store
+	services  *services.Service
+	publisher network.Publisher
+	webhooks  *webhooks.Dispatcher
+	queue     chan trigger
+
+	// chained holds the events published by the actions of the worker, evaluated before the next queued one
+	chainedMu sync.Mutex
+	chained   []trigger
+}
+
+// NewEngine returns a rules engine, it evaluates nothing until started
+func NewEngine(store persistence.Store, svc *services.Service, publisher network.Publisher, dispatcher *webhooks.Dispatcher) *Engine {
+	return &Engine{store: store, services: svc, publisher: publisher, webhooks: dispatcher, queue: make(chan trigger, queueSize)}
+}
+
+// Start subscribes the rules engine to the event bus and evaluates rules until the process exits
+func (r *Engine) Start() {
+	events.Subscribe(r.enqueue)
+	go r.run()
+}
+
+// enqueue is the bus handler. Events caused by rule actions come from the worker and are kept for it, the others
+// wait up to enqueueTimeout for room in the queue.
+func (r *Engine) enqueue(e models.EntityEvent) {
+	t := trigger{event: e, chain: e.RuleChain}
+	if len(t.chain) > 0 {
+		r.chainedMu.Lock()
+		r.chained = append(r.chained, t)
+		r.chainedMu.Unlock()
+		return
+	}
+
+	select {
+	case r.queue <- t:
+		return
+	default:
+	}
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case r.queue <- t:
+	case <-timer.C:
+		log.Printf("Rules engine queue full for %s, event %s of entity %s not evaluated", enqueueTimeout, e.ID, e.EntityHex)
+	}
+}
+
+func (r *Engine) run() {
+	for t := range r.queue {
+		r.evaluateAll(t)
+		for {
+			next, ok := r.nextChained()
+			if !ok {
+				break
+			}
+			r.evaluateAll(next)
+		}
+	}
+}
+
+// nextChained takes the oldest event caused by a rule action, if any
+func (r *Engine) nextChained() (trigger, bool) {
+	r.chainedMu.Lock()
+	defer r.chainedMu.Unlock()
+	if len(r.chained) == 0 {
+		return trigger{}, false
+	}
+	t := r.chained[0]
+	r.chained = r.chained[1:]
+	return t, true
+}
+
+// evaluateAll runs the actions of every rule matching the event
+func (r *Engine) evaluateAll(t trigger) {
+	rules, err := r.store.GetAllRules()
+	if err != nil {
+		log.Printf("Error loading rules: %v", err)
+		return
+	}
+
+	view := &snapshot{store: r.store}
+	for i := range rules {
+		matched, reason, err := evaluate(&rules[i], &t.event, t.chain, view)
+		if err != nil {
+			log.Printf("Error evaluating rule '%s': %v", rules[i].Name, err)
+			continue
+		}
+		if !matched {
+			if strings.HasPrefix(reason, loopReason) {
+				log.Printf("Rule '%s' skipped for event %s: %s", rules[i].Name, t.event.ID, reason)
+			}
+			continue
+		}
+		r.execute(&rules[i], t)
+	}
+}
+
+// execute runs the actions of a matched rule in order, a failed action does not stop the following ones
+func (r *Engine) execute(rule *models.Rule, t trigger) {
+	// The changes of the actions carry the chain on to the events they cause
+	svc := r.services.WithRuleChain(append(append([]string{}, t.chain...), rule.Name))
+
+	for i := range rule.Actions {
+		if err := r.runAction(svc, rule, &rule.Actions[i], &t.event); err != nil {
+			log.Printf("Rule '%s' action %d (%s) failed: %v", rule.Name, i+1, rule.Actions[i].Type, err)
+		}
+	}
+}
+
+func (r *Engine) runAction(svc *services.Service, rule *models.Rule, action *models.RuleAction, e *models.EntityEvent) error {
+	switch action.Type {
+	case models.RuleActionSetState:
+		ref := models.StateJs{Label: action.State}
+		if action.EntityHex != "" {
+			hex, err := utils.ParseEntityHex(action.EntityHex)
+			if err != nil {
+				return err
+			}
+			_, err = svc.SetEntityState(hex, ref, models.SourceRule)
+			return err
+		}
+		_, err := svc.SetGroupState(action.Groups, ref, models.SourceRule)
+		return err
+
+	case models.RuleActionPublish:
+		payload, err := publishPayload(action, e)
+		if err != nil {
+			return err
+		}
+		return r.publisher.Publish(action.Topic, payload)
+
+	case models.RuleActionWebhook:
+		return r.webhooks.DeliverRuleAction(action.Webhook, rule.Name, *e)
+	}
+	return nil
+}
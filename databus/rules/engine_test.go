@@ -0,0 +1,157 @@
+package rules
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/services"
+	"databus/webhooks"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type nopPublisher struct{}
+
+func (nopPublisher) Publish(string, []byte) error { return nil }
+
+// newTestEngine returns an engine on a store holding the switches 0x01 and 0x02, both off
+func newTestEngine(t *testing.T) (*Engine, persistence.Store, *services.Service) {
+	t.Helper()
+	store := persistence.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	definition := models.DefinitionRaw{Name: "Switch", States: []models.StateRaw{{Hex: 0x00, Label: "off"}, {Hex: 0x01, Label: "on"}}}
+	if err := store.InsertDefinition(&definition); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{
+		{EntityHex: 0x01, Definition: definition.ID, Groups: []primitive.ObjectID{}},
+		{EntityHex: 0x02, Definition: definition.ID, Groups: []primitive.ObjectID{}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := services.NewService(store)
+	return NewEngine(store, svc, nopPublisher{}, webhooks.NewDispatcher(store)), store, svc
+}
+
+func TestRuleChainIsCarriedByTheEvents(t *testing.T) {
+	r, store, svc := newTestEngine(t)
+
+	// a and b trigger each other, the loop ends when a would run a second time
+	for _, rule := range []models.Rule{
+		{Name: "a", When: models.RuleTrigger{EntityHexes: []string{"0x01"}, State: "on"},
+			Actions: []models.RuleAction{{Type: models.RuleActionSetState, EntityHex: "0x02", State: "on"}}},
+		{Name: "b", When: models.RuleTrigger{EntityHexes: []string{"0x02"}},
+			Actions: []models.RuleAction{{Type: models.RuleActionSetState, EntityHex: "0x01", State: "off"}}},
+	} {
+		rule := rule
+		if err := store.InsertRule(&rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Start()
+
+	if _, err := svc.SetEntityState(0x01, models.StateJs{Label: "on"}, models.SourceREST); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		history, err := store.GetEntityEventsByHex("0x01", time.Time{}, time.Now().Add(time.Hour), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) == 2 {
+			// Switched on through REST, then off by b after a switched 0x02 on
+			chains := map[string]bool{}
+			for _, e := range history {
+				chains[strings.Join(e.RuleChain, " -> ")] = true
+			}
+			if !chains[""] || !chains["a -> b"] {
+				t.Fatalf("rule chains %v, want none and a -> b", chains)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events of 0x01 recorded, want 2", len(history))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFullQueueWaitsInsteadOfDropping(t *testing.T) {
+	r, _, _ := newTestEngine(t)
+	for i := 0; i < queueSize; i++ {
+		r.queue <- trigger{}
+	}
+
+	// The worker publishes the consequences of its rules, it must never wait on its own queue
+	chained := models.EntityEvent{ID: "chained", RuleChain: []string{"a"}}
+	r.enqueue(chained)
+	if next, ok := r.nextChained(); !ok || next.event.ID != "chained" {
+		t.Fatalf("got %+v, want the chained event kept for the worker", next)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.enqueue(models.EntityEvent{ID: "external"})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("event dropped from a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-r.queue
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publisher still waiting once the queue had room")
+	}
+	for i := 0; i < queueSize-1; i++ {
+		<-r.queue
+	}
+	if last := <-r.queue; last.event.ID != "external" {
+		t.Fatalf("last queued event %q, want external", last.event.ID)
+	}
+}
+
+func TestWebhookActionIsStoredForTheDispatcher(t *testing.T) {
+	r, store, svc := newTestEngine(t)
+
+	sub := models.WebhookSubscription{Name: "notify", URL: "https://example.com/hooks", Secret: "s3cret"}
+	if err := store.InsertWebhook(&sub); err != nil {
+		t.Fatal(err)
+	}
+
+	rule := &models.Rule{Name: "door"}
+	event := &models.EntityEvent{ID: primitive.NewObjectID().Hex(), Type: models.EventStateChanged, EntityHex: "0x01"}
+	if err := r.runAction(svc, rule, &models.RuleAction{Type: models.RuleActionWebhook, Webhook: "notify"}, event); err != nil {
+		t.Fatal(err)
+	}
+
+	// The delivery waits in the store, signed and retried by the dispatcher once started
+	retries, err := store.GetDueWebhookRetries(time.Now().Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retries) != 1 || retries[0].Subscription != "notify" || retries[0].Attempt != 1 {
+		t.Fatalf("retries %+v, want the first attempt to 'notify'", retries)
+	}
+	var body struct {
+		Rule  string
+		Event models.EntityEvent
+	}
+	if err := json.Unmarshal(retries[0].Payload, &body); err != nil || body.Rule != "door" || body.Event.ID != event.ID {
+		t.Fatalf("payload %s, want the rule and the event", retries[0].Payload)
+	}
+
+	if err := r.runAction(svc, rule, &models.RuleAction{Type: models.RuleActionWebhook, Webhook: "missing"}, event); err == nil {
+		t.Fatal("delivered to a webhook that does not exist")
+	}
+}
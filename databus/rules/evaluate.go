@@ -0,0 +1,188 @@
+// evaluate.go
+package rules
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/utils"
+	"fmt"
+	"strings"
+)
+
+// defaultEventTypes are the events a rule reacts to when its trigger lists none
+var defaultEventTypes = []string{models.EventStateChanged, models.EventReported}
+
+const loopReason = "loop detected"
+
+// evaluate reports whether the rule applies to the event, and why not when it doesn't.
+// chain lists the rules that led to the event, view is used to check the conditions.
+func evaluate(rule *models.Rule, e *models.EntityEvent, chain []string, view *snapshot) (bool, string, error) {
+	if rule.Disabled {
+		return false, "rule is disabled", nil
+	}
+	if !triggerMatches(&rule.When, e) {
+		return false, "trigger does not match", nil
+	}
+	if utils.Contains(chain, rule.Name) {
+		return false, fmt.Sprintf("%s: %s -> %s", loopReason, strings.Join(chain, " -> "), rule.Name), nil
+	}
+	if len(chain) >= MaxChainDepth {
+		return false, fmt.Sprintf("chain of rules longer than %d: %s", MaxChainDepth, strings.Join(chain, " -> ")), nil
+	}
+
+	for i := range rule.Conditions {
+		ok, err := view.conditionHolds(&rule.Conditions[i])
+		if err != nil {
+			return false, "", err
+		}
+		if !ok {
+			return false, fmt.Sprintf("condition %d does not hold", i+1), nil
+		}
+	}
+	return true, "", nil
+}
+
+// triggerMatches reports whether the event is one the trigger selects
+func triggerMatches(when *models.RuleTrigger, e *models.EntityEvent) bool {
+	eventTypes := when.EventTypes
+	if len(eventTypes) == 0 {
+		eventTypes = defaultEventTypes
+	}
+	if !utils.Contains(eventTypes, e.Type) {
+		return false
+	}
+	if len(when.EntityHexes) > 0 && !utils.Contains(when.EntityHexes, e.EntityHex) {
+		return false
+	}
+	if len(when.Definitions) > 0 && !utils.Contains(when.Definitions, e.Definition) {
+		return false
+	}
+	if len(when.Groups) > 0 && !utils.ContainsAny(e.Groups, when.Groups) {
+		return false
+	}
+	if when.FromState != "" && (e.OldState == nil || e.OldState.Label != when.FromState) {
+		return false
+	}
+	if when.State != "" && (e.NewState == nil || e.NewState.Label != when.State) {
+		return false
+	}
+	return true
+}
+
+/*
+A view of the definitions, groups and entities used to check conditions. It is loaded on first use, so events
+that match no rule with conditions never touch the database. Dry runs change the entities in place to simulate
+the effects of actions.
+*/
+type snapshot struct {
+	store       persistence.Store
+	loaded      bool
+	definitions []models.DefinitionRaw
+	groups      []models.GroupRaw
+	entities    []models.ReactiveEntityRaw
+}
+
+func (s *snapshot) load() error {
+	if s.loaded {
+		return nil
+	}
+
+	var err error
+	if s.definitions, err = s.store.GetAllDefinitions(); err != nil {
+		return err
+	}
+	if s.groups, err = s.store.GetAllGroups(); err != nil {
+		return err
+	}
+	if s.entities, err = s.store.GetAllReactiveEntities(); err != nil {
+		return err
+	}
+	s.loaded = true
+	return nil
+}
+
+// conditionHolds reports whether the entity, or every entity of the group, of the condition is in its desired state
+func (s *snapshot) conditionHolds(cond *models.RuleCondition) (bool, error) {
+	if err := s.load(); err != nil {
+		return false, err
+	}
+
+	var entities []*models.ReactiveEntityRaw
+	if cond.EntityHex != "" {
+		entity := s.entity(cond.EntityHex)
+		if entity == nil {
+			return false, nil
+		}
+		entities = append(entities, entity)
+	} else {
+		entities = s.groupEntities([]string{cond.Group})
+	}
+
+	for _, entity := range entities {
+		if s.stateLabel(entity) != cond.State {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// entity returns the entity with the given hex ("0x1a"), or nil
+func (s *snapshot) entity(hex string) *models.ReactiveEntityRaw {
+	val, err := utils.ParseEntityHex(hex)
+	if err != nil {
+		return nil
+	}
+	for i := range s.entities {
+		if s.entities[i].EntityHex == val {
+			return &s.entities[i]
+		}
+	}
+	return nil
+}
+
+// groupEntities returns the entities belonging to every one of the given groups
+func (s *snapshot) groupEntities(groupNames []string) []*models.ReactiveEntityRaw {
+	var entities []*models.ReactiveEntityRaw
+	for i := range s.entities {
+		member := true
+		for _, name := range groupNames {
+			group := s.group(name)
+			if group == nil || !utils.Contains(s.entities[i].Groups, group.ID) {
+				member = false
+				break
+			}
+		}
+		if member {
+			entities = append(entities, &s.entities[i])
+		}
+	}
+	return entities
+}
+
+func (s *snapshot) group(name string) *models.GroupRaw {
+	for i := range s.groups {
+		if s.groups[i].Name == name {
+			return &s.groups[i]
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) definition(entity *models.ReactiveEntityRaw) *models.DefinitionRaw {
+	for i := range s.definitions {
+		if s.definitions[i].ID == entity.Definition {
+			return &s.definitions[i]
+		}
+	}
+	return nil
+}
+
+// stateLabel returns the label of the desired state of the entity
+func (s *snapshot) stateLabel(entity *models.ReactiveEntityRaw) string {
+	definition := s.definition(entity)
+	if definition == nil {
+		return ""
+	}
+	state, _ := definition.FindStateByHex(uint16(entity.Data.CurrentState))
+	return state.Label
+}
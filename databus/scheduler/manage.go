@@ -0,0 +1,219 @@
+// manage.go
+package scheduler
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/services"
+	"databus/utils"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrScheduleExists   = errors.New("schedule already exists")
+	ErrInvalidSchedule  = errors.New("invalid schedule")
+)
+
+// scheduleNamePattern keeps schedule names usable in URLs
+var scheduleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CreateSchedule validates and stores a new schedule, with its first run
+func (sch *Scheduler) CreateSchedule(s models.Schedule) (*models.Schedule, error) {
+	if err := sch.ValidateSchedule(&s); err != nil {
+		return nil, err
+	}
+	if err := checkAtAhead(&s); err != nil {
+		return nil, err
+	}
+
+	if _, err := sch.store.GetScheduleByName(s.Name); err == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrScheduleExists, s.Name)
+	} else if !errors.Is(err, persistence.ErrNotFound) {
+		return nil, err
+	}
+
+	s.ID = primitive.NilObjectID
+	s.LastRun = nil
+	s.LastError = ""
+	s.ClaimedRun, s.ClaimExpiresAt = nil, nil
+	next, err := nextRun(&s, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	s.NextRun = next
+
+	if err := sch.store.InsertSchedule(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// UpdateSchedule replaces a schedule (it cannot be renamed). The next run is computed again from now.
+func (sch *Scheduler) UpdateSchedule(name string, s models.Schedule) (*models.Schedule, error) {
+	if s.Name == "" {
+		s.Name = name
+	}
+	if s.Name != name {
+		return nil, fmt.Errorf("%w: schedule '%s' cannot be renamed", ErrInvalidSchedule, name)
+	}
+
+	current, err := sch.getSchedule(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := sch.ValidateSchedule(&s); err != nil {
+		return nil, err
+	}
+	if err := checkAtAhead(&s); err != nil {
+		return nil, err
+	}
+
+	s.ID = current.ID
+	s.LastRun = current.LastRun
+	s.LastError = current.LastError
+	// A run in progress keeps its claim
+	s.ClaimedRun, s.ClaimExpiresAt = current.ClaimedRun, current.ClaimExpiresAt
+	next, err := nextRun(&s, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	s.NextRun = next
+
+	if err := sch.store.ReplaceSchedule(&s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// PreviewRuns returns up to count upcoming runs of a stored schedule, or of an unsaved one when name is empty
+func (sch *Scheduler) PreviewRuns(name string, s models.Schedule, count int) ([]time.Time, error) {
+	if name != "" {
+		current, err := sch.getSchedule(name)
+		if err != nil {
+			return nil, err
+		}
+		s = *current
+	} else if err := validateTiming(&s); err != nil {
+		return nil, err
+	}
+	return NextRuns(&s, time.Now().UTC(), count)
+}
+
+// DeleteSchedule removes a schedule
+func (sch *Scheduler) DeleteSchedule(name string) error {
+	current, err := sch.getSchedule(name)
+	if err != nil {
+		return err
+	}
+	return sch.store.DeleteSchedule(current.ID)
+}
+
+// ValidateSchedule checks the timing and the target of a schedule, and normalizes its entity hex
+func (sch *Scheduler) ValidateSchedule(s *models.Schedule) error {
+	if !scheduleNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("%w: invalid name '%s'", ErrInvalidSchedule, s.Name)
+	}
+
+	if err := validateTiming(s); err != nil {
+		return err
+	}
+
+	if s.State == "" {
+		return fmt.Errorf("%w: State is required", ErrInvalidSchedule)
+	}
+	if (s.EntityHex == "") == (len(s.Groups) == 0) {
+		return fmt.Errorf("%w: either EntityHex or Groups is required", ErrInvalidSchedule)
+	}
+
+	definitions, err := sch.store.GetAllDefinitions()
+	if err != nil {
+		return err
+	}
+
+	if s.EntityHex != "" {
+		hex, err := utils.ParseEntityHex(s.EntityHex)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+		}
+		s.EntityHex = utils.FormatHex(hex)
+
+		entity, err := sch.store.GetReactiveEntityByHex(hex)
+		if err != nil {
+			if errors.Is(err, persistence.ErrNotFound) {
+				return fmt.Errorf("%w: reactive entity %s not found", ErrInvalidSchedule, s.EntityHex)
+			}
+			return err
+		}
+		for i := range definitions {
+			if definitions[i].ID == entity.Definition {
+				if _, err := services.ResolveState(&definitions[i], models.StateJs{Label: s.State}); err != nil {
+					return fmt.Errorf("%w: %v", ErrInvalidSchedule, err)
+				}
+			}
+		}
+		return nil
+	}
+
+	groups, err := sch.store.GetAllGroups()
+	if err != nil {
+		return err
+	}
+	for _, name := range s.Groups {
+		found := false
+		for _, group := range groups {
+			if group.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: group '%s' not found", ErrInvalidSchedule, name)
+		}
+	}
+	for i := range definitions {
+		if _, ok := definitions[i].FindStateByLabel(s.State); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: '%s' is not a state of any definition", ErrInvalidSchedule, s.State)
+}
+
+// validateTiming checks that a schedule has either a valid cron expression or a run time, and a known timezone
+func validateTiming(s *models.Schedule) error {
+	if (s.Cron == "") == (s.At == nil) {
+		return fmt.Errorf("%w: either Cron or At is required", ErrInvalidSchedule)
+	}
+	if s.Cron != "" {
+		if _, err := cron.ParseStandard(s.Cron); err != nil {
+			return fmt.Errorf("%w: invalid cron expression %q: %v", ErrInvalidSchedule, s.Cron, err)
+		}
+	}
+	_, err := location(s)
+	return err
+}
+
+// checkAtAhead refuses a one-shot schedule whose run time already passed, it would never run
+func checkAtAhead(s *models.Schedule) error {
+	if s.At != nil && !s.At.After(time.Now()) {
+		return fmt.Errorf("%w: At is in the past", ErrInvalidSchedule)
+	}
+	return nil
+}
+
+func (sch *Scheduler) getSchedule(name string) (*models.Schedule, error) {
+	s, err := sch.store.GetScheduleByName(name)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: '%s'", ErrScheduleNotFound, name)
+		}
+		return nil, err
+	}
+	return s, nil
+}
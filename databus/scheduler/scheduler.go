@@ -0,0 +1,210 @@
+// scheduler.go
+package scheduler
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/services"
+	"databus/utils"
+	"log"
+	"time"
+)
+
+/*
+The scheduler runs the schedules of the Schedules collection through the same state service as the REST API.
+
+Every schedule stores its next run. A due run is first claimed in the database, by atomically moving the schedule
+to its following run, and only executed once the claim succeeded. A restart (or a second instance) therefore never
+runs it twice. The claim is renewed while the run executes and released once it completed; a claim that expires
+first belongs to a run that was interrupted, which is run again unless it expired longer than the misfire grace ago. Runs missed by more than the
+misfire grace (e.g. while the databus was down) are skipped.
+*/
+
+const (
+	// pollInterval is how often due schedules are looked up
+	pollInterval = time.Second
+	// claimLease is how long a claim lasts without being renewed, the run renews it every claimRenewal while it
+	// executes. A run whose claim expires (its process stopped) is run again.
+	claimLease   = 30 * time.Second
+	claimRenewal = claimLease / 3
+)
+
+/* The scheduler, built in main from the store and the services applying the scheduled states */
+type Scheduler struct {
+	store    persistence.Store
+	services *services.Service
+}
+
+// New returns a scheduler, it runs nothing until started
+func New(store persistence.Store, svc *services.Service) *Scheduler {
+	return &Scheduler{store: store, services: svc}
+}
+
+// Start runs due schedules until the process exits. Runs late by more than grace are skipped.
+func (sch *Scheduler) Start(grace time.Duration) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sch.runDue(grace)
+		sch.rerunInterrupted(grace)
+	}
+}
+
+func (sch *Scheduler) runDue(grace time.Duration) {
+	now := time.Now().UTC()
+	due, err := sch.store.GetDueSchedules(now)
+	if err != nil {
+		log.Printf("Error loading due schedules: %v", err)
+		return
+	}
+
+	for i := range due {
+		s := &due[i]
+		dueAt := *s.NextRun
+
+		// Recurring schedules continue from now, so a backlog of missed runs is not replayed
+		next, err := nextRun(s, now)
+		if err != nil {
+			log.Printf("Error computing the next run of schedule '%s': %v", s.Name, err)
+			continue
+		}
+
+		if now.Sub(dueAt) > grace {
+			log.Printf("Schedule '%s' missed its run at %s, skipped", s.Name, dueAt.Format(time.RFC3339))
+			if err := sch.store.SkipScheduleRun(s.ID, dueAt, next); err != nil {
+				log.Printf("Error skipping the run of schedule '%s': %v", s.Name, err)
+			}
+			continue
+		}
+
+		expiresAt := leaseFrom(now)
+		claimed, err := sch.store.ClaimScheduleRun(s.ID, dueAt, next, now, expiresAt)
+		if err != nil {
+			log.Printf("Error claiming the run of schedule '%s': %v", s.Name, err)
+			continue
+		}
+		if !claimed {
+			// Changed or already run in the meantime
+			continue
+		}
+
+		sch.run(s, dueAt, expiresAt)
+	}
+}
+
+// rerunInterrupted runs again the claimed runs whose claim expired before they completed
+func (sch *Scheduler) rerunInterrupted(grace time.Duration) {
+	now := time.Now().UTC()
+	expired, err := sch.store.GetExpiredScheduleClaims(now)
+	if err != nil {
+		log.Printf("Error loading interrupted schedule runs: %v", err)
+		return
+	}
+
+	for i := range expired {
+		s := &expired[i]
+		runAt, expiredAt := *s.ClaimedRun, *s.ClaimExpiresAt
+
+		if now.Sub(expiredAt) > grace {
+			log.Printf("Schedule '%s' run at %s was interrupted, not run again", s.Name, runAt.Format(time.RFC3339))
+			if err := sch.store.CompleteScheduleRun(s.ID, runAt, "run interrupted"); err != nil {
+				log.Printf("Error releasing the run of schedule '%s': %v", s.Name, err)
+			}
+			continue
+		}
+
+		expiresAt := leaseFrom(now)
+		renewed, err := sch.store.RenewScheduleClaim(s.ID, runAt, expiredAt, expiresAt)
+		if err != nil {
+			log.Printf("Error claiming the interrupted run of schedule '%s': %v", s.Name, err)
+			continue
+		}
+		if !renewed {
+			// Completed or taken over in the meantime
+			continue
+		}
+		log.Printf("Schedule '%s' run at %s was interrupted, running it again", s.Name, runAt.Format(time.RFC3339))
+		sch.run(s, runAt, expiresAt)
+	}
+}
+
+// run executes a claimed run (claimed until expiresAt), renewing the claim while it executes, then releases the
+// claim with the result
+func (sch *Scheduler) run(s *models.Schedule, runAt time.Time, expiresAt time.Time) {
+	stop := make(chan struct{})
+	renewing := make(chan struct{})
+	go func() {
+		defer close(renewing)
+		sch.keepClaim(s, runAt, expiresAt, stop)
+	}()
+
+	message := ""
+	if err := sch.execute(s); err != nil {
+		log.Printf("Schedule '%s' failed: %v", s.Name, err)
+		message = err.Error()
+	}
+
+	// No renewal may land after the claim is released
+	close(stop)
+	<-renewing
+	if err := sch.store.CompleteScheduleRun(s.ID, runAt, message); err != nil {
+		log.Printf("Error recording the result of schedule '%s': %v", s.Name, err)
+	}
+}
+
+// keepClaim renews the claim of a run every claimRenewal until stop is closed. It gives up once the claim was lost,
+// which only happens when the run took longer than the lease between two renewals.
+func (sch *Scheduler) keepClaim(s *models.Schedule, runAt time.Time, expiresAt time.Time, stop <-chan struct{}) {
+	ticker := time.NewTicker(claimRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			var renewed bool
+			if expiresAt, renewed = sch.renewClaim(s, runAt, expiresAt, time.Now().UTC()); !renewed {
+				return
+			}
+		}
+	}
+}
+
+// renewClaim extends the claim of a run expiring at expiresAt by a lease from now, and returns its new expiry. A
+// failed store call keeps the current claim, which the next renewal retries.
+func (sch *Scheduler) renewClaim(s *models.Schedule, runAt time.Time, expiresAt time.Time, now time.Time) (time.Time, bool) {
+	next := leaseFrom(now)
+	renewed, err := sch.store.RenewScheduleClaim(s.ID, runAt, expiresAt, next)
+	if err != nil {
+		log.Printf("Error renewing the claim of schedule '%s': %v", s.Name, err)
+		return expiresAt, true
+	}
+	if !renewed {
+		log.Printf("Schedule '%s' run at %s lost its claim, it may run again", s.Name, runAt.Format(time.RFC3339))
+		return expiresAt, false
+	}
+	return next, true
+}
+
+// leaseFrom returns the expiry of a claim made or renewed at now. Stores keep times to the millisecond, the expiry
+// renewals match on must compare equal once stored.
+func leaseFrom(now time.Time) time.Time {
+	return now.Add(claimLease).Truncate(time.Millisecond)
+}
+
+// execute applies the state of a schedule to its target
+func (sch *Scheduler) execute(s *models.Schedule) error {
+	ref := models.StateJs{Label: s.State}
+	if s.EntityHex != "" {
+		hex, err := utils.ParseEntityHex(s.EntityHex)
+		if err != nil {
+			return err
+		}
+		_, err = sch.services.SetEntityState(hex, ref, models.SourceScheduler)
+		return err
+	}
+	_, err := sch.services.SetGroupState(s.Groups, ref, models.SourceScheduler)
+	return err
+}
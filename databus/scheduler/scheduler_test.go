@@ -0,0 +1,161 @@
+package scheduler
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"databus/services"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestScheduler returns a scheduler on a store holding the switch 0x01, off
+func newTestScheduler(t *testing.T) (*Scheduler, persistence.Store) {
+	t.Helper()
+	store := persistence.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	definition := models.DefinitionRaw{Name: "Switch", States: []models.StateRaw{{Hex: 0x00, Label: "off"}, {Hex: 0x01, Label: "on"}}}
+	if err := store.InsertDefinition(&definition); err != nil {
+		t.Fatal(err)
+	}
+	entity := models.ReactiveEntityRaw{EntityHex: 0x01, Definition: definition.ID, Groups: []primitive.ObjectID{}}
+	if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{entity}); err != nil {
+		t.Fatal(err)
+	}
+	return New(store, services.NewService(store)), store
+}
+
+func insertSchedule(t *testing.T, store persistence.Store, s models.Schedule) *models.Schedule {
+	t.Helper()
+	s.Name, s.EntityHex, s.State = "switch-on", "0x01", "on"
+	if err := store.InsertSchedule(&s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+func entityState(t *testing.T, store persistence.Store) int {
+	t.Helper()
+	entity, err := store.GetReactiveEntityByHex(0x01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity.Data.CurrentState
+}
+
+func TestDueRunIsCompletedAfterItRan(t *testing.T) {
+	sch, store := newTestScheduler(t)
+	at := time.Now().UTC().Add(-time.Second).Truncate(time.Millisecond)
+	insertSchedule(t, store, models.Schedule{At: &at, NextRun: &at})
+
+	sch.runDue(time.Minute)
+
+	s, err := store.GetScheduleByName("switch-on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.NextRun != nil || s.LastRun == nil || s.LastError != "" {
+		t.Fatalf("schedule %+v, want it run once", s)
+	}
+	if s.ClaimedRun != nil || s.ClaimExpiresAt != nil {
+		t.Fatalf("claim %v until %v left after the run", s.ClaimedRun, s.ClaimExpiresAt)
+	}
+	if state := entityState(t, store); state != 0x01 {
+		t.Fatalf("entity in state %#02x, want 0x01", state)
+	}
+}
+
+func TestInterruptedRunIsRunAgain(t *testing.T) {
+	sch, store := newTestScheduler(t)
+	runAt := time.Now().UTC().Add(-claimLease).Truncate(time.Millisecond)
+	expired := runAt.Add(claimLease - time.Second)
+	insertSchedule(t, store, models.Schedule{At: &runAt, LastRun: &runAt, ClaimedRun: &runAt, ClaimExpiresAt: &expired})
+
+	sch.rerunInterrupted(time.Minute)
+
+	s, err := store.GetScheduleByName("switch-on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ClaimedRun != nil || s.LastError != "" {
+		t.Fatalf("schedule %+v, want the run completed", s)
+	}
+	if state := entityState(t, store); state != 0x01 {
+		t.Fatalf("entity in state %#02x, want 0x01", state)
+	}
+}
+
+func TestRunInterruptedBeyondTheGraceIsDropped(t *testing.T) {
+	sch, store := newTestScheduler(t)
+	runAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+	expired := runAt.Add(claimLease)
+	insertSchedule(t, store, models.Schedule{At: &runAt, LastRun: &runAt, ClaimedRun: &runAt, ClaimExpiresAt: &expired})
+
+	sch.rerunInterrupted(time.Minute)
+
+	s, err := store.GetScheduleByName("switch-on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ClaimedRun != nil || s.LastError == "" {
+		t.Fatalf("schedule %+v, want the claim released with an error", s)
+	}
+	if state := entityState(t, store); state != 0x00 {
+		t.Fatalf("entity in state %#02x, want it left off", state)
+	}
+}
+
+func TestPendingClaimIsNotRunAgain(t *testing.T) {
+	sch, store := newTestScheduler(t)
+	runAt := time.Now().UTC().Truncate(time.Millisecond)
+	expires := runAt.Add(claimLease)
+	insertSchedule(t, store, models.Schedule{At: &runAt, LastRun: &runAt, ClaimedRun: &runAt, ClaimExpiresAt: &expires})
+
+	sch.rerunInterrupted(time.Minute)
+
+	if state := entityState(t, store); state != 0x00 {
+		t.Fatalf("entity in state %#02x, a run still in progress was run again", state)
+	}
+}
+
+func TestRunningClaimIsRenewed(t *testing.T) {
+	sch, store := newTestScheduler(t)
+	runAt := time.Now().UTC().Truncate(time.Millisecond)
+	expires := leaseFrom(runAt)
+	s := insertSchedule(t, store, models.Schedule{At: &runAt, LastRun: &runAt, ClaimedRun: &runAt, ClaimExpiresAt: &expires})
+
+	// A renewal just before the lease ends keeps the claim past its first expiry
+	renewedAt := expires.Add(-time.Second)
+	next, renewed := sch.renewClaim(s, runAt, expires, renewedAt)
+	if !renewed || !next.After(expires) {
+		t.Fatalf("claim renewed %v until %v, want it extended past %v", renewed, next, expires)
+	}
+	expired, err := store.GetExpiredScheduleClaims(expires.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 0 {
+		t.Fatalf("renewed claim listed as expired: %+v", expired[0])
+	}
+
+	// Once another process took over, the claim is lost
+	if _, renewed := sch.renewClaim(s, runAt, expires, renewedAt); renewed {
+		t.Fatal("stale claim renewed")
+	}
+}
+
+func TestUpdateCannotMoveAtIntoThePast(t *testing.T) {
+	sch, _ := newTestScheduler(t)
+	at := time.Now().UTC().Add(time.Hour)
+	if _, err := sch.CreateSchedule(models.Schedule{Name: "switch-on", At: &at, EntityHex: "0x01", State: "on"}); err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().UTC().Add(-time.Hour)
+	if _, err := sch.UpdateSchedule("switch-on", models.Schedule{At: &past, EntityHex: "0x01", State: "on"}); !errors.Is(err, ErrInvalidSchedule) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidSchedule)
+	}
+}
@@ -0,0 +1,78 @@
+// timing.go
+package scheduler
+
+import (
+	"databus/models"
+	"fmt"
+	"time"
+	_ "time/tzdata" // schedules may name any timezone, also on images without a zoneinfo database
+
+	"github.com/robfig/cron/v3"
+)
+
+// MaxPreviewRuns bounds the number of upcoming runs returned by a preview
+const MaxPreviewRuns = 100
+
+// location returns the timezone of a schedule, UTC by default
+func location(s *models.Schedule) (*time.Location, error) {
+	if s.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unknown timezone %q", ErrInvalidSchedule, s.Timezone)
+	}
+	return loc, nil
+}
+
+// nextRun returns the first run of a schedule strictly after the given time, nil when there is none
+func nextRun(s *models.Schedule, after time.Time) (*time.Time, error) {
+	if s.At != nil {
+		if s.At.After(after) {
+			at := s.At.UTC()
+			return &at, nil
+		}
+		return nil, nil
+	}
+
+	expr, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid cron expression %q: %v", ErrInvalidSchedule, s.Cron, err)
+	}
+	loc, err := location(s)
+	if err != nil {
+		return nil, err
+	}
+
+	next := expr.Next(after.In(loc))
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// NextRuns returns up to count upcoming runs of a schedule after the given time, in the schedule's timezone
+func NextRuns(s *models.Schedule, after time.Time, count int) ([]time.Time, error) {
+	if count > MaxPreviewRuns {
+		count = MaxPreviewRuns
+	}
+	loc, err := location(s)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := []time.Time{}
+	for len(runs) < count {
+		next, err := nextRun(s, after)
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			break
+		}
+		runs = append(runs, next.In(loc))
+		after = *next
+	}
+	return runs, nil
+}
@@ -0,0 +1,151 @@
+// attributes.go
+package services
+
+import (
+	"databus/events"
+	"databus/models"
+	"databus/persistence"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidAttribute = errors.New("invalid attribute")
+
+// ValidateAttributes checks every value against the typed attributes declared by the definition.
+// The values are returned normalized for storage.
+func ValidateAttributes(definition *models.DefinitionRaw, values map[string]interface{}) (map[string]interface{}, error) {
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%w: no attribute values given", ErrInvalidAttribute)
+	}
+
+	normalized := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		attr, ok := definition.FindAttribute(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: '%s' is not an attribute of definition '%s'", ErrInvalidAttribute, name, definition.Name)
+		}
+		v, err := attr.ValidateValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidAttribute, err)
+		}
+		normalized[name] = v
+	}
+	return normalized, nil
+}
+
+// SetEntityAttributes validates and writes attribute values of a single reactive entity.
+// Attributes that are not given keep their value.
+func (s *Service) SetEntityAttributes(hex uint16, values map[string]interface{}, source string) (*models.ReactiveEntityJs, error) {
+	entity, err := s.getEntity(hex)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	definition := findDefinition(definitions, entity.Definition)
+	if definition == nil {
+		return nil, fmt.Errorf("definition of entity %#02x not found", hex)
+	}
+	normalized, err := ValidateAttributes(definition, values)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.applyAttributes(entity, normalized, definitions, groups, source)
+}
+
+// SetGroupAttributes validates and writes attribute values of every reactive entity belonging to all the given groups.
+// The values are validated against every entity before anything is written, and written to all of them at once:
+// when an entity is removed in the meantime none of them is updated.
+func (s *Service) SetGroupAttributes(groupNames []string, values map[string]interface{}, source string) ([]models.ReactiveEntityJs, error) {
+	entities, definitions, groups, err := s.loadGroupEntities(groupNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the values for every entity before applying any of them
+	changes := make([]persistence.AttributeChange, len(entities))
+	targets := make(map[uint16]map[string]interface{}, len(entities))
+	for i := range entities {
+		definition := findDefinition(definitions, entities[i].Definition)
+		if definition == nil {
+			return nil, fmt.Errorf("definition of entity %#02x not found", entities[i].EntityHex)
+		}
+		normalized, err := ValidateAttributes(definition, values)
+		if err != nil {
+			return nil, fmt.Errorf("entity %#02x: %w", entities[i].EntityHex, err)
+		}
+		changes[i] = persistence.AttributeChange{EntityHex: entities[i].EntityHex, Values: normalized}
+		targets[entities[i].EntityHex] = normalized
+	}
+
+	now := time.Now().UTC()
+	results := make(map[uint16]*stateResult, len(entities))
+	_, err = s.store.UpdateReactiveEntitiesAttributes(changes, now, s.attributesChanged(targets, results, now, definitions, groups, source))
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: an entity of the group was removed during the update, retry (%v)", ErrStateConflict, err)
+		}
+		return nil, err
+	}
+
+	updated := make([]models.ReactiveEntityJs, 0, len(entities))
+	for i := range entities {
+		result := results[entities[i].EntityHex]
+		events.Publish(*result.event)
+		updated = append(updated, *result.entity)
+	}
+	return updated, nil
+}
+
+// attributesChanged returns the EventFunc of an attribute update to the given values (by entity hex), see stateChanged
+func (s *Service) attributesChanged(targets map[uint16]map[string]interface{}, results map[uint16]*stateResult, now time.Time, definitions []models.DefinitionRaw, groups []models.GroupRaw, source string) persistence.EventFunc {
+	return func(previous *models.ReactiveEntityRaw) *models.EntityEvent {
+		values := targets[previous.EntityHex]
+
+		// Copy the attribute map so the before snapshot keeps its values
+		updated := *previous
+		updated.Data.Attributes = make(map[string]interface{}, len(previous.Data.Attributes)+len(values))
+		for name, value := range previous.Data.Attributes {
+			updated.Data.Attributes[name] = value
+		}
+		for name, value := range values {
+			updated.Data.Attributes[name] = value
+		}
+		updated.Data.AttributesUpdated = &now
+		result := &stateResult{entity: updated.ToJs(definitions, groups)}
+		results[previous.EntityHex] = result
+
+		e := events.NewAttributesChangedEvent(previous.ToJs(definitions, groups), result.entity, values, source)
+		e.RuleChain = s.ruleChain
+		result.event = &e
+		return result.event
+	}
+}
+
+func (s *Service) applyAttributes(entity *models.ReactiveEntityRaw, values map[string]interface{}, definitions []models.DefinitionRaw, groups []models.GroupRaw, source string) (*models.ReactiveEntityJs, error) {
+	now := time.Now().UTC()
+	results := make(map[uint16]*stateResult, 1)
+	changed := s.attributesChanged(map[uint16]map[string]interface{}{entity.EntityHex: values}, results, now, definitions, groups, source)
+
+	_, err := s.store.UpdateReactiveEntityAttributes(entity.EntityHex, values, now, changed)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %#02x", ErrEntityNotFound, entity.EntityHex)
+		}
+		return nil, err
+	}
+
+	result := results[entity.EntityHex]
+	events.Publish(*result.event)
+	return result.entity, nil
+}
@@ -0,0 +1,277 @@
+// entities.go
+package services
+
+import (
+	"databus/events"
+	"databus/models"
+	"databus/persistence"
+	"databus/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidEntity = errors.New("invalid reactive entity")
+	ErrEntityExists  = errors.New("reactive entity with this EntityHex already exists")
+	ErrStateConflict = errors.New("state conflict")
+)
+
+// ValidateEntityReferences checks that the definition and every group referenced by a reactive entity exist.
+// The referenced definition is returned.
+func ValidateEntityReferences(entity *models.ReactiveEntityJs, definitions []models.DefinitionRaw, groups []models.GroupRaw) (*models.DefinitionRaw, error) {
+	// Validate that the definition exists
+	var definition *models.DefinitionRaw
+	for i := range definitions {
+		if definitions[i].Name == entity.Definition {
+			definition = &definitions[i]
+			break
+		}
+	}
+	if definition == nil {
+		return nil, fmt.Errorf("%w: Definition '%s' not found", ErrInvalidEntity, entity.Definition)
+	}
+
+	// Validate that all groups exist
+	groupMap := make(map[string]struct{})
+	for _, group := range groups {
+		groupMap[group.Name] = struct{}{}
+	}
+	for _, groupName := range entity.Groups {
+		if _, exists := groupMap[groupName]; !exists {
+			return nil, fmt.Errorf("%w: Group '%s' not found", ErrInvalidEntity, groupName)
+		}
+	}
+
+	// Validate that every group allows the definition
+	if err := ValidateGroupMembership(definition, entity.Groups, groups); err != nil {
+		return nil, err
+	}
+
+	return definition, nil
+}
+
+// ValidateGroupMembership checks that a definition is in the AllowedDefinitions of every named group.
+// The returned error lists every violating group, not just the first.
+func ValidateGroupMembership(definition *models.DefinitionRaw, groupNames []string, groups []models.GroupRaw) error {
+	var violations []string
+	for _, groupName := range groupNames {
+		for _, group := range groups {
+			if group.Name == groupName && !isDefinitionAllowed(&group, definition) {
+				violations = append(violations, groupName)
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf(
+			"%w: Definition '%s' is not allowed in group(s) '%s'",
+			ErrInvalidEntity, definition.Name, strings.Join(violations, "', '"),
+		)
+	}
+	return nil
+}
+
+// GetGroupViolations returns the entities of a group whose definition is no longer in the group's AllowedDefinitions,
+// e.g. after groups.json was changed
+func (s *Service) GetGroupViolations(groupName string) ([]models.ReactiveEntityJs, error) {
+	group, err := s.store.GetGroupByName(groupName)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: '%s'", ErrGroupNotFound, groupName)
+		}
+		return nil, err
+	}
+
+	entities, err := s.store.GetReactiveEntitiesByGroup([]string{groupName})
+	if err != nil {
+		return nil, err
+	}
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	violations := make([]models.ReactiveEntityJs, 0)
+	for i := range entities {
+		definition := findDefinition(definitions, entities[i].Definition)
+		if definition == nil || !isDefinitionAllowed(group, definition) {
+			violations = append(violations, *entities[i].ToJs(definitions, groups))
+		}
+	}
+	return violations, nil
+}
+
+func isDefinitionAllowed(group *models.GroupRaw, definition *models.DefinitionRaw) bool {
+	for _, id := range group.AllowedDefinitions {
+		if id == definition.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateEntity replaces the metadata of a reactive entity (full PUT semantics).
+// Data is never replaced, use SetEntityState to change the state.
+func (s *Service) UpdateEntity(hex uint16, entityJs models.ReactiveEntityJs, source string) (*models.ReactiveEntityJs, error) {
+	current, err := s.getEntity(hex)
+	if err != nil {
+		return nil, err
+	}
+	return s.updateEntity(current, entityJs, source)
+}
+
+// PatchEntity applies a JSON merge patch (RFC 7386) to the metadata of a reactive entity
+func (s *Service) PatchEntity(hex uint16, patch []byte, source string) (*models.ReactiveEntityJs, error) {
+	current, err := s.getEntity(hex)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	// Patch the JSON representation of the entity, then decode the result back
+	currentJs, err := json.Marshal(current.ToJs(definitions, groups))
+	if err != nil {
+		return nil, err
+	}
+	patched, err := utils.MergePatch(currentJs, patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid merge patch: %v", ErrInvalidEntity, err)
+	}
+
+	var entityJs models.ReactiveEntityJs
+	if err := json.Unmarshal(patched, &entityJs); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEntity, err)
+	}
+	return s.updateEntity(current, entityJs, source)
+}
+
+func (s *Service) updateEntity(current *models.ReactiveEntityRaw, entityJs models.ReactiveEntityJs, source string) (*models.ReactiveEntityJs, error) {
+	// Validate required fields
+	if entityJs.Definition == "" {
+		return nil, fmt.Errorf("%w: Definition is required", ErrInvalidEntity)
+	}
+
+	// The hex may be omitted to keep the current one
+	newHex := current.EntityHex
+	if entityJs.EntityHex != "" {
+		val, err := utils.ParseEntityHex(entityJs.EntityHex)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidEntity, err)
+		}
+		newHex = val
+	}
+	entityJs.EntityHex = utils.FormatHex(newHex)
+
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	definition, err := ValidateEntityReferences(&entityJs, definitions, groups)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new definition must still fit the data of the entity
+	if definition.ID != current.Definition {
+		if err := checkDataFits(current, definition); err != nil {
+			return nil, err
+		}
+	}
+
+	// Moving to another hex must not collide with an existing entity (checked again by the store, when writing)
+	if newHex != current.EntityHex {
+		existing, err := s.store.GetReactiveEntityByHex(newHex)
+		if err != nil && !errors.Is(err, persistence.ErrNotFound) {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, fmt.Errorf("%w: %#02x", ErrEntityExists, newHex)
+		}
+	}
+
+	raw := entityJs.ToRaw(definitions, groups)
+	var updatedJs *models.ReactiveEntityJs
+	var event models.EntityEvent
+	_, err = s.store.UpdateReactiveEntityMetadata(current.EntityHex, current.Data.CurrentState, raw, func(updated *models.ReactiveEntityRaw) *models.EntityEvent {
+		updatedJs = updated.ToJs(definitions, groups)
+		event = events.NewUpdatedEvent(current.ToJs(definitions, groups), updatedJs, definition, source)
+		event.RuleChain = s.ruleChain
+		return &event
+	})
+	if err != nil {
+		if errors.Is(err, persistence.ErrDuplicateEntityHex) {
+			return nil, fmt.Errorf("%w: %#02x", ErrEntityExists, newHex)
+		}
+		if errors.Is(err, persistence.ErrNotFound) {
+			// Either the entity is gone or its state changed since it was validated
+			if _, err := s.getEntity(current.EntityHex); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("%w: state of entity %#02x changed during the update, retry", ErrStateConflict, current.EntityHex)
+		}
+		return nil, err
+	}
+
+	events.Publish(event)
+	return updatedJs, nil
+}
+
+// checkDataFits checks that the current and reported states of an entity are states of a definition, and that
+// the attribute values it holds (desired or reported) are valid attributes of it
+func checkDataFits(entity *models.ReactiveEntityRaw, definition *models.DefinitionRaw) error {
+	if _, ok := definition.FindStateByHex(uint16(entity.Data.CurrentState)); !ok {
+		return fmt.Errorf(
+			"%w: current state %#02x of entity %#02x is not a state of definition '%s'",
+			ErrStateConflict, entity.Data.CurrentState, entity.EntityHex, definition.Name,
+		)
+	}
+	if reported := entity.Data.ReportedState; reported != nil {
+		if _, ok := definition.FindStateByHex(uint16(*reported)); !ok {
+			return fmt.Errorf(
+				"%w: reported state %#02x of entity %#02x is not a state of definition '%s'",
+				ErrStateConflict, *reported, entity.EntityHex, definition.Name,
+			)
+		}
+	}
+	if len(entity.Data.Attributes) > 0 {
+		if _, err := ValidateAttributes(definition, entity.Data.Attributes); err != nil {
+			return fmt.Errorf("%w: attributes of entity %#02x do not fit definition '%s': %v", ErrStateConflict, entity.EntityHex, definition.Name, err)
+		}
+	}
+	if len(entity.Data.ReportedAttributes) > 0 {
+		if _, err := ValidateAttributes(definition, entity.Data.ReportedAttributes); err != nil {
+			return fmt.Errorf("%w: reported attributes of entity %#02x do not fit definition '%s': %v", ErrStateConflict, entity.EntityHex, definition.Name, err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) getEntity(hex uint16) (*models.ReactiveEntityRaw, error) {
+	entity, err := s.store.GetReactiveEntityByHex(hex)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %#02x", ErrEntityNotFound, hex)
+		}
+		return nil, err
+	}
+	return entity, nil
+}
@@ -0,0 +1,183 @@
+// reported.go
+package services
+
+import (
+	"databus/events"
+	"databus/models"
+	"databus/persistence"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ReportEntityState records the state a device reports it is actually in. Unlike SetEntityState
+// this never changes the desired state, it only updates the reported side of the entity's Data.
+func (s *Service) ReportEntityState(hex uint16, ref models.StateJs, source string) (*models.ReactiveEntityJs, error) {
+	entity, err := s.getEntity(hex)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	definition := findDefinition(definitions, entity.Definition)
+	if definition == nil {
+		return nil, fmt.Errorf("definition of entity %#02x not found", hex)
+	}
+	state, err := ResolveState(definition, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	reported := int(state.Hex)
+	var updatedJs *models.ReactiveEntityJs
+	var event *models.EntityEvent
+	_, err = s.store.UpdateReactiveEntityReportedState(hex, reported, now, func(previous *models.ReactiveEntityRaw) *models.EntityEvent {
+		updated := *previous
+		updated.Data.ReportedState = &reported
+		updated.Data.ReportedUpdated = &now
+		updatedJs = updated.ToJs(definitions, groups)
+
+		// Only announce actual changes of the reported state
+		event = nil
+		if previous.Data.ReportedState == nil || *previous.Data.ReportedState != reported {
+			e := events.NewReportedEvent(previous.ToJs(definitions, groups), updatedJs, definition, source)
+			e.RuleChain = s.ruleChain
+			event = &e
+		}
+		return event
+	})
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %#02x", ErrEntityNotFound, hex)
+		}
+		return nil, err
+	}
+
+	if event != nil {
+		events.Publish(*event)
+	}
+	return updatedJs, nil
+}
+
+// ReportEntityAttributes records attribute values a device reports (readings, or the value it actually applied). They
+// are kept apart from the desired values, which only the API and commands write.
+func (s *Service) ReportEntityAttributes(hex uint16, values map[string]interface{}, source string) (*models.ReactiveEntityJs, error) {
+	entity, err := s.getEntity(hex)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	definition := findDefinition(definitions, entity.Definition)
+	if definition == nil {
+		return nil, fmt.Errorf("definition of entity %#02x not found", hex)
+	}
+	normalized, err := ValidateAttributes(definition, values)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var updatedJs *models.ReactiveEntityJs
+	var event *models.EntityEvent
+	_, err = s.store.UpdateReactiveEntityReportedAttributes(hex, normalized, now, func(previous *models.ReactiveEntityRaw) *models.EntityEvent {
+		// Copy the reported attribute map so the before snapshot keeps its values
+		updated := *previous
+		updated.Data.ReportedAttributes = make(map[string]interface{}, len(previous.Data.ReportedAttributes)+len(normalized))
+		for name, value := range previous.Data.ReportedAttributes {
+			updated.Data.ReportedAttributes[name] = value
+		}
+		changed := make(map[string]interface{})
+		for name, value := range normalized {
+			if old, ok := previous.Data.ReportedAttributes[name]; !ok || fmt.Sprint(old) != fmt.Sprint(value) {
+				changed[name] = value
+			}
+			updated.Data.ReportedAttributes[name] = value
+		}
+		updated.Data.ReportedAttributesUpdated = &now
+		updatedJs = updated.ToJs(definitions, groups)
+
+		// Only announce the values that actually changed
+		event = nil
+		if len(changed) > 0 {
+			e := events.NewReportedEvent(previous.ToJs(definitions, groups), updatedJs, definition, source)
+			e.Attributes = changed
+			e.RuleChain = s.ruleChain
+			event = &e
+		}
+		return event
+	})
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %#02x", ErrEntityNotFound, hex)
+		}
+		return nil, err
+	}
+
+	if event != nil {
+		events.Publish(*event)
+	}
+	return updatedJs, nil
+}
+
+// GetDeltas lists the entities whose reported state or attribute values have differed from the desired ones for at
+// least olderThan
+func (s *Service) GetDeltas(olderThan time.Duration) ([]models.EntityDelta, error) {
+	entities, err := s.store.GetOutOfSyncReactiveEntities()
+	if err != nil {
+		return nil, err
+	}
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	deltas := make([]models.EntityDelta, 0)
+	for i := range entities {
+		data := entities[i].Data
+		if data.InSync() || now.Sub(data.OutOfSyncSince()) < olderThan {
+			continue
+		}
+
+		definition := findDefinition(definitions, entities[i].Definition)
+		delta := models.EntityDelta{
+			EntityHex:      fmt.Sprintf("%#02x", entities[i].EntityHex),
+			Desired:        events.StateRef(definition, data.CurrentState),
+			OutOfSyncSince: data.OutOfSyncSince(),
+		}
+		if data.ReportedState != nil {
+			delta.Reported = events.StateRef(definition, *data.ReportedState)
+		}
+		if names := data.AttributeDeltas(); len(names) > 0 {
+			delta.DesiredAttributes = make(map[string]interface{}, len(names))
+			delta.ReportedAttributes = make(map[string]interface{}, len(names))
+			for _, name := range names {
+				delta.DesiredAttributes[name] = data.Attributes[name]
+				delta.ReportedAttributes[name] = data.ReportedAttributes[name]
+			}
+		}
+		if definition != nil {
+			delta.Definition = definition.Name
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas, nil
+}
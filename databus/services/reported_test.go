@@ -0,0 +1,63 @@
+package services
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"testing"
+)
+
+func TestReportedAttributesAreKeptApartFromTheDesiredOnes(t *testing.T) {
+	store := persistence.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	definition := models.DefinitionRaw{
+		Name:   "Dimmer",
+		States: []models.StateRaw{{Hex: 0x00, Label: "off"}, {Hex: 0x01, Label: "on"}},
+		Attributes: []models.AttributeDef{
+			{Name: "brightness", Type: models.AttributeInteger},
+			{Name: "temperature", Type: models.AttributeFloat},
+		},
+	}
+	if err := store.InsertDefinition(&definition); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertReactiveEntities([]models.ReactiveEntityRaw{{EntityHex: 0x1a, Definition: definition.ID}}); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(store)
+
+	if _, err := svc.SetEntityAttributes(0x1a, map[string]interface{}{"brightness": 80}, models.SourceREST); err != nil {
+		t.Fatal(err)
+	}
+	entity, err := svc.ReportEntityAttributes(0x1a, map[string]interface{}{"brightness": 40, "temperature": 21.5}, models.SourceMQTT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := entity.Data.Attributes["brightness"]; got != int64(80) {
+		t.Errorf("desired brightness is %v after the report, want 80", got)
+	}
+	if got := entity.Data.ReportedAttributes["brightness"]; got != int64(40) {
+		t.Errorf("reported brightness is %v, want 40", got)
+	}
+
+	deltas, err := svc.GetDeltas(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deltas) != 1 {
+		t.Fatalf("got %d deltas, want 1", len(deltas))
+	}
+	// The temperature reading has no desired value, it is not part of the delta
+	delta := deltas[0]
+	if len(delta.DesiredAttributes) != 1 || delta.DesiredAttributes["brightness"] != int64(80) || delta.ReportedAttributes["brightness"] != int64(40) {
+		t.Errorf("got desired %v and reported %v, want brightness 80 and 40", delta.DesiredAttributes, delta.ReportedAttributes)
+	}
+
+	// Once the device applied the desired value the entity is in sync again
+	if _, err := svc.ReportEntityAttributes(0x1a, map[string]interface{}{"brightness": 80}, models.SourceMQTT); err != nil {
+		t.Fatal(err)
+	}
+	if deltas, err = svc.GetDeltas(0); err != nil || len(deltas) != 0 {
+		t.Errorf("got deltas %v (%v), want none", deltas, err)
+	}
+}
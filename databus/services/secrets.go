@@ -0,0 +1,51 @@
+// secrets.go
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"databus/persistence"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+/*
+Devices authenticate on the embedded broker with their entity hex as username and a per-device secret as password.
+The secret is generated by the databus and handed out once, only its SHA-256 is stored on the entity. Generating a
+new secret replaces the previous one, clients connecting with the old one are refused from then on.
+*/
+
+// GenerateEntitySecret creates a new secret for the device of a reactive entity and returns it, it cannot be read back later
+func (s *Service) GenerateEntitySecret(entityHex uint16) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(buf)
+
+	if err := s.store.SetReactiveEntitySecret(entityHex, HashSecret(secret)); err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return "", fmt.Errorf("%w: %#02x", ErrEntityNotFound, entityHex)
+		}
+		return "", err
+	}
+	return secret, nil
+}
+
+// HashSecret returns the hash of a device secret as stored on the entity
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// SecretMatches reports whether a password is the secret of a stored hash, in constant time. An entity without
+// a secret matches nothing.
+func SecretMatches(secretHash string, password []byte) bool {
+	if secretHash == "" || len(password) == 0 {
+		return false
+	}
+	sum := sha256.Sum256(password)
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(secretHash)) == 1
+}
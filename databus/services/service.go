@@ -0,0 +1,25 @@
+// service.go
+package services
+
+import "databus/persistence"
+
+/*
+Service is the single path through which reactive entities change, on the store opened in main. The REST handlers,
+the MQTT listeners, the rules engine and the scheduler all share one.
+*/
+type Service struct {
+	store persistence.Store
+	// ruleChain is stamped on the events of the changes, see WithRuleChain
+	ruleChain []string
+}
+
+// NewService returns the services using the given store
+func NewService(store persistence.Store) *Service {
+	return &Service{store: store}
+}
+
+// WithRuleChain returns services whose events carry the chain of rules that made the changes, for the actions
+// of the rules engine. The engine reads the chain back from the events to detect loops.
+func (s *Service) WithRuleChain(chain []string) *Service {
+	return &Service{store: s.store, ruleChain: chain}
+}
@@ -0,0 +1,253 @@
+// state.go
+package services
+
+import (
+	"databus/events"
+	"databus/models"
+	"databus/persistence"
+	"databus/utils"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The state service is the single path through which the state of a reactive entity changes.
+It validates the requested state against the entity's definition, persists it, and publishes
+the resulting event, so every caller (REST, MQTT, ...) behaves identically.
+*/
+
+var (
+	ErrEntityNotFound = errors.New("reactive entity not found")
+	ErrGroupNotFound  = errors.New("group not found")
+	ErrInvalidState   = errors.New("invalid state")
+)
+
+// ResolveState finds the state of a definition referenced by hex (e.g. "0x01") or by label (e.g. "on").
+// When both are given they must refer to the same state.
+func ResolveState(definition *models.DefinitionRaw, ref models.StateJs) (models.StateRaw, error) {
+	if ref.Hex == "" && ref.Label == "" {
+		return models.StateRaw{}, fmt.Errorf("%w: Hex or Label is required", ErrInvalidState)
+	}
+
+	var byHex, byLabel *models.StateRaw
+	if ref.Hex != "" {
+		val, err := utils.ParseHex(ref.Hex)
+		if err != nil {
+			return models.StateRaw{}, fmt.Errorf("%w: invalid hex value %q", ErrInvalidState, ref.Hex)
+		}
+		st, ok := definition.FindStateByHex(val)
+		if !ok {
+			return models.StateRaw{}, fmt.Errorf("%w: hex %q is not a state of definition '%s'", ErrInvalidState, ref.Hex, definition.Name)
+		}
+		byHex = &st
+	}
+	if ref.Label != "" {
+		st, ok := definition.FindStateByLabel(ref.Label)
+		if !ok {
+			return models.StateRaw{}, fmt.Errorf("%w: label %q is not a state of definition '%s'", ErrInvalidState, ref.Label, definition.Name)
+		}
+		byLabel = &st
+	}
+
+	if byHex != nil && byLabel != nil && byHex.Hex != byLabel.Hex {
+		return models.StateRaw{}, fmt.Errorf("%w: hex %q and label %q refer to different states", ErrInvalidState, ref.Hex, ref.Label)
+	}
+	if byHex != nil {
+		return *byHex, nil
+	}
+	return *byLabel, nil
+}
+
+// SetEntityState validates and applies a new state to a single reactive entity.
+// source (e.g. models.SourceREST) is recorded on the resulting event.
+func (s *Service) SetEntityState(hex uint16, ref models.StateJs, source string) (*models.ReactiveEntityJs, error) {
+	entity, err := s.getEntity(hex)
+	if err != nil {
+		return nil, err
+	}
+
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	definition := findDefinition(definitions, entity.Definition)
+	if definition == nil {
+		return nil, fmt.Errorf("definition of entity %#02x not found", hex)
+	}
+	state, err := ResolveState(definition, ref)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckTransition(entity, definition, state, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	return s.applyState(entity, state, definitions, groups, source)
+}
+
+// SetGroupState validates and applies a new state to every reactive entity belonging to all the given groups.
+// The state is validated against every entity before anything is written, and written to all of them at once:
+// when an entity changed in the meantime none of them is updated.
+func (s *Service) SetGroupState(groupNames []string, ref models.StateJs, source string) ([]models.ReactiveEntityJs, error) {
+	entities, definitions, groups, err := s.loadGroupEntities(groupNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve and check the state for every entity before applying any of them
+	now := time.Now().UTC()
+	states := make([]models.StateRaw, len(entities))
+	for i := range entities {
+		definition := findDefinition(definitions, entities[i].Definition)
+		if definition == nil {
+			return nil, fmt.Errorf("definition of entity %#02x not found", entities[i].EntityHex)
+		}
+		states[i], err = ResolveState(definition, ref)
+		if err != nil {
+			return nil, fmt.Errorf("entity %#02x: %w", entities[i].EntityHex, err)
+		}
+		if err := CheckTransition(&entities[i], definition, states[i], now); err != nil {
+			return nil, err
+		}
+	}
+
+	// With a transition graph the checked transition must still start from the state the entity is in
+	changes := make([]persistence.StateChange, len(entities))
+	targets := make(map[uint16]models.StateRaw, len(entities))
+	for i := range entities {
+		changes[i] = persistence.StateChange{EntityHex: entities[i].EntityHex, State: int(states[i].Hex)}
+		if definition := findDefinition(definitions, entities[i].Definition); definition.HasTransitions() {
+			changes[i].ExpectedState = &entities[i].Data.CurrentState
+		}
+		targets[entities[i].EntityHex] = states[i]
+	}
+
+	results := make(map[uint16]*stateResult, len(entities))
+	_, err = s.store.UpdateReactiveEntityStates(changes, now, s.stateChanged(targets, results, now, definitions, groups, source))
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: an entity of the group changed during the update, retry (%v)", ErrStateConflict, err)
+		}
+		return nil, err
+	}
+
+	updated := make([]models.ReactiveEntityJs, 0, len(entities))
+	for i := range entities {
+		result := results[entities[i].EntityHex]
+		if result.event != nil {
+			events.Publish(*result.event)
+		}
+		updated = append(updated, *result.entity)
+	}
+	return updated, nil
+}
+
+/* The outcome of a state or attribute update of one entity: the entity after the update and its event, nil when the state did not change */
+type stateResult struct {
+	entity *models.ReactiveEntityJs
+	event  *models.EntityEvent
+}
+
+// stateChanged returns the EventFunc of a state update to the given states (by entity hex). The events are built
+// from the entities as the update found them and written to the outbox with the update; each outcome is recorded
+// in results.
+func (s *Service) stateChanged(targets map[uint16]models.StateRaw, results map[uint16]*stateResult, now time.Time, definitions []models.DefinitionRaw, groups []models.GroupRaw, source string) persistence.EventFunc {
+	return func(previous *models.ReactiveEntityRaw) *models.EntityEvent {
+		updated := *previous
+		updated.Data.CurrentState = int(targets[previous.EntityHex].Hex)
+		updated.Data.LastUpdated = now
+		result := &stateResult{entity: updated.ToJs(definitions, groups)}
+		results[previous.EntityHex] = result
+
+		// Only announce actual changes of state
+		if previous.Data.CurrentState != updated.Data.CurrentState {
+			definition := findDefinition(definitions, previous.Definition)
+			e := events.NewStateChangedEvent(previous.ToJs(definitions, groups), result.entity, definition, source)
+			e.RuleChain = s.ruleChain
+			result.event = &e
+		}
+		return result.event
+	}
+}
+
+func (s *Service) applyState(entity *models.ReactiveEntityRaw, state models.StateRaw, definitions []models.DefinitionRaw, groups []models.GroupRaw, source string) (*models.ReactiveEntityJs, error) {
+	definition := findDefinition(definitions, entity.Definition)
+	now := time.Now().UTC()
+
+	results := make(map[uint16]*stateResult, 1)
+	changed := s.stateChanged(map[uint16]models.StateRaw{entity.EntityHex: state}, results, now, definitions, groups, source)
+
+	// With a transition graph the checked transition must still start from the state the entity is in
+	var err error
+	restricted := definition != nil && definition.HasTransitions()
+	if restricted {
+		_, err = s.store.UpdateReactiveEntityStateFrom(entity.EntityHex, entity.Data.CurrentState, int(state.Hex), now, changed)
+	} else {
+		_, err = s.store.UpdateReactiveEntityState(entity.EntityHex, int(state.Hex), now, changed)
+	}
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			if restricted {
+				if _, err := s.getEntity(entity.EntityHex); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("%w: state of entity %#02x changed during the update, retry", ErrStateConflict, entity.EntityHex)
+			}
+			return nil, fmt.Errorf("%w: %#02x", ErrEntityNotFound, entity.EntityHex)
+		}
+		return nil, err
+	}
+
+	result := results[entity.EntityHex]
+	if result.event != nil {
+		events.Publish(*result.event)
+	}
+	return result.entity, nil
+}
+
+// loadGroupEntities returns the entities belonging to all the given groups, along with all definitions and groups.
+// Every group must exist.
+func (s *Service) loadGroupEntities(groupNames []string) ([]models.ReactiveEntityRaw, []models.DefinitionRaw, []models.GroupRaw, error) {
+	definitions, err := s.store.GetAllDefinitions()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	groups, err := s.store.GetAllGroups()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Validate that all groups exist
+	groupMap := make(map[string]struct{})
+	for _, group := range groups {
+		groupMap[group.Name] = struct{}{}
+	}
+	for _, groupName := range groupNames {
+		if _, exists := groupMap[groupName]; !exists {
+			return nil, nil, nil, fmt.Errorf("%w: '%s'", ErrGroupNotFound, groupName)
+		}
+	}
+
+	entities, err := s.store.GetReactiveEntitiesByGroup(groupNames)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return entities, definitions, groups, nil
+}
+
+func findDefinition(definitions []models.DefinitionRaw, id primitive.ObjectID) *models.DefinitionRaw {
+	for i := range definitions {
+		if definitions[i].ID == id {
+			return &definitions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// transitions.go
+package services
+
+import (
+	"databus/models"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Definitions may declare a transition graph between their states (e.g. off -> warming -> on).
+Every change of the desired state goes through CheckTransition, so REST and MQTT enforce the same rules.
+*/
+
+var ErrTransitionNotAllowed = errors.New("transition not allowed")
+
+// TransitionError describes a refused state change and the states the entity may move to instead
+type TransitionError struct {
+	EntityHex uint16
+	From      models.StateJs
+	To        models.StateJs
+	Allowed   []models.StateJs
+	Reason    string
+}
+
+func (e *TransitionError) Error() string {
+	labels := make([]string, len(e.Allowed))
+	for i, st := range e.Allowed {
+		labels[i] = st.Label
+	}
+	allowed := "none"
+	if len(labels) > 0 {
+		allowed = strings.Join(labels, ", ")
+	}
+	return fmt.Sprintf("%s: entity %#02x cannot move from '%s' to '%s' (%s), allowed next states: %s",
+		ErrTransitionNotAllowed, e.EntityHex, e.From.Label, e.To.Label, e.Reason, allowed)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrTransitionNotAllowed
+}
+
+// CheckTransition verifies that the entity may move from its current desired state to the given state at the given time.
+// Staying in the same state is always allowed. An entity in a state its definition does not declare may only be
+// reset to the initial state.
+func CheckTransition(entity *models.ReactiveEntityRaw, definition *models.DefinitionRaw, to models.StateRaw, at time.Time) error {
+	if !definition.HasTransitions() || entity.Data.CurrentState == int(to.Hex) {
+		return nil
+	}
+
+	from, ok := definition.FindStateByHex(uint16(entity.Data.CurrentState))
+	if !ok {
+		initial, _ := definition.InitialState()
+		if to.Hex == initial.Hex {
+			return nil
+		}
+		return &TransitionError{
+			EntityHex: entity.EntityHex,
+			From:      models.StateJs{Hex: fmt.Sprintf("%#02x", entity.Data.CurrentState)},
+			To:        to.ToJs(),
+			Allowed:   []models.StateJs{initial.ToJs()},
+			Reason:    fmt.Sprintf("the current state is not declared by definition '%s'", definition.Name),
+		}
+	}
+
+	next := definition.NextStates(from.Hex)
+	refused := &TransitionError{
+		EntityHex: entity.EntityHex,
+		From:      from.ToJs(),
+		To:        to.ToJs(),
+		Allowed:   make([]models.StateJs, len(next)),
+	}
+	for i := range next {
+		refused.Allowed[i] = next[i].ToJs()
+	}
+
+	allowed := false
+	for _, st := range next {
+		if st.Hex == to.Hex {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		refused.Reason = "not a declared transition"
+		return refused
+	}
+
+	// Guard: minimum time spent in the current state before this move
+	tr, _ := definition.FindTransition(from.Label, to.Label)
+	if tr.MinDwell != "" {
+		minDwell, err := time.ParseDuration(tr.MinDwell)
+		if err != nil {
+			return fmt.Errorf("definition '%s' has an invalid MinDwell %q", definition.Name, tr.MinDwell)
+		}
+		if dwelled := at.Sub(entity.Data.LastUpdated); dwelled < minDwell {
+			refused.Reason = fmt.Sprintf("must stay in '%s' for %s, %s left", from.Label, minDwell, (minDwell - dwelled).Round(time.Second))
+			return refused
+		}
+	}
+	return nil
+}
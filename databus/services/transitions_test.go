@@ -0,0 +1,75 @@
+package services
+
+import (
+	"databus/models"
+	"errors"
+	"testing"
+	"time"
+)
+
+var kiln = models.DefinitionRaw{
+	Name:   "Kiln-Controller",
+	States: []models.StateRaw{{Hex: 0x00, Label: "off"}, {Hex: 0x01, Label: "warming"}, {Hex: 0x02, Label: "on"}},
+	Transitions: []models.TransitionDef{
+		{From: "off", To: []string{"warming"}},
+		{From: "warming", To: []string{"on"}, MinDwell: "10m"},
+		{From: "warming", To: []string{"off"}},
+		{From: "on", To: []string{"off"}},
+	},
+}
+
+func TestCheckTransition(t *testing.T) {
+	now := time.Now()
+	state := func(label string) models.StateRaw {
+		st, _ := kiln.FindStateByLabel(label)
+		return st
+	}
+	entity := func(current int, since time.Duration) *models.ReactiveEntityRaw {
+		return &models.ReactiveEntityRaw{EntityHex: 0x1a, Data: models.DataObj{CurrentState: current, LastUpdated: now.Add(-since)}}
+	}
+
+	tests := []struct {
+		name    string
+		entity  *models.ReactiveEntityRaw
+		to      models.StateRaw
+		allowed bool
+	}{
+		{"declared move", entity(0x00, 0), state("warming"), true},
+		{"undeclared move", entity(0x00, 0), state("on"), false},
+		{"same state", entity(0x02, 0), state("on"), true},
+		{"guarded move too early", entity(0x01, time.Minute), state("on"), false},
+		{"guarded move after the dwell", entity(0x01, 11*time.Minute), state("on"), true},
+		{"unguarded move from the same state", entity(0x01, time.Minute), state("off"), true},
+		{"undeclared current state", entity(0x7f, time.Hour), state("on"), false},
+		{"undeclared current state reset", entity(0x7f, 0), state("off"), true},
+	}
+	for _, tt := range tests {
+		err := CheckTransition(tt.entity, &kiln, tt.to, now)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.allowed && !errors.Is(err, ErrTransitionNotAllowed) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, ErrTransitionNotAllowed)
+		}
+	}
+}
+
+func TestStateTransitionsListMinDwellPerTarget(t *testing.T) {
+	for _, tr := range kiln.StateTransitions() {
+		if tr.From.Label != "warming" {
+			continue
+		}
+		if len(tr.To) != 2 {
+			t.Fatalf("%d next states of warming, want 2", len(tr.To))
+		}
+		for _, next := range tr.To {
+			want := ""
+			if next.Label == "on" {
+				want = "10m"
+			}
+			if next.MinDwell != want {
+				t.Errorf("warming -> %s: MinDwell %q, want %q", next.Label, next.MinDwell, want)
+			}
+		}
+	}
+}
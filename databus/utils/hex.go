@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseHex parses a 16 bit hex value, with or without the "0x" prefix ("1A", "0x1a", "0X1A"). It is the one
+// parser of entity hexes and state hexes, in topics, requests and configuration documents alike.
+func ParseHex(s string) (uint16, error) {
+	val, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(s), "0x"), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hex %q", s)
+	}
+	return uint16(val), nil
+}
+
+// ParseEntityHex parses an entity hex like ParseHex, with an error naming the entity hex
+func ParseEntityHex(s string) (uint16, error) {
+	val, err := ParseHex(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid entity hex %q", s)
+	}
+	return val, nil
+}
+
+// FormatHex formats a 16 bit value the way events and the API carry it ("0x1a")
+func FormatHex(val uint16) string {
+	return fmt.Sprintf("%#02x", val)
+}
+
+// NormalizeEntityHex formats an entity hex ("1A", "0x1a", ...) the way events carry it ("0x1a")
+func NormalizeEntityHex(s string) (string, error) {
+	val, err := ParseEntityHex(s)
+	if err != nil {
+		return "", err
+	}
+	return FormatHex(val), nil
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"encoding/json"
+)
+
+// MergePatch applies a JSON merge patch (RFC 7386) to a JSON document and returns the result.
+// Objects are merged recursively, null removes a member and any other value replaces it.
+func MergePatch(target []byte, patch []byte) ([]byte, error) {
+	var targetVal, patchVal interface{}
+	if err := json.Unmarshal(target, &targetVal); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(patch, &patchVal); err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(targetVal, patchVal))
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		// Non-object patches replace the target entirely
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for key, val := range patchObj {
+		if val == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergeValue(targetObj[key], val)
+	}
+	return targetObj
+}
@@ -0,0 +1,21 @@
+package utils
+
+// Contains reports whether val is an element of list
+func Contains[T comparable](list []T, val T) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsAny reports whether any of vals is an element of list
+func ContainsAny[T comparable](list []T, vals []T) bool {
+	for _, val := range vals {
+		if Contains(list, val) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// delivery.go
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"databus/models"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+/* Headers sent with every webhook delivery */
+const (
+	SignatureHeader = "X-Databus-Signature"
+	EventTypeHeader = "X-Databus-Event"
+	EventIDHeader   = "X-Databus-Event-ID"
+)
+
+// Sign returns the signature of a payload as sent in the X-Databus-Signature header: "sha256=" followed by
+// the hex encoded HMAC-SHA256 of the raw body, keyed with the subscription secret
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends one delivery and returns the HTTP status code, any non-2xx response is an error
+func (d *Dispatcher) post(sub *models.WebhookSubscription, e *models.EntityEvent, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "databus-webhooks")
+	req.Header.Set(EventTypeHeader, e.Type)
+	req.Header.Set(EventIDHeader, e.ID)
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Drain (a bounded part of) the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
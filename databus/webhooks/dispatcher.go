@@ -0,0 +1,403 @@
+// dispatcher.go
+package webhooks
+
+import (
+	"databus/events"
+	"databus/models"
+	"databus/persistence"
+	"databus/utils"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Webhook subscriptions receive the entity events passing their filter as HTTP POSTs of the same JSON envelope
+that is published on MQTT. The webhook actions of rules are delivered to their subscription the same way, with the
+rule name and the triggering event as body.
+
+Events are taken off the bus into a queue, matched against the subscriptions by a dispatcher and delivered
+by a pool of workers. When the queue is full, publishing the next event waits (up to enqueueTimeout) for room
+rather than the event being skipped. Failed deliveries are retried with exponential backoff; once every attempt
+failed the event is moved to the WebhookDeadLetters collection. Every attempt is recorded in WebhookDeliveries.
+Every delivery is stored in the WebhookRetries collection before its first attempt, and pending retries are
+polled from there, so deliveries queued or failed when the process stops are resumed after a restart; the entry
+is removed once its delivery succeeded or was given up.
+*/
+
+const (
+	queueSize         = 1024
+	baseBackoff       = time.Second
+	maxBackoff        = 5 * time.Minute
+	retryPollInterval = time.Second
+	enqueueTimeout    = 5 * time.Second
+)
+
+/* The body of a delivery made by the webhook action of a rule */
+type ruleActionBody struct {
+	Rule  string             `json:"Rule"`
+	Event models.EntityEvent `json:"Event"`
+}
+
+/* A delivery of one event to one subscription */
+type job struct {
+	subscription models.WebhookSubscription
+	event        models.EntityEvent
+	payload      []byte
+	attempt      int
+	// retryID is the stored retry of this delivery, zero when it could not be stored
+	retryID primitive.ObjectID
+}
+
+/* The webhook dispatcher, built in main from the store holding the subscriptions and the delivery log */
+type Dispatcher struct {
+	store    persistence.Store
+	incoming chan models.EntityEvent
+	jobs     chan job
+
+	client      *http.Client
+	maxAttempts int
+
+	// inFlight holds the retries queued or being attempted, so the poller does not queue them twice
+	inFlightMu sync.Mutex
+	inFlight   map[primitive.ObjectID]bool
+
+	// subscriptions are cached until they change through the API
+	subscriptionsMu     sync.RWMutex
+	subscriptionsLoaded bool
+	subscriptionsCache  []models.WebhookSubscription
+}
+
+// NewDispatcher returns a webhook dispatcher, it delivers nothing until started
+func NewDispatcher(store persistence.Store) *Dispatcher {
+	return &Dispatcher{
+		store:       store,
+		incoming:    make(chan models.EntityEvent, queueSize),
+		jobs:        make(chan job, queueSize),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 1,
+		inFlight:    make(map[primitive.ObjectID]bool),
+	}
+}
+
+// Start subscribes the webhook dispatcher to the event bus and runs workers delivery workers.
+// Each delivery is attempted up to attempts times, every attempt times out after timeout.
+func (d *Dispatcher) Start(workers int, attempts int, timeout time.Duration) {
+	d.client = &http.Client{Timeout: timeout}
+	d.maxAttempts = attempts
+	if d.maxAttempts < 1 {
+		d.maxAttempts = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	events.Subscribe(d.enqueue)
+	go d.dispatch()
+	go d.pollRetries()
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+}
+
+// enqueue is the bus handler, when the queue is full it waits up to enqueueTimeout for room
+func (d *Dispatcher) enqueue(e models.EntityEvent) {
+	select {
+	case d.incoming <- e:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case d.incoming <- e:
+	case <-timer.C:
+		log.Printf("Webhook queue full for %s, event %s of entity %s not delivered", enqueueTimeout, e.ID, e.EntityHex)
+	}
+}
+
+// dispatch matches every event against the subscriptions and queues a delivery per match
+func (d *Dispatcher) dispatch() {
+	for e := range d.incoming {
+		subscriptions, err := d.getSubscriptions()
+		if err != nil {
+			log.Printf("Error loading webhook subscriptions: %v", err)
+			continue
+		}
+
+		var payload []byte
+		for _, sub := range subscriptions {
+			if sub.Disabled || !matches(&sub, &e) {
+				continue
+			}
+			if payload == nil {
+				if payload, err = json.Marshal(e); err != nil {
+					log.Printf("Error encoding event %s for webhooks: %v", e.ID, err)
+					break
+				}
+			}
+			d.submit(sub, e, payload, true)
+		}
+	}
+}
+
+// DeliverRuleAction delivers the rule name and the triggering event to the named subscription, whatever its filter.
+// It does not wait for room in the queue, a delivery stored but not queued is left to the retry poller.
+func (d *Dispatcher) DeliverRuleAction(webhook string, rule string, e models.EntityEvent) error {
+	subscriptions, err := d.getSubscriptions()
+	if err != nil {
+		return err
+	}
+	for _, sub := range subscriptions {
+		if sub.Name != webhook {
+			continue
+		}
+		if sub.Disabled {
+			return fmt.Errorf("webhook '%s' is disabled", webhook)
+		}
+		payload, err := json.Marshal(ruleActionBody{Rule: rule, Event: e})
+		if err != nil {
+			return err
+		}
+		return d.submit(sub, e, payload, false)
+	}
+	return fmt.Errorf("%w: '%s'", ErrWebhookNotFound, webhook)
+}
+
+// submit stores the first attempt of a delivery as a retry due now, then queues it. With wait a delivery that could
+// not be stored is still attempted once and a full queue is waited on; without, both are left to the caller and to
+// the retry poller.
+func (d *Dispatcher) submit(sub models.WebhookSubscription, e models.EntityEvent, payload []byte, wait bool) error {
+	retry := models.WebhookRetry{
+		ID:             primitive.NewObjectID(),
+		SubscriptionID: sub.ID,
+		Subscription:   sub.Name,
+		Event:          e,
+		Payload:        payload,
+		Attempt:        1,
+		NextAttemptAt:  time.Now().UTC(),
+	}
+	d.claim(retry.ID)
+	if err := d.store.SaveWebhookRetry(&retry); err != nil {
+		d.release(retry.ID)
+		if !wait {
+			return err
+		}
+		log.Printf("Error storing the delivery of event %s for '%s', it is not resumed after a restart: %v", e.ID, sub.Name, err)
+		retry.ID = primitive.NilObjectID
+	}
+
+	j := job{subscription: sub, event: e, payload: payload, attempt: 1, retryID: retry.ID}
+	if wait {
+		d.jobs <- j
+		return nil
+	}
+	select {
+	case d.jobs <- j:
+	default:
+		d.release(retry.ID)
+	}
+	return nil
+}
+
+func (d *Dispatcher) work() {
+	for j := range d.jobs {
+		d.deliver(j)
+	}
+}
+
+// deliver makes one attempt, then stores a retry or moves the event to the dead letters
+func (d *Dispatcher) deliver(j job) {
+	defer d.release(j.retryID)
+
+	started := time.Now()
+	status, err := d.post(&j.subscription, &j.event, j.payload)
+
+	delivery := models.WebhookDelivery{
+		Subscription: j.subscription.Name,
+		EventID:      j.event.ID,
+		EventType:    j.event.Type,
+		EntityHex:    j.event.EntityHex,
+		Attempt:      j.attempt,
+		Success:      err == nil,
+		StatusCode:   status,
+		DurationMs:   time.Since(started).Milliseconds(),
+		Timestamp:    started.UTC(),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	if err := d.store.InsertWebhookDelivery(&delivery); err != nil {
+		log.Printf("Error recording webhook delivery to '%s': %v", j.subscription.Name, err)
+	}
+	if delivery.Success {
+		d.removeRetry(j)
+		return
+	}
+
+	if j.attempt >= d.maxAttempts {
+		deadLetter := models.WebhookDeadLetter{
+			Subscription: j.subscription.Name,
+			URL:          j.subscription.URL,
+			Event:        j.event,
+			Attempts:     j.attempt,
+			LastError:    delivery.Error,
+			FailedAt:     time.Now().UTC(),
+		}
+		if err := d.store.InsertWebhookDeadLetter(&deadLetter); err != nil {
+			log.Printf("Error recording dead letter for '%s': %v", j.subscription.Name, err)
+		}
+		log.Printf("Webhook '%s' gave up on event %s after %d attempts: %s", j.subscription.Name, j.event.ID, j.attempt, delivery.Error)
+		d.removeRetry(j)
+		return
+	}
+
+	retry := models.WebhookRetry{
+		ID:             j.retryID,
+		SubscriptionID: j.subscription.ID,
+		Subscription:   j.subscription.Name,
+		Event:          j.event,
+		Payload:        j.payload,
+		Attempt:        j.attempt + 1,
+		LastError:      delivery.Error,
+		NextAttemptAt:  time.Now().Add(backoff(j.attempt)).UTC(),
+	}
+	if err := d.store.SaveWebhookRetry(&retry); err != nil {
+		log.Printf("Error storing the retry of event %s for '%s', it is not delivered: %v", j.event.ID, j.subscription.Name, err)
+	}
+}
+
+func (d *Dispatcher) removeRetry(j job) {
+	if j.retryID.IsZero() {
+		return
+	}
+	if err := d.store.DeleteWebhookRetry(j.retryID); err != nil {
+		log.Printf("Error removing the retry of event %s for '%s': %v", j.event.ID, j.subscription.Name, err)
+	}
+}
+
+// pollRetries queues the stored retries as they become due
+func (d *Dispatcher) pollRetries() {
+	ticker := time.NewTicker(retryPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := d.queueDueRetries(time.Now()); err != nil {
+			log.Printf("Error loading webhook retries: %v", err)
+		}
+	}
+}
+
+// queueDueRetries queues the retries due at now that are not queued yet. A retry whose subscription was removed
+// or disabled in the meantime is dropped.
+func (d *Dispatcher) queueDueRetries(now time.Time) error {
+	retries, err := d.store.GetDueWebhookRetries(now, queueSize)
+	if err != nil {
+		return err
+	}
+
+	for _, retry := range retries {
+		if !d.claim(retry.ID) {
+			continue
+		}
+		current, ok := d.findSubscription(retry.SubscriptionID.Hex())
+		if !ok || current.Disabled {
+			if err := d.store.DeleteWebhookRetry(retry.ID); err != nil {
+				log.Printf("Error removing the retry of event %s for '%s': %v", retry.Event.ID, retry.Subscription, err)
+			}
+			d.release(retry.ID)
+			continue
+		}
+		d.jobs <- job{subscription: current, event: retry.Event, payload: retry.Payload, attempt: retry.Attempt, retryID: retry.ID}
+	}
+	return nil
+}
+
+// claim marks a retry in flight, it reports false when it already is
+func (d *Dispatcher) claim(id primitive.ObjectID) bool {
+	d.inFlightMu.Lock()
+	defer d.inFlightMu.Unlock()
+	if d.inFlight[id] {
+		return false
+	}
+	d.inFlight[id] = true
+	return true
+}
+
+func (d *Dispatcher) release(id primitive.ObjectID) {
+	if id.IsZero() {
+		return
+	}
+	d.inFlightMu.Lock()
+	defer d.inFlightMu.Unlock()
+	delete(d.inFlight, id)
+}
+
+// backoff returns the delay before the retry following the given attempt: 1s, 2s, 4s, ... up to 5m, with up to 20% jitter
+func backoff(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 20 {
+		delay = baseBackoff << (attempt - 1)
+	}
+	delay += time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// matches reports whether an event passes the filter of a subscription
+func matches(sub *models.WebhookSubscription, e *models.EntityEvent) bool {
+	if len(sub.EventTypes) > 0 && !utils.Contains(sub.EventTypes, e.Type) {
+		return false
+	}
+	filter := events.Filter{EntityHexes: sub.EntityHexes, Groups: sub.Groups, Definitions: sub.Definitions}
+	return filter.Matches(*e)
+}
+
+func (d *Dispatcher) getSubscriptions() ([]models.WebhookSubscription, error) {
+	d.subscriptionsMu.RLock()
+	if d.subscriptionsLoaded {
+		defer d.subscriptionsMu.RUnlock()
+		return d.subscriptionsCache, nil
+	}
+	d.subscriptionsMu.RUnlock()
+
+	subscriptions, err := d.store.GetAllWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	d.subscriptionsMu.Lock()
+	defer d.subscriptionsMu.Unlock()
+	d.subscriptionsCache = subscriptions
+	d.subscriptionsLoaded = true
+	return subscriptions, nil
+}
+
+func (d *Dispatcher) findSubscription(id string) (models.WebhookSubscription, bool) {
+	subscriptions, err := d.getSubscriptions()
+	if err != nil {
+		return models.WebhookSubscription{}, false
+	}
+	for _, sub := range subscriptions {
+		if sub.ID.Hex() == id {
+			return sub, true
+		}
+	}
+	return models.WebhookSubscription{}, false
+}
+
+// invalidateSubscriptions makes the dispatcher reload the subscriptions on the next event
+func (d *Dispatcher) invalidateSubscriptions() {
+	d.subscriptionsMu.Lock()
+	defer d.subscriptionsMu.Unlock()
+	d.subscriptionsLoaded = false
+	d.subscriptionsCache = nil
+}
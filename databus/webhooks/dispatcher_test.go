@@ -0,0 +1,224 @@
+package webhooks
+
+import (
+	"databus/models"
+	"databus/persistence"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* A webhook endpoint answering with the queued status codes (then 200), checking the signature of every request */
+type endpoint struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		e.t.Error(err)
+	}
+	if got, want := r.Header.Get(SignatureHeader), Sign(e.secret, body); got != want {
+		e.t.Errorf("signature %q, want %q", got, want)
+	}
+	if r.Header.Get(EventIDHeader) == "" || r.Header.Get(EventTypeHeader) == "" {
+		e.t.Errorf("event headers missing: %v", r.Header)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bodies = append(e.bodies, body)
+	status := http.StatusOK
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func newTestDispatcher(t *testing.T, store persistence.Store, attempts int) *Dispatcher {
+	d := NewDispatcher(store)
+	d.client = &http.Client{Timeout: 5 * time.Second}
+	d.maxAttempts = attempts
+	return d
+}
+
+// setup returns a store with a subscription of every event to an endpoint failing with the given statuses
+func setup(t *testing.T, statuses ...int) (persistence.Store, *endpoint, models.WebhookSubscription) {
+	store := persistence.NewMemoryStore()
+	t.Cleanup(func() { store.Close() })
+
+	ep := &endpoint{t: t, secret: "s3cret", statuses: statuses}
+	server := httptest.NewServer(ep)
+	t.Cleanup(server.Close)
+
+	sub := models.WebhookSubscription{Name: "test", URL: server.URL, Secret: ep.secret}
+	if err := store.InsertWebhook(&sub); err != nil {
+		t.Fatal(err)
+	}
+	return store, ep, sub
+}
+
+func firstJob(t *testing.T, sub models.WebhookSubscription) job {
+	e := models.EntityEvent{ID: "65f0c0ffee00000000000001", Type: models.EventStateChanged, EntityHex: "0x01"}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job{subscription: sub, event: e, payload: payload, attempt: 1}
+}
+
+// nextRetry queues the retries due at now and returns the one job queued
+func nextRetry(t *testing.T, d *Dispatcher, now time.Time) job {
+	t.Helper()
+	if err := d.queueDueRetries(now); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case j := <-d.jobs:
+		return j
+	default:
+		t.Fatal("no retry queued")
+		return job{}
+	}
+}
+
+func TestDeliverySignsTheBody(t *testing.T) {
+	store, ep, sub := setup(t)
+	d := newTestDispatcher(t, store, 3)
+
+	j := firstJob(t, sub)
+	d.deliver(j)
+
+	if len(ep.bodies) != 1 || string(ep.bodies[0]) != string(j.payload) {
+		t.Fatalf("bodies %q, want the event", ep.bodies)
+	}
+	deliveries, _ := store.GetWebhookDeliveries("test", 10)
+	if len(deliveries) != 1 || !deliveries[0].Success || deliveries[0].StatusCode != 200 {
+		t.Fatalf("deliveries %+v", deliveries)
+	}
+	if retries, _ := store.GetDueWebhookRetries(time.Now().Add(time.Hour), 10); len(retries) != 0 {
+		t.Fatalf("%d retries stored after a success", len(retries))
+	}
+}
+
+func TestFailedDeliveryIsRetriedWithBackoffAfterARestart(t *testing.T) {
+	store, ep, sub := setup(t, 500)
+	d := newTestDispatcher(t, store, 3)
+
+	started := time.Now()
+	d.deliver(firstJob(t, sub))
+
+	retries, err := store.GetDueWebhookRetries(started.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retries) != 1 || retries[0].Attempt != 2 || retries[0].LastError == "" {
+		t.Fatalf("retries %+v, want attempt 2", retries)
+	}
+	// 1s after the first attempt, with up to 20% jitter
+	if delay := retries[0].NextAttemptAt.Sub(started); delay < time.Second || delay > 1300*time.Millisecond {
+		t.Fatalf("retried after %s, want 1s to 1.2s", delay)
+	}
+	if due, _ := store.GetDueWebhookRetries(started, 10); len(due) != 0 {
+		t.Fatal("retry due before its backoff")
+	}
+
+	// A new dispatcher on the same store picks the retry up
+	restarted := newTestDispatcher(t, store, 3)
+	j := nextRetry(t, restarted, started.Add(2*time.Second))
+	if err := restarted.queueDueRetries(started.Add(2 * time.Second)); err != nil || len(restarted.jobs) != 0 {
+		t.Fatal("a retry in flight was queued twice")
+	}
+	restarted.deliver(j)
+
+	if len(ep.bodies) != 2 || string(ep.bodies[0]) != string(ep.bodies[1]) {
+		t.Fatalf("bodies %q, want the same body twice", ep.bodies)
+	}
+	if retries, _ := store.GetDueWebhookRetries(started.Add(time.Hour), 10); len(retries) != 0 {
+		t.Fatalf("%d retries left after the delivery succeeded", len(retries))
+	}
+}
+
+func TestDeliveryIsDeadLetteredAfterTheLastAttempt(t *testing.T) {
+	store, _, sub := setup(t, 500, 502, 503)
+	d := newTestDispatcher(t, store, 3)
+
+	now := time.Now()
+	d.deliver(firstJob(t, sub))
+	for attempt := 2; attempt <= 3; attempt++ {
+		now = now.Add(maxBackoff)
+		j := nextRetry(t, d, now)
+		if j.attempt != attempt {
+			t.Fatalf("attempt %d, want %d", j.attempt, attempt)
+		}
+		d.deliver(j)
+	}
+
+	deadLetters, _ := store.GetWebhookDeadLetters("test", 10)
+	if len(deadLetters) != 1 || deadLetters[0].Attempts != 3 || deadLetters[0].Event.EntityHex != "0x01" {
+		t.Fatalf("dead letters %+v", deadLetters)
+	}
+	if retries, _ := store.GetDueWebhookRetries(now.Add(time.Hour), 10); len(retries) != 0 {
+		t.Fatalf("%d retries left after giving up", len(retries))
+	}
+	deliveries, _ := store.GetWebhookDeliveries("test", 10)
+	if len(deliveries) != 3 {
+		t.Fatalf("%d deliveries recorded, want 3", len(deliveries))
+	}
+}
+
+func TestRetryOfARemovedSubscriptionIsDropped(t *testing.T) {
+	store, _, sub := setup(t, 500)
+	d := newTestDispatcher(t, store, 3)
+	d.deliver(firstJob(t, sub))
+
+	if err := store.DeleteWebhook(sub.ID); err != nil {
+		t.Fatal(err)
+	}
+	d.invalidateSubscriptions()
+	if err := d.queueDueRetries(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.jobs) != 0 {
+		t.Fatal("retry queued for a removed subscription")
+	}
+	if retries, _ := store.GetDueWebhookRetries(time.Now().Add(time.Hour), 10); len(retries) != 0 {
+		t.Fatalf("%d retries left", len(retries))
+	}
+}
+
+func TestFirstAttemptIsStoredBeforeDelivery(t *testing.T) {
+	store, ep, sub := setup(t)
+	d := newTestDispatcher(t, store, 3)
+
+	first := firstJob(t, sub)
+	d.submit(sub, first.event, first.payload, true)
+
+	// Queued but not attempted yet: a restart would find it due
+	retries, err := store.GetDueWebhookRetries(time.Now().Add(time.Second), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retries) != 1 || retries[0].Attempt != 1 || retries[0].Event.ID != first.event.ID {
+		t.Fatalf("retries %+v, want the first attempt", retries)
+	}
+	if err := d.queueDueRetries(time.Now().Add(time.Second)); err != nil || len(d.jobs) != 1 {
+		t.Fatal("a queued delivery was queued twice")
+	}
+
+	d.deliver(<-d.jobs)
+	if len(ep.bodies) != 1 {
+		t.Fatalf("%d deliveries, want 1", len(ep.bodies))
+	}
+	if retries, _ := store.GetDueWebhookRetries(time.Now().Add(time.Hour), 10); len(retries) != 0 {
+		t.Fatalf("%d retries left after the delivery succeeded", len(retries))
+	}
+}
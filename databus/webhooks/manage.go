@@ -0,0 +1,215 @@
+// manage.go
+package webhooks
+
+import (
+	"crypto/rand"
+	"databus/events"
+	"databus/models"
+	"databus/persistence"
+	"databus/utils"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrWebhookExists   = errors.New("webhook already exists")
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+	ErrWebhookInUse    = errors.New("webhook in use")
+)
+
+// webhookNamePattern keeps subscription names usable in URLs
+var webhookNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// eventTypes are the event types a subscription can select
+var eventTypes = []string{
+	models.EventCreated,
+	models.EventUpdated,
+	models.EventDeleted,
+	models.EventStateChanged,
+	models.EventReported,
+	models.EventAttributesChanged,
+}
+
+// CreateWebhook validates and stores a new subscription. A secret is generated when none is given;
+// the returned subscription is the only place it can be read back.
+func (d *Dispatcher) CreateWebhook(w models.WebhookSubscription) (*models.WebhookSubscription, error) {
+	if err := d.ValidateWebhook(&w); err != nil {
+		return nil, err
+	}
+
+	if _, err := d.store.GetWebhookByName(w.Name); err == nil {
+		return nil, fmt.Errorf("%w: '%s'", ErrWebhookExists, w.Name)
+	} else if !errors.Is(err, persistence.ErrNotFound) {
+		return nil, err
+	}
+
+	if w.Secret == "" {
+		secret, err := generateSecret()
+		if err != nil {
+			return nil, err
+		}
+		w.Secret = secret
+	}
+	w.ID = primitive.NilObjectID
+	w.CreatedAt = time.Now().UTC()
+
+	if err := d.store.InsertWebhook(&w); err != nil {
+		return nil, err
+	}
+	d.invalidateSubscriptions()
+	return &w, nil
+}
+
+// UpdateWebhook replaces a subscription (it cannot be renamed). The secret is kept when none is given.
+func (d *Dispatcher) UpdateWebhook(name string, w models.WebhookSubscription) (*models.WebhookSubscription, error) {
+	if w.Name == "" {
+		w.Name = name
+	}
+	if w.Name != name {
+		return nil, fmt.Errorf("%w: webhook '%s' cannot be renamed", ErrInvalidWebhook, name)
+	}
+
+	current, err := d.GetWebhook(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.ValidateWebhook(&w); err != nil {
+		return nil, err
+	}
+
+	w.ID = current.ID
+	w.CreatedAt = current.CreatedAt
+	if w.Secret == "" {
+		w.Secret = current.Secret
+	}
+
+	if err := d.store.ReplaceWebhook(&w); err != nil {
+		return nil, err
+	}
+	d.invalidateSubscriptions()
+	return &w, nil
+}
+
+// DeleteWebhook removes a subscription no rule delivers to, its delivery log and dead letters are kept
+func (d *Dispatcher) DeleteWebhook(name string) error {
+	current, err := d.GetWebhook(name)
+	if err != nil {
+		return err
+	}
+
+	rules, err := d.store.GetAllRules()
+	if err != nil {
+		return err
+	}
+	var usedBy []string
+	for _, rule := range rules {
+		for _, action := range rule.Actions {
+			if action.Type == models.RuleActionWebhook && action.Webhook == name {
+				usedBy = append(usedBy, rule.Name)
+				break
+			}
+		}
+	}
+	if len(usedBy) > 0 {
+		return fmt.Errorf("%w: '%s' is delivered to by rule(s) '%s'", ErrWebhookInUse, name, strings.Join(usedBy, "', '"))
+	}
+	if err := d.store.DeleteWebhook(current.ID); err != nil {
+		return err
+	}
+	d.invalidateSubscriptions()
+	return nil
+}
+
+// GetWebhook returns a stored subscription
+func (d *Dispatcher) GetWebhook(name string) (*models.WebhookSubscription, error) {
+	w, err := d.store.GetWebhookByName(name)
+	if err != nil {
+		if errors.Is(err, persistence.ErrNotFound) {
+			return nil, fmt.Errorf("%w: '%s'", ErrWebhookNotFound, name)
+		}
+		return nil, err
+	}
+	return w, nil
+}
+
+// ValidateWebhook checks the URL and the filter of a subscription, and normalizes its entity hexes
+func (d *Dispatcher) ValidateWebhook(w *models.WebhookSubscription) error {
+	if !webhookNamePattern.MatchString(w.Name) {
+		return fmt.Errorf("%w: invalid name '%s'", ErrInvalidWebhook, w.Name)
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: URL must be an absolute http(s) URL", ErrInvalidWebhook)
+	}
+
+	for _, eventType := range w.EventTypes {
+		if !utils.Contains(eventTypes, eventType) {
+			return fmt.Errorf("%w: unknown event type '%s'", ErrInvalidWebhook, eventType)
+		}
+	}
+
+	filter, err := events.Filter{EntityHexes: w.EntityHexes, Groups: w.Groups, Definitions: w.Definitions}.Normalized()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+	w.EntityHexes = filter.EntityHexes
+	if len(w.EntityHexes) == 0 {
+		w.EntityHexes = nil
+	}
+
+	if len(w.Groups) > 0 {
+		groups, err := d.store.GetAllGroups()
+		if err != nil {
+			return err
+		}
+		for _, name := range w.Groups {
+			found := false
+			for _, group := range groups {
+				if group.Name == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%w: group '%s' not found", ErrInvalidWebhook, name)
+			}
+		}
+	}
+
+	if len(w.Definitions) > 0 {
+		definitions, err := d.store.GetAllDefinitions()
+		if err != nil {
+			return err
+		}
+		for _, name := range w.Definitions {
+			found := false
+			for _, definition := range definitions {
+				if definition.Name == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("%w: definition '%s' not found", ErrInvalidWebhook, name)
+			}
+		}
+	}
+	return nil
+}
+
+func generateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}